@@ -0,0 +1,309 @@
+/*
+Package audit keeps a tamper-evident trail of the two-factor events: the enrollments, the successful and the failed
+validations, the lock downs, the secret key reveals (QR, QRCode, URL and Secret) and the resets.
+
+Each record is signed with HMAC-SHA256 and contains the hash of the previous record, so that Verify detects
+the altered, the inserted and the deleted records. The records are appended to a Sink: an io.Writer, a file or a SQL table.
+
+	logger, err := audit.New(key, sink)
+	...
+	// all the TOTPs, without request metadata
+	twofactor.RegisterObserver(logger)
+	// or per request, with the metadata of the request
+	otp.AddObserver(logger.With(audit.Metadata{"request_id": id, "remote_addr": r.RemoteAddr}))
+
+Register the logger globally or add it per request, not both, otherwise the events are recorded twice.
+
+The observer methods cannot return the errors of the sink, a missing record must not go unnoticed though:
+by default they are written to the standard logger (the standard error), and they are always counted by Failures.
+Set an error handler with SetErrorHandler to raise an alert or to stop the service instead.
+The key must be kept apart from the records, otherwise whoever can alter the records can sign them again.
+*/
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sec51/twofactor"
+)
+
+const (
+	min_key_size = 32 // the minimum length in bytes of the HMAC key: 256 bits
+)
+
+// The types of the records
+const (
+	TypeEnroll  = "enroll"
+	TypeReveal  = "reveal"
+	TypeReset   = "reset"
+	TypeSuccess = "success"
+	TypeFailure = "failure"
+	TypeLockout = "lockout"
+	TypeUnlock  = "unlock"
+	TypeResync  = "resync"
+	TypeReuse   = "reuse"
+)
+
+var (
+	WeakKeyError = errors.New("The audit key is too short: at least 256 bits are required.")
+)
+
+// Metadata is the metadata of the request supplied by the caller, like the request id, the remote address or the operator
+type Metadata map[string]string
+
+// Record is an entry of the audit trail, it never contains the codes or the secret keys
+type Record struct {
+	Sequence  uint64    `json:"sequence"` // starts at 1, without gaps
+	Time      time.Time `json:"time"`     // UTC
+	Type      string    `json:"type"`     // one of the Type constants, or a type of the caller, see Log
+	Account   string    `json:"account"`
+	Issuer    string    `json:"issuer"`
+	Algorithm string    `json:"algorithm,omitempty"`
+	Operation string    `json:"operation,omitempty"` // the method which revealed the secret key, the step of the enrollment
+	Offset    int       `json:"offset,omitempty"`    // the offset of the matching time step
+	Failures  int       `json:"failures"`            // the verification failures after the event
+	Error     string    `json:"error,omitempty"`     // the reason of the failure
+	Metadata  Metadata  `json:"metadata,omitempty"`
+	Previous  string    `json:"previous"` // the hex SHA-256 of the previous record, empty for the first one
+	MAC       string    `json:"mac"`      // the hex HMAC-SHA256 of the record without the MAC
+}
+
+// Private function which returns the HMAC of the record without its MAC
+func (r Record) sign(key []byte) (string, error) {
+	r.MAC = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Private function which returns the hash of the signed record, stored in the next record
+func (r Record) hash() (string, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Checkpoint identifies the last record of the trail. Store it apart from the records (Logger.Head)
+// and pass it to Verify, to detect the records deleted at the end of the trail.
+type Checkpoint struct {
+	Sequence uint64
+	Hash     string
+}
+
+// VerificationError locates the first record which fails the verification
+type VerificationError struct {
+	Sequence uint64 // the sequence of the record, or the expected one when records are missing
+	Reason   string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("The audit record %d is invalid: %s.", e.Sequence, e.Reason)
+}
+
+// Verify checks the signatures and the chain of the records, which must follow the given checkpoint:
+// the zero Checkpoint when the records start from the beginning of the trail.
+// It returns the checkpoint of the last record, to be compared with the one stored by the caller,
+// or a *VerificationError on the first altered, inserted, reordered or missing record.
+func Verify(key []byte, from Checkpoint, records []Record) (Checkpoint, error) {
+
+	if len(key) < min_key_size {
+		return from, WeakKeyError
+	}
+
+	head := from
+	for _, record := range records {
+		mac, err := record.sign(key)
+		if err != nil {
+			return head, err
+		}
+		if !hmac.Equal([]byte(mac), []byte(record.MAC)) {
+			return head, &VerificationError{Sequence: record.Sequence, Reason: "the signature does not match, the record has been altered"}
+		}
+
+		switch {
+		case record.Sequence > head.Sequence+1:
+			return head, &VerificationError{Sequence: head.Sequence + 1, Reason: "the record is missing"}
+		case record.Sequence <= head.Sequence:
+			return head, &VerificationError{Sequence: record.Sequence, Reason: "the record is duplicated or out of order"}
+		case record.Previous != head.Hash:
+			return head, &VerificationError{Sequence: record.Sequence, Reason: "the hash of the previous record does not match"}
+		}
+
+		hash, err := record.hash()
+		if err != nil {
+			return head, err
+		}
+		head = Checkpoint{Sequence: record.Sequence, Hash: hash}
+	}
+
+	return head, nil
+}
+
+// Logger appends the signed records to the sink. It is a twofactor.Observer and a twofactor.LifecycleObserver
+// which records the events without metadata, use With to add the metadata of the request.
+type Logger struct {
+	mutex    sync.Mutex
+	key      []byte
+	sink     Sink
+	head     Checkpoint
+	handler  func(error)
+	failures uint64
+}
+
+// New creates a logger which continues the trail of the sink, signing the records with the key.
+// The last record of the sink is verified, so that the logger does not extend an altered trail.
+func New(key []byte, sink Sink) (*Logger, error) {
+
+	if len(key) < min_key_size {
+		return nil, WeakKeyError
+	}
+
+	logger := &Logger{key: key, sink: sink}
+
+	last, err := sink.Last()
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		// the previous record is unknown: verify only the signature of the last one
+		from := Checkpoint{Sequence: last.Sequence - 1, Hash: last.Previous}
+		if logger.head, err = Verify(key, from, []Record{*last}); err != nil {
+			return nil, err
+		}
+	}
+
+	return logger, nil
+}
+
+// SetErrorHandler sets the function called when a record cannot be appended to the sink by the observer methods,
+// which cannot return the error. When no handler is set, the errors are written to the standard logger.
+func (l *Logger) SetErrorHandler(handler func(error)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.handler = handler
+}
+
+// Failures returns the amount of the events which could not be recorded by the observer methods
+func (l *Logger) Failures() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.failures
+}
+
+// Head returns the checkpoint of the last record appended
+func (l *Logger) Head() Checkpoint {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.head
+}
+
+// Log signs the record and appends it to the sink, for instance to record the events of the application
+// in the same trail. The sequence, the previous hash and the MAC are set by the logger, the time when it is zero.
+func (l *Logger) Log(record Record) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Time = record.Time.UTC()
+	record.Sequence = l.head.Sequence + 1
+	record.Previous = l.head.Hash
+
+	var err error
+	if record.MAC, err = record.sign(l.key); err != nil {
+		return err
+	}
+	hash, err := record.hash()
+	if err != nil {
+		return err
+	}
+
+	// the head moves only once the record is stored, so that a failure does not leave a gap
+	if err := l.sink.Append(record); err != nil {
+		return err
+	}
+	l.head = Checkpoint{Sequence: record.Sequence, Hash: hash}
+	return nil
+}
+
+// Private function which records the event of an observer
+func (l *Logger) record(recordType string, event twofactor.Event, metadata Metadata) {
+	record := Record{
+		Time:      event.Time,
+		Type:      recordType,
+		Account:   event.Account,
+		Issuer:    event.Issuer,
+		Algorithm: event.Algorithm,
+		Operation: event.Operation,
+		Offset:    event.Offset,
+		Failures:  event.Failures,
+		Metadata:  metadata,
+	}
+	if event.Err != nil {
+		record.Error = event.Err.Error()
+	}
+
+	if err := l.Log(record); err != nil {
+		l.mutex.Lock()
+		l.failures++
+		handler := l.handler
+		l.mutex.Unlock()
+		if handler != nil {
+			handler(err)
+		} else {
+			log.Printf("audit: the %s event of %s:%s has not been recorded: %s", recordType, event.Issuer, event.Account, err)
+		}
+	}
+}
+
+// With returns an observer which records the events with the metadata of the request,
+// to be added to the TOTP with AddObserver
+func (l *Logger) With(metadata Metadata) twofactor.Observer {
+	copied := make(Metadata, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return &observer{logger: l, metadata: copied}
+}
+
+func (l *Logger) OnSuccess(event twofactor.Event) { l.record(TypeSuccess, event, nil) }
+func (l *Logger) OnFailure(event twofactor.Event) { l.record(TypeFailure, event, nil) }
+func (l *Logger) OnLockout(event twofactor.Event) { l.record(TypeLockout, event, nil) }
+func (l *Logger) OnUnlock(event twofactor.Event)  { l.record(TypeUnlock, event, nil) }
+func (l *Logger) OnResync(event twofactor.Event)  { l.record(TypeResync, event, nil) }
+func (l *Logger) OnReuse(event twofactor.Event)   { l.record(TypeReuse, event, nil) }
+func (l *Logger) OnEnroll(event twofactor.Event)  { l.record(TypeEnroll, event, nil) }
+func (l *Logger) OnReveal(event twofactor.Event)  { l.record(TypeReveal, event, nil) }
+func (l *Logger) OnReset(event twofactor.Event)   { l.record(TypeReset, event, nil) }
+
+// observer records the events of a request with its metadata
+type observer struct {
+	logger   *Logger
+	metadata Metadata
+}
+
+func (o *observer) OnSuccess(event twofactor.Event) { o.logger.record(TypeSuccess, event, o.metadata) }
+func (o *observer) OnFailure(event twofactor.Event) { o.logger.record(TypeFailure, event, o.metadata) }
+func (o *observer) OnLockout(event twofactor.Event) { o.logger.record(TypeLockout, event, o.metadata) }
+func (o *observer) OnUnlock(event twofactor.Event)  { o.logger.record(TypeUnlock, event, o.metadata) }
+func (o *observer) OnResync(event twofactor.Event)  { o.logger.record(TypeResync, event, o.metadata) }
+func (o *observer) OnReuse(event twofactor.Event)   { o.logger.record(TypeReuse, event, o.metadata) }
+func (o *observer) OnEnroll(event twofactor.Event)  { o.logger.record(TypeEnroll, event, o.metadata) }
+func (o *observer) OnReveal(event twofactor.Event)  { o.logger.record(TypeReveal, event, o.metadata) }
+func (o *observer) OnReset(event twofactor.Event)   { o.logger.record(TypeReset, event, o.metadata) }
@@ -0,0 +1,221 @@
+package audit
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sec51/twofactor"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Private function which logs the given amount of records to a new writer sink
+func newTestTrail(t *testing.T, total int) (*Logger, []Record) {
+	var buffer bytes.Buffer
+	logger, err := New(testKey, NewWriterSink(&buffer))
+	checkError(t, err)
+	for i := 0; i < total; i++ {
+		checkError(t, logger.Log(Record{Type: "test", Account: "info@sec51.com", Issuer: "Sec51"}))
+	}
+	records, err := ReadRecords(&buffer)
+	checkError(t, err)
+	return logger, records
+}
+
+// Private function which checks that the verification fails on the given sequence
+func checkVerificationError(t *testing.T, err error, sequence uint64) {
+	verificationError, ok := err.(*VerificationError)
+	if !ok {
+		t.Errorf("Expected a VerificationError, got %v\n", err)
+		return
+	}
+	if verificationError.Sequence != sequence {
+		t.Errorf("Expected the verification to fail on the record %d, got %d: %s\n", sequence, verificationError.Sequence, verificationError.Reason)
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	logger, records := newTestTrail(t, 5)
+	if len(records) != 5 {
+		t.Fatalf("Expected 5 records, got %d\n", len(records))
+	}
+
+	head, err := Verify(testKey, Checkpoint{}, records)
+	checkError(t, err)
+	if head != logger.Head() || head.Sequence != 5 {
+		t.Errorf("Unexpected head %+v, expected %+v\n", head, logger.Head())
+	}
+
+	// the records can be verified from a checkpoint
+	middle, err := Verify(testKey, Checkpoint{}, records[:2])
+	checkError(t, err)
+	head, err = Verify(testKey, middle, records[2:])
+	checkError(t, err)
+	if head != logger.Head() {
+		t.Errorf("Unexpected head %+v, expected %+v\n", head, logger.Head())
+	}
+
+	// the wrong key
+	_, err = Verify([]byte("fedcba9876543210fedcba9876543210"), Checkpoint{}, records)
+	checkVerificationError(t, err, 1)
+
+	if _, err := Verify([]byte("short"), Checkpoint{}, records); err != WeakKeyError {
+		t.Errorf("Expected WeakKeyError, got %v\n", err)
+	}
+	if _, err := New([]byte("short"), NewWriterSink(&bytes.Buffer{})); err != WeakKeyError {
+		t.Errorf("Expected WeakKeyError, got %v\n", err)
+	}
+}
+
+func TestVerifyTampering(t *testing.T) {
+
+	_, records := newTestTrail(t, 5)
+
+	// altered record
+	altered := append([]Record{}, records...)
+	altered[2].Failures = 0
+	altered[2].Account = "attacker@sec51.com"
+	_, err := Verify(testKey, Checkpoint{}, altered)
+	checkVerificationError(t, err, 3)
+
+	// deleted record
+	deleted := append(append([]Record{}, records[:2]...), records[3:]...)
+	_, err = Verify(testKey, Checkpoint{}, deleted)
+	checkVerificationError(t, err, 3)
+
+	// deleted first record
+	_, err = Verify(testKey, Checkpoint{}, records[1:])
+	checkVerificationError(t, err, 1)
+
+	// reordered records
+	reordered := append([]Record{}, records...)
+	reordered[1], reordered[2] = reordered[2], reordered[1]
+	_, err = Verify(testKey, Checkpoint{}, reordered)
+	checkVerificationError(t, err, 2)
+
+	// record of another trail with the same key and sequence
+	_, other := newTestTrail(t, 5)
+	spliced := append(append([]Record{}, records[:2]...), other[2:]...)
+	_, err = Verify(testKey, Checkpoint{}, spliced)
+	checkVerificationError(t, err, 3)
+
+	// deleted last records: the head differs from the stored checkpoint
+	expected, err := Verify(testKey, Checkpoint{}, records)
+	checkError(t, err)
+	head, err := Verify(testKey, Checkpoint{}, records[:3])
+	checkError(t, err)
+	if head == expected {
+		t.Error("The deletion of the last records has not been detected")
+	}
+}
+
+func TestLoggerObserver(t *testing.T) {
+
+	var buffer bytes.Buffer
+	logger, err := New(testKey, NewWriterSink(&buffer))
+	checkError(t, err)
+
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	otp.AddObserver(logger.With(Metadata{"request_id": "42", "remote_addr": "192.0.2.1"}))
+
+	enrollment, err := twofactor.NewEnrollment(otp, twofactor.EnrollmentOptions{})
+	checkError(t, err)
+	_, err = enrollment.QR()
+	checkError(t, err)
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, enrollment.Confirm(code))
+
+	for i := 0; i < 3; i++ {
+		otp.Validate("000000x")
+	}
+	otp.ResetLockDown()
+
+	records, err := ReadRecords(&buffer)
+	checkError(t, err)
+	_, err = Verify(testKey, Checkpoint{}, records)
+	checkError(t, err)
+
+	expected := []string{TypeEnroll, TypeReveal, TypeEnroll, TypeFailure, TypeFailure, TypeFailure, TypeLockout, TypeReset, TypeUnlock}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d\n", len(expected), len(records))
+	}
+	for i, record := range records {
+		if record.Type != expected[i] {
+			t.Errorf("Expected the record %d to be %s, got %s\n", i+1, expected[i], record.Type)
+		}
+		if record.Account != "info@sec51.com" || record.Metadata["request_id"] != "42" || record.Metadata["remote_addr"] != "192.0.2.1" {
+			t.Errorf("Unexpected record %+v\n", record)
+		}
+	}
+	if records[1].Operation != "QR" || records[2].Operation != "confirm" || records[6].Failures != 3 || records[3].Error == "" {
+		t.Errorf("Unexpected records %+v\n", records)
+	}
+}
+
+// failingSink fails to append the records
+type failingSink struct{}
+
+func (failingSink) Append(record Record) error { return errors.New("disk full") }
+func (failingSink) Last() (*Record, error)     { return nil, nil }
+
+func TestLoggerErrorHandler(t *testing.T) {
+
+	logger, err := New(testKey, failingSink{})
+	checkError(t, err)
+
+	var failures []error
+	logger.SetErrorHandler(func(err error) {
+		failures = append(failures, err)
+	})
+
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	otp.AddObserver(logger)
+	otp.Validate("000000x")
+
+	if len(failures) != 1 {
+		t.Errorf("Expected 1 error, got %d\n", len(failures))
+	}
+	if logger.Head().Sequence != 0 {
+		t.Error("The head has moved without a stored record")
+	}
+	if logger.Failures() != 1 {
+		t.Errorf("Expected 1 failure, got %d\n", logger.Failures())
+	}
+}
+
+func TestLoggerDefaultErrorHandler(t *testing.T) {
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	logger, err := New(testKey, failingSink{})
+	checkError(t, err)
+
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	otp.AddObserver(logger)
+	otp.Validate("000000x")
+
+	if !strings.Contains(output.String(), "disk full") {
+		t.Errorf("The error has not been logged: %q\n", output.String())
+	}
+	if logger.Failures() != 1 {
+		t.Errorf("Expected 1 failure, got %d\n", logger.Failures())
+	}
+}
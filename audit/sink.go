@@ -0,0 +1,241 @@
+package audit
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// Sink stores the records of a single logger, in the order they are appended
+type Sink interface {
+	Append(record Record) error
+	Last() (*Record, error) // the last record, nil when the sink is empty
+}
+
+// WriterSink writes the records to an io.Writer as JSON lines, for instance to the standard output collected by a log shipper.
+// The writer cannot be read: a new WriterSink starts a new trail, unless the last record is set with Resume.
+type WriterSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	last   *Record
+}
+
+// NewWriterSink creates a sink writing to the writer
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{writer: writer}
+}
+
+// Resume sets the last record of the trail written by the previous process, to continue its chain
+func (s *WriterSink) Resume(last Record) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.last = &last
+}
+
+// Append writes the record as a JSON line
+func (s *WriterSink) Append(record Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := writeRecord(s.writer, record); err != nil {
+		return err
+	}
+	s.last = &record
+	return nil
+}
+
+// Last returns the last record written
+func (s *WriterSink) Last() (*Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last, nil
+}
+
+// FileSink appends the records to a file as JSON lines
+type FileSink struct {
+	mutex sync.Mutex
+	file  *os.File
+	last  *Record
+}
+
+// OpenFileSink opens or creates the file, the new records continue the trail of the existing ones
+func OpenFileSink(path string) (*FileSink, error) {
+
+	records, err := ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &FileSink{file: file}
+	if len(records) > 0 {
+		sink.last = &records[len(records)-1]
+	}
+	return sink, nil
+}
+
+// Append writes the record at the end of the file. The file is not synced after each record, see Sync.
+func (s *FileSink) Append(record Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := writeRecord(s.file, record); err != nil {
+		return err
+	}
+	s.last = &record
+	return nil
+}
+
+// Last returns the last record of the file
+func (s *FileSink) Last() (*Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last, nil
+}
+
+// Sync commits the records to the disk
+func (s *FileSink) Sync() error {
+	return s.file.Sync()
+}
+
+// Close syncs and closes the file
+func (s *FileSink) Close() error {
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// Private function which writes the record as a JSON line, with a single write so that the lines are never interleaved
+func writeRecord(writer io.Writer, record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(data, '\n'))
+	return err
+}
+
+// ReadRecords reads the JSON lines written by WriterSink and FileSink
+func ReadRecords(reader io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, errors.New(fmt.Sprintf("The audit line %d is not a record: %s", len(records)+1, err))
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// ReadFile reads the records of the file written by FileSink
+func ReadFile(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadRecords(file)
+}
+
+// Placeholders is the syntax of the query parameters of the SQL driver
+type Placeholders int
+
+const (
+	QuestionPlaceholders Placeholders = iota // ?, like MySQL and SQLite
+	DollarPlaceholders                       // $1, like PostgreSQL
+)
+
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// SQLSink stores the records in a SQL table with two columns: the sequence, which is the primary key,
+// and the record as JSON text. The table must be used by a single logger, the primary key rejects the records
+// of a second one: give each replica of the service its own table.
+type SQLSink struct {
+	db           *sql.DB
+	table        string
+	placeholders Placeholders
+}
+
+// NewSQLSink creates a sink storing the records in the table, which can be created with CreateTable
+func NewSQLSink(db *sql.DB, table string, placeholders Placeholders) (*SQLSink, error) {
+	if !tableName.MatchString(table) {
+		return nil, errors.New(fmt.Sprintf("Invalid audit table name %q", table))
+	}
+	return &SQLSink{db: db, table: table, placeholders: placeholders}, nil
+}
+
+// CreateTable creates the table if it does not exist
+func (s *SQLSink) CreateTable() error {
+	_, err := s.db.Exec("CREATE TABLE IF NOT EXISTS " + s.table + " (sequence BIGINT PRIMARY KEY, record TEXT NOT NULL)")
+	return err
+}
+
+// Append inserts the record
+func (s *SQLSink) Append(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO " + s.table + " (sequence, record) VALUES (?, ?)"
+	if s.placeholders == DollarPlaceholders {
+		query = "INSERT INTO " + s.table + " (sequence, record) VALUES ($1, $2)"
+	}
+	_, err = s.db.Exec(query, int64(record.Sequence), string(data))
+	return err
+}
+
+// Last returns the record with the highest sequence
+func (s *SQLSink) Last() (*Record, error) {
+	records, err := s.query("SELECT record FROM " + s.table + " ORDER BY sequence DESC LIMIT 1")
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[0], nil
+}
+
+// Records returns all the records ordered by sequence, to be verified with Verify
+func (s *SQLSink) Records() ([]Record, error) {
+	return s.query("SELECT record FROM " + s.table + " ORDER BY sequence")
+}
+
+// Private function which runs the query and decodes the records
+func (s *SQLSink) query(query string) ([]Record, error) {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := OpenFileSink(path)
+	checkError(t, err)
+	logger, err := New(testKey, sink)
+	checkError(t, err)
+	checkError(t, logger.Log(Record{Type: "test"}))
+	checkError(t, logger.Log(Record{Type: "test"}))
+	checkError(t, sink.Close())
+
+	// the trail continues after a restart
+	sink, err = OpenFileSink(path)
+	checkError(t, err)
+	logger, err = New(testKey, sink)
+	checkError(t, err)
+	checkError(t, logger.Log(Record{Type: "test"}))
+	checkError(t, sink.Close())
+
+	records, err := ReadFile(path)
+	checkError(t, err)
+	head, err := Verify(testKey, Checkpoint{}, records)
+	checkError(t, err)
+	if head.Sequence != 3 || head != logger.Head() {
+		t.Errorf("Unexpected head %+v\n", head)
+	}
+
+	// the logger does not continue an altered trail
+	data, err := os.ReadFile(path)
+	checkError(t, err)
+	checkError(t, os.WriteFile(path, []byte(strings.Replace(string(data), `"type":"test"`, `"type":"none"`, -1)), 0600))
+	sink, err = OpenFileSink(path)
+	checkError(t, err)
+	defer sink.Close()
+	if _, err := New(testKey, sink); err == nil {
+		t.Error("The logger continues an altered trail")
+	}
+}
+
+func TestWriterSinkResume(t *testing.T) {
+
+	logger, records := newTestTrail(t, 2)
+
+	var buffer bytes.Buffer
+	sink := NewWriterSink(&buffer)
+	sink.Resume(records[1])
+	resumed, err := New(testKey, sink)
+	checkError(t, err)
+	if resumed.Head() != logger.Head() {
+		t.Errorf("Unexpected head %+v, expected %+v\n", resumed.Head(), logger.Head())
+	}
+
+	checkError(t, resumed.Log(Record{Type: "test"}))
+	more, err := ReadRecords(&buffer)
+	checkError(t, err)
+	_, err = Verify(testKey, Checkpoint{}, append(records, more...))
+	checkError(t, err)
+}
+
+func TestSQLSink(t *testing.T) {
+
+	testDatabase.mutex.Lock()
+	testDatabase.rows = map[int64]string{}
+	testDatabase.mutex.Unlock()
+
+	db, err := sql.Open("audittest", "")
+	checkError(t, err)
+	defer db.Close()
+
+	if _, err := NewSQLSink(db, "audit; DROP TABLE users", QuestionPlaceholders); err == nil {
+		t.Error("The invalid table name has been accepted")
+	}
+
+	sink, err := NewSQLSink(db, "twofactor_audit", DollarPlaceholders)
+	checkError(t, err)
+	checkError(t, sink.CreateTable())
+
+	logger, err := New(testKey, sink)
+	checkError(t, err)
+	for i := 0; i < 3; i++ {
+		checkError(t, logger.Log(Record{Type: "test", Metadata: Metadata{"request_id": "42"}}))
+	}
+
+	// the trail continues after a restart
+	logger, err = New(testKey, sink)
+	checkError(t, err)
+	checkError(t, logger.Log(Record{Type: "test"}))
+
+	records, err := sink.Records()
+	checkError(t, err)
+	head, err := Verify(testKey, Checkpoint{}, records)
+	checkError(t, err)
+	if head.Sequence != 4 || head != logger.Head() {
+		t.Errorf("Unexpected head %+v\n", head)
+	}
+
+	// a deleted row
+	testDatabase.mutex.Lock()
+	delete(testDatabase.rows, 2)
+	testDatabase.mutex.Unlock()
+	records, err = sink.Records()
+	checkError(t, err)
+	_, err = Verify(testKey, Checkpoint{}, records)
+	checkVerificationError(t, err, 2)
+}
+
+// testDatabase is a minimal database/sql driver which understands only the queries of SQLSink
+var testDatabase = &database{rows: map[int64]string{}}
+
+func init() {
+	sql.Register("audittest", testDatabase)
+}
+
+type database struct {
+	mutex sync.Mutex
+	rows  map[int64]string
+}
+
+func (d *database) Open(name string) (driver.Conn, error) { return connection{d}, nil }
+
+type connection struct{ database *database }
+
+func (c connection) Prepare(query string) (driver.Stmt, error) {
+	return statement{c.database, query}, nil
+}
+func (c connection) Close() error              { return nil }
+func (c connection) Begin() (driver.Tx, error) { return nil, driver.ErrSkip }
+
+type statement struct {
+	database *database
+	query    string
+}
+
+func (s statement) Close() error  { return nil }
+func (s statement) NumInput() int { return -1 }
+
+func (s statement) Exec(args []driver.Value) (driver.Result, error) {
+	s.database.mutex.Lock()
+	defer s.database.mutex.Unlock()
+	if strings.HasPrefix(s.query, "INSERT") {
+		if _, exists := s.database.rows[args[0].(int64)]; exists {
+			return nil, io.ErrUnexpectedEOF
+		}
+		s.database.rows[args[0].(int64)] = args[1].(string)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s statement) Query(args []driver.Value) (driver.Rows, error) {
+	s.database.mutex.Lock()
+	defer s.database.mutex.Unlock()
+	var sequences []int64
+	for sequence := range s.database.rows {
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	if strings.Contains(s.query, "DESC LIMIT 1") && len(sequences) > 0 {
+		sequences = sequences[len(sequences)-1:]
+	}
+	values := make([]string, len(sequences))
+	for i, sequence := range sequences {
+		values[i] = s.database.rows[sequence]
+	}
+	return &rows{values: values}, nil
+}
+
+type rows struct {
+	values []string
+}
+
+func (r *rows) Columns() []string { return []string{"record"} }
+func (r *rows) Close() error      { return nil }
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
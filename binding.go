@@ -0,0 +1,53 @@
+package twofactor
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+)
+
+var (
+	AssociatedDataError      = errors.New("The TOTP bytes are bound to different associated data: they have been moved from another record.")
+	BindingBytesVersionError = errors.New("The associated data binding can be serialized only with BytesVersion2.")
+)
+
+// ToBytesBound serialises the TOTP like ToBytesWith with BytesVersion2, and binds the byte array to the associated data,
+// for instance the user id and the tenant id of the record which stores it.
+// The byte array can then be read only with TOTPFromBytesBound and the same associated data:
+// when it is copied to the record of another user, it fails to load with AssociatedDataError.
+// The SHA-256 of the associated data is stored inside the encrypted payload, the associated data itself is not stored.
+// The associated data should be immutable identifiers: if they change the byte array cannot be read anymore.
+// The Totp keeps the binding, therefore ToBytes and ToBytesWith with BytesVersion1 return BindingBytesVersionError.
+func (otp *Totp) ToBytesBound(engineID string, associatedData []byte) ([]byte, error) {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return nil, err
+	}
+
+	if len(associatedData) == 0 {
+		return nil, errors.New("The associated data cannot be empty")
+	}
+
+	binding := sha256.Sum256(associatedData)
+	otp.binding = binding[:]
+	return otp.ToBytesWith(engineID, BytesVersion2)
+}
+
+// TOTPFromBytesBound converts a byte array created by ToBytesBound to a totp object.
+// It returns AssociatedDataError when the byte array is bound to different associated data, or is not bound at all:
+// the existing byte arrays need to be read with TOTPFromBytes and written again with ToBytesBound.
+func TOTPFromBytesBound(encryptedMessage []byte, engineID string, associatedData []byte) (*Totp, error) {
+
+	otp, _, err := decryptTOTP(encryptedMessage, engineID)
+	if err != nil {
+		return nil, err
+	}
+
+	binding := sha256.Sum256(associatedData)
+	if otp.binding == nil || subtle.ConstantTimeCompare(otp.binding, binding[:]) != 1 {
+		return nil, AssociatedDataError
+	}
+
+	return otp, nil
+}
@@ -0,0 +1,72 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+)
+
+func TestBinding(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	alice := []byte("tenant-1/user-1")
+	bob := []byte("tenant-1/user-2")
+
+	data, err := otp.ToBytesBound("Sec51", alice)
+	checkError(t, err)
+
+	restored, err := TOTPFromBytesBound(data, "Sec51", alice)
+	checkError(t, err)
+	if restored.Secret() != otp.Secret() {
+		t.Error("The TOTP has not been restored")
+	}
+
+	// the byte array has been copied to the record of another user
+	if _, err := TOTPFromBytesBound(data, "Sec51", bob); err != AssociatedDataError {
+		t.Errorf("Expected AssociatedDataError, got %v\n", err)
+	}
+
+	// the binding cannot be skipped
+	if _, err := TOTPFromBytes(data, "Sec51"); err != AssociatedDataError {
+		t.Errorf("Expected AssociatedDataError, got %v\n", err)
+	}
+	if _, _, err := TOTPFromBytesWith(data, "Sec51"); err != AssociatedDataError {
+		t.Errorf("Expected AssociatedDataError, got %v\n", err)
+	}
+
+	// the loaded TOTP keeps its binding
+	if _, err := restored.ToBytes(); err != BindingBytesVersionError {
+		t.Errorf("Expected BindingBytesVersionError, got %v\n", err)
+	}
+	data, err = restored.ToBytesWith("Sec51", BytesVersion2)
+	checkError(t, err)
+	_, err = TOTPFromBytesBound(data, "Sec51", alice)
+	checkError(t, err)
+
+	if _, err := otp.ToBytesBound("Sec51", nil); err == nil {
+		t.Error("The empty associated data has been accepted")
+	}
+}
+
+func TestBindingOfUnboundBytes(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	data, err := otp.ToBytes()
+	checkError(t, err)
+
+	// the unbound byte arrays are refused as well
+	if _, err := TOTPFromBytesBound(data, "Sec51", []byte("user-1")); err != AssociatedDataError {
+		t.Errorf("Expected AssociatedDataError, got %v\n", err)
+	}
+
+	// migration of the existing byte arrays
+	restored, err := TOTPFromBytes(data, "Sec51")
+	checkError(t, err)
+	data, err = restored.ToBytesBound("Sec51", []byte("user-1"))
+	checkError(t, err)
+	_, err = TOTPFromBytesBound(data, "Sec51", []byte("user-1"))
+	checkError(t, err)
+}
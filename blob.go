@@ -0,0 +1,142 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+// The version 2 of the serialized TOTP appends a list of extension records to the original layout:
+// Sizes:     4      4       N
+// Format: |type|value_size|value| ...
+// The records with an unknown type are skipped, so that new properties can be added without a new version.
+const (
+	totp_fixed_size = 52 // the size of the original layout without the key, the issuer and the account
+	message_type_v2 = 1  // the cryptoengine message type of the version 2
+
+	extension_verification_time = 1 // the last verification time in nanoseconds, the original layout has only seconds
+	extension_next_key          = 2 // the next secret key of the rotation in progress
+	extension_rotation_deadline = 3 // the end of the grace period of the rotation in nanoseconds
+	extension_binding           = 4 // the SHA-256 of the associated data the byte array is bound to
+	extension_generation        = 5 // the generation of the serialized state, see VerifyLoad
+	extension_trusted_devices   = 6 // the generation of the trusted device tokens, see RevokeTrustedDevices
+)
+
+// Private function which maps the format version to the cryptoengine message type
+func messageTypeOfVersion(version int) (int, error) {
+	switch version {
+	case BytesVersion1:
+		return message_type, nil
+	case BytesVersion2:
+		return message_type_v2, nil
+	}
+	return 0, errors.New(fmt.Sprintf("Unsupported TOTP bytes version %d", version))
+}
+
+// Private function which maps the cryptoengine message type to the format version
+func versionOfMessageType(messageType int) (int, error) {
+	switch messageType {
+	case message_type:
+		return BytesVersion1, nil
+	case message_type_v2:
+		return BytesVersion2, nil
+	}
+	return 0, errors.New(fmt.Sprintf("Unsupported TOTP bytes message type %d", messageType))
+}
+
+// Private function which encodes the extension records of the version 2
+func encodeExtensions(otp *Totp) []byte {
+	var buffer bytes.Buffer
+
+	if !otp.lastVerificationTime.IsZero() {
+		nanoseconds := bigendian.ToUint64(uint64(otp.lastVerificationTime.UnixNano()))
+		writeExtension(&buffer, extension_verification_time, nanoseconds[:])
+	}
+
+	if otp.nextKey != nil {
+		deadline := bigendian.ToUint64(uint64(otp.rotationDeadline.UnixNano()))
+		writeExtension(&buffer, extension_next_key, otp.nextKey)
+		writeExtension(&buffer, extension_rotation_deadline, deadline[:])
+	}
+
+	if otp.binding != nil {
+		writeExtension(&buffer, extension_binding, otp.binding)
+	}
+
+	if otp.generation != 0 {
+		generation := bigendian.ToUint64(otp.generation)
+		writeExtension(&buffer, extension_generation, generation[:])
+	}
+
+	if otp.trustedDevicesGeneration != 0 {
+		generation := bigendian.ToUint64(otp.trustedDevicesGeneration)
+		writeExtension(&buffer, extension_trusted_devices, generation[:])
+	}
+
+	return buffer.Bytes()
+}
+
+// Private function which writes an extension record
+func writeExtension(buffer *bytes.Buffer, recordType int, value []byte) {
+	typeBytes := bigendian.ToInt(recordType)
+	sizeBytes := bigendian.ToInt(len(value))
+	buffer.Write(typeBytes[:])
+	buffer.Write(sizeBytes[:])
+	buffer.Write(value)
+}
+
+// Private function which decodes the extension records of the version 2
+func decodeExtensions(otp *Totp, data []byte) error {
+
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return MalformedBytesError
+		}
+		recordType := bigendian.FromInt([4]byte{data[0], data[1], data[2], data[3]})
+		size := bigendian.FromInt([4]byte{data[4], data[5], data[6], data[7]})
+		if size < 0 || size > len(data)-8 {
+			return MalformedBytesError
+		}
+		value := data[8 : 8+size]
+		data = data[8+size:]
+
+		switch recordType {
+		case extension_verification_time:
+			if size != 8 {
+				return MalformedBytesError
+			}
+			nanoseconds := bigendian.FromUint64([8]byte{value[0], value[1], value[2], value[3], value[4], value[5], value[6], value[7]})
+			otp.lastVerificationTime = time.Unix(0, int64(nanoseconds))
+		case extension_next_key:
+			// copied, so that the plain text can be wiped
+			otp.nextKey = append([]byte(nil), value...)
+		case extension_rotation_deadline:
+			if size != 8 {
+				return MalformedBytesError
+			}
+			nanoseconds := bigendian.FromUint64([8]byte{value[0], value[1], value[2], value[3], value[4], value[5], value[6], value[7]})
+			otp.rotationDeadline = time.Unix(0, int64(nanoseconds)).UTC()
+		case extension_binding:
+			if size != sha256.Size {
+				return MalformedBytesError
+			}
+			otp.binding = append([]byte(nil), value...)
+		case extension_generation:
+			if size != 8 {
+				return MalformedBytesError
+			}
+			otp.generation = bigendian.FromUint64([8]byte{value[0], value[1], value[2], value[3], value[4], value[5], value[6], value[7]})
+		case extension_trusted_devices:
+			if size != 8 {
+				return MalformedBytesError
+			}
+			otp.trustedDevicesGeneration = bigendian.FromUint64([8]byte{value[0], value[1], value[2], value[3], value[4], value[5], value[6], value[7]})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+	"time"
+)
+
+func TestBytesVersion2(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 8)
+	checkError(t, err)
+	otp.totalVerificationFailures = 3
+	otp.lastVerificationTime = time.Unix(1500000000, 123456789)
+
+	data, err := otp.ToBytesWith("Sec51", BytesVersion2)
+	checkError(t, err)
+
+	restored, version, err := TOTPFromBytesWith(data, "Sec51")
+	checkError(t, err)
+	if version != BytesVersion2 {
+		t.Errorf("Expected the version 2, instead we've got %d\n", version)
+	}
+	if !restored.lastVerificationTime.Equal(otp.lastVerificationTime) {
+		t.Errorf("The version 2 did not preserve the nanoseconds: %s\n", restored.lastVerificationTime)
+	}
+	if restored.label() != otp.label() || restored.totalVerificationFailures != 3 || restored.hashFunction != crypto.SHA256 {
+		t.Error("TOTP properties differ after the version 2 round trip")
+	}
+
+	// the version 1 keeps only the seconds
+	data, err = restored.ToBytes()
+	checkError(t, err)
+	restored, version, err = TOTPFromBytesWith(data, "Sec51")
+	checkError(t, err)
+	if version != BytesVersion1 || restored.lastVerificationTime.Unix() != 1500000000 || restored.lastVerificationTime.Nanosecond() != 0 {
+		t.Errorf("Version 1 mismatch: version %d, time %s\n", version, restored.lastVerificationTime)
+	}
+
+	if _, err := otp.ToBytesWith("Sec51", 3); err == nil {
+		t.Error("The unsupported version 3 has been accepted")
+	}
+}
+
+func TestBytesEngineID(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	data, err := otp.ToBytesWith("Sec51-2", BytesVersion1)
+	checkError(t, err)
+
+	if _, err := TOTPFromBytes(data, "Sec51"); err == nil {
+		t.Error("The bytes have been decrypted with the wrong identifier")
+	}
+
+	restored, err := TOTPFromBytes(data, "Sec51-2")
+	checkError(t, err)
+	if restored.issuer != "Sec51" {
+		t.Errorf("Expected the issuer Sec51, instead we've got %s\n", restored.issuer)
+	}
+}
+
+func TestMalformedBytes(t *testing.T) {
+
+	malformed := [][]byte{
+		{},
+		{0, 0, 0, 10},
+		{0, 0, 0x10, 0},
+		// total size 56 with a key size larger than the total size
+		append([]byte{0, 0, 0, 56, 0, 0, 1, 0}, make([]byte, 48)...),
+	}
+
+	for _, data := range malformed {
+		if _, err := decodeTOTP(data, BytesVersion1); err == nil {
+			t.Errorf("The malformed bytes %v have been accepted\n", data)
+		}
+	}
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	otp.lastVerificationTime = time.Now()
+	if err := decodeExtensions(otp, []byte{0, 0, 0, 1, 0, 0, 0, 9, 1}); err != MalformedBytesError {
+		t.Errorf("Expected MalformedBytesError for a truncated extension, instead we've got %v\n", err)
+	}
+}
+
+func TestStateAndResetLockDown(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA512, 8)
+	checkError(t, err)
+
+	for i := 0; i < max_failures; i++ {
+		otp.Validate("00000000")
+	}
+
+	state, err := otp.State()
+	checkError(t, err)
+	if !state.LockedDown || state.VerificationFailures != max_failures || state.Algorithm != "SHA512" || state.KeySize != 64 {
+		t.Errorf("Unexpected state: %+v\n", state)
+	}
+
+	otp.ResetLockDown()
+	token, err := otp.OTP()
+	checkError(t, err)
+	if err := otp.Validate(token); err != nil {
+		t.Errorf("The validation failed after the reset: %s\n", err)
+	}
+}
@@ -0,0 +1,413 @@
+/*
+Command twofactor-admin inspects and maintains the encrypted TOTP byte arrays created by Totp.ToBytes.
+
+Usage:
+
+	twofactor-admin inspect -id ID [-dump] [-encoding raw|base64|hex] [INPUT...]
+	twofactor-admin reset   -id ID [-dump] [-encoding raw|base64|hex] [-out OUTPUT] [INPUT...]
+	twofactor-admin migrate -id ID [-new-id ID] [-version 1|2] [-dump] [-encoding raw|base64|hex] [-out OUTPUT] [INPUT...]
+
+The ID is the cryptoengine identifier used to encrypt the byte arrays: the issuer, unless ToBytesWith was used.
+The cryptoengine keys are read from the working directory, as in the services.
+The byte arrays bound to associated data with ToBytesBound cannot be processed.
+
+An INPUT is a file, a directory (all its files) or - for the standard input, which is the default.
+Each file contains one byte array, raw or encoded with -encoding. With -dump each file contains one byte array per line,
+base64 encoded and optionally prefixed by an identifier and a tab, a space or a comma, like the output of a database query.
+Empty lines and lines starting with # are copied unchanged.
+
+inspect prints the properties of each byte array, with the secret key redacted.
+
+reset clears the verification failures, so that the locked down users can verify again.
+
+migrate decrypts the byte arrays and encrypts them again with the new identifier. Each byte array keeps its
+format version, unless -version is given: a version 2 byte array with a rotation in progress, a binding
+or revoked trusted devices cannot be written as version 1.
+
+reset and migrate write the files with the same name in the OUTPUT directory, or the dump to the OUTPUT file.
+When OUTPUT is missing the result is written to the standard output, as long as there is a single input.
+Nothing is written if any of the byte arrays cannot be processed.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sec51/twofactor"
+)
+
+// options are the parsed command line options
+type options struct {
+	id       string
+	newID    string
+	version  int
+	dump     bool
+	encoding string
+	out      string
+}
+
+// record is a serialized TOTP read from an input
+type record struct {
+	source string // the file name, and the line number for the dumps
+	input  string // the input file, - for the standard input
+	prefix string // dump only: the identifier and the separator before the byte array
+	line   string // dump only: the original line, for the lines which are not byte arrays
+	data   []byte // the encrypted byte array, nil for the dump lines which are copied unchanged
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes the command and returns the exit status
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+
+	usage := func() {
+		fmt.Fprintln(stderr, "Usage: twofactor-admin inspect|reset|migrate -id ID [options] [INPUT...]")
+	}
+
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	command := args[0]
+
+	opts := &options{}
+	fs := flag.NewFlagSet("twofactor-admin "+command, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.id, "id", "", "the cryptoengine identifier of the byte arrays, usually the issuer")
+	fs.BoolVar(&opts.dump, "dump", false, "the inputs contain one base64 encoded byte array per line")
+	fs.StringVar(&opts.encoding, "encoding", "raw", "the encoding of the byte array files: raw, base64 or hex")
+	switch command {
+	case "inspect":
+	case "reset":
+		fs.StringVar(&opts.out, "out", "", "the output directory, or the output file with -dump")
+	case "migrate":
+		fs.StringVar(&opts.out, "out", "", "the output directory, or the output file with -dump")
+		fs.StringVar(&opts.newID, "new-id", "", "the cryptoengine identifier of the migrated byte arrays (default the -id)")
+		fs.IntVar(&opts.version, "version", 0, "the format version of the migrated byte arrays (default the version of each byte array)")
+	default:
+		usage()
+		return 2
+	}
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if opts.id == "" {
+		fmt.Fprintln(stderr, "twofactor-admin: the -id option is required")
+		return 2
+	}
+	if opts.newID == "" {
+		opts.newID = opts.id
+	}
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	records, err := readRecords(inputs, opts, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "twofactor-admin: %s\n", err)
+		return 1
+	}
+
+	if command == "inspect" {
+		return inspect(records, opts, stdout, stderr)
+	}
+
+	// process all the records before writing anything
+	failed := false
+	for _, r := range records {
+		if r.data == nil {
+			continue
+		}
+		if err := transform(r, command, opts); err != nil {
+			fmt.Fprintf(stderr, "twofactor-admin: %s: %s\n", r.source, err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+
+	if err := writeRecords(records, inputs, opts, stdout); err != nil {
+		fmt.Fprintf(stderr, "twofactor-admin: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// inspect prints the properties of each record, it continues after the errors
+func inspect(records []*record, opts *options, stdout, stderr io.Writer) int {
+
+	status := 0
+	for _, r := range records {
+		if r.data == nil {
+			continue
+		}
+
+		otp, version, err := twofactor.TOTPFromBytesWith(r.data, opts.id)
+		if err == nil {
+			err = printState(stdout, r, otp, version)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "twofactor-admin: %s: %s\n", r.source, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// printState prints the properties of the TOTP, without the secret key
+func printState(w io.Writer, r *record, otp *twofactor.Totp, version int) error {
+
+	state, err := otp.State()
+	if err != nil {
+		return err
+	}
+
+	lastVerification := "never"
+	if !state.LastVerificationTime.IsZero() && state.LastVerificationTime.Unix() > 0 {
+		lastVerification = state.LastVerificationTime.UTC().Format(time.RFC3339)
+	}
+
+	lockedDown := "no"
+	if state.LockedDown {
+		lockedDown = "yes"
+	}
+
+	_, err = fmt.Fprintf(w, "source: %s\nversion: %d\naccount: %s\nissuer: %s\nalgorithm: %s\nkey: redacted (%d bytes)\n"+
+		"digits: %d\nstep size: %ds\nclient offset: %d\ncounter: %d\nverification failures: %d\nlast verification: %s\nlocked down: %s\n\n",
+		r.source, version, state.Account, state.Issuer, state.Algorithm, state.KeySize,
+		state.Digits, state.StepSize, state.ClientOffset, state.Counter, state.VerificationFailures, lastVerification, lockedDown)
+	return err
+}
+
+// transform applies the reset or the migration to the record
+func transform(r *record, command string, opts *options) error {
+
+	otp, version, err := twofactor.TOTPFromBytesWith(r.data, opts.id)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "reset":
+		otp.ResetLockDown()
+		r.data, err = otp.ToBytesWith(opts.id, version)
+	case "migrate":
+		if opts.version != 0 {
+			version = opts.version
+		}
+		r.data, err = otp.ToBytesWith(opts.newID, version)
+	}
+	return err
+}
+
+// readRecords reads the records of all the inputs, expanding the directories
+func readRecords(inputs []string, opts *options, stdin io.Reader) ([]*record, error) {
+
+	var records []*record
+	for _, input := range inputs {
+		files := []string{input}
+		if input != "-" {
+			info, err := os.Stat(input)
+			if err != nil {
+				return nil, err
+			}
+			if info.IsDir() {
+				if files, err = listFiles(input); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, file := range files {
+			var content []byte
+			var err error
+			if file == "-" {
+				content, err = ioutil.ReadAll(stdin)
+			} else {
+				content, err = ioutil.ReadFile(file)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			name := file
+			if file == "-" {
+				name = "stdin"
+			}
+
+			if opts.dump {
+				dumpRecords, err := parseDump(name, file, content)
+				if err != nil {
+					return nil, err
+				}
+				records = append(records, dumpRecords...)
+				continue
+			}
+
+			data, err := decode(content, opts.encoding)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: %s", name, err))
+			}
+			records = append(records, &record{source: name, input: file, data: data})
+		}
+	}
+
+	return records, nil
+}
+
+// listFiles returns the regular files of the directory, sorted by name
+func listFiles(dir string) ([]string, error) {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// parseDump splits the dump in records, one per line
+func parseDump(name, file string, content []byte) ([]*record, error) {
+
+	var records []*record
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		r := &record{source: fmt.Sprintf("%s:%d", name, number), input: file, line: line}
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			// the byte array is the last field
+			separator := strings.LastIndexAny(line, "\t ,")
+			r.prefix = line[:separator+1]
+			data, err := base64.StdEncoding.DecodeString(line[separator+1:])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: %s", r.source, err))
+			}
+			r.data = data
+		}
+		records = append(records, r)
+	}
+
+	return records, scanner.Err()
+}
+
+// writeRecords writes the records to the output directory, the output file or the standard output
+func writeRecords(records []*record, inputs []string, opts *options, stdout io.Writer) error {
+
+	// group the records by input file, keeping the order
+	var files []string
+	byFile := map[string][]*record{}
+	for _, r := range records {
+		if _, ok := byFile[r.input]; !ok {
+			files = append(files, r.input)
+		}
+		byFile[r.input] = append(byFile[r.input], r)
+	}
+
+	if opts.dump {
+		var buffer bytes.Buffer
+		for _, file := range files {
+			for _, r := range byFile[file] {
+				if r.data == nil {
+					buffer.WriteString(r.line + "\n")
+				} else {
+					buffer.WriteString(r.prefix + base64.StdEncoding.EncodeToString(r.data) + "\n")
+				}
+			}
+		}
+		return writeOutput(opts.out, buffer.Bytes(), stdout)
+	}
+
+	if opts.out == "" || opts.out == "-" {
+		if len(records) != 1 || len(inputs) != 1 {
+			return errors.New("the -out directory is required with multiple byte arrays")
+		}
+		return writeOutput(opts.out, encode(records[0].data, opts.encoding), stdout)
+	}
+
+	// the inputs with the same name, from different directories, would overwrite each other: nothing is written
+	names := make([]string, len(records))
+	inputByName := map[string]string{}
+	for i, r := range records {
+		names[i] = filepath.Base(r.input)
+		if r.input == "-" {
+			names[i] = "stdin"
+		}
+		if other, ok := inputByName[names[i]]; ok {
+			return errors.New(fmt.Sprintf("%s and %s would both be written to %s in the -out directory", other, r.input, names[i]))
+		}
+		inputByName[names[i]] = r.input
+	}
+
+	if err := os.MkdirAll(opts.out, 0700); err != nil {
+		return err
+	}
+	for i, r := range records {
+		// the byte arrays contain the secrets: only the owner can read them
+		if err := ioutil.WriteFile(filepath.Join(opts.out, names[i]), encode(r.data, opts.encoding), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOutput writes the content to the file, or to the standard output when the file is empty or -
+func writeOutput(file string, content []byte, stdout io.Writer) error {
+	if file == "" || file == "-" {
+		_, err := stdout.Write(content)
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0600)
+}
+
+// decode decodes the content of a byte array file
+func decode(content []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "raw":
+		return content, nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	case "hex":
+		return hex.DecodeString(strings.TrimSpace(string(content)))
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported encoding %q", encoding))
+}
+
+// encode encodes the byte array for a file, the text encodings end with a new line
+func encode(data []byte, encoding string) []byte {
+	switch encoding {
+	case "base64":
+		return []byte(base64.StdEncoding.EncodeToString(data) + "\n")
+	case "hex":
+		return []byte(hex.EncodeToString(data) + "\n")
+	}
+	return data
+}
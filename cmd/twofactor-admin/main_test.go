@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sec51/twofactor"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lockedDownBlob returns the bytes of a TOTP which failed the verification too many times
+func lockedDownBlob(t *testing.T, account string) []byte {
+
+	otp, err := twofactor.NewTOTP(account, "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	for i := 0; i < 3; i++ {
+		otp.Validate("000000")
+	}
+
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	return data
+}
+
+func runCommand(stdin []byte, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	status := run(args, bytes.NewReader(stdin), &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestInspect(t *testing.T) {
+
+	data := lockedDownBlob(t, "alice@sec51.com")
+
+	status, stdout, stderr := runCommand(data, "inspect", "-id", "Sec51")
+	if status != 0 {
+		t.Fatalf("inspect failed: %s\n", stderr)
+	}
+
+	for _, expected := range []string{"account: alice@sec51.com", "verification failures: 3", "locked down: yes", "key: redacted (20 bytes)"} {
+		if !strings.Contains(stdout, expected) {
+			t.Errorf("The inspect output does not contain %q:\n%s\n", expected, stdout)
+		}
+	}
+
+	status, _, _ = runCommand(data, "inspect", "-id", "Other")
+	if status != 1 {
+		t.Errorf("Expected status 1 with the wrong identifier, instead we've got %d\n", status)
+	}
+}
+
+func TestReset(t *testing.T) {
+
+	data := lockedDownBlob(t, "alice@sec51.com")
+
+	status, stdout, stderr := runCommand([]byte(base64.StdEncoding.EncodeToString(data)), "reset", "-id", "Sec51", "-encoding", "base64")
+	if status != 0 {
+		t.Fatalf("reset failed: %s\n", stderr)
+	}
+
+	reset, err := base64.StdEncoding.DecodeString(strings.TrimSpace(stdout))
+	checkError(t, err)
+
+	otp, err := twofactor.TOTPFromBytes(reset, "Sec51")
+	checkError(t, err)
+	state, err := otp.State()
+	checkError(t, err)
+	if state.LockedDown || state.VerificationFailures != 0 {
+		t.Errorf("The lock down has not been reset: %+v\n", state)
+	}
+}
+
+func TestMigrateDump(t *testing.T) {
+
+	dump := "# user_id,totp\n" +
+		"1," + base64.StdEncoding.EncodeToString(lockedDownBlob(t, "alice@sec51.com")) + "\n" +
+		"\n" +
+		"2\t" + base64.StdEncoding.EncodeToString(lockedDownBlob(t, "bob@sec51.com")) + "\n"
+
+	status, stdout, stderr := runCommand([]byte(dump), "migrate", "-id", "Sec51", "-new-id", "Sec51-2", "-version", "2", "-dump")
+	if status != 0 {
+		t.Fatalf("migrate failed: %s\n", stderr)
+	}
+
+	lines := strings.Split(stdout, "\n")
+	if len(lines) != 5 || lines[0] != "# user_id,totp" || lines[2] != "" || !strings.HasPrefix(lines[1], "1,") || !strings.HasPrefix(lines[3], "2\t") {
+		t.Fatalf("The dump structure has not been preserved:\n%s\n", stdout)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(lines[3][2:])
+	checkError(t, err)
+	otp, version, err := twofactor.TOTPFromBytesWith(data, "Sec51-2")
+	checkError(t, err)
+	state, err := otp.State()
+	checkError(t, err)
+	if version != twofactor.BytesVersion2 || state.Account != "bob@sec51.com" || state.VerificationFailures != 3 {
+		t.Errorf("Migration mismatch: version %d, %+v\n", version, state)
+	}
+
+	// nothing is written when a byte array cannot be decrypted
+	status, stdout, _ = runCommand([]byte(dump), "migrate", "-id", "Other", "-dump")
+	if status != 1 || stdout != "" {
+		t.Errorf("Expected status 1 and no output, instead we've got %d:\n%s\n", status, stdout)
+	}
+}
+
+func TestMigrateDirectory(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "twofactor-admin")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "in")
+	output := filepath.Join(dir, "out")
+	checkError(t, os.Mkdir(input, 0700))
+	checkError(t, ioutil.WriteFile(filepath.Join(input, "alice"), lockedDownBlob(t, "alice@sec51.com"), 0600))
+	checkError(t, ioutil.WriteFile(filepath.Join(input, "bob"), lockedDownBlob(t, "bob@sec51.com"), 0600))
+
+	status, _, stderr := runCommand(nil, "migrate", "-id", "Sec51", "-new-id", "Sec51-2", "-out", output, input)
+	if status != 0 {
+		t.Fatalf("migrate failed: %s\n", stderr)
+	}
+
+	for _, name := range []string{"alice", "bob"} {
+		data, err := ioutil.ReadFile(filepath.Join(output, name))
+		checkError(t, err)
+		otp, err := twofactor.TOTPFromBytes(data, "Sec51-2")
+		checkError(t, err)
+		state, err := otp.State()
+		checkError(t, err)
+		if state.Account != name+"@sec51.com" {
+			t.Errorf("Expected the account %s@sec51.com, instead we've got %s\n", name, state.Account)
+		}
+	}
+
+	// multiple byte arrays need an output directory
+	if status, _, _ := runCommand(nil, "migrate", "-id", "Sec51", input); status != 1 {
+		t.Errorf("Expected status 1 without -out, instead we've got %d\n", status)
+	}
+
+	// the inputs with the same name would overwrite each other
+	other := filepath.Join(dir, "other")
+	checkError(t, os.Mkdir(other, 0700))
+	checkError(t, ioutil.WriteFile(filepath.Join(other, "alice"), lockedDownBlob(t, "alice@example.com"), 0600))
+	conflict := filepath.Join(dir, "conflict")
+	status, _, stderr = runCommand(nil, "migrate", "-id", "Sec51", "-new-id", "Sec51-2", "-out", conflict, input, other)
+	if status != 1 || !strings.Contains(stderr, "alice") {
+		t.Errorf("Expected status 1 with the same name twice, instead we've got %d: %s\n", status, stderr)
+	}
+	if _, err := os.Stat(conflict); !os.IsNotExist(err) {
+		t.Error("The output directory has been written")
+	}
+}
+
+func TestMigrateKeepsVersion(t *testing.T) {
+
+	otp, err := twofactor.NewTOTP("alice@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	checkError(t, otp.StartRotation(time.Hour))
+	data, err := otp.ToBytesWith("Sec51", twofactor.BytesVersion2)
+	checkError(t, err)
+
+	status, stdout, stderr := runCommand(data, "migrate", "-id", "Sec51", "-new-id", "Sec51-2")
+	if status != 0 {
+		t.Fatalf("migrate failed: %s\n", stderr)
+	}
+
+	migrated, version, err := twofactor.TOTPFromBytesWith([]byte(stdout), "Sec51-2")
+	checkError(t, err)
+	state, err := migrated.State()
+	checkError(t, err)
+	if version != twofactor.BytesVersion2 || !state.RotationPending {
+		t.Errorf("The version 2 byte array has been downgraded: version %d, %+v\n", version, state)
+	}
+}
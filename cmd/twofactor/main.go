@@ -0,0 +1,501 @@
+/*
+Command twofactor generates and verifies TOTP (RFC 6238) and HOTP (RFC 4226) codes.
+It accepts the same options of oathtool, so that it can replace it in existing scripts.
+
+Usage:
+
+	twofactor [options] KEY [CODE]
+	twofactor -new [-totp] -issuer ISSUER -account ACCOUNT [-qr FILE [-qr-format FORMAT]]
+
+The KEY is hex encoded, base32 encoded with -base32, or an otpauth:// key URL.
+The parameters of a key URL take precedence over the defaults, the explicit options take precedence over the key URL.
+
+Without CODE the command prints the code for the counter or the time, followed by the next -window codes.
+With CODE the command searches it in the window and prints the matched offset:
+the counter offset for HOTP, the time steps offset (negative for past codes) for TOTP.
+It exits with status 1 when the code does not match.
+
+With -new the command creates a new random secret and prints its key URL, or writes its QR code with -qr.
+The QR code is a PNG image, unless -qr-format selects svg, terminal (Unicode half blocks with ANSI colors) or text.
+
+Examples:
+
+	twofactor -totp -base32 JBSWY3DPEHPK3PXP
+	twofactor -totp=sha256 -digits 8 -N 2009-02-13T23:31:30Z 3132333435363738393031323334353637383930313233343536373839303132
+	twofactor -window 10 3132333435363738393031323334353637383930 520489
+	twofactor -new -totp -issuer Example -account alice@example.com -qr alice.png
+	twofactor -new -totp -issuer Example -account alice@example.com -qr - -qr-format terminal
+*/
+package main
+
+import (
+	"crypto"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sec51/twofactor"
+)
+
+// totpFlag is a boolean flag which optionally carries the hash function, like the oathtool --totp[=MODE] option
+type totpFlag struct {
+	enabled bool
+	hash    string
+	hashSet bool // whether the hash function has been given explicitly
+}
+
+func (f *totpFlag) IsBoolFlag() bool { return true }
+
+func (f *totpFlag) String() string {
+	if f == nil || !f.enabled {
+		return "false"
+	}
+	return f.hash
+}
+
+func (f *totpFlag) Set(value string) error {
+	switch strings.ToLower(value) {
+	case "true":
+		f.enabled = true
+	case "false":
+		f.enabled = false
+	case "sha1", "sha256", "sha512":
+		f.enabled = true
+		f.hash = strings.ToUpper(value)
+		f.hashSet = true
+	default:
+		return errors.New("the TOTP mode must be sha1, sha256 or sha512")
+	}
+	return nil
+}
+
+// options are the parsed command line options
+type options struct {
+	totp      totpFlag
+	base32    bool
+	digits    int
+	counter   uint64
+	stepSize  time.Duration
+	startTime string
+	now       string
+	window    int
+	verbose   bool
+	newKey    bool
+	issuer    string
+	account   string
+	qr        string
+	qrFormat  string
+	qrLevel   string
+	set       map[string]bool // the options explicitly set on the command line
+}
+
+// generator abstracts the TOTP and HOTP codes computation over a window
+type generator struct {
+	totp     *twofactor.Totp
+	hotp     *twofactor.Hotp
+	counter  uint64        // HOTP: the first counter of the window
+	now      time.Time     // TOTP: the time of the current code
+	stepSize time.Duration // TOTP: the time step
+}
+
+// code returns the code at the given offset from the current counter or time step
+func (g *generator) code(offset int) (string, error) {
+	if g.totp != nil {
+		return g.totp.OTPAt(g.now.Add(time.Duration(offset) * g.stepSize))
+	}
+	return g.hotp.OTPAt(g.counter + uint64(offset))
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command and returns the exit status
+func run(args []string, stdout, stderr io.Writer) int {
+
+	opts := &options{totp: totpFlag{hash: "SHA1"}, set: map[string]bool{}}
+
+	fs := flag.NewFlagSet("twofactor", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: twofactor [options] KEY [CODE]")
+		fmt.Fprintln(stderr, "       twofactor -new [-totp] -issuer ISSUER -account ACCOUNT [-qr FILE [-qr-format FORMAT]]")
+		fs.PrintDefaults()
+	}
+
+	fs.Var(&opts.totp, "totp", "use TOTP instead of HOTP, optionally with the hash function: -totp=sha256")
+	fs.BoolVar(&opts.base32, "base32", false, "the KEY is base32 encoded instead of hex")
+	fs.BoolVar(&opts.base32, "b", false, "shorthand for -base32")
+	fs.IntVar(&opts.digits, "digits", 6, "the number of digits of the code (6, 7 or 8)")
+	fs.IntVar(&opts.digits, "d", 6, "shorthand for -digits")
+	fs.Uint64Var(&opts.counter, "counter", 0, "the HOTP counter")
+	fs.Uint64Var(&opts.counter, "c", 0, "shorthand for -counter")
+	fs.DurationVar(&opts.stepSize, "time-step-size", 30*time.Second, "the TOTP time step")
+	fs.DurationVar(&opts.stepSize, "s", 30*time.Second, "shorthand for -time-step-size")
+	fs.StringVar(&opts.startTime, "start-time", "", "the TOTP start time T0, only the unix epoch is supported")
+	fs.StringVar(&opts.startTime, "S", "", "shorthand for -start-time")
+	fs.StringVar(&opts.now, "now", "", "the time of the TOTP code, RFC 3339 or @unix seconds (default the current time)")
+	fs.StringVar(&opts.now, "N", "", "shorthand for -now")
+	fs.IntVar(&opts.window, "window", 0, "the number of codes to print or to search after (and for TOTP before) the current one")
+	fs.IntVar(&opts.window, "w", 0, "shorthand for -window")
+	fs.BoolVar(&opts.verbose, "verbose", false, "print the key parameters")
+	fs.BoolVar(&opts.verbose, "v", false, "shorthand for -verbose")
+	fs.BoolVar(&opts.newKey, "new", false, "create a new random secret and print its key URL")
+	fs.StringVar(&opts.issuer, "issuer", "", "the issuer of the key URL")
+	fs.StringVar(&opts.account, "account", "", "the account of the key URL")
+	fs.StringVar(&opts.qr, "qr", "", "with -new, write the QR code to the file (- for the standard output)")
+	fs.StringVar(&opts.qrFormat, "qr-format", "png", "the format of the QR code: png, svg, terminal (ANSI colors) or text")
+	fs.StringVar(&opts.qrLevel, "qr-level", "Q", "the error correction level of the QR code: L, M, Q or H")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	fs.Visit(func(f *flag.Flag) {
+		opts.set[canonicalFlag(f.Name)] = true
+	})
+
+	var err error
+	if opts.newKey {
+		if fs.NArg() != 0 {
+			fs.Usage()
+			return 2
+		}
+		err = newKey(opts, stdout)
+	} else {
+		if fs.NArg() < 1 || fs.NArg() > 2 {
+			fs.Usage()
+			return 2
+		}
+		var matched bool
+		matched, err = generate(opts, fs.Arg(0), fs.Arg(1), stdout)
+		if err == nil && !matched {
+			fmt.Fprintln(stderr, "twofactor: the code does not match")
+			return 1
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "twofactor: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// canonicalFlag maps the shorthand flags to their long name
+func canonicalFlag(name string) string {
+	switch name {
+	case "b":
+		return "base32"
+	case "d":
+		return "digits"
+	case "c":
+		return "counter"
+	case "s":
+		return "time-step-size"
+	case "S":
+		return "start-time"
+	case "N":
+		return "now"
+	case "w":
+		return "window"
+	case "v":
+		return "verbose"
+	}
+	return name
+}
+
+// generate prints the codes of the window, or searches the code in the window when it is not empty.
+// It returns whether the code matched, always true when no code is given.
+func generate(opts *options, key, code string, stdout io.Writer) (bool, error) {
+
+	if opts.window < 0 {
+		return false, errors.New("the window cannot be negative")
+	}
+	if opts.startTime != "" && opts.startTime != "0" && opts.startTime != "1970-01-01T00:00:00Z" {
+		return false, errors.New("only the unix epoch is supported as start time")
+	}
+
+	rawurl, err := keyURL(opts, key)
+	if err != nil {
+		return false, err
+	}
+
+	g, err := newGenerator(opts, rawurl)
+	if err != nil {
+		return false, err
+	}
+
+	if opts.verbose {
+		fmt.Fprintf(stdout, "Key URL: %s\n", rawurl)
+		if g.totp != nil {
+			fmt.Fprintf(stdout, "Time: %s\nStep size: %s\n", g.now.Format(time.RFC3339), g.stepSize)
+		} else {
+			fmt.Fprintf(stdout, "Counter: %d\n", g.counter)
+		}
+	}
+
+	if code == "" {
+		for offset := 0; offset <= opts.window; offset++ {
+			c, err := g.code(offset)
+			if err != nil {
+				return false, err
+			}
+			fmt.Fprintln(stdout, c)
+		}
+		return true, nil
+	}
+
+	// the HOTP codes are searched only forward, the TOTP codes in both directions, the closest first
+	offsets := []int{0}
+	for i := 1; i <= opts.window; i++ {
+		if g.totp != nil {
+			offsets = append(offsets, -i)
+		}
+		offsets = append(offsets, i)
+	}
+
+	for _, offset := range offsets {
+		c, err := g.code(offset)
+		if err != nil {
+			return false, err
+		}
+		if c == code {
+			fmt.Fprintln(stdout, offset)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// keyURL converts the KEY argument and the options in an otpauth key URL
+func keyURL(opts *options, key string) (string, error) {
+
+	otpType := "hotp"
+	if opts.totp.enabled {
+		otpType = "totp"
+	}
+
+	var u *url.URL
+	if strings.HasPrefix(key, "otpauth://") {
+		var err error
+		if u, err = url.Parse(key); err != nil {
+			return "", err
+		}
+		// the key URL defines the type, unless -totp is explicitly set
+		if !opts.set["totp"] {
+			otpType = u.Host
+		}
+		u.Host = otpType
+	} else {
+		secret, err := decodeKey(key, opts.base32)
+		if err != nil {
+			return "", err
+		}
+		u = &url.URL{Scheme: "otpauth", Host: otpType, Path: "/" + url.QueryEscape(opts.issuer) + ":" + opts.account}
+		values := url.Values{}
+		values.Set("secret", base32.StdEncoding.EncodeToString(secret))
+		values.Set("algorithm", opts.totp.hash)
+		values.Set("digits", strconv.Itoa(opts.digits))
+		values.Set("period", strconv.Itoa(int(opts.stepSize/time.Second)))
+		values.Set("counter", strconv.FormatUint(opts.counter, 10))
+		u.RawQuery = values.Encode()
+		return u.String(), nil
+	}
+
+	// the explicit options override the key URL parameters
+	values := u.Query()
+	if opts.totp.hashSet {
+		values.Set("algorithm", opts.totp.hash)
+	}
+	if opts.set["digits"] {
+		values.Set("digits", strconv.Itoa(opts.digits))
+	}
+	if opts.set["time-step-size"] {
+		values.Set("period", strconv.Itoa(int(opts.stepSize/time.Second)))
+	}
+	if opts.set["counter"] {
+		values.Set("counter", strconv.FormatUint(opts.counter, 10))
+	}
+	u.RawQuery = values.Encode()
+	return u.String(), nil
+}
+
+// decodeKey decodes a hex or base32 secret, spaces are ignored
+func decodeKey(key string, isBase32 bool) ([]byte, error) {
+
+	key = strings.Replace(key, " ", "", -1)
+	if !isBase32 {
+		secret, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, errors.New("the KEY is not hex encoded, use -base32 for base32 keys")
+		}
+		return secret, nil
+	}
+
+	key = strings.ToUpper(strings.TrimRight(key, "="))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(key)
+	if err != nil {
+		return nil, errors.New("the KEY is not base32 encoded")
+	}
+	return secret, nil
+}
+
+// newGenerator creates the TOTP or HOTP from the key URL
+func newGenerator(opts *options, rawurl string) (*generator, error) {
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &generator{}
+	if u.Host == "totp" {
+		if g.totp, err = twofactor.TOTPFromURL(rawurl); err != nil {
+			return nil, err
+		}
+
+		g.stepSize = 30 * time.Second
+		if period := u.Query().Get("period"); period != "" {
+			seconds, err := strconv.Atoi(period)
+			if err != nil {
+				return nil, err
+			}
+			g.stepSize = time.Duration(seconds) * time.Second
+		}
+
+		if g.now, err = parseTime(opts.now); err != nil {
+			return nil, err
+		}
+		return g, nil
+	}
+
+	if g.hotp, err = twofactor.HOTPFromURL(rawurl); err != nil {
+		return nil, err
+	}
+	g.counter = g.hotp.Counter()
+	return g, nil
+}
+
+// parseTime parses the -now option: RFC 3339, @unix seconds, or empty for the current time
+func parseTime(value string) (time.Time, error) {
+
+	if value == "" {
+		return time.Now().UTC(), nil
+	}
+
+	if strings.HasPrefix(value, "@") {
+		seconds, err := strconv.ParseInt(value[1:], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05 MST", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("cannot parse the time %q", value))
+}
+
+// newKey creates a new random secret and prints its key URL, or writes its QR code
+func newKey(opts *options, stdout io.Writer) error {
+
+	hash := crypto.SHA1
+	switch opts.totp.hash {
+	case "SHA256":
+		hash = crypto.SHA256
+	case "SHA512":
+		hash = crypto.SHA512
+	}
+
+	if opts.digits < 6 || opts.digits > 8 {
+		return errors.New("the digits must be 6, 7 or 8")
+	}
+
+	var rawurl string
+	if opts.totp.enabled {
+		if opts.stepSize != 30*time.Second {
+			return errors.New("the new keys use the default time step of 30 seconds")
+		}
+		otp, err := twofactor.NewTOTP(opts.account, opts.issuer, hash, opts.digits)
+		if err != nil {
+			return err
+		}
+		if rawurl, err = otp.URL(); err != nil {
+			return err
+		}
+	} else {
+		otp, err := twofactor.NewHOTP(opts.account, opts.issuer, hash, opts.digits)
+		if err != nil {
+			return err
+		}
+		if rawurl, err = otp.URL(); err != nil {
+			return err
+		}
+	}
+
+	if opts.qr == "" {
+		_, err := fmt.Fprintln(stdout, rawurl)
+		return err
+	}
+
+	image, err := renderQR(rawurl, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.qr == "-" {
+		_, err = stdout.Write(image)
+		return err
+	}
+
+	// the QR code contains the secret: only the owner can read it
+	if err = ioutil.WriteFile(opts.qr, image, 0600); err == nil && opts.verbose {
+		_, err = fmt.Fprintln(stdout, rawurl)
+	}
+	return err
+}
+
+// renderQR renders the QR code of the key URL in the -qr-format
+func renderQR(rawurl string, opts *options) ([]byte, error) {
+
+	levels := map[string]twofactor.QRLevel{
+		"L": twofactor.QRLevelL,
+		"M": twofactor.QRLevelM,
+		"Q": twofactor.QRLevelQ,
+		"H": twofactor.QRLevelH,
+	}
+	level, ok := levels[strings.ToUpper(opts.qrLevel)]
+	if !ok {
+		return nil, errors.New("the QR code level must be L, M, Q or H")
+	}
+
+	code, err := twofactor.NewQRCode(rawurl, twofactor.QROptions{Level: level})
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.qrFormat {
+	case "png":
+		return code.PNG()
+	case "svg":
+		return []byte(code.SVG()), nil
+	case "terminal":
+		return []byte(code.Terminal()), nil
+	case "text":
+		return []byte(code.Text()), nil
+	}
+	return nil, errors.New("the QR code format must be png, svg, terminal or text")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const rfcKeyHex = "3132333435363738393031323334353637383930"
+
+func runCommand(t *testing.T, args ...string) (int, string) {
+	var stdout, stderr bytes.Buffer
+	status := run(args, &stdout, &stderr)
+	return status, strings.TrimSpace(stdout.String() + stderr.String())
+}
+
+func TestHOTPCodes(t *testing.T) {
+
+	// RFC 4226 appendix D
+	status, output := runCommand(t, "-w", "2", rfcKeyHex)
+	if status != 0 || output != "755224\n287082\n359152" {
+		t.Errorf("HOTP window mismatch, status %d:\n%s\n", status, output)
+	}
+
+	status, output = runCommand(t, "-c", "5", "-d", "6", rfcKeyHex)
+	if status != 0 || output != "254676" {
+		t.Errorf("HOTP counter mismatch, status %d: %s\n", status, output)
+	}
+}
+
+func TestTOTPCodes(t *testing.T) {
+
+	// RFC 6238 appendix B
+	status, output := runCommand(t, "-totp", "-d", "8", "-N", "@1111111109", rfcKeyHex)
+	if status != 0 || output != "07081804" {
+		t.Errorf("TOTP SHA1 mismatch, status %d: %s\n", status, output)
+	}
+
+	status, output = runCommand(t, "-totp=sha256", "-d", "8", "-N", "2009-02-13T23:31:30Z",
+		"3132333435363738393031323334353637383930313233343536373839303132")
+	if status != 0 || output != "91819424" {
+		t.Errorf("TOTP SHA256 mismatch, status %d: %s\n", status, output)
+	}
+
+	// base32 key and key URL
+	status, output = runCommand(t, "-totp", "-b", "-d", "8", "-N", "@59", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if status != 0 || output != "94287082" {
+		t.Errorf("TOTP base32 mismatch, status %d: %s\n", status, output)
+	}
+
+	status, output = runCommand(t, "-N", "@59", "otpauth://totp/Example:alice?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&digits=8")
+	if status != 0 || output != "94287082" {
+		t.Errorf("TOTP key URL mismatch, status %d: %s\n", status, output)
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	status, output := runCommand(t, "-w", "10", rfcKeyHex, "520489")
+	if status != 0 || output != "9" {
+		t.Errorf("HOTP verification mismatch, status %d: %s\n", status, output)
+	}
+
+	// the code of 1111111109 is one step before 1111111139
+	status, output = runCommand(t, "-totp", "-d", "8", "-w", "1", "-N", "@1111111139", rfcKeyHex, "07081804")
+	if status != 0 || output != "-1" {
+		t.Errorf("TOTP verification mismatch, status %d: %s\n", status, output)
+	}
+
+	status, _ = runCommand(t, "-w", "3", rfcKeyHex, "520489")
+	if status != 1 {
+		t.Errorf("Expected status 1 for a code outside of the window, instead we've got %d\n", status)
+	}
+}
+
+func TestNewKey(t *testing.T) {
+
+	status, output := runCommand(t, "-new", "-totp", "-issuer", "Example", "-account", "alice@example.com")
+	if status != 0 || !strings.HasPrefix(output, "otpauth://totp/Example:alice@example.com?") {
+		t.Errorf("New key URL mismatch, status %d: %s\n", status, output)
+	}
+
+	// the new key URL generates codes
+	status, code := runCommand(t, output)
+	if status != 0 || len(code) != 6 {
+		t.Errorf("The new key URL cannot generate codes, status %d: %s\n", status, code)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if run([]string{"-new", "-qr", "-"}, &stdout, &stderr) != 0 || !bytes.HasPrefix(stdout.Bytes(), []byte("\x89PNG")) {
+		t.Errorf("The QR code is not a PNG: %s\n", stderr.String())
+	}
+
+	status, output = runCommand(t, "-new", "-qr", "-", "-qr-format", "svg", "-qr-level", "h")
+	if status != 0 || !strings.HasPrefix(output, "<svg") {
+		t.Errorf("The QR code is not a SVG image, status %d: %s\n", status, output)
+	}
+
+	status, output = runCommand(t, "-new", "-qr", "-", "-qr-format", "terminal")
+	if status != 0 || !strings.Contains(output, "\x1b[") {
+		t.Errorf("The QR code is not rendered for the terminal, status %d\n", status)
+	}
+
+	if status, _ := runCommand(t, "-new", "-qr", "-", "-qr-format", "gif"); status == 0 {
+		t.Error("The unsupported QR code format has been accepted")
+	}
+}
+
+func TestInvalidArguments(t *testing.T) {
+
+	invalid := [][]string{
+		{},
+		{"not-hex"},
+		{"-totp=md5", rfcKeyHex},
+		{"-S", "@100", "-totp", rfcKeyHex},
+		{"-new", rfcKeyHex},
+	}
+	for _, args := range invalid {
+		if status, _ := runCommand(t, args...); status == 0 {
+			t.Errorf("The invalid arguments %v have been accepted\n", args)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/sec51/convert/bigendian"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	min_master_key_size = 32                        // the minimum length in bytes of the master key: 256 bits
+	derivation_label    = "sec51/twofactor totp v1" // binds the derived keys to this derivation scheme
+)
+
+var (
+	WeakMasterKeyError = errors.New("The master key is too short: at least 256 bits are required.")
+)
+
+// DeriveTOTP creates the TOTP of the account with a secret key derived from the master key,
+// instead of a random one. The same master key, issuer, account and key version always return the same secret,
+// so the TOTP can be reconstructed when needed and the secret key does not need to be stored.
+// The secret is HKDF-SHA256(masterKey, salt: issuer, info: account and keyVersion), as long as the hash output size.
+//
+// keyVersion is stored per account by the caller, it is not secret: incrementing it gives the account a new secret,
+// to enroll a new device or to replace a leaked secret, without changing the master key of the other accounts.
+//
+// Trade-offs of this stateless mode, compared to NewTOTP and ToBytes:
+//
+//   - the master key protects all the accounts: if it leaks, all the secrets leak and every account needs a new key version,
+//     therefore it should live in a KMS or a HSM, never next to the data
+//   - the master key cannot be rotated without re-enrolling all the users, since the secrets depend on it
+//   - the account must be an immutable identifier, like the user id: renaming the account changes the secret
+//   - the existing secrets cannot be imported, use NewTOTPFromSecret instead
+//   - the verification failures, the lock down and the client offset are part of the Totp state:
+//     when the Totp is derived again on each request they are lost, so the caller needs to rate limit the verifications
+//     or still persist the Totp with ToBytes
+func DeriveTOTP(masterKey []byte, account, issuer string, keyVersion uint32, hash crypto.Hash, digits int) (*Totp, error) {
+
+	if hash != crypto.SHA1 && hash != crypto.SHA256 && hash != crypto.SHA512 {
+		return nil, errors.New("The hash function must be crypto.SHA1, crypto.SHA256 or crypto.SHA512")
+	}
+
+	key, err := DeriveSecret(masterKey, account, issuer, keyVersion, hash.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTOTPFromSecret(key, account, issuer, hash, digits)
+}
+
+// DeriveSecret returns the secret key of the given size used by DeriveTOTP.
+// Useful to derive the secret of a HOTP or of another OTP implementation with the same scheme.
+func DeriveSecret(masterKey []byte, account, issuer string, keyVersion uint32, size int) ([]byte, error) {
+
+	if len(masterKey) < min_master_key_size {
+		return nil, WeakMasterKeyError
+	}
+
+	if account == "" {
+		return nil, errors.New("The account is required to derive the secret key")
+	}
+
+	if size < min_key_size {
+		return nil, WeakKeyError
+	}
+
+	// the account is prefixed by its length, so that the info of two accounts can never be the same
+	var info bytes.Buffer
+	accountSize := bigendian.ToInt(len(account))
+	version := bigendian.ToInt(int(keyVersion))
+	info.WriteString(derivation_label)
+	info.Write(accountSize[:])
+	info.WriteString(account)
+	info.Write(version[:])
+
+	key := make([]byte, size)
+	reader := hkdf.New(sha256.New, masterKey, []byte(issuer), info.Bytes())
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
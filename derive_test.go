@@ -0,0 +1,77 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"testing"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestDeriveTOTP(t *testing.T) {
+
+	otp, err := DeriveTOTP(testMasterKey, "user-42", "Sec51", 1, crypto.SHA1, 6)
+	checkError(t, err)
+
+	// the derivation must never change, otherwise all the users would need to enroll again
+	expected := "4f9aba7675743eefd79d69e381bb99cdd3ab3825"
+	if hex.EncodeToString(otp.key) != expected {
+		t.Errorf("Derived key mismatch: got %x, expected %s\n", otp.key, expected)
+	}
+
+	again, err := DeriveTOTP(testMasterKey, "user-42", "Sec51", 1, crypto.SHA1, 6)
+	checkError(t, err)
+	if again.Secret() != otp.Secret() {
+		t.Error("The derivation is not deterministic")
+	}
+
+	// the key size follows the hash function
+	sha512Otp, err := DeriveTOTP(testMasterKey, "user-42", "Sec51", 1, crypto.SHA512, 8)
+	checkError(t, err)
+	if len(sha512Otp.key) != crypto.SHA512.Size() {
+		t.Errorf("Expected a %d bytes key, got %d\n", crypto.SHA512.Size(), len(sha512Otp.key))
+	}
+
+	if _, err := DeriveTOTP(testMasterKey, "user-42", "Sec51", 1, crypto.MD5, 6); err == nil {
+		t.Error("The invalid hash function has been accepted")
+	}
+}
+
+func TestDeriveSecretInputs(t *testing.T) {
+
+	base, err := DeriveSecret(testMasterKey, "user-42", "Sec51", 1, 20)
+	checkError(t, err)
+
+	otherMasterKey := append([]byte{}, testMasterKey...)
+	otherMasterKey[0] ^= 1
+
+	derivations := []struct {
+		masterKey  []byte
+		account    string
+		issuer     string
+		keyVersion uint32
+	}{
+		{otherMasterKey, "user-42", "Sec51", 1},
+		{testMasterKey, "user-43", "Sec51", 1},
+		{testMasterKey, "user-42", "Sec52", 1},
+		{testMasterKey, "user-42", "Sec51", 2},
+	}
+	for _, d := range derivations {
+		key, err := DeriveSecret(d.masterKey, d.account, d.issuer, d.keyVersion, 20)
+		checkError(t, err)
+		if bytes.Equal(key, base) {
+			t.Errorf("The same key has been derived for %+v\n", d)
+		}
+	}
+
+	if _, err := DeriveSecret(testMasterKey[:31], "user-42", "Sec51", 1, 20); err != WeakMasterKeyError {
+		t.Errorf("Expected WeakMasterKeyError, got %v\n", err)
+	}
+	if _, err := DeriveSecret(testMasterKey, "", "Sec51", 1, 20); err == nil {
+		t.Error("The empty account has been accepted")
+	}
+	if _, err := DeriveSecret(testMasterKey, "user-42", "Sec51", 1, 10); err != WeakKeyError {
+		t.Errorf("Expected WeakKeyError, got %v\n", err)
+	}
+}
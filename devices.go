@@ -0,0 +1,488 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+	"github.com/sec51/cryptoengine"
+)
+
+// The serialized devices are encrypted with their own cryptoengine message type:
+// Sizes:        4                   8                  4
+// Format: |total_failures|verification_time|devices_count| device ...
+// Each device:
+// Sizes:       4       N        4       N       8        8       4          4      N
+// Format: |name_size|name|label_size|label|created|last_used|otp_type|otp_size|otp|
+// The TOTP uses the layout version 2 of ToBytes, the HOTP:
+// Sizes:      4      N     8       4            4
+// Format: |key_size|key|counter|digits|hashFunction_type|
+const (
+	devices_message_type = 3 // the cryptoengine message type of the serialized devices
+	device_type_totp     = 0
+	device_type_hotp     = 1
+)
+
+var (
+	DeviceNotFoundError = errors.New("The device does not exist.")
+	DeviceExistsError   = errors.New("A device with the same name already exists.")
+)
+
+// Device is the metadata of a device registered for an account, without the secret key
+type Device struct {
+	Name     string    // the unique name of the device, reported by Validate
+	Label    string    // the description displayed to the user, like "Work phone"
+	Type     string    // totp or hotp
+	Created  time.Time // when the device has been added
+	LastUsed time.Time // the last successful validation, zero if never used
+}
+
+// device is a registered device with its credential: exactly one of totp and hotp is set
+type device struct {
+	Device
+	totp *Totp
+	hotp *Hotp
+}
+
+// Devices holds the TOTP and HOTP credentials of all the devices of an account, like a phone and a hardware token.
+// A code generated by any of the devices is accepted. The lock down is shared: the failures of all the devices
+// count towards the same limit, so that adding devices does not multiply the attempts of an attacker.
+type Devices struct {
+	account                   string
+	issuer                    string
+	devices                   []*device
+	totalVerificationFailures int        // the failures of all the devices
+	lastVerificationTime      time.Time  // the last failed verification
+	observers                 []Observer // notified of the failures and of the events of the devices, not serialized
+}
+
+// NewDevices creates an empty set of devices for the account.
+// The issuer is used to encrypt the devices with ToBytes.
+func NewDevices(account, issuer string) *Devices {
+	return &Devices{account: account, issuer: issuer}
+}
+
+// AddTOTP registers a TOTP device. The name must be unique within the account.
+func (d *Devices) AddTOTP(name, label string, otp *Totp) error {
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return err
+	}
+	return d.add(&device{Device: Device{Name: name, Label: label, Type: "totp"}, totp: otp})
+}
+
+// AddHOTP registers a HOTP device, typically a hardware token. The name must be unique within the account.
+func (d *Devices) AddHOTP(name, label string, otp *Hotp) error {
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return err
+	}
+	return d.add(&device{Device: Device{Name: name, Label: label, Type: "hotp"}, hotp: otp})
+}
+
+// Private function which adds the device after checking its name
+func (d *Devices) add(dev *device) error {
+	if dev.Name == "" {
+		return errors.New("The device name cannot be empty")
+	}
+	if d.find(dev.Name) >= 0 {
+		return DeviceExistsError
+	}
+	dev.Created = time.Now().UTC()
+	for _, observer := range d.observers {
+		dev.addObserver(observer)
+	}
+	d.devices = append(d.devices, dev)
+	return nil
+}
+
+// Remove unregisters the device, its codes are not accepted anymore
+func (d *Devices) Remove(name string) error {
+	i := d.find(name)
+	if i < 0 {
+		return DeviceNotFoundError
+	}
+	d.devices = append(d.devices[:i], d.devices[i+1:]...)
+	return nil
+}
+
+// Private function which returns the position of the device, -1 if it does not exist
+func (d *Devices) find(name string) int {
+	for i, dev := range d.devices {
+		if dev.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// List returns the metadata of the devices, in the order they have been added
+func (d *Devices) List() []Device {
+	list := make([]Device, len(d.devices))
+	for i, dev := range d.devices {
+		list[i] = dev.Device
+	}
+	return list
+}
+
+// Len returns the amount of registered devices
+func (d *Devices) Len() int {
+	return len(d.devices)
+}
+
+// Totp returns the TOTP of the device, to show its QR code during the registration
+func (d *Devices) Totp(name string) (*Totp, error) {
+	i := d.find(name)
+	if i < 0 || d.devices[i].totp == nil {
+		return nil, DeviceNotFoundError
+	}
+	return d.devices[i].totp, nil
+}
+
+// Hotp returns the HOTP of the device
+func (d *Devices) Hotp(name string) (*Hotp, error) {
+	i := d.find(name)
+	if i < 0 || d.devices[i].hotp == nil {
+		return nil, DeviceNotFoundError
+	}
+	return d.devices[i].hotp, nil
+}
+
+// Validate checks the user code against all the devices and returns the name of the device which generated it.
+// All the devices are checked, without stopping at the first match, so that the time spent does not reveal
+// which device matched. The matching TOTP is re-synchronized and the matching HOTP counter moves forward.
+// After max_failures failures of any device the validation returns LockDownError for backoff_minutes.
+func (d *Devices) Validate(userCode string) (string, error) {
+
+	if len(d.devices) == 0 {
+		return "", DeviceNotFoundError
+	}
+
+	// verify that the token is valid
+	if userCode == "" {
+		return "", errors.New("User provided token is empty")
+	}
+
+	// check against the total amount of failures
+	if d.totalVerificationFailures >= max_failures && !validBackoffTime(d.lastVerificationTime) {
+		d.notifyEvent(Observer.OnFailure, LockDownError)
+		return "", LockDownError
+	}
+
+	if d.totalVerificationFailures >= max_failures && validBackoffTime(d.lastVerificationTime) {
+		// reset the total verification failures counter
+		d.totalVerificationFailures = 0
+		d.notifyEvent(Observer.OnUnlock, nil)
+	}
+
+	now := time.Now().UTC()
+	var matched *device
+	var totpOffset int
+	var hotpCounter uint64
+	var promote bool
+	for _, dev := range d.devices {
+		if dev.totp != nil {
+			dev.totp.expireRotation()
+			offset, ok := matchTOTP(dev.totp, userCode, now)
+			nextOffset, nextOk := dev.totp.matchNextKey(userCode, now)
+			if ok && matched == nil {
+				matched, totpOffset = dev, offset
+			}
+			// the first code of the next secret completes the rotation, see StartRotation
+			if nextOk && matched == nil {
+				matched, totpOffset, promote = dev, nextOffset, true
+			}
+		} else {
+			counter, ok := matchHOTP(dev.hotp, userCode)
+			if ok && matched == nil {
+				matched, hotpCounter = dev, counter
+			}
+		}
+	}
+
+	if matched == nil {
+		d.totalVerificationFailures++
+		d.lastVerificationTime = now // important to have it in UTC
+		return "", d.failed(errors.New("Tokens mismatch."))
+	}
+
+	matched.LastUsed = now
+	if matched.totp != nil {
+		if promote {
+			matched.totp.promoteNextKey()
+		}
+		return matched.Name, matched.totp.succeeded(totpOffset)
+	}
+	return matched.Name, matched.hotp.succeeded(hotpCounter)
+}
+
+// ResetLockDown clears the shared verification failures, like Totp.ResetLockDown
+func (d *Devices) ResetLockDown() {
+	d.totalVerificationFailures = 0
+	d.lastVerificationTime = time.Time{}
+}
+
+// ToBytes serialises all the devices with their secret keys, encrypted with the issuer like Totp.ToBytes.
+// The result can be read only with DevicesFromBytes.
+func (d *Devices) ToBytes() ([]byte, error) {
+
+	var buffer bytes.Buffer
+
+	failuresBytes := bigendian.ToInt(d.totalVerificationFailures)
+	verificationTimeBytes := bigendian.ToUint64(nanoseconds(d.lastVerificationTime))
+	countBytes := bigendian.ToInt(len(d.devices))
+	buffer.Write(failuresBytes[:])
+	buffer.Write(verificationTimeBytes[:])
+	buffer.Write(countBytes[:])
+
+	for _, dev := range d.devices {
+		writeSizedBytes(&buffer, []byte(dev.Name))
+		writeSizedBytes(&buffer, []byte(dev.Label))
+		createdBytes := bigendian.ToUint64(nanoseconds(dev.Created))
+		lastUsedBytes := bigendian.ToUint64(nanoseconds(dev.LastUsed))
+		buffer.Write(createdBytes[:])
+		buffer.Write(lastUsedBytes[:])
+
+		if dev.totp != nil {
+			otpBytes, err := encodeTOTP(dev.totp, BytesVersion2)
+			if err != nil {
+				return nil, err
+			}
+			typeBytes := bigendian.ToInt(device_type_totp)
+			buffer.Write(typeBytes[:])
+			writeSizedBytes(&buffer, otpBytes)
+			wipe(otpBytes)
+		} else {
+			otpBytes := encodeHOTP(dev.hotp)
+			typeBytes := bigendian.ToInt(device_type_hotp)
+			buffer.Write(typeBytes[:])
+			writeSizedBytes(&buffer, otpBytes)
+			wipe(otpBytes)
+		}
+	}
+
+	engine, err := cryptoengine.InitCryptoEngine(d.issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the buffer can be wiped, not the string copy of cryptoengine (see wipe)
+	message, err := cryptoengine.NewMessage(buffer.String(), devices_message_type)
+	wipe(buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedMessage, err := engine.NewEncryptedMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptedMessage.ToBytes()
+}
+
+// DevicesFromBytes converts a byte array created by Devices.ToBytes to the devices of the account
+func DevicesFromBytes(encryptedMessage []byte, account, issuer string) (*Devices, error) {
+
+	engine, err := cryptoengine.InitCryptoEngine(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := engine.Decrypt(encryptedMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Type != devices_message_type {
+		return nil, errors.New(fmt.Sprintf("Unsupported devices bytes message type %d", message.Type))
+	}
+
+	plainText := []byte(message.Text)
+	defer wipe(plainText)
+	reader := bytes.NewReader(plainText)
+	d := NewDevices(account, issuer)
+
+	failures, err := readInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	verificationTime, err := readUint64(reader)
+	if err != nil {
+		return nil, err
+	}
+	count, err := readInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	d.totalVerificationFailures = failures
+	d.lastVerificationTime = timeOfNanoseconds(verificationTime)
+
+	for i := 0; i < count; i++ {
+		dev := new(device)
+
+		name, err := readSizedBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		label, err := readSizedBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		created, err := readUint64(reader)
+		if err != nil {
+			return nil, err
+		}
+		lastUsed, err := readUint64(reader)
+		if err != nil {
+			return nil, err
+		}
+		otpType, err := readInt(reader)
+		if err != nil {
+			return nil, err
+		}
+		otpBytes, err := readSizedBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		dev.Name = string(name)
+		dev.Label = string(label)
+		dev.Created = timeOfNanoseconds(created)
+		dev.LastUsed = timeOfNanoseconds(lastUsed)
+
+		switch otpType {
+		case device_type_totp:
+			dev.Type = "totp"
+			dev.totp, err = decodeTOTP(otpBytes, BytesVersion2)
+		case device_type_hotp:
+			dev.Type = "hotp"
+			dev.hotp, err = decodeHOTP(otpBytes, account, issuer)
+		default:
+			err = MalformedBytesError
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		d.devices = append(d.devices, dev)
+	}
+
+	return d, nil
+}
+
+// Private function which encodes the HOTP layout described in Devices.ToBytes
+func encodeHOTP(otp *Hotp) []byte {
+	var buffer bytes.Buffer
+	writeSizedBytes(&buffer, otp.key)
+	buffer.Write(otp.counter[:])
+	digitsBytes := bigendian.ToInt(otp.digits)
+	hashBytes := bigendian.ToInt(hashFunctionType(otp.hashFunction))
+	buffer.Write(digitsBytes[:])
+	buffer.Write(hashBytes[:])
+	return buffer.Bytes()
+}
+
+// Private function which decodes the HOTP layout described in Devices.ToBytes
+func decodeHOTP(data []byte, account, issuer string) (*Hotp, error) {
+	reader := bytes.NewReader(data)
+
+	key, err := readSizedBytes(reader)
+	if err != nil {
+		return nil, err
+	}
+	counter, err := readUint64(reader)
+	if err != nil {
+		return nil, err
+	}
+	digits, err := readInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	hashType, err := readInt(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashFunction crypto.Hash
+	switch hashType {
+	case 1:
+		hashFunction = crypto.SHA256
+	case 2:
+		hashFunction = crypto.SHA512
+	default:
+		hashFunction = crypto.SHA1
+	}
+
+	return makeHOTP(key, account, issuer, hashFunction, digits, counter)
+}
+
+// Private function which returns the hashFunction_type of the serialized layouts: 0 = SHA1; 1 = SHA256; 2 = SHA512
+func hashFunctionType(hashFunction crypto.Hash) int {
+	switch hashFunction {
+	case crypto.SHA256:
+		return 1
+	case crypto.SHA512:
+		return 2
+	}
+	return 0
+}
+
+// Private function which returns the Unix time in nanoseconds, 0 for the zero time
+func nanoseconds(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+// Private function which returns the UTC time of the Unix time in nanoseconds, the zero time for 0
+func timeOfNanoseconds(nanoseconds uint64) time.Time {
+	if nanoseconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(nanoseconds)).UTC()
+}
+
+// Private function which writes the size of the value followed by the value
+func writeSizedBytes(buffer *bytes.Buffer, value []byte) {
+	sizeBytes := bigendian.ToInt(len(value))
+	buffer.Write(sizeBytes[:])
+	buffer.Write(value)
+}
+
+// Private function which reads a value written by writeSizedBytes
+func readSizedBytes(reader *bytes.Reader) ([]byte, error) {
+	size, err := readInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > reader.Len() {
+		return nil, MalformedBytesError
+	}
+	value := make([]byte, size)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return nil, MalformedBytesError
+	}
+	return value, nil
+}
+
+// Private function which reads a big endian int of 4 bytes
+func readInt(reader *bytes.Reader) (int, error) {
+	var value [4]byte
+	if _, err := io.ReadFull(reader, value[:]); err != nil {
+		return 0, MalformedBytesError
+	}
+	return bigendian.FromInt(value), nil
+}
+
+// Private function which reads a big endian uint64 of 8 bytes
+func readUint64(reader *bytes.Reader) (uint64, error) {
+	var value [8]byte
+	if _, err := io.ReadFull(reader, value[:]); err != nil {
+		return 0, MalformedBytesError
+	}
+	return bigendian.FromUint64(value), nil
+}
@@ -0,0 +1,186 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+)
+
+func newTestDevices(t *testing.T) (*Devices, *Totp, *Hotp) {
+	devices := NewDevices("info@sec51.com", "Sec51")
+
+	phone, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	checkError(t, devices.AddTOTP("phone", "Work phone", phone))
+
+	token, err := NewHOTP("info@sec51.com", "Sec51", crypto.SHA256, 8)
+	checkError(t, err)
+	checkError(t, devices.AddHOTP("token", "Hardware token", token))
+
+	return devices, phone, token
+}
+
+func TestDevicesValidate(t *testing.T) {
+
+	devices, phone, token := newTestDevices(t)
+
+	code, err := phone.OTP()
+	checkError(t, err)
+	name, err := devices.Validate(code)
+	checkError(t, err)
+	if name != "phone" {
+		t.Errorf("Expected the phone to match, got %q\n", name)
+	}
+
+	// a code generated ahead on the hardware token
+	code, err = token.OTPAt(3)
+	checkError(t, err)
+	name, err = devices.Validate(code)
+	checkError(t, err)
+	if name != "token" {
+		t.Errorf("Expected the token to match, got %q\n", name)
+	}
+	if token.Counter() != 4 {
+		t.Errorf("Expected the HOTP counter to move past the matching code, got %d\n", token.Counter())
+	}
+
+	// the same HOTP code cannot be used twice
+	if _, err := devices.Validate(code); err == nil {
+		t.Error("The HOTP code has been accepted twice")
+	}
+
+	for _, device := range devices.List() {
+		if device.Created.IsZero() || device.LastUsed.IsZero() {
+			t.Errorf("The metadata of the device %s has not been updated\n", device.Name)
+		}
+	}
+}
+
+func TestDevicesSharedLockDown(t *testing.T) {
+
+	devices, phone, _ := newTestDevices(t)
+
+	for i := 0; i < max_failures; i++ {
+		if _, err := devices.Validate("0000000x"); err == nil {
+			t.Error("The wrong code has been accepted")
+		}
+	}
+
+	code, err := phone.OTP()
+	checkError(t, err)
+	if _, err := devices.Validate(code); err != LockDownError {
+		t.Errorf("Expected LockDownError, got %v\n", err)
+	}
+
+	devices.ResetLockDown()
+	if _, err := devices.Validate(code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDevicesAddRemove(t *testing.T) {
+
+	devices, phone, _ := newTestDevices(t)
+
+	if err := devices.AddTOTP("phone", "Another phone", phone); err != DeviceExistsError {
+		t.Errorf("Expected DeviceExistsError, got %v\n", err)
+	}
+	if err := devices.AddTOTP("", "No name", phone); err == nil {
+		t.Error("The device without name has been added")
+	}
+	if err := devices.AddTOTP("empty", "Empty", &Totp{}); err == nil {
+		t.Error("The uninitialized TOTP has been added")
+	}
+
+	if _, err := devices.Hotp("phone"); err != DeviceNotFoundError {
+		t.Errorf("Expected DeviceNotFoundError, got %v\n", err)
+	}
+	if otp, err := devices.Totp("phone"); err != nil || otp != phone {
+		t.Error("The TOTP of the phone has not been returned")
+	}
+
+	code, err := phone.OTP()
+	checkError(t, err)
+
+	checkError(t, devices.Remove("phone"))
+	if err := devices.Remove("phone"); err != DeviceNotFoundError {
+		t.Errorf("Expected DeviceNotFoundError, got %v\n", err)
+	}
+	if devices.Len() != 1 || devices.List()[0].Name != "token" {
+		t.Error("The phone has not been removed")
+	}
+
+	// the codes of the removed device are not accepted anymore
+	if _, err := devices.Validate(code); err == nil {
+		t.Error("The code of the removed device has been accepted")
+	}
+
+	checkError(t, devices.Remove("token"))
+	if _, err := devices.Validate(code); err != DeviceNotFoundError {
+		t.Errorf("Expected DeviceNotFoundError, got %v\n", err)
+	}
+}
+
+func TestDevicesSerialization(t *testing.T) {
+
+	devices, phone, token := newTestDevices(t)
+
+	code, err := token.OTP()
+	checkError(t, err)
+	_, err = devices.Validate(code)
+	checkError(t, err)
+	_, err = devices.Validate("0000000x")
+	if err == nil {
+		t.Error("The wrong code has been accepted")
+	}
+
+	data, err := devices.ToBytes()
+	checkError(t, err)
+
+	// the devices bytes are not TOTP bytes
+	if _, err := TOTPFromBytes(data, "Sec51"); err == nil {
+		t.Error("The devices bytes have been decoded as TOTP bytes")
+	}
+
+	restored, err := DevicesFromBytes(data, "info@sec51.com", "Sec51")
+	checkError(t, err)
+
+	if restored.totalVerificationFailures != 1 {
+		t.Errorf("Expected 1 verification failure, got %d\n", restored.totalVerificationFailures)
+	}
+
+	list, restoredList := devices.List(), restored.List()
+	if len(restoredList) != len(list) {
+		t.Fatalf("Expected %d devices, got %d\n", len(list), len(restoredList))
+	}
+	for i := range list {
+		if restoredList[i].Name != list[i].Name || restoredList[i].Label != list[i].Label || restoredList[i].Type != list[i].Type ||
+			!restoredList[i].Created.Equal(list[i].Created) || !restoredList[i].LastUsed.Equal(list[i].LastUsed) {
+			t.Errorf("Device metadata mismatch: got %+v, expected %+v\n", restoredList[i], list[i])
+		}
+	}
+	if !restoredList[0].LastUsed.IsZero() {
+		t.Error("The phone has never been used")
+	}
+
+	restoredPhone, err := restored.Totp("phone")
+	checkError(t, err)
+	if restoredPhone.Secret() != phone.Secret() {
+		t.Error("The TOTP secret has not been restored")
+	}
+
+	restoredToken, err := restored.Hotp("token")
+	checkError(t, err)
+	if restoredToken.Secret() != token.Secret() || restoredToken.Counter() != token.Counter() ||
+		restoredToken.digits != 8 || restoredToken.hashFunction != crypto.SHA256 {
+		t.Error("The HOTP has not been restored")
+	}
+
+	// the restored token accepts the next code only
+	code, err = token.OTP()
+	checkError(t, err)
+	name, err := restored.Validate(code)
+	checkError(t, err)
+	if name != "token" {
+		t.Errorf("Expected the token to match, got %q\n", name)
+	}
+}
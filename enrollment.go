@@ -0,0 +1,337 @@
+package twofactor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+	"github.com/sec51/cryptoengine"
+)
+
+// The serialized enrollment is encrypted with its own cryptoengine message type, followed by the TOTP layout version 2:
+// Sizes:     4           4                 4               8            8          8        N
+// Format: |state|required_codes|confirmed_codes|last_step|created_at|ttl|totp|
+const (
+	enrollment_ttl          = 10 * time.Minute // the default time to confirm an enrollment
+	enrollment_message_type = 2                // the cryptoengine message type of the serialized enrollment
+	enrollment_fixed_size   = 36               // the size of the enrollment layout without the TOTP
+)
+
+// EnrollmentState is the state of an enrollment
+type EnrollmentState int
+
+const (
+	EnrollmentPending EnrollmentState = iota // the user has not confirmed a code yet
+	EnrollmentActive                         // the user has confirmed the codes, the TOTP must be enforced
+	EnrollmentExpired                        // the enrollment has not been confirmed in time
+)
+
+var (
+	EnrollmentPendingError = errors.New("The enrollment has not been confirmed yet.")
+	EnrollmentActiveError  = errors.New("The enrollment has already been confirmed: the secret key cannot be shown again.")
+	EnrollmentExpiredError = errors.New("The enrollment has expired, a new one needs to be created.")
+)
+
+// EnrollmentOptions are the options of NewEnrollment
+type EnrollmentOptions struct {
+	TTL              time.Duration    // the time to confirm the enrollment, 10 minutes when 0
+	ConsecutiveCodes int              // 1 or 2 codes of consecutive time steps to confirm the enrollment, 1 when 0
+	Clock            func() time.Time // returns the current time, time.Now when nil
+}
+
+// Enrollment wraps a newly created TOTP until the user proves that the secret key has been added to the device.
+// While pending, the QR code and the secret key can be shown to the user, who confirms the enrollment with one
+// or two valid codes. Once active, the TOTP can be retrieved and enforced, but the secret key is no longer shown.
+// An enrollment which is not confirmed within its TTL expires.
+type Enrollment struct {
+	otp            *Totp
+	state          EnrollmentState
+	requiredCodes  int              // the amount of consecutive codes required to activate the enrollment
+	confirmedCodes int              // the amount of consecutive codes confirmed so far
+	lastStep       uint64           // the time step of the last confirmed code
+	createdAt      time.Time        // the creation time of the enrollment
+	ttl            time.Duration    // the time to confirm the enrollment
+	clock          func() time.Time // returns the current time
+}
+
+// NewEnrollment starts the enrollment of the TOTP, which should have just been created with NewTOTP
+func NewEnrollment(otp *Totp, options EnrollmentOptions) (*Enrollment, error) {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return nil, err
+	}
+
+	if options.TTL < 0 {
+		return nil, errors.New("The enrollment TTL cannot be negative")
+	}
+	if options.TTL == 0 {
+		options.TTL = enrollment_ttl
+	}
+
+	if options.ConsecutiveCodes == 0 {
+		options.ConsecutiveCodes = 1
+	}
+	if options.ConsecutiveCodes < 1 || options.ConsecutiveCodes > 2 {
+		return nil, errors.New(fmt.Sprintf("The enrollment requires 1 or 2 consecutive codes, got %d", options.ConsecutiveCodes))
+	}
+
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+
+	enrollment := &Enrollment{
+		otp:           otp,
+		state:         EnrollmentPending,
+		requiredCodes: options.ConsecutiveCodes,
+		createdAt:     options.Clock().UTC(),
+		ttl:           options.TTL,
+		clock:         options.Clock,
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnEnroll, "start")
+	return enrollment, nil
+}
+
+// AddObserver registers an observer of the TOTP of the enrollment, see Totp.AddObserver.
+// The observers are not serialized, they need to be added after EnrollmentFromBytes.
+func (e *Enrollment) AddObserver(observer Observer) {
+	e.otp.AddObserver(observer)
+}
+
+// SetClock replaces the function which returns the current time, time.Now when nil.
+// The clock is not serialized, therefore it needs to be set again after EnrollmentFromBytes.
+func (e *Enrollment) SetClock(clock func() time.Time) {
+	if clock == nil {
+		clock = time.Now
+	}
+	e.clock = clock
+}
+
+// State returns the state of the enrollment, a pending enrollment expires once its TTL has elapsed
+func (e *Enrollment) State() EnrollmentState {
+	if e.state == EnrollmentPending && !e.clock().UTC().Before(e.createdAt.Add(e.ttl)) {
+		e.state = EnrollmentExpired
+	}
+	return e.state
+}
+
+// ExpiresAt returns the time after which the pending enrollment cannot be confirmed anymore
+func (e *Enrollment) ExpiresAt() time.Time {
+	return e.createdAt.Add(e.ttl)
+}
+
+// Confirm checks the code displayed on the user device.
+// When two consecutive codes are required, the second code must be the one of the time step following the first code,
+// otherwise the confirmation starts again from the new code.
+// It returns nil when the code is valid, even if another code is still required to activate the enrollment: State tells when it is active.
+// The failures count towards the lock down of the TOTP, like Validate.
+func (e *Enrollment) Confirm(userCode string) error {
+
+	switch e.State() {
+	case EnrollmentActive:
+		return EnrollmentActiveError
+	case EnrollmentExpired:
+		return EnrollmentExpiredError
+	}
+
+	if userCode == "" {
+		return errors.New("User provided token is empty")
+	}
+
+	otp := e.otp
+	now := e.clock().UTC()
+
+	// check against the total amount of failures
+	if otp.totalVerificationFailures >= max_failures {
+		if now.Before(otp.lastVerificationTime.UTC().Add(backoff_minutes * time.Minute)) {
+			otp.notify(Observer.OnFailure, 0, LockDownError)
+			return LockDownError
+		}
+		otp.totalVerificationFailures = 0
+		otp.notify(Observer.OnUnlock, 0, nil)
+	}
+
+	matched, ok := matchTOTP(otp, userCode, now)
+	if !ok {
+		otp.totalVerificationFailures++
+		otp.lastVerificationTime = now
+		return otp.failed(otp.totalVerificationFailures, errors.New("Tokens mismatch."))
+	}
+
+	step := increment(now.Unix(), otp.stepSize) + uint64(matched)
+	switch {
+	case e.confirmedCodes > 0 && step == e.lastStep:
+		// the same code twice does not prove that the device keeps generating the codes
+		return errors.New("The code has already been used, please enter the next code.")
+	case e.confirmedCodes > 0 && step == e.lastStep+1:
+		e.confirmedCodes++
+	default:
+		e.confirmedCodes = 1
+	}
+	e.lastStep = step
+
+	if e.confirmedCodes >= e.requiredCodes {
+		otp.synchronizeCounter(matched)
+		otp.totalVerificationFailures = 0
+		e.state = EnrollmentActive
+		otp.sealed = true
+		otp.notifyLifecycle(LifecycleObserver.OnEnroll, "confirm")
+	}
+	return nil
+}
+
+// Totp returns the TOTP of the active enrollment, which can then be enforced and stored with ToBytes.
+// The key of the returned TOTP cannot be revealed again: URL, QR and QRCode return EnrollmentActiveError,
+// Secret and Key return nothing. A new key is shown only through a rotation (see StartRotation).
+// The restriction is not serialized: the TOTP read again from its bytes can reveal the key, for instance to the admin tools.
+func (e *Enrollment) Totp() (*Totp, error) {
+	if err := e.checkPending(); err != EnrollmentActiveError {
+		if err == nil {
+			err = EnrollmentPendingError
+		}
+		return nil, err
+	}
+	return e.otp, nil
+}
+
+// URL returns the otpauth URL of the pending enrollment, to be displayed to the user
+func (e *Enrollment) URL() (string, error) {
+	if err := e.checkPending(); err != nil {
+		return "", err
+	}
+	return e.otp.URL()
+}
+
+// QR returns the PNG QR code of the pending enrollment, to be displayed to the user
+func (e *Enrollment) QR() ([]byte, error) {
+	if err := e.checkPending(); err != nil {
+		return nil, err
+	}
+	return e.otp.QR()
+}
+
+// QRCode returns the QR code of the pending enrollment with the given options
+func (e *Enrollment) QRCode(options QROptions) (*QRCode, error) {
+	if err := e.checkPending(); err != nil {
+		return nil, err
+	}
+	return e.otp.QRCode(options)
+}
+
+// Secret returns the base32 secret key of the pending enrollment, for the users who cannot scan the QR code
+func (e *Enrollment) Secret() (string, error) {
+	if err := e.checkPending(); err != nil {
+		return "", err
+	}
+	return e.otp.Secret(), nil
+}
+
+// Private function which returns an error when the enrollment is not pending
+func (e *Enrollment) checkPending() error {
+	switch e.State() {
+	case EnrollmentActive:
+		return EnrollmentActiveError
+	case EnrollmentExpired:
+		return EnrollmentExpiredError
+	}
+	return nil
+}
+
+// ToBytes serialises the enrollment together with its TOTP, encrypted with the issuer like Totp.ToBytes.
+// The result can be read only with EnrollmentFromBytes.
+func (e *Enrollment) ToBytes() ([]byte, error) {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(e.otp); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+
+	stateBytes := bigendian.ToInt(int(e.state))
+	requiredBytes := bigendian.ToInt(e.requiredCodes)
+	confirmedBytes := bigendian.ToInt(e.confirmedCodes)
+	lastStepBytes := bigendian.ToUint64(e.lastStep)
+	createdAtBytes := bigendian.ToUint64(uint64(e.createdAt.UnixNano()))
+	ttlBytes := bigendian.ToUint64(uint64(e.ttl))
+	buffer.Write(stateBytes[:])
+	buffer.Write(requiredBytes[:])
+	buffer.Write(confirmedBytes[:])
+	buffer.Write(lastStepBytes[:])
+	buffer.Write(createdAtBytes[:])
+	buffer.Write(ttlBytes[:])
+
+	totpBytes, err := encodeTOTP(e.otp, BytesVersion2)
+	if err != nil {
+		return nil, err
+	}
+	buffer.Write(totpBytes)
+	wipe(totpBytes)
+
+	engine, err := cryptoengine.InitCryptoEngine(e.otp.issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the buffer can be wiped, not the string copy of cryptoengine (see wipe)
+	message, err := cryptoengine.NewMessage(buffer.String(), enrollment_message_type)
+	wipe(buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedMessage, err := engine.NewEncryptedMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptedMessage.ToBytes()
+}
+
+// EnrollmentFromBytes converts a byte array created by Enrollment.ToBytes to an enrollment.
+// The clock is time.Now, use SetClock to change it.
+func EnrollmentFromBytes(encryptedMessage []byte, issuer string) (*Enrollment, error) {
+
+	engine, err := cryptoengine.InitCryptoEngine(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := engine.Decrypt(encryptedMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Type != enrollment_message_type {
+		return nil, errors.New(fmt.Sprintf("Unsupported enrollment bytes message type %d", message.Type))
+	}
+
+	data := []byte(message.Text)
+	defer wipe(data)
+	if len(data) < enrollment_fixed_size {
+		return nil, MalformedBytesError
+	}
+
+	e := &Enrollment{clock: time.Now}
+	e.state = EnrollmentState(bigendian.FromInt([4]byte{data[0], data[1], data[2], data[3]}))
+	e.requiredCodes = bigendian.FromInt([4]byte{data[4], data[5], data[6], data[7]})
+	e.confirmedCodes = bigendian.FromInt([4]byte{data[8], data[9], data[10], data[11]})
+	e.lastStep = bigendian.FromUint64([8]byte{data[12], data[13], data[14], data[15], data[16], data[17], data[18], data[19]})
+	createdAt := bigendian.FromUint64([8]byte{data[20], data[21], data[22], data[23], data[24], data[25], data[26], data[27]})
+	e.createdAt = time.Unix(0, int64(createdAt)).UTC()
+	ttl := bigendian.FromUint64([8]byte{data[28], data[29], data[30], data[31], data[32], data[33], data[34], data[35]})
+	e.ttl = time.Duration(ttl)
+
+	if e.state < EnrollmentPending || e.state > EnrollmentExpired || e.requiredCodes < 1 || e.requiredCodes > 2 {
+		return nil, MalformedBytesError
+	}
+
+	if e.otp, err = decodeTOTP(data[enrollment_fixed_size:], BytesVersion2); err != nil {
+		return nil, err
+	}
+	e.otp.sealed = e.state == EnrollmentActive
+
+	return e, nil
+}
@@ -0,0 +1,249 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+	"time"
+)
+
+// testClock is a clock which can be moved forward by the tests
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func newTestEnrollment(t *testing.T, options EnrollmentOptions) (*Enrollment, *testClock) {
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	clock := &testClock{now: time.Unix(1500000000, 0)}
+	options.Clock = clock.Now
+	enrollment, err := NewEnrollment(otp, options)
+	checkError(t, err)
+	return enrollment, clock
+}
+
+func TestEnrollmentConfirm(t *testing.T) {
+
+	enrollment, clock := newTestEnrollment(t, EnrollmentOptions{})
+
+	if enrollment.State() != EnrollmentPending {
+		t.Errorf("Expected a pending enrollment, got %d\n", enrollment.State())
+	}
+	if _, err := enrollment.Totp(); err != EnrollmentPendingError {
+		t.Errorf("Expected EnrollmentPendingError, got %v\n", err)
+	}
+
+	// the secret can be shown while pending
+	if _, err := enrollment.URL(); err != nil {
+		t.Error(err)
+	}
+	if _, err := enrollment.Secret(); err != nil {
+		t.Error(err)
+	}
+
+	if err := enrollment.Confirm("000000x"); err == nil {
+		t.Error("The wrong code has confirmed the enrollment")
+	}
+	if enrollment.State() != EnrollmentPending {
+		t.Errorf("Expected a pending enrollment, got %d\n", enrollment.State())
+	}
+
+	// the code of the previous time step is accepted as well
+	code, err := enrollment.otp.OTPAt(clock.now.Add(-30 * time.Second))
+	checkError(t, err)
+	checkError(t, enrollment.Confirm(code))
+
+	if enrollment.State() != EnrollmentActive {
+		t.Errorf("Expected an active enrollment, got %d\n", enrollment.State())
+	}
+	otp, err := enrollment.Totp()
+	checkError(t, err)
+	if otp.totalVerificationFailures != 0 {
+		t.Errorf("Expected the verification failures to be reset, got %d\n", otp.totalVerificationFailures)
+	}
+
+	// the secret cannot be shown anymore
+	if _, err := enrollment.URL(); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+	if _, err := enrollment.QR(); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+	if _, err := enrollment.QRCode(QROptions{}); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+	if _, err := enrollment.Secret(); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+	if err := enrollment.Confirm(code); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+
+	// neither through the TOTP of the enrollment
+	if otp.Secret() != "" || otp.Key() != nil {
+		t.Error("The secret of the active enrollment has been revealed")
+	}
+	if _, err := otp.QR(); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+	if _, err := otp.URL(); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+	if _, err := otp.QRCode(QROptions{}); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+
+	// an active enrollment does not expire
+	clock.now = clock.now.Add(time.Hour)
+	if enrollment.State() != EnrollmentActive {
+		t.Errorf("Expected an active enrollment, got %d\n", enrollment.State())
+	}
+}
+
+func TestEnrollmentConsecutiveCodes(t *testing.T) {
+
+	enrollment, clock := newTestEnrollment(t, EnrollmentOptions{ConsecutiveCodes: 2})
+
+	first, err := enrollment.otp.OTPAt(clock.now)
+	checkError(t, err)
+	checkError(t, enrollment.Confirm(first))
+	if enrollment.State() != EnrollmentPending {
+		t.Errorf("Expected a pending enrollment after the first code, got %d\n", enrollment.State())
+	}
+
+	// the same code again is refused
+	if err := enrollment.Confirm(first); err == nil {
+		t.Error("The same code has been accepted twice")
+	}
+
+	// a code which is not the next one starts again
+	clock.now = clock.now.Add(90 * time.Second)
+	third, err := enrollment.otp.OTPAt(clock.now)
+	checkError(t, err)
+	checkError(t, enrollment.Confirm(third))
+	if enrollment.State() != EnrollmentPending {
+		t.Errorf("Expected a pending enrollment after a non consecutive code, got %d\n", enrollment.State())
+	}
+
+	clock.now = clock.now.Add(30 * time.Second)
+	fourth, err := enrollment.otp.OTPAt(clock.now)
+	checkError(t, err)
+	checkError(t, enrollment.Confirm(fourth))
+	if enrollment.State() != EnrollmentActive {
+		t.Errorf("Expected an active enrollment, got %d\n", enrollment.State())
+	}
+
+	if _, err := NewEnrollment(enrollment.otp, EnrollmentOptions{ConsecutiveCodes: 3}); err == nil {
+		t.Error("3 consecutive codes have been accepted")
+	}
+}
+
+func TestEnrollmentExpiry(t *testing.T) {
+
+	enrollment, clock := newTestEnrollment(t, EnrollmentOptions{TTL: 5 * time.Minute})
+
+	if !enrollment.ExpiresAt().Equal(clock.now.Add(5 * time.Minute)) {
+		t.Errorf("Unexpected expiry time %s\n", enrollment.ExpiresAt())
+	}
+
+	clock.now = clock.now.Add(5 * time.Minute)
+	if enrollment.State() != EnrollmentExpired {
+		t.Errorf("Expected an expired enrollment, got %d\n", enrollment.State())
+	}
+
+	code, err := enrollment.otp.OTPAt(clock.now)
+	checkError(t, err)
+	if err := enrollment.Confirm(code); err != EnrollmentExpiredError {
+		t.Errorf("Expected EnrollmentExpiredError, got %v\n", err)
+	}
+	if _, err := enrollment.QR(); err != EnrollmentExpiredError {
+		t.Errorf("Expected EnrollmentExpiredError, got %v\n", err)
+	}
+	if _, err := enrollment.Totp(); err != EnrollmentExpiredError {
+		t.Errorf("Expected EnrollmentExpiredError, got %v\n", err)
+	}
+}
+
+func TestEnrollmentLockDown(t *testing.T) {
+
+	enrollment, clock := newTestEnrollment(t, EnrollmentOptions{})
+
+	for i := 0; i < max_failures; i++ {
+		if err := enrollment.Confirm("000000x"); err == nil {
+			t.Error("The wrong code has confirmed the enrollment")
+		}
+	}
+
+	code, err := enrollment.otp.OTPAt(clock.now)
+	checkError(t, err)
+	if err := enrollment.Confirm(code); err != LockDownError {
+		t.Errorf("Expected LockDownError, got %v\n", err)
+	}
+
+	// after the backoff time the valid code is accepted
+	clock.now = clock.now.Add(backoff_minutes*time.Minute + time.Second)
+	code, err = enrollment.otp.OTPAt(clock.now)
+	checkError(t, err)
+	checkError(t, enrollment.Confirm(code))
+	if enrollment.State() != EnrollmentActive {
+		t.Errorf("Expected an active enrollment, got %d\n", enrollment.State())
+	}
+}
+
+func TestEnrollmentSerialization(t *testing.T) {
+
+	enrollment, clock := newTestEnrollment(t, EnrollmentOptions{TTL: time.Hour, ConsecutiveCodes: 2})
+
+	first, err := enrollment.otp.OTPAt(clock.now)
+	checkError(t, err)
+	checkError(t, enrollment.Confirm(first))
+
+	data, err := enrollment.ToBytes()
+	checkError(t, err)
+
+	// the enrollment bytes are not TOTP bytes
+	if _, err := TOTPFromBytes(data, "Sec51"); err == nil {
+		t.Error("The enrollment bytes have been decoded as TOTP bytes")
+	}
+
+	restored, err := EnrollmentFromBytes(data, "Sec51")
+	checkError(t, err)
+	restored.SetClock(clock.Now)
+
+	if restored.State() != EnrollmentPending {
+		t.Errorf("Expected a pending enrollment, got %d\n", restored.State())
+	}
+	if !restored.ExpiresAt().Equal(enrollment.ExpiresAt()) {
+		t.Errorf("Expiry time mismatch: got %s, expected %s\n", restored.ExpiresAt(), enrollment.ExpiresAt())
+	}
+	if restored.otp.Secret() != enrollment.otp.Secret() {
+		t.Error("The TOTP secret has not been restored")
+	}
+
+	// the confirmation continues with the next code
+	clock.now = clock.now.Add(30 * time.Second)
+	second, err := restored.otp.OTPAt(clock.now)
+	checkError(t, err)
+	checkError(t, restored.Confirm(second))
+	if restored.State() != EnrollmentActive {
+		t.Errorf("Expected an active enrollment, got %d\n", restored.State())
+	}
+
+	// the active state is kept as well
+	data, err = restored.ToBytes()
+	checkError(t, err)
+	restored, err = EnrollmentFromBytes(data, "Sec51")
+	checkError(t, err)
+	if _, err := restored.URL(); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+	otp, err := restored.Totp()
+	checkError(t, err)
+	if _, err := otp.QR(); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+}
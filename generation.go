@@ -0,0 +1,127 @@
+package twofactor
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+var (
+	RollbackError   = errors.New("The TOTP bytes are older than the last saved state: they have been replaced with a previous version.")
+	StaleStateError = errors.New("The TOTP state is not newer than the last saved state: it has been loaded from stale bytes, or not serialized with BytesVersion2.")
+)
+
+// GenerationVerifier remembers the last generation of the serialized state of each TOTP, to detect the rollbacks:
+// an attacker, or a buggy replica, writing an older byte array back to the storage would otherwise reset
+// the verification failures and reopen the brute force window.
+// The generations must be stored apart from the byte arrays, where the same attacker cannot write,
+// for instance in another database or in a counter of the secrets manager.
+// The id identifies the TOTP, it is the query escaped issuer and the account separated by a colon.
+type GenerationVerifier interface {
+	// LastGeneration returns the last generation saved for the id, 0 when none has been saved
+	LastGeneration(id string) (uint64, error)
+	// SaveGeneration records the generation of the id. It must return StaleStateError, atomically,
+	// when the generation is not newer than the saved one, so that concurrent saves cannot both succeed.
+	SaveGeneration(id string, generation uint64) error
+}
+
+// Generation returns the generation of the TOTP state, incremented each time it is serialized with BytesVersion2.
+// The byte arrays of the version 1 do not store it: the rollback protection requires the version 2.
+func (otp *Totp) Generation() uint64 {
+	return otp.generation
+}
+
+// VerifyLoad checks that the TOTP just read from a byte array is not older than the last saved state.
+// It returns RollbackError when an older byte array has been written back to the storage.
+//
+//	otp, err := twofactor.TOTPFromBytes(data, issuer)
+//	...
+//	if err := otp.VerifyLoad(verifier); err != nil {
+//		return err
+//	}
+func (otp *Totp) VerifyLoad(verifier GenerationVerifier) error {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return err
+	}
+
+	last, err := verifier.LastGeneration(otp.stateId())
+	if err != nil {
+		return err
+	}
+
+	if otp.generation < last {
+		return RollbackError
+	}
+	return nil
+}
+
+// VerifySave records the generation of the TOTP just serialized with BytesVersion2, before the byte array is stored.
+// It returns StaleStateError when a newer state has been saved in the meantime, for instance by a concurrent request:
+// the byte array must then be discarded and the TOTP loaded again.
+// If storing the byte array fails after VerifySave, the stored one cannot be loaded anymore:
+// serialize the TOTP and call VerifySave again to retry the write.
+//
+//	data, err := otp.ToBytesWith(issuer, twofactor.BytesVersion2)
+//	...
+//	if err := otp.VerifySave(verifier); err != nil {
+//		return err
+//	}
+//	// store data
+func (otp *Totp) VerifySave(verifier GenerationVerifier) error {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return err
+	}
+
+	id := otp.stateId()
+	last, err := verifier.LastGeneration(id)
+	if err != nil {
+		return err
+	}
+
+	if otp.generation <= last {
+		return StaleStateError
+	}
+	return verifier.SaveGeneration(id, otp.generation)
+}
+
+// Private function which returns the id of the TOTP passed to the GenerationVerifier and the StateBackend.
+// The issuer is query escaped like in the label, so that the first colon is always the separator
+// and two different pairs of issuer and account cannot have the same id.
+func (otp *Totp) stateId() string {
+	return fmt.Sprintf("%s:%s", url.QueryEscape(otp.issuer), otp.account)
+}
+
+// MemoryGenerationVerifier is a GenerationVerifier which keeps the generations in memory.
+// It protects a single process only and it is reset on restart, it is useful for the tests and as an example.
+type MemoryGenerationVerifier struct {
+	mutex       sync.Mutex
+	generations map[string]uint64
+}
+
+// NewMemoryGenerationVerifier creates an empty MemoryGenerationVerifier
+func NewMemoryGenerationVerifier() *MemoryGenerationVerifier {
+	return &MemoryGenerationVerifier{generations: map[string]uint64{}}
+}
+
+// LastGeneration returns the last generation saved for the id
+func (v *MemoryGenerationVerifier) LastGeneration(id string) (uint64, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.generations[id], nil
+}
+
+// SaveGeneration records the generation of the id, it refuses a generation which is not newer than the saved one
+func (v *MemoryGenerationVerifier) SaveGeneration(id string, generation uint64) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if generation <= v.generations[id] {
+		return StaleStateError
+	}
+	v.generations[id] = generation
+	return nil
+}
@@ -0,0 +1,98 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+)
+
+func TestGenerationRollback(t *testing.T) {
+
+	verifier := NewMemoryGenerationVerifier()
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	// the initial state
+	old, err := otp.ToBytesWith("Sec51", BytesVersion2)
+	checkError(t, err)
+	checkError(t, otp.VerifySave(verifier))
+
+	// the attacker fails 3 times: the user is locked down and the new state is saved
+	loaded, err := TOTPFromBytes(old, "Sec51")
+	checkError(t, err)
+	checkError(t, loaded.VerifyLoad(verifier))
+	for i := 0; i < max_failures; i++ {
+		if err := loaded.Validate("000000x"); err == nil {
+			t.Error("The wrong code has been accepted")
+		}
+	}
+	locked, err := loaded.ToBytesWith("Sec51", BytesVersion2)
+	checkError(t, err)
+	checkError(t, loaded.VerifySave(verifier))
+
+	if loaded.Generation() != 2 {
+		t.Errorf("Expected the generation 2, got %d\n", loaded.Generation())
+	}
+
+	// the attacker writes the initial state back to the storage to reset the failures
+	replayed, err := TOTPFromBytes(old, "Sec51")
+	checkError(t, err)
+	if err := replayed.VerifyLoad(verifier); err != RollbackError {
+		t.Errorf("Expected RollbackError, got %v\n", err)
+	}
+
+	// the current state loads
+	current, err := TOTPFromBytes(locked, "Sec51")
+	checkError(t, err)
+	checkError(t, current.VerifyLoad(verifier))
+	if current.totalVerificationFailures != max_failures {
+		t.Errorf("Expected %d verification failures, got %d\n", max_failures, current.totalVerificationFailures)
+	}
+}
+
+func TestGenerationStaleSave(t *testing.T) {
+
+	verifier := NewMemoryGenerationVerifier()
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	data, err := otp.ToBytesWith("Sec51", BytesVersion2)
+	checkError(t, err)
+	checkError(t, otp.VerifySave(verifier))
+
+	// two concurrent requests load the same state
+	first, err := TOTPFromBytes(data, "Sec51")
+	checkError(t, err)
+	second, err := TOTPFromBytes(data, "Sec51")
+	checkError(t, err)
+
+	_, err = first.ToBytesWith("Sec51", BytesVersion2)
+	checkError(t, err)
+	checkError(t, first.VerifySave(verifier))
+
+	// the second request would overwrite the state saved by the first one
+	_, err = second.ToBytesWith("Sec51", BytesVersion2)
+	checkError(t, err)
+	if err := second.VerifySave(verifier); err != StaleStateError {
+		t.Errorf("Expected StaleStateError, got %v\n", err)
+	}
+
+	// the version 1 does not store the generation
+	_, err = first.ToBytes()
+	checkError(t, err)
+	if err := first.VerifySave(verifier); err != StaleStateError {
+		t.Errorf("Expected StaleStateError, got %v\n", err)
+	}
+}
+
+func TestStateId(t *testing.T) {
+
+	first, err := NewTOTP("b:c", "a", crypto.SHA1, 6)
+	checkError(t, err)
+	second, err := NewTOTP("c", "a:b", crypto.SHA1, 6)
+	checkError(t, err)
+
+	if first.stateId() == second.stateId() {
+		t.Errorf("Two different issuers and accounts have the same id %s\n", first.stateId())
+	}
+}
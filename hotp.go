@@ -0,0 +1,243 @@
+package twofactor
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+const (
+	hotp_look_ahead = 10 // the amount of counter values checked after the current one, see RFC 4226 section 7.4
+)
+
+// WARNING: The `Hotp` struct should never be instantiated manually!
+// Use the `NewHOTP` function
+type Hotp struct {
+	key                       []byte             // this is the secret key
+	counter                   [counter_size]byte // this is the moving factor shared with the client device
+	digits                    int                // total amount of digits of the code displayed on the device
+	issuer                    string             // the company which issues the 2FA
+	account                   string             // usually the user email or the account id
+	totalVerificationFailures int                // the total amount of verification failures from the client
+	lastVerificationTime      time.Time          // the last verification executed
+	hashFunction              crypto.Hash        // the hash function used in the HMAC construction (sha1 - sha156 - sha512)
+	observers                 []Observer         // notified of the outcomes of Validate and of the reveals, not serialized
+}
+
+// This function creates a new HOTP object (RFC 4226)
+// account: usually the user email
+// issuer: the name of the company/service
+// hash: is the crypto function used: crypto.SHA1, crypto.SHA256, crypto.SHA512
+// digits: is the token amount of digits (6 or 7 or 8)
+// it automatically generates a secret key using the golang crypto rand package and starts the counter at 0.
+// As for the TOTP, the key is a secret and needs to be protected.
+func NewHOTP(account, issuer string, hash crypto.Hash, digits int) (*Hotp, error) {
+
+	keySize := hash.Size()
+	key := make([]byte, keySize)
+	total, err := rand.Read(key)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("HOTP failed to create because there is not enough entropy, we got only %d random bytes", total))
+	}
+
+	// sanitize the digits range otherwise it may create invalid tokens !
+	if digits < 6 || digits > 8 {
+		digits = 8
+	}
+
+	return makeHOTP(key, account, issuer, hash, digits, 0)
+
+}
+
+// Private function which initialize the HOTP so that it's easier to unit test it
+// Used internally
+func makeHOTP(key []byte, account, issuer string, hash crypto.Hash, digits int, counter uint64) (*Hotp, error) {
+	otp := new(Hotp)
+	otp.key = key
+	otp.account = account
+	otp.issuer = issuer
+	otp.digits = digits
+	otp.counter = bigendian.ToUint64(counter)
+	otp.hashFunction = hash
+	return otp, nil
+}
+
+// Counter returns the current value of the moving factor.
+// This is the counter of the next code the server expects from the client device.
+func (otp *Hotp) Counter() uint64 {
+	return bigendian.FromUint64(otp.counter)
+}
+
+// Generates the one time password for the current counter value.
+// The counter is not incremented: it moves forward only when a code is validated.
+func (otp *Hotp) OTP() (string, error) {
+
+	// verify the proper initialization
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return "", err
+	}
+
+	return calculateHOTP(otp, otp.Counter()), nil
+}
+
+// Generates the one time password for the given counter value, without changing the state of the HOTP.
+func (otp *Hotp) OTPAt(counter uint64) (string, error) {
+
+	// verify the proper initialization
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return "", err
+	}
+
+	return calculateHOTP(otp, counter), nil
+}
+
+// This function validates the user provided token against the current counter
+// and the following hotp_look_ahead counter values, to tolerate codes generated
+// on the device but never submitted.
+// When a code matches, the counter is moved past it so the same code cannot be used twice.
+// The same lock down policy of the TOTP applies: after max_failures the validation
+// returns LockDownError for backoff_minutes.
+func (otp *Hotp) Validate(userCode string) error {
+
+	// check Hotp initialization
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return err
+	}
+
+	// verify that the token is valid
+	if userCode == "" {
+		return errors.New("User provided token is empty")
+	}
+
+	// check against the total amount of failures
+	if otp.totalVerificationFailures >= max_failures && !validBackoffTime(otp.lastVerificationTime) {
+		otp.notifyEvent(Observer.OnFailure, 0, otp.totalVerificationFailures, LockDownError, "")
+		return LockDownError
+	}
+
+	if otp.totalVerificationFailures >= max_failures && validBackoffTime(otp.lastVerificationTime) {
+		// reset the total verification failures counter
+		otp.totalVerificationFailures = 0
+		otp.notifyEvent(Observer.OnUnlock, 0, 0, nil, "")
+	}
+
+	if counter, ok := matchHOTP(otp, userCode); ok {
+		return otp.succeeded(counter)
+	}
+
+	otp.totalVerificationFailures++
+	otp.lastVerificationTime = time.Now().UTC() // important to have it in UTC
+
+	return otp.failed(otp.totalVerificationFailures, errors.New("Tokens mismatch."))
+}
+
+// Private function which checks the user code against the current counter and the following hotp_look_ahead counter values.
+// It checks all the counters in the window, without stopping at the first match,
+// so that the time spent does not depend on the matching position.
+// It returns the matching counter value and whether a counter matched.
+func matchHOTP(otp *Hotp, userCode string) (uint64, bool) {
+	counter := otp.Counter()
+	matched := -1
+	for i := 0; i <= hotp_look_ahead; i++ {
+		token := calculateHOTP(otp, counter+uint64(i))
+		if subtle.ConstantTimeCompare([]byte(token), []byte(userCode)) == 1 && matched < 0 {
+			matched = i
+		}
+	}
+	return counter + uint64(matched), matched >= 0
+}
+
+// Private function which calculates the HOTP token for the given counter value
+func calculateHOTP(otp *Hotp, counter uint64) string {
+	h := newHMAC(otp.hashFunction, otp.key)
+	counterBytes := bigendian.ToUint64(counter)
+	return calculateToken(counterBytes[:], otp.digits, h)
+}
+
+// Secret returns the underlying base32 encoded secret.
+// The same precautions of the TOTP Secret apply: the observers are notified of a reveal.
+// It returns an empty string when the HOTP has not been initialized.
+func (otp *Hotp) Secret() string {
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return ""
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "Secret")
+	return base32.StdEncoding.EncodeToString(otp.key)
+}
+
+// Label returns the combination of issuer:account string
+func (otp *Hotp) label() string {
+	return fmt.Sprintf("%s:%s", url.QueryEscape(otp.issuer), otp.account)
+}
+
+// URL returns a suitable URL, such as for the Google Authenticator app
+// example: otpauth://hotp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example&counter=0
+func (otp *Hotp) URL() (string, error) {
+	u, err := otp.keyURL()
+	if err == nil {
+		otp.notifyLifecycle(LifecycleObserver.OnReveal, "URL")
+	}
+	return u, err
+}
+
+// Private function which returns the otpauth URL without notifying the observers
+func (otp *Hotp) keyURL() (string, error) {
+
+	// verify the proper initialization
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return "", err
+	}
+
+	u := url.URL{}
+	v := url.Values{}
+	u.Scheme = "otpauth"
+	u.Host = "hotp"
+	u.Path = otp.label()
+	v.Add("secret", base32.StdEncoding.EncodeToString(otp.key))
+	v.Add("counter", strconv.FormatUint(otp.Counter(), 10))
+	v.Add("issuer", otp.issuer)
+	v.Add("digits", strconv.Itoa(otp.digits))
+	v.Add("algorithm", hashFunctionName(otp.hashFunction))
+	u.RawQuery = v.Encode()
+	return u.String(), nil
+}
+
+// QR generates a byte array containing QR code encoded PNG image, with level Q error correction.
+// The same precautions of the TOTP QR code apply.
+func (otp *Hotp) QR() ([]byte, error) {
+
+	u, err := otp.keyURL()
+	if err != nil {
+		return nil, err
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "QR")
+	return encodeQR(u)
+}
+
+// QRCode returns the QR code of the key URL with the given options.
+// The same precautions of the TOTP QR code apply.
+func (otp *Hotp) QRCode(options QROptions) (*QRCode, error) {
+
+	u, err := otp.keyURL()
+	if err != nil {
+		return nil, err
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "QRCode")
+	return NewQRCode(u, options)
+}
+
+// this method checks the proper initialization of the Hotp object
+func hotpHasBeenInitialized(otp *Hotp) error {
+	if otp == nil || otp.key == nil || len(otp.key) == 0 {
+		return initializationFailedError
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+)
+
+// RFC 4226 Appendix D test values
+var hotpKey = []byte("12345678901234567890")
+
+var hotpTestData = []string{
+	"755224",
+	"287082",
+	"359152",
+	"969429",
+	"338314",
+	"254676",
+	"287922",
+	"162583",
+	"399871",
+	"520489",
+}
+
+func TestHOTP(t *testing.T) {
+
+	otp, err := makeHOTP(hotpKey, "info@sec51.com", "Sec51", crypto.SHA1, 6, 0)
+	checkError(t, err)
+
+	for counter, expected := range hotpTestData {
+		token := calculateHOTP(otp, uint64(counter))
+		if token != expected {
+			t.Errorf("HOTP test data, token mismatch. Got %s, expected %s\n", token, expected)
+		}
+	}
+
+	token, err := otp.OTP()
+	checkError(t, err)
+	if token != hotpTestData[0] {
+		t.Errorf("HOTP token mismatch. Got %s, expected %s\n", token, hotpTestData[0])
+	}
+
+}
+
+func TestHOTPValidation(t *testing.T) {
+
+	otp, err := makeHOTP(hotpKey, "info@sec51.com", "Sec51", crypto.SHA1, 6, 0)
+	checkError(t, err)
+
+	// the current code moves the counter by one
+	if err := otp.Validate(hotpTestData[0]); err != nil {
+		t.Fatal(err)
+	}
+	if otp.Counter() != 1 {
+		t.Errorf("Expected counter 1, instead we've got %d\n", otp.Counter())
+	}
+
+	// the same code cannot be used twice
+	if err := otp.Validate(hotpTestData[0]); err == nil {
+		t.Fatal("An already used HOTP code has been accepted")
+	}
+
+	// a code inside the look ahead window re-synchronizes the counter
+	if err := otp.Validate(hotpTestData[5]); err != nil {
+		t.Fatal(err)
+	}
+	if otp.Counter() != 6 {
+		t.Errorf("Expected counter 6, instead we've got %d\n", otp.Counter())
+	}
+
+	// after max_failures the validation is locked down
+	for i := 0; i < max_failures; i++ {
+		otp.Validate("000000")
+	}
+	if err := otp.Validate(hotpTestData[6]); err != LockDownError {
+		t.Errorf("Expected the lock down error, instead we've got %v\n", err)
+	}
+
+}
+
+func TestNewHOTP(t *testing.T) {
+
+	otp, err := NewHOTP("info@sec51.com", "Sec51", crypto.SHA256, 9)
+	checkError(t, err)
+
+	if len(otp.key) != crypto.SHA256.Size() {
+		t.Errorf("Expected a %d bytes key, instead we've got %d\n", crypto.SHA256.Size(), len(otp.key))
+	}
+
+	if otp.digits != 8 {
+		t.Errorf("Expected the digits to be sanitized to 8, instead we've got %d\n", otp.digits)
+	}
+
+	token, err := otp.OTP()
+	checkError(t, err)
+	if err := otp.Validate(token); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := new(Hotp).OTP(); err == nil {
+		t.Fatal("Hotp is not properly initialized and the method did not catch it")
+	}
+
+}
+
+func TestHOTPAt(t *testing.T) {
+
+	otp, err := makeHOTP(hotpKey, "info@sec51.com", "Sec51", crypto.SHA1, 6, 0)
+	checkError(t, err)
+
+	for counter, expected := range hotpTestData {
+		token, err := otp.OTPAt(uint64(counter))
+		checkError(t, err)
+		if token != expected {
+			t.Errorf("HOTP token mismatch for counter %d. Got %s, expected %s\n", counter, token, expected)
+		}
+	}
+
+	// the counter does not move
+	if otp.Counter() != 0 {
+		t.Errorf("Expected the counter 0, instead we've got %d\n", otp.Counter())
+	}
+}
@@ -0,0 +1,403 @@
+/*
+Package httphandlers provides the net/http handlers of the usual two-factor endpoints:
+
+	handlers := httphandlers.New(store, currentUser, httphandlers.Options{Issuer: "Sec51"})
+	mux.HandleFunc("/2fa/enroll", handlers.StartEnrollment)
+	mux.HandleFunc("/2fa/enroll/confirm", handlers.ConfirmEnrollment)
+	mux.HandleFunc("/2fa/verify", handlers.Verify)
+
+The handlers accept only POST requests, with a JSON body ({"code": "123456"}) or form-encoded (code=123456).
+The responses have the same encoding of the request, unless the Accept header asks for application/json.
+The account is resolved from the request by the caller-supplied function, usually from the session:
+the handlers must be mounted behind the authentication of the first factor.
+
+StartEnrollment returns the QR code (PNG data URI or SVG) and the secret key for the manual entry.
+They are returned only by this response: starting again replaces the pending enrollment with a new secret key,
+and the accounts with an active TOTP cannot start a new enrollment.
+
+The concurrent requests of an account are serialized by the compare-and-swap of the Store: only the first one
+to store the new state is answered, the others get 409 Conflict and can be retried.
+Each code is accepted only once, and the failures are counted, by the StateBackend of the options:
+when it is missing the handlers use a MemoryStateBackend, which is shared only by the requests of the process.
+The services with several replicas need a shared backend, like the one of the redisbackend package.
+*/
+package httphandlers
+
+import (
+	"crypto"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sec51/twofactor"
+	"github.com/sec51/twofactor/tracing"
+)
+
+const (
+	max_body_size = 4096 // the requests contain only a code and an option
+
+	content_type_json = "application/json"
+	content_type_form = "application/x-www-form-urlencoded"
+)
+
+// Options are the options of the handlers
+type Options struct {
+	Issuer     string                                 // the issuer of the new TOTPs, and the cryptoengine identifier of their bytes
+	Hash       crypto.Hash                            // the hash function of the new TOTPs, crypto.SHA1 when 0
+	Digits     int                                    // the digits of the new TOTPs, 6 when 0
+	Enrollment twofactor.EnrollmentOptions            // the options of the new enrollments
+	QR         twofactor.QROptions                    // the rendering of the QR codes
+	Backend    twofactor.StateBackend                 // the used codes and the failures, shared between the replicas; a MemoryStateBackend when nil
+	Observer   func(*http.Request) twofactor.Observer // returns the observer of the request, like an audit logger with the request metadata, optional
+}
+
+// Handlers serves the enrollment and verification endpoints
+type Handlers struct {
+	store   Store
+	user    func(*http.Request) (string, error)
+	options Options
+}
+
+// New creates the handlers. The user function returns the account of the authenticated user of the request,
+// an error or an empty account are answered with 401 Unauthorized.
+func New(store Store, user func(*http.Request) (string, error), options Options) *Handlers {
+	if options.Hash == 0 {
+		options.Hash = crypto.SHA1
+	}
+	if options.Digits == 0 {
+		options.Digits = 6
+	}
+	// the TOTP does not record the used codes: without a backend the same code would be accepted twice
+	if options.Backend == nil {
+		options.Backend = twofactor.NewMemoryStateBackend()
+	}
+	return &Handlers{store: store, user: user, options: options}
+}
+
+// StartEnrollment creates a new TOTP and its pending enrollment, and returns the QR code and the secret key.
+// The optional parameter "qr" selects the image: "png" (data URI, default) or "svg".
+// Response: secret, url, qr, qr_type and expires_at (RFC 3339).
+func (h *Handlers) StartEnrollment(w http.ResponseWriter, r *http.Request) {
+
+	account, values, ok := h.begin(w, r)
+	if !ok {
+		return
+	}
+
+	qrType := values.Get("qr")
+	if qrType == "" {
+		qrType = "png"
+	}
+	if qrType != "png" && qrType != "svg" {
+		respondError(w, r, http.StatusBadRequest, "The qr parameter must be png or svg.")
+		return
+	}
+
+	// an active TOTP cannot be replaced by the user
+	if _, err := h.store.LoadTOTP(account); err != NotFoundError {
+		if err != nil {
+			respondError(w, r, http.StatusInternalServerError, "The two-factor state cannot be loaded.")
+			return
+		}
+		respondError(w, r, http.StatusConflict, "The two-factor authentication is already active.")
+		return
+	}
+
+	// the pending enrollment, if any, is replaced
+	old, err := h.store.LoadEnrollment(account)
+	if err != nil && err != NotFoundError {
+		respondError(w, r, http.StatusInternalServerError, "The two-factor state cannot be loaded.")
+		return
+	}
+
+	otp, err := twofactor.NewTOTP(account, h.options.Issuer, h.options.Hash, h.options.Digits)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, "The secret key cannot be generated.")
+		return
+	}
+	h.addObserver(r, otp)
+	enrollment, err := twofactor.NewEnrollment(otp, h.options.Enrollment)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the enrollment is stored before the secret key is revealed
+	if !h.saveEnrollment(w, r, account, old, enrollment) {
+		return
+	}
+
+	code, err := enrollment.QRCode(h.options.QR)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, "The QR code cannot be generated.")
+		return
+	}
+	secret, err := enrollment.Secret()
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	keyURL, err := enrollment.URL()
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := map[string]string{
+		"secret":     secret,
+		"url":        keyURL,
+		"expires_at": enrollment.ExpiresAt().Format(time.RFC3339),
+	}
+	if qrType == "svg" {
+		response["qr"] = code.SVG()
+		response["qr_type"] = "image/svg+xml"
+	} else {
+		if response["qr"], err = code.DataURI(); err != nil {
+			respondError(w, r, http.StatusInternalServerError, "The QR code cannot be generated.")
+			return
+		}
+		response["qr_type"] = "image/png"
+	}
+
+	// the secret key must not be kept by the caches
+	w.Header().Set("Cache-Control", "no-store")
+	respond(w, r, http.StatusOK, response)
+}
+
+// ConfirmEnrollment checks the "code" parameter against the pending enrollment.
+// Response: status "active" once the TOTP is enforced, "pending" when another consecutive code is required.
+func (h *Handlers) ConfirmEnrollment(w http.ResponseWriter, r *http.Request) {
+
+	account, values, ok := h.begin(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.store.LoadEnrollment(account)
+	if err != nil {
+		h.loadError(w, r, err, "There is no pending enrollment.")
+		return
+	}
+	enrollment, err := twofactor.EnrollmentFromBytes(data, h.options.Issuer)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, "The enrollment cannot be decrypted.")
+		return
+	}
+	if h.options.Observer != nil {
+		enrollment.AddObserver(h.options.Observer(r))
+	}
+
+	err = enrollment.Confirm(values.Get("code"))
+	switch {
+	case err == twofactor.EnrollmentExpiredError:
+		if err := h.store.DeleteEnrollment(account, data); err != nil {
+			storeError(w, r, err, "The enrollment cannot be deleted.")
+			return
+		}
+		respondError(w, r, http.StatusGone, twofactor.EnrollmentExpiredError.Error())
+		return
+	case err != nil:
+		// the failures count towards the lock down
+		if h.saveEnrollment(w, r, account, data, enrollment) {
+			respondError(w, r, validationStatus(err), err.Error())
+		}
+		return
+	}
+
+	if enrollment.State() != twofactor.EnrollmentActive {
+		if h.saveEnrollment(w, r, account, data, enrollment) {
+			respond(w, r, http.StatusOK, map[string]string{"status": "pending"})
+		}
+		return
+	}
+
+	otp, err := enrollment.Totp()
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// the TOTP is stored only when the account has none, so that a concurrent confirmation cannot activate it too
+	if !h.saveTOTP(w, r, account, nil, otp, twofactor.BytesVersion1) {
+		return
+	}
+	// the TOTP is active even when the deletion fails: the enrollment left over cannot be confirmed again
+	// and StartEnrollment refuses the accounts with an active TOTP
+	h.store.DeleteEnrollment(account, data)
+	respond(w, r, http.StatusOK, map[string]string{"status": "active"})
+}
+
+// Verify checks the "code" parameter against the active TOTP during the login.
+// Response: status "verified", or an error with 401 Unauthorized, or 423 Locked during the lock down,
+// or 409 Conflict when a concurrent request of the account has changed the state first.
+func (h *Handlers) Verify(w http.ResponseWriter, r *http.Request) {
+
+	account, values, ok := h.begin(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := h.store.LoadTOTP(account)
+	if err != nil {
+		h.loadError(w, r, err, "The two-factor authentication is not active.")
+		return
+	}
+	otp, version, err := tracing.TOTPFromBytes(r.Context(), data, h.options.Issuer)
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, "The two-factor state cannot be decrypted.")
+		return
+	}
+	otp.SetStateBackend(h.options.Backend)
+	h.addObserver(r, otp)
+
+	// the state is stored after the failures too, for the lock down:
+	// the result is answered only when no concurrent request has changed the state in the meantime
+	validationErr := tracing.Validate(r.Context(), otp, values.Get("code"))
+	if !h.saveTOTP(w, r, account, data, otp, version) {
+		return
+	}
+	if validationErr != nil {
+		respondError(w, r, validationStatus(validationErr), validationErr.Error())
+		return
+	}
+	respond(w, r, http.StatusOK, map[string]string{"status": "verified"})
+}
+
+// Private function which checks the method, resolves the account and reads the parameters of the request
+func (h *Handlers) begin(w http.ResponseWriter, r *http.Request) (string, url.Values, bool) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		respondError(w, r, http.StatusMethodNotAllowed, "Only POST is allowed.")
+		return "", nil, false
+	}
+
+	account, err := h.user(r)
+	if err != nil || account == "" {
+		respondError(w, r, http.StatusUnauthorized, "The user is not authenticated.")
+		return "", nil, false
+	}
+
+	values, err := readValues(w, r)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, "The request body is invalid.")
+		return "", nil, false
+	}
+	return account, values, true
+}
+
+// Private function which adds the observer of the request to the TOTP
+func (h *Handlers) addObserver(r *http.Request, otp *twofactor.Totp) {
+	if h.options.Observer != nil {
+		otp.AddObserver(h.options.Observer(r))
+	}
+}
+
+// Private function which answers a failed load, 404 Not Found when the state does not exist
+func (h *Handlers) loadError(w http.ResponseWriter, r *http.Request, err error, notFound string) {
+	if err == NotFoundError {
+		respondError(w, r, http.StatusNotFound, notFound)
+		return
+	}
+	respondError(w, r, http.StatusInternalServerError, "The two-factor state cannot be loaded.")
+}
+
+// Private function which answers a failed store, 409 Conflict when a concurrent request has changed the state
+func storeError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if err == ConflictError {
+		respondError(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	respondError(w, r, http.StatusInternalServerError, message)
+}
+
+// Private function which replaces the old bytes of the enrollment, it answers the request when it fails
+func (h *Handlers) saveEnrollment(w http.ResponseWriter, r *http.Request, account string, old []byte, enrollment *twofactor.Enrollment) bool {
+	data, err := enrollment.ToBytes()
+	if err == nil {
+		err = h.store.SaveEnrollment(account, old, data)
+	}
+	if err != nil {
+		storeError(w, r, err, "The enrollment cannot be stored.")
+		return false
+	}
+	return true
+}
+
+// Private function which replaces the old bytes of the TOTP, it answers the request when it fails.
+// The version is the one of the old bytes: the extensions of version 2, like a rotation in progress, cannot be written as version 1.
+func (h *Handlers) saveTOTP(w http.ResponseWriter, r *http.Request, account string, old []byte, otp *twofactor.Totp, version int) bool {
+	data, err := tracing.ToBytes(r.Context(), otp, h.options.Issuer, version)
+	if err == nil {
+		err = h.store.SaveTOTP(account, old, data)
+	}
+	if err != nil {
+		storeError(w, r, err, "The two-factor state cannot be stored.")
+		return false
+	}
+	return true
+}
+
+// Private function which maps the validation errors to the status codes
+func validationStatus(err error) int {
+	if err == twofactor.LockDownError {
+		return http.StatusLocked
+	}
+	return http.StatusUnauthorized
+}
+
+// Private function which tells whether the request body is JSON
+func isJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == content_type_json
+}
+
+// Private function which reads the parameters of the JSON or form-encoded request
+func readValues(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, max_body_size)
+
+	if !isJSON(r) {
+		// the values of the query string are ignored: the codes must not end up in the access logs
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.PostForm, nil
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	for key, value := range body {
+		values.Set(key, value)
+	}
+	return values, nil
+}
+
+// Private function which writes the response with the encoding of the request
+func respond(w http.ResponseWriter, r *http.Request, status int, values map[string]string) {
+
+	if isJSON(r) || strings.Contains(r.Header.Get("Accept"), content_type_json) {
+		w.Header().Set("Content-Type", content_type_json)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(values)
+		return
+	}
+
+	form := url.Values{}
+	for key, value := range values {
+		form.Set(key, value)
+	}
+	w.Header().Set("Content-Type", content_type_form)
+	w.WriteHeader(status)
+	w.Write([]byte(form.Encode()))
+}
+
+// Private function which writes the error message with the encoding of the request
+func respondError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	respond(w, r, status, map[string]string{"error": message})
+}
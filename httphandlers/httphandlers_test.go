@@ -0,0 +1,384 @@
+package httphandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sec51/twofactor"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Private function which resolves the user from a test header
+func currentUser(r *http.Request) (string, error) {
+	account := r.Header.Get("X-User")
+	if account == "" {
+		return "", errors.New("no session")
+	}
+	return account, nil
+}
+
+// Private function which sends a JSON request and decodes the JSON response
+func postJSON(t *testing.T, handler http.HandlerFunc, user string, body map[string]string) (int, map[string]string) {
+	data, err := json.Marshal(body)
+	checkError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(data)))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-User", user)
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if w.Header().Get("Content-Type") != content_type_json {
+		t.Errorf("Expected a JSON response, got %s\n", w.Header().Get("Content-Type"))
+	}
+	var response map[string]string
+	checkError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return w.Code, response
+}
+
+// Private function which sends a form-encoded request and decodes the form-encoded response
+func postForm(t *testing.T, handler http.HandlerFunc, user string, form url.Values) (int, url.Values) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", content_type_form)
+	r.Header.Set("X-User", user)
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if w.Header().Get("Content-Type") != content_type_form {
+		t.Errorf("Expected a form-encoded response, got %s\n", w.Header().Get("Content-Type"))
+	}
+	response, err := url.ParseQuery(w.Body.String())
+	checkError(t, err)
+	return w.Code, response
+}
+
+// Private function which starts and confirms the enrollment of the account, it returns the device TOTP
+func enroll(t *testing.T, handlers *Handlers, account string) *twofactor.Totp {
+	status, response := postJSON(t, handlers.StartEnrollment, account, nil)
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %v\n", status, response)
+	}
+	device, err := twofactor.TOTPFromURL(response["url"])
+	checkError(t, err)
+
+	code, err := device.OTP()
+	checkError(t, err)
+	status, response = postJSON(t, handlers.ConfirmEnrollment, account, map[string]string{"code": code})
+	if status != http.StatusOK || response["status"] != "active" {
+		t.Fatalf("Expected the active enrollment, got %d: %v\n", status, response)
+	}
+	return device
+}
+
+func TestEnrollment(t *testing.T) {
+
+	store := NewMemoryStore()
+	handlers := New(store, currentUser, Options{Issuer: "Sec51"})
+
+	// the secret key is returned with the QR code
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"qr": "png"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-User", "info@sec51.com")
+	w := httptest.NewRecorder()
+	handlers.StartEnrollment(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Unexpected response %d %v\n", w.Code, w.Header())
+	}
+	var first map[string]string
+	checkError(t, json.Unmarshal(w.Body.Bytes(), &first))
+	if first["secret"] == "" || !strings.HasPrefix(first["qr"], "data:image/png;base64,") || first["qr_type"] != "image/png" {
+		t.Errorf("Unexpected response %v\n", first)
+	}
+
+	// starting again replaces the secret key
+	status, second := postJSON(t, handlers.StartEnrollment, "info@sec51.com", map[string]string{"qr": "svg"})
+	if status != http.StatusOK || second["secret"] == first["secret"] || !strings.HasPrefix(second["qr"], "<svg") {
+		t.Errorf("Unexpected response %d: %v\n", status, second)
+	}
+
+	// the codes of the replaced secret key are refused
+	replaced, err := twofactor.TOTPFromURL(first["url"])
+	checkError(t, err)
+	code, err := replaced.OTP()
+	checkError(t, err)
+	status, response := postJSON(t, handlers.ConfirmEnrollment, "info@sec51.com", map[string]string{"code": code})
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d: %v\n", status, response)
+	}
+
+	device, err := twofactor.TOTPFromURL(second["url"])
+	checkError(t, err)
+	code, err = device.OTP()
+	checkError(t, err)
+	status, response = postJSON(t, handlers.ConfirmEnrollment, "info@sec51.com", map[string]string{"code": code})
+	if status != http.StatusOK || response["status"] != "active" {
+		t.Errorf("Expected the active enrollment, got %d: %v\n", status, response)
+	}
+
+	// the secret key is never returned again
+	status, response = postJSON(t, handlers.StartEnrollment, "info@sec51.com", nil)
+	if status != http.StatusConflict || response["secret"] != "" {
+		t.Errorf("Expected 409, got %d: %v\n", status, response)
+	}
+	status, _ = postJSON(t, handlers.ConfirmEnrollment, "info@sec51.com", map[string]string{"code": code})
+	if status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d\n", status)
+	}
+
+	// invalid requests
+	status, _ = postJSON(t, handlers.StartEnrollment, "other@sec51.com", map[string]string{"qr": "gif"})
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d\n", status)
+	}
+	status, _ = postJSON(t, handlers.StartEnrollment, "", nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d\n", status)
+	}
+	w = httptest.NewRecorder()
+	handlers.StartEnrollment(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d\n", w.Code)
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	store := NewMemoryStore()
+	handlers := New(store, currentUser, Options{Issuer: "Sec51"})
+	device := enroll(t, handlers, "info@sec51.com")
+
+	code, err := device.OTP()
+	checkError(t, err)
+	status, response := postForm(t, handlers.Verify, "info@sec51.com", url.Values{"code": {code}})
+	if status != http.StatusOK || response.Get("status") != "verified" {
+		t.Errorf("Expected the verification, got %d: %v\n", status, response)
+	}
+
+	// the failures are stored, until the lock down
+	for i := 0; i < 3; i++ {
+		status, response = postForm(t, handlers.Verify, "info@sec51.com", url.Values{"code": {"000000x"}})
+		if status != http.StatusUnauthorized || response.Get("error") == "" {
+			t.Errorf("Expected 401, got %d: %v\n", status, response)
+		}
+	}
+	status, _ = postForm(t, handlers.Verify, "info@sec51.com", url.Values{"code": {code}})
+	if status != http.StatusLocked {
+		t.Errorf("Expected 423, got %d\n", status)
+	}
+
+	status, _ = postForm(t, handlers.Verify, "other@sec51.com", url.Values{"code": {code}})
+	if status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d\n", status)
+	}
+}
+
+func TestVerifyQueryCode(t *testing.T) {
+
+	handlers := New(NewMemoryStore(), currentUser, Options{Issuer: "Sec51"})
+	device := enroll(t, handlers, "info@sec51.com")
+
+	// the code of the query string is ignored
+	code, err := device.OTP()
+	checkError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/?code="+code, strings.NewReader(""))
+	r.Header.Set("Content-Type", content_type_form)
+	r.Header.Set("X-User", "info@sec51.com")
+	w := httptest.NewRecorder()
+	handlers.Verify(w, r)
+	if w.Code == http.StatusOK {
+		t.Errorf("The code of the query string has been accepted: %s\n", w.Body.String())
+	}
+}
+
+// deleteFailureStore fails the deletions of the enrollments
+type deleteFailureStore struct {
+	*MemoryStore
+}
+
+func (s deleteFailureStore) DeleteEnrollment(account string, old []byte) error {
+	return errors.New("unavailable")
+}
+
+func TestConfirmEnrollmentDeleteFailure(t *testing.T) {
+
+	store := deleteFailureStore{NewMemoryStore()}
+	handlers := New(store, currentUser, Options{Issuer: "Sec51"})
+
+	// the TOTP is stored before the enrollment is deleted
+	device := enroll(t, handlers, "info@sec51.com")
+	if _, err := store.LoadTOTP("info@sec51.com"); err != nil {
+		t.Fatalf("Expected the active TOTP, got %v\n", err)
+	}
+
+	// the enrollment left over cannot be confirmed again
+	code, err := device.OTP()
+	checkError(t, err)
+	status, response := postJSON(t, handlers.ConfirmEnrollment, "info@sec51.com", map[string]string{"code": code})
+	if status != http.StatusConflict {
+		t.Errorf("Expected 409, got %d: %v\n", status, response)
+	}
+}
+
+// barrierStore makes the loads of the TOTP wait for each other, so that the requests run concurrently
+type barrierStore struct {
+	*MemoryStore
+	barrier *sync.WaitGroup
+}
+
+func (s barrierStore) LoadTOTP(account string) ([]byte, error) {
+	data, err := s.MemoryStore.LoadTOTP(account)
+	s.barrier.Done()
+	s.barrier.Wait()
+	return data, err
+}
+
+// Private function which sends the form-encoded code from n concurrent requests, it returns the amount of each status
+func postParallel(handlers *Handlers, store barrierStore, user, code string, n int) map[int]int {
+	store.barrier.Add(n)
+	statuses := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url.Values{"code": {code}}.Encode()))
+			r.Header.Set("Content-Type", content_type_form)
+			r.Header.Set("X-User", user)
+			w := httptest.NewRecorder()
+			handlers.Verify(w, r)
+			statuses <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	return counts
+}
+
+func TestVerifyParallel(t *testing.T) {
+
+	store := NewMemoryStore()
+	handlers := New(store, currentUser, Options{Issuer: "Sec51"})
+	device := enroll(t, handlers, "info@sec51.com")
+	parallel := barrierStore{MemoryStore: store, barrier: &sync.WaitGroup{}}
+	handlers.store = parallel
+
+	// the same code is accepted at most once
+	code, err := device.OTP()
+	checkError(t, err)
+	counts := postParallel(handlers, parallel, "info@sec51.com", code, 10)
+	if counts[http.StatusOK] > 1 || counts[http.StatusOK]+counts[http.StatusUnauthorized]+counts[http.StatusConflict] != 10 {
+		t.Errorf("Expected the code to be accepted at most once, got %v\n", counts)
+	}
+
+	// the parallel wrong codes cannot bypass the lock down: they are all counted by the backend
+	counts = postParallel(handlers, parallel, "info@sec51.com", "000000x", 10)
+	if counts[http.StatusUnauthorized] != 1 || counts[http.StatusConflict] != 9 {
+		t.Errorf("Expected 1 failure and 9 conflicts, got %v\n", counts)
+	}
+	counts = postParallel(handlers, parallel, "info@sec51.com", "000000x", 10)
+	if counts[http.StatusLocked] == 0 || counts[http.StatusLocked]+counts[http.StatusConflict] != 10 {
+		t.Errorf("Expected the lock down, got %v\n", counts)
+	}
+
+	handlers.store = store
+	code, err = device.OTP()
+	checkError(t, err)
+	if status, _ := postForm(t, handlers.Verify, "info@sec51.com", url.Values{"code": {code}}); status != http.StatusLocked {
+		t.Errorf("Expected 423, got %d\n", status)
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+
+	handlers := New(NewMemoryStore(), currentUser, Options{Issuer: "Sec51"})
+	device := enroll(t, handlers, "info@sec51.com")
+
+	code, err := device.OTP()
+	checkError(t, err)
+	if status, _ := postForm(t, handlers.Verify, "info@sec51.com", url.Values{"code": {code}}); status != http.StatusOK {
+		t.Errorf("Expected 200, got %d\n", status)
+	}
+	if status, response := postForm(t, handlers.Verify, "info@sec51.com", url.Values{"code": {code}}); status != http.StatusUnauthorized || response.Get("error") != twofactor.ReplayError.Error() {
+		t.Errorf("Expected the replay to be refused, got %d: %v\n", status, response)
+	}
+}
+
+func TestVerifyRotation(t *testing.T) {
+
+	store := NewMemoryStore()
+	handlers := New(store, currentUser, Options{Issuer: "Sec51"})
+	enroll(t, handlers, "info@sec51.com")
+
+	// a rotation in progress can be stored only as version 2
+	data, err := store.LoadTOTP("info@sec51.com")
+	checkError(t, err)
+	otp, err := twofactor.TOTPFromBytes(data, "Sec51")
+	checkError(t, err)
+	checkError(t, otp.StartRotation(time.Hour))
+	rotated, err := otp.ToBytesWith("Sec51", twofactor.BytesVersion2)
+	checkError(t, err)
+	checkError(t, store.SaveTOTP("info@sec51.com", data, rotated))
+
+	for i := 0; i < 3; i++ {
+		if status, _ := postForm(t, handlers.Verify, "info@sec51.com", url.Values{"code": {"000000x"}}); status != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d\n", status)
+		}
+	}
+	if status, _ := postForm(t, handlers.Verify, "info@sec51.com", url.Values{"code": {"000000x"}}); status != http.StatusLocked {
+		t.Errorf("Expected 423, got %d\n", status)
+	}
+}
+
+func TestObserverOfRequest(t *testing.T) {
+
+	var events []string
+	observer := &recorder{events: &events}
+	handlers := New(NewMemoryStore(), currentUser, Options{
+		Issuer:   "Sec51",
+		Backend:  twofactor.NewMemoryStateBackend(),
+		Observer: func(r *http.Request) twofactor.Observer { return observer },
+	})
+	device := enroll(t, handlers, "info@sec51.com")
+
+	code, err := device.OTP()
+	checkError(t, err)
+	postJSON(t, handlers.Verify, "info@sec51.com", map[string]string{"code": code})
+
+	// the backend refuses the same code twice
+	status, _ := postJSON(t, handlers.Verify, "info@sec51.com", map[string]string{"code": code})
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d\n", status)
+	}
+
+	expected := "enroll reveal reveal reveal enroll success reuse"
+	if strings.Join(events, " ") != expected {
+		t.Errorf("Expected the events %s, got %v\n", expected, events)
+	}
+}
+
+// recorder records the names of the events
+type recorder struct {
+	twofactor.NopObserver
+	events *[]string
+}
+
+func (r *recorder) OnSuccess(event twofactor.Event) { *r.events = append(*r.events, "success") }
+func (r *recorder) OnReuse(event twofactor.Event)   { *r.events = append(*r.events, "reuse") }
+func (r *recorder) OnEnroll(event twofactor.Event)  { *r.events = append(*r.events, "enroll") }
+func (r *recorder) OnReveal(event twofactor.Event)  { *r.events = append(*r.events, "reveal") }
@@ -0,0 +1,94 @@
+package httphandlers
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+var (
+	NotFoundError = errors.New("The two-factor state of the account does not exist.")
+	ConflictError = errors.New("The two-factor state of the account has been changed by a concurrent request.")
+)
+
+// Store persists the encrypted bytes of the pending enrollments and of the active TOTPs of the accounts.
+// The bytes are already encrypted by the cryptoengine, the store does not need to encrypt them again.
+// The loads return NotFoundError when the account has no such state.
+//
+// The saves and the delete are compare-and-swap operations: they change the state only when the stored bytes
+// are still the old ones returned by the load (nil when the state does not exist yet), atomically,
+// otherwise they return ConflictError. Without it the concurrent verifications of an account would all read
+// the same failures and bypass the lock down, or accept the same code twice.
+// A SQL store can implement it with UPDATE ... WHERE account = ? AND data = ?, checking the affected rows.
+type Store interface {
+	LoadEnrollment(account string) ([]byte, error)
+	SaveEnrollment(account string, old, data []byte) error
+	DeleteEnrollment(account string, old []byte) error
+	LoadTOTP(account string) ([]byte, error)
+	SaveTOTP(account string, old, data []byte) error
+}
+
+// MemoryStore is a Store which keeps the state in memory, useful for the tests and for the prototypes
+type MemoryStore struct {
+	mutex       sync.Mutex
+	enrollments map[string][]byte
+	totps       map[string][]byte
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		enrollments: map[string][]byte{},
+		totps:       map[string][]byte{},
+	}
+}
+
+// Private function which loads a copy of the bytes
+func (s *MemoryStore) load(m map[string][]byte, account string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ok := m[account]
+	if !ok {
+		return nil, NotFoundError
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// Private function which stores a copy of the bytes, or deletes them when data is nil,
+// as long as the stored bytes are still the old ones
+func (s *MemoryStore) save(m map[string][]byte, account string, old, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, ok := m[account]
+	if ok != (old != nil) || !bytes.Equal(current, old) {
+		return ConflictError
+	}
+
+	if data == nil {
+		delete(m, account)
+	} else {
+		m[account] = append([]byte(nil), data...)
+	}
+	return nil
+}
+
+func (s *MemoryStore) LoadEnrollment(account string) ([]byte, error) {
+	return s.load(s.enrollments, account)
+}
+
+func (s *MemoryStore) SaveEnrollment(account string, old, data []byte) error {
+	return s.save(s.enrollments, account, old, data)
+}
+
+func (s *MemoryStore) DeleteEnrollment(account string, old []byte) error {
+	return s.save(s.enrollments, account, old, nil)
+}
+
+func (s *MemoryStore) LoadTOTP(account string) ([]byte, error) {
+	return s.load(s.totps, account)
+}
+
+func (s *MemoryStore) SaveTOTP(account string, old, data []byte) error {
+	return s.save(s.totps, account, old, data)
+}
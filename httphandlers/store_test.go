@@ -0,0 +1,39 @@
+package httphandlers
+
+import (
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+
+	store := NewMemoryStore()
+	if _, err := store.LoadTOTP("info@sec51.com"); err != NotFoundError {
+		t.Errorf("Expected NotFoundError, got %v\n", err)
+	}
+
+	data := []byte{1, 2, 3}
+	checkError(t, store.SaveEnrollment("info@sec51.com", nil, data))
+	data[0] = 9
+	loaded, err := store.LoadEnrollment("info@sec51.com")
+	checkError(t, err)
+	if loaded[0] != 1 {
+		t.Error("The store does not copy the bytes")
+	}
+
+	// the stored bytes must be the old ones
+	if err := store.SaveEnrollment("info@sec51.com", nil, []byte{4}); err != ConflictError {
+		t.Errorf("Expected ConflictError, got %v\n", err)
+	}
+	if err := store.SaveEnrollment("info@sec51.com", data, []byte{4}); err != ConflictError {
+		t.Errorf("Expected ConflictError, got %v\n", err)
+	}
+	checkError(t, store.SaveEnrollment("info@sec51.com", loaded, []byte{4}))
+	if err := store.DeleteEnrollment("info@sec51.com", loaded); err != ConflictError {
+		t.Errorf("Expected ConflictError, got %v\n", err)
+	}
+
+	checkError(t, store.DeleteEnrollment("info@sec51.com", []byte{4}))
+	if _, err := store.LoadEnrollment("info@sec51.com"); err != NotFoundError {
+		t.Errorf("Expected NotFoundError, got %v\n", err)
+	}
+}
@@ -0,0 +1,122 @@
+package twofactor
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// The formatting methods have value receivers, so that the secret key is redacted also when a Totp or a Hotp
+// is printed by value, for instance as a field of another struct with %+v
+const redacted = "REDACTED"
+
+// Private function which zeroes the secret bytes.
+// Only the byte slices of this package can be wiped: the cryptoengine messages hold the plain text
+// in immutable strings (NewMessage and Message.Text), whose copies stay in memory until they are collected.
+func wipe(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// Private function which describes the state of the key in the redacted representations
+func keyState(key []byte) string {
+	if len(key) == 0 {
+		return "destroyed"
+	}
+	return redacted
+}
+
+// Private function which implements fmt.Formatter with the redacted representations
+func formatRedacted(f fmt.State, verb rune, text, goText string) {
+	switch verb {
+	case 'v':
+		if f.Flag('#') {
+			io.WriteString(f, goText)
+			return
+		}
+		io.WriteString(f, text)
+	case 's':
+		io.WriteString(f, text)
+	case 'q':
+		fmt.Fprintf(f, "%q", text)
+	default:
+		fmt.Fprintf(f, "%%!%c(%s)", verb, text)
+	}
+}
+
+// Destroy zeroes the secret key, and the next secret key of a rotation in progress.
+// The TOTP cannot be used anymore: all the methods return an initialization error, Secret an empty string and Key nil,
+// and no reveal is notified to the observers.
+// The copies of the key made by the Go runtime, like the HMAC pads of crypto/hmac and the plain text strings
+// of the cryptoengine messages, are not reachable and cannot be wiped.
+func (otp *Totp) Destroy() {
+	wipe(otp.key)
+	wipe(otp.nextKey)
+	otp.key = nil
+	otp.nextKey = nil
+	otp.rotationDeadline = time.Time{}
+}
+
+// String returns a description of the TOTP without the secret key
+func (otp Totp) String() string {
+	return fmt.Sprintf("Totp{issuer: %s, account: %s, algorithm: %s, digits: %d, key: %s}",
+		otp.issuer, otp.account, hashFunctionName(otp.hashFunction), otp.digits, keyState(otp.key))
+}
+
+// GoString returns the %#v representation of the TOTP without the secret key
+func (otp Totp) GoString() string {
+	return fmt.Sprintf("twofactor.Totp{issuer: %q, account: %q, algorithm: %q, digits: %d, key: %q}",
+		otp.issuer, otp.account, hashFunctionName(otp.hashFunction), otp.digits, keyState(otp.key))
+}
+
+// Format implements fmt.Formatter, so that no verb prints the secret key
+func (otp Totp) Format(f fmt.State, verb rune) {
+	formatRedacted(f, verb, otp.String(), otp.GoString())
+}
+
+// LogValue implements slog.LogValuer, so that the loggers never receive the secret key
+func (otp Totp) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("issuer", otp.issuer),
+		slog.String("account", otp.account),
+		slog.String("algorithm", hashFunctionName(otp.hashFunction)),
+		slog.Int("digits", otp.digits),
+		slog.String("key", keyState(otp.key)),
+	)
+}
+
+// Destroy zeroes the secret key, the HOTP cannot be used anymore
+func (otp *Hotp) Destroy() {
+	wipe(otp.key)
+	otp.key = nil
+}
+
+// String returns a description of the HOTP without the secret key
+func (otp Hotp) String() string {
+	return fmt.Sprintf("Hotp{issuer: %s, account: %s, algorithm: %s, digits: %d, key: %s}",
+		otp.issuer, otp.account, hashFunctionName(otp.hashFunction), otp.digits, keyState(otp.key))
+}
+
+// GoString returns the %#v representation of the HOTP without the secret key
+func (otp Hotp) GoString() string {
+	return fmt.Sprintf("twofactor.Hotp{issuer: %q, account: %q, algorithm: %q, digits: %d, key: %q}",
+		otp.issuer, otp.account, hashFunctionName(otp.hashFunction), otp.digits, keyState(otp.key))
+}
+
+// Format implements fmt.Formatter, so that no verb prints the secret key
+func (otp Hotp) Format(f fmt.State, verb rune) {
+	formatRedacted(f, verb, otp.String(), otp.GoString())
+}
+
+// LogValue implements slog.LogValuer, so that the loggers never receive the secret key
+func (otp Hotp) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("issuer", otp.issuer),
+		slog.String("account", otp.account),
+		slog.String("algorithm", hashFunctionName(otp.hashFunction)),
+		slog.Int("digits", otp.digits),
+		slog.String("key", keyState(otp.key)),
+	)
+}
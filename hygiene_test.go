@@ -0,0 +1,174 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Private function which checks that the text contains none of the representations of the key
+func checkRedacted(t *testing.T, text string, key []byte) {
+	for _, secret := range []string{
+		fmt.Sprintf("%v", key)[1:20], // the decimal bytes, as printed by %v
+		hex.EncodeToString(key),
+		fmt.Sprintf("%X", key),
+		fmt.Sprintf("%q", key)[1:10],
+		fmt.Sprintf("%#v", key)[8:30],
+		strings.TrimRight(base32.StdEncoding.EncodeToString(key), "="),
+	} {
+		if strings.Contains(text, secret) {
+			t.Errorf("The key has been printed: %s\n", text)
+			return
+		}
+	}
+}
+
+func TestFormatRedacted(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	checkError(t, otp.StartRotation(time.Hour))
+
+	wrapper := struct {
+		Name string
+		Otp  Totp
+		Ptr  *Totp
+	}{"wrapper", *otp, otp}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d"} {
+		for _, value := range []interface{}{otp, *otp, wrapper, []*Totp{otp}} {
+			text := fmt.Sprintf(format, value)
+			checkRedacted(t, text, otp.key)
+			checkRedacted(t, text, otp.nextKey)
+		}
+	}
+
+	if text := fmt.Sprint(otp); !strings.Contains(text, "info@sec51.com") || !strings.Contains(text, redacted) {
+		t.Errorf("Unexpected representation %s\n", text)
+	}
+	if text := fmt.Sprintf("%#v", otp); !strings.HasPrefix(text, "twofactor.Totp{") {
+		t.Errorf("Unexpected Go representation %s\n", text)
+	}
+
+	hotp, err := NewHOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%x"} {
+		checkRedacted(t, fmt.Sprintf(format, hotp), hotp.key)
+		checkRedacted(t, fmt.Sprintf(format, *hotp), hotp.key)
+	}
+}
+
+func TestLogValueRedacted(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 8)
+	checkError(t, err)
+
+	var buffer bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buffer, nil))
+	logger.Info("enrolled", "otp", otp, "value", *otp)
+	logger.Info("enrolled", slog.Any("otp", otp))
+
+	checkRedacted(t, buffer.String(), otp.key)
+	if !strings.Contains(buffer.String(), `"algorithm":"SHA256"`) || !strings.Contains(buffer.String(), `"key":"REDACTED"`) {
+		t.Errorf("Unexpected log %s\n", buffer.String())
+	}
+}
+
+func TestDestroy(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	checkError(t, otp.StartRotation(time.Hour))
+	key, nextKey := otp.key, otp.nextKey
+
+	otp.Destroy()
+	for _, b := range append(append([]byte{}, key...), nextKey...) {
+		if b != 0 {
+			t.Fatal("The key has not been zeroed")
+		}
+	}
+
+	if _, err := otp.OTP(); err != initializationFailedError {
+		t.Errorf("Expected initializationFailedError, got %v\n", err)
+	}
+	if err := otp.Validate("123456"); err != initializationFailedError {
+		t.Errorf("Expected initializationFailedError, got %v\n", err)
+	}
+	if _, err := otp.ToBytes(); err != initializationFailedError {
+		t.Errorf("Expected initializationFailedError, got %v\n", err)
+	}
+	if _, err := otp.QR(); err != initializationFailedError {
+		t.Errorf("Expected initializationFailedError, got %v\n", err)
+	}
+
+	// the destroyed key is not revealed
+	r := &recorder{}
+	otp.AddObserver(r)
+	if _, err := otp.URL(); err != initializationFailedError {
+		t.Errorf("Expected initializationFailedError, got %v\n", err)
+	}
+	if otp.Secret() != "" || otp.Key() != nil {
+		t.Error("The destroyed key has been returned")
+	}
+	if _, err := otp.RotationSecret(); err != initializationFailedError {
+		t.Errorf("Expected initializationFailedError, got %v\n", err)
+	}
+	r.check(t)
+
+	if !strings.Contains(otp.String(), "destroyed") {
+		t.Errorf("Unexpected representation %s\n", otp)
+	}
+
+	hotp, err := NewHOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	hotp.Destroy()
+	if _, err := hotp.OTP(); err != initializationFailedError {
+		t.Errorf("Expected initializationFailedError, got %v\n", err)
+	}
+}
+
+func TestRotationWipesOldKey(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	checkError(t, otp.StartRotation(time.Hour))
+	key := otp.key
+	nextKey := append([]byte{}, otp.nextKey...)
+
+	otp.promoteNextKey()
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Error("The old key has not been zeroed")
+	}
+	if !bytes.Equal(otp.key, nextKey) {
+		t.Error("The next key has been altered by the promotion")
+	}
+}
+
+func TestDecodeDoesNotAliasPlainText(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	checkError(t, otp.StartRotation(time.Hour))
+
+	plainText, err := encodeTOTP(otp, BytesVersion2)
+	checkError(t, err)
+	decoded, err := decodeTOTP(plainText, BytesVersion2)
+	checkError(t, err)
+
+	// the plain text is wiped after decoding, the decoded keys must survive
+	wipe(plainText)
+	if !bytes.Equal(decoded.key, otp.key) || !bytes.Equal(decoded.nextKey, otp.nextKey) {
+		t.Error("The decoded keys share the plain text buffer")
+	}
+
+	// the wiped HMAC results do not change the codes
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, decoded.Validate(code))
+}
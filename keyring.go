@@ -0,0 +1,168 @@
+package twofactor
+
+import (
+	"bytes"
+	"errors"
+)
+
+// The keyring envelope prefixes the encrypted TOTP bytes with the identifier of the key:
+// Sizes:    4        4       N        N
+// Format: |magic|key_id_size|key_id|encrypted_totp|
+const (
+	keyring_magic       = "2FK1"
+	keyring_header_size = 8 // the magic and the key id size
+)
+
+var (
+	UnknownKeyError = errors.New("The TOTP bytes are encrypted with a key which is not in the keyring.")
+)
+
+// Keyring encrypts the TOTP bytes with the primary key and decrypts them with any of its keys,
+// so that the keys can be rotated without downtime: the new key becomes the primary one, the old key is retired
+// and the TOTPs are re-encrypted with the primary key the next time they are validated, see ValidateAndReseal.
+// The keys are cryptoengine identifiers, like the engineID of ToBytesWith: the key material is managed by the cryptoengine.
+// Once no TOTP is encrypted with a retired key anymore, it can be removed from the keyring.
+type Keyring struct {
+	primary string
+	retired []string
+}
+
+// NewKeyring creates a keyring which encrypts with the primary key and decrypts with the primary or the retired keys
+func NewKeyring(primary string, retired ...string) (*Keyring, error) {
+
+	if primary == "" {
+		return nil, errors.New("The primary key id cannot be empty")
+	}
+
+	for _, id := range retired {
+		if id == "" || id == primary {
+			return nil, errors.New("The retired key ids cannot be empty or the primary key id")
+		}
+	}
+
+	return &Keyring{primary: primary, retired: retired}, nil
+}
+
+// Primary returns the id of the key used to encrypt
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Private function which tells whether the key id is in the keyring
+func (k *Keyring) contains(id string) bool {
+	if id == k.primary {
+		return true
+	}
+	for _, retired := range k.retired {
+		if id == retired {
+			return true
+		}
+	}
+	return false
+}
+
+// Seal serialises the TOTP with BytesVersion2, encrypts it with the primary key and prefixes the key id
+func (k *Keyring) Seal(otp *Totp) ([]byte, error) {
+
+	data, err := otp.ToBytesWith(k.primary, BytesVersion2)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(keyring_magic)
+	writeSizedBytes(&buffer, []byte(k.primary))
+	buffer.Write(data)
+
+	otp.keyring = k
+	otp.keyID = k.primary
+	return buffer.Bytes(), nil
+}
+
+// Open decrypts the TOTP bytes created by Seal with the key they have been encrypted with.
+// The bytes created by ToBytes and ToBytesWith, without the key id, are decrypted trying all the keys of the keyring,
+// the primary one first: this way the existing bytes can be migrated to the keyring.
+// The byte arrays bound to associated data return AssociatedDataError, use OpenBound.
+func (k *Keyring) Open(data []byte) (*Totp, error) {
+	return k.open(data, func(encryptedMessage []byte, id string) (*Totp, error) {
+		otp, _, err := TOTPFromBytesWith(encryptedMessage, id)
+		return otp, err
+	})
+}
+
+// OpenBound decrypts the TOTP bytes like Open, and checks the associated data like TOTPFromBytesBound
+func (k *Keyring) OpenBound(data []byte, associatedData []byte) (*Totp, error) {
+	return k.open(data, func(encryptedMessage []byte, id string) (*Totp, error) {
+		return TOTPFromBytesBound(encryptedMessage, id, associatedData)
+	})
+}
+
+// Private function which finds the key of the TOTP bytes and decrypts them
+func (k *Keyring) open(data []byte, decrypt func([]byte, string) (*Totp, error)) (*Totp, error) {
+
+	var otp *Totp
+	var id string
+	var err error
+
+	if len(data) >= keyring_header_size && string(data[:4]) == keyring_magic {
+		reader := bytes.NewReader(data[4:])
+		keyID, err := readSizedBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		id = string(keyID)
+		if !k.contains(id) {
+			return nil, UnknownKeyError
+		}
+		encryptedMessage := data[len(data)-reader.Len():]
+		if otp, err = decrypt(encryptedMessage, id); err != nil {
+			return nil, err
+		}
+	} else {
+		// the bytes without key id: try all the keys
+		for _, id = range append([]string{k.primary}, k.retired...) {
+			if otp, err = decrypt(data, id); err == nil || err == AssociatedDataError {
+				break
+			}
+		}
+		if err == AssociatedDataError {
+			return nil, err
+		}
+		if err != nil {
+			return nil, UnknownKeyError
+		}
+		// the bytes without key id always need to be sealed again
+		id = ""
+	}
+
+	otp.keyring = k
+	otp.keyID = id
+	return otp, nil
+}
+
+// KeyID returns the id of the key the TOTP has been sealed with, empty if it has not been opened with a keyring
+// or if the bytes had no key id
+func (otp *Totp) KeyID() string {
+	return otp.keyID
+}
+
+// NeedsReencryption tells whether the TOTP opened with a keyring has been encrypted with a retired key,
+// or without key id, and should be sealed again with the primary key
+func (otp *Totp) NeedsReencryption() bool {
+	return otp.keyring != nil && otp.keyID != otp.keyring.primary
+}
+
+// ValidateAndReseal validates the user code like Validate. When the validation succeeds and the TOTP needs
+// to be re-encrypted, it returns the bytes sealed with the primary key, which replace the stored ones.
+// Otherwise the returned bytes are nil. This way the keys are rotated lazily, when the users log in.
+func (otp *Totp) ValidateAndReseal(userCode string) ([]byte, error) {
+
+	if err := otp.Validate(userCode); err != nil {
+		return nil, err
+	}
+
+	if !otp.NeedsReencryption() {
+		return nil, nil
+	}
+	return otp.keyring.Seal(otp)
+}
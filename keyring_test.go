@@ -0,0 +1,122 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	oldKeyring, err := NewKeyring("Sec51-k1")
+	checkError(t, err)
+	data, err := oldKeyring.Seal(otp)
+	checkError(t, err)
+
+	// the key is rotated: k2 becomes the primary key and k1 is retired
+	keyring, err := NewKeyring("Sec51-k2", "Sec51-k1")
+	checkError(t, err)
+
+	loaded, err := keyring.Open(data)
+	checkError(t, err)
+	if loaded.KeyID() != "Sec51-k1" || !loaded.NeedsReencryption() {
+		t.Errorf("Expected the TOTP to need the re-encryption, key id %q\n", loaded.KeyID())
+	}
+
+	// a failed validation does not re-seal
+	resealed, err := loaded.ValidateAndReseal("000000x")
+	if err == nil || resealed != nil {
+		t.Error("The wrong code has re-sealed the TOTP")
+	}
+
+	code, err := otp.OTP()
+	checkError(t, err)
+	resealed, err = loaded.ValidateAndReseal(code)
+	checkError(t, err)
+	if resealed == nil {
+		t.Fatal("The TOTP has not been re-sealed")
+	}
+	if loaded.NeedsReencryption() {
+		t.Error("The re-sealed TOTP still needs the re-encryption")
+	}
+
+	// the retired key can now be removed
+	newKeyring, err := NewKeyring("Sec51-k2")
+	checkError(t, err)
+	restored, err := newKeyring.Open(resealed)
+	checkError(t, err)
+	if restored.KeyID() != "Sec51-k2" || restored.NeedsReencryption() || restored.Secret() != otp.Secret() {
+		t.Error("The re-sealed TOTP has not been restored")
+	}
+
+	// nothing to do for the TOTPs already encrypted with the primary key
+	code, err = otp.OTP()
+	checkError(t, err)
+	resealed, err = restored.ValidateAndReseal(code)
+	checkError(t, err)
+	if resealed != nil {
+		t.Error("The TOTP encrypted with the primary key has been re-sealed")
+	}
+
+	// the old bytes cannot be opened without the retired key
+	if _, err := newKeyring.Open(data); err != UnknownKeyError {
+		t.Errorf("Expected UnknownKeyError, got %v\n", err)
+	}
+}
+
+func TestKeyringLegacyBytes(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	// the bytes created before the keyring, without key id
+	data, err := otp.ToBytesWith("Sec51-k1", BytesVersion1)
+	checkError(t, err)
+
+	keyring, err := NewKeyring("Sec51-k2", "Sec51-k1")
+	checkError(t, err)
+	loaded, err := keyring.Open(data)
+	checkError(t, err)
+	if !loaded.NeedsReencryption() || loaded.Secret() != otp.Secret() {
+		t.Error("The legacy bytes have not been opened")
+	}
+
+	unknown, err := NewKeyring("Sec51-k3")
+	checkError(t, err)
+	if _, err := unknown.Open(data); err != UnknownKeyError {
+		t.Errorf("Expected UnknownKeyError, got %v\n", err)
+	}
+
+	// a TOTP which has not been opened with a keyring never needs the re-encryption
+	if otp.NeedsReencryption() {
+		t.Error("The TOTP without keyring needs the re-encryption")
+	}
+
+	if _, err := NewKeyring("Sec51-k2", "Sec51-k2"); err == nil {
+		t.Error("The primary key has been accepted as retired key")
+	}
+}
+
+func TestKeyringBound(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	_, err = otp.ToBytesBound("Sec51-k1", []byte("user-1"))
+	checkError(t, err)
+
+	keyring, err := NewKeyring("Sec51-k1")
+	checkError(t, err)
+	data, err := keyring.Seal(otp)
+	checkError(t, err)
+
+	if _, err := keyring.Open(data); err != AssociatedDataError {
+		t.Errorf("Expected AssociatedDataError, got %v\n", err)
+	}
+	if _, err := keyring.OpenBound(data, []byte("user-2")); err != AssociatedDataError {
+		t.Errorf("Expected AssociatedDataError, got %v\n", err)
+	}
+	_, err = keyring.OpenBound(data, []byte("user-1"))
+	checkError(t, err)
+}
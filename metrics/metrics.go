@@ -0,0 +1,292 @@
+/*
+Package metrics collects the metrics of the OTP verifications and of the TOTP serializations:
+the validations by outcome, the lock downs, the clock drift of the devices, the time spent in Validate
+and the errors of ToBytes and TOTPFromBytes.
+
+The Collector is an observer of all the TOTPs, it can be exposed to Prometheus or with expvar:
+
+	collector := metrics.New()
+	twofactor.RegisterObserver(collector)
+	prometheus.MustRegister(collector)
+	// or
+	expvar.Publish("twofactor", collector.Expvar())
+
+The labels are only the issuer and the algorithm, the accounts are never used as labels.
+*/
+package metrics
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sec51/twofactor"
+)
+
+const (
+	namespace = "twofactor"
+
+	outcome_success     = "success"
+	outcome_failure     = "failure"
+	outcome_locked_down = "locked_down"
+	outcome_reused      = "reused"
+)
+
+var (
+	driftBuckets    = []float64{-1, 0, 1}
+	durationBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+)
+
+// labels are the labels of all the metrics
+type labels struct {
+	issuer    string
+	algorithm string
+}
+
+// histogram is a cumulative histogram with fixed buckets
+type histogram struct {
+	counts []uint64 // one per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(buckets []float64, value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, bound := range buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// cumulative returns the cumulative counts of the buckets, as expected by Prometheus
+func (h *histogram) cumulative(buckets []float64) map[float64]uint64 {
+	result := make(map[float64]uint64, len(buckets))
+	var total uint64
+	for i, bound := range buckets {
+		if h.counts != nil {
+			total += h.counts[i]
+		}
+		result[bound] = total
+	}
+	return result
+}
+
+// Collector is a twofactor.Observer and a twofactor.BytesObserver which counts the events,
+// and a prometheus.Collector which exposes them
+type Collector struct {
+	twofactor.NopObserver
+
+	mutex        sync.Mutex
+	validations  map[labels]map[string]uint64 // by outcome
+	lockouts     map[labels]uint64
+	drift        map[labels]*histogram
+	duration     map[labels]*histogram
+	encodeErrors map[labels]uint64
+	decodeErrors map[labels]uint64
+
+	validationsDesc  *prometheus.Desc
+	lockoutsDesc     *prometheus.Desc
+	driftDesc        *prometheus.Desc
+	durationDesc     *prometheus.Desc
+	encodeErrorsDesc *prometheus.Desc
+	decodeErrorsDesc *prometheus.Desc
+}
+
+// New creates a collector, which needs to be registered with twofactor.RegisterObserver
+func New() *Collector {
+	variableLabels := []string{"issuer", "algorithm"}
+	return &Collector{
+		validations:  map[labels]map[string]uint64{},
+		lockouts:     map[labels]uint64{},
+		drift:        map[labels]*histogram{},
+		duration:     map[labels]*histogram{},
+		encodeErrors: map[labels]uint64{},
+		decodeErrors: map[labels]uint64{},
+
+		validationsDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "validations_total"),
+			"The OTP validations by outcome: success, failure, locked_down or reused.", append(variableLabels, "outcome"), nil),
+		lockoutsDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "lockouts_total"),
+			"The lock downs after too many failures.", variableLabels, nil),
+		driftDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "drift_steps"),
+			"The offset in time steps of the accepted codes, caused by the clock drift of the devices.", variableLabels, nil),
+		durationDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "validation_duration_seconds"),
+			"The time spent in Validate.", variableLabels, nil),
+		encodeErrorsDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "encode_errors_total"),
+			"The failures of the serialization and encryption of the TOTPs.", variableLabels, nil),
+		decodeErrorsDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "decode_errors_total"),
+			"The failures of the decryption and deserialization of the TOTPs, the algorithm is unknown when the decryption fails.", variableLabels, nil),
+	}
+}
+
+// Private function which counts a validation and its duration
+func (c *Collector) validated(event twofactor.Event, outcome string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	l := labels{event.Issuer, event.Algorithm}
+	if c.validations[l] == nil {
+		c.validations[l] = map[string]uint64{}
+	}
+	c.validations[l][outcome]++
+
+	if c.duration[l] == nil {
+		c.duration[l] = new(histogram)
+	}
+	c.duration[l].observe(durationBuckets, event.Duration.Seconds())
+}
+
+// OnSuccess counts the successful validation and the drift of the device
+func (c *Collector) OnSuccess(event twofactor.Event) {
+	c.validated(event, outcome_success)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	l := labels{event.Issuer, event.Algorithm}
+	if c.drift[l] == nil {
+		c.drift[l] = new(histogram)
+	}
+	c.drift[l].observe(driftBuckets, float64(event.Offset))
+}
+
+// OnFailure counts the failed validation
+func (c *Collector) OnFailure(event twofactor.Event) {
+	if event.Err == twofactor.LockDownError {
+		c.validated(event, outcome_locked_down)
+	} else {
+		c.validated(event, outcome_failure)
+	}
+}
+
+// OnReuse counts the validation of an already used code
+func (c *Collector) OnReuse(event twofactor.Event) {
+	c.validated(event, outcome_reused)
+}
+
+// OnLockout counts the lock down
+func (c *Collector) OnLockout(event twofactor.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lockouts[labels{event.Issuer, event.Algorithm}]++
+}
+
+// OnBytes counts the errors of the serializations and of the deserializations
+func (c *Collector) OnBytes(event twofactor.BytesEvent) {
+	if event.Err == nil {
+		return
+	}
+
+	algorithm := event.Algorithm
+	if algorithm == "" {
+		algorithm = "unknown"
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	l := labels{event.Issuer, algorithm}
+	if event.Operation == "encode" {
+		c.encodeErrors[l]++
+	} else {
+		c.decodeErrors[l]++
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.validationsDesc
+	ch <- c.lockoutsDesc
+	ch <- c.driftDesc
+	ch <- c.durationDesc
+	ch <- c.encodeErrorsDesc
+	ch <- c.decodeErrorsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for l, outcomes := range c.validations {
+		for outcome, count := range outcomes {
+			ch <- prometheus.MustNewConstMetric(c.validationsDesc, prometheus.CounterValue, float64(count), l.issuer, l.algorithm, outcome)
+		}
+	}
+	for l, count := range c.lockouts {
+		ch <- prometheus.MustNewConstMetric(c.lockoutsDesc, prometheus.CounterValue, float64(count), l.issuer, l.algorithm)
+	}
+	for l, h := range c.drift {
+		ch <- prometheus.MustNewConstHistogram(c.driftDesc, h.count, h.sum, h.cumulative(driftBuckets), l.issuer, l.algorithm)
+	}
+	for l, h := range c.duration {
+		ch <- prometheus.MustNewConstHistogram(c.durationDesc, h.count, h.sum, h.cumulative(durationBuckets), l.issuer, l.algorithm)
+	}
+	for l, count := range c.encodeErrors {
+		ch <- prometheus.MustNewConstMetric(c.encodeErrorsDesc, prometheus.CounterValue, float64(count), l.issuer, l.algorithm)
+	}
+	for l, count := range c.decodeErrors {
+		ch <- prometheus.MustNewConstMetric(c.decodeErrorsDesc, prometheus.CounterValue, float64(count), l.issuer, l.algorithm)
+	}
+}
+
+// Expvar returns the metrics as an expvar.Var, for the services without Prometheus.
+// The value is a JSON object with one entry per issuer and algorithm, like "Sec51/SHA1".
+func (c *Collector) Expvar() expvar.Var {
+	return expvar.Func(func() interface{} {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		result := map[string]map[string]interface{}{}
+		entry := func(l labels) map[string]interface{} {
+			name := l.issuer + "/" + l.algorithm
+			if result[name] == nil {
+				result[name] = map[string]interface{}{}
+			}
+			return result[name]
+		}
+
+		for l, outcomes := range c.validations {
+			validations := map[string]uint64{}
+			for outcome, count := range outcomes {
+				validations[outcome] = count
+			}
+			entry(l)["validations"] = validations
+		}
+		for l, count := range c.lockouts {
+			entry(l)["lockouts"] = count
+		}
+		for l, h := range c.drift {
+			drift := map[string]uint64{}
+			for i, bound := range driftBuckets {
+				drift[formatOffset(bound)] = h.counts[i]
+			}
+			entry(l)["drift"] = drift
+		}
+		for l, h := range c.duration {
+			entry(l)["validation_seconds_sum"] = h.sum
+			entry(l)["validation_count"] = h.count
+		}
+		for l, count := range c.encodeErrors {
+			entry(l)["encode_errors"] = count
+		}
+		for l, count := range c.decodeErrors {
+			entry(l)["decode_errors"] = count
+		}
+		return result
+	})
+}
+
+// Private function which formats the drift offset as a key of the expvar object
+func formatOffset(offset float64) string {
+	switch {
+	case offset < 0:
+		return "-1"
+	case offset > 0:
+		return "+1"
+	}
+	return "0"
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"crypto"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sec51/twofactor"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollector(t *testing.T) {
+
+	collector := New()
+	unregister := twofactor.RegisterObserver(collector)
+	defer unregister()
+
+	registry := prometheus.NewPedanticRegistry()
+	checkError(t, registry.Register(collector))
+
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, otp.Validate(code))
+	if err := otp.Validate("000000"); err == nil {
+		t.Error("The wrong code has been accepted")
+	}
+
+	// the decryption fails with the wrong engine
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	if _, err := twofactor.TOTPFromBytes(data, "Other"); err == nil {
+		t.Error("The bytes have been decrypted with the wrong engine")
+	}
+
+	expected := `
+# HELP twofactor_validations_total The OTP validations by outcome: success, failure, locked_down or reused.
+# TYPE twofactor_validations_total counter
+twofactor_validations_total{algorithm="SHA1",issuer="Sec51",outcome="failure"} 1
+twofactor_validations_total{algorithm="SHA1",issuer="Sec51",outcome="success"} 1
+# HELP twofactor_decode_errors_total The failures of the decryption and deserialization of the TOTPs, the algorithm is unknown when the decryption fails.
+# TYPE twofactor_decode_errors_total counter
+twofactor_decode_errors_total{algorithm="unknown",issuer="Other"} 1
+`
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected), "twofactor_validations_total", "twofactor_decode_errors_total")
+	checkError(t, err)
+
+	// one duration and one drift observation
+	families, err := registry.Gather()
+	checkError(t, err)
+	for _, family := range families {
+		switch family.GetName() {
+		case "twofactor_validation_duration_seconds":
+			if count := family.GetMetric()[0].GetHistogram().GetSampleCount(); count != 2 {
+				t.Errorf("Expected 2 validation durations, got %d\n", count)
+			}
+		case "twofactor_drift_steps":
+			if count := family.GetMetric()[0].GetHistogram().GetSampleCount(); count != 1 {
+				t.Errorf("Expected 1 drift observation, got %d\n", count)
+			}
+		}
+	}
+}
+
+func TestCollectorLockout(t *testing.T) {
+
+	collector := New()
+	unregister := twofactor.RegisterObserver(collector)
+	defer unregister()
+
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 8)
+	checkError(t, err)
+
+	// the lock down is reached after 3 failures, the next validation is locked down
+	for i := 0; i < 4; i++ {
+		otp.Validate("00000000")
+	}
+
+	l := labels{"Sec51", "SHA256"}
+	if count := collector.lockouts[l]; count != 1 {
+		t.Errorf("Expected 1 lock down, got %d\n", count)
+	}
+	if count := collector.validations[l][outcome_locked_down]; count != 1 {
+		t.Errorf("Expected 1 locked down validation, got %d\n", count)
+	}
+	if count := collector.validations[l][outcome_failure]; count != 3 {
+		t.Errorf("Expected 3 failed validations, got %d\n", count)
+	}
+}
+
+func TestExpvar(t *testing.T) {
+
+	collector := New()
+	unregister := twofactor.RegisterObserver(collector)
+	defer unregister()
+
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA512, 6)
+	checkError(t, err)
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, otp.Validate(code))
+
+	var values map[string]struct {
+		Validations map[string]uint64 `json:"validations"`
+		Drift       map[string]uint64 `json:"drift"`
+	}
+	checkError(t, json.Unmarshal([]byte(collector.Expvar().String()), &values))
+
+	entry, ok := values["Sec51/SHA512"]
+	if !ok {
+		t.Fatalf("The expvar value has no entry for the issuer and the algorithm: %v\n", values)
+	}
+	if entry.Validations[outcome_success] != 1 {
+		t.Errorf("Expected 1 successful validation, got %d\n", entry.Validations[outcome_success])
+	}
+	if entry.Drift["0"] != 1 {
+		t.Errorf("Expected 1 validation without drift, got %d\n", entry.Drift["0"])
+	}
+}
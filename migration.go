@@ -0,0 +1,367 @@
+package twofactor
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+const (
+	migration_scheme             = "otpauth-migration"
+	migration_host               = "offline"
+	migration_version            = 1
+	migration_entries_per_batch  = 10 // the default amount of entries per QR code, it keeps the QR codes easy to scan
+	migration_time_steps         = 30 // Google Authenticator does not transfer the period
+	migration_max_batch_identity = 1 << 31
+)
+
+// protobuf enum values of the MigrationPayload message
+const (
+	migration_algorithm_unspecified = 0
+	migration_algorithm_sha1        = 1
+	migration_algorithm_sha256      = 2
+	migration_algorithm_sha512      = 3
+	migration_digits_unspecified    = 0
+	migration_digits_six            = 1
+	migration_digits_eight          = 2
+	migration_type_hotp             = 1
+	migration_type_totp             = 2
+)
+
+var (
+	MigrationURLError = errors.New("The URL is not a valid otpauth-migration URL.")
+)
+
+// MigrationEntry is an account transferred with the Google Authenticator bulk export.
+// Exactly one of Totp and Hotp is set.
+type MigrationEntry struct {
+	Totp *Totp
+	Hotp *Hotp
+}
+
+// MigrationBatch is the content of a single otpauth-migration QR code.
+// Large exports are split across several batches, which share the same BatchId.
+type MigrationBatch struct {
+	Entries    []MigrationEntry
+	Version    int // the version of the payload
+	BatchSize  int // the total amount of batches of the export
+	BatchIndex int // the position of this batch in the export, starting from 0
+	BatchId    int // the identifier shared by all the batches of the same export
+}
+
+// NewMigrationBatches splits the entries in batches of at most entriesPerBatch entries, ready to be
+// displayed as QR codes and scanned by Google Authenticator.
+// When entriesPerBatch is 0 or negative, 10 entries per batch are used.
+// Google Authenticator supports only 6 or 8 digits and a 30 seconds period, the entries which
+// cannot be represented return an error instead of being silently changed.
+func NewMigrationBatches(entries []MigrationEntry, entriesPerBatch int) ([]*MigrationBatch, error) {
+
+	if entriesPerBatch <= 0 {
+		entriesPerBatch = migration_entries_per_batch
+	}
+
+	// make sure all the entries can be exported before creating the batches
+	for _, entry := range entries {
+		if _, err := entry.parameters(); err != nil {
+			return nil, err
+		}
+	}
+
+	batchId, err := rand.Int(rand.Reader, big.NewInt(migration_max_batch_identity))
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize := (len(entries) + entriesPerBatch - 1) / entriesPerBatch
+	batches := make([]*MigrationBatch, 0, batchSize)
+	for start := 0; start < len(entries); start += entriesPerBatch {
+		end := start + entriesPerBatch
+		if end > len(entries) {
+			end = len(entries)
+		}
+		batches = append(batches, &MigrationBatch{
+			Entries:    entries[start:end],
+			Version:    migration_version,
+			BatchSize:  batchSize,
+			BatchIndex: len(batches),
+			BatchId:    int(batchId.Int64()),
+		})
+	}
+
+	return batches, nil
+}
+
+// ParseMigrationURL decodes an otpauth-migration://offline?data=... URL, as exported by Google Authenticator.
+// The accounts are converted in Totp and Hotp objects.
+func ParseMigrationURL(rawurl string) (*MigrationBatch, error) {
+
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != migration_scheme || u.Host != migration_host {
+		return nil, MigrationURLError
+	}
+
+	// some QR code scanners do not escape the base64 plus sign, which is then decoded as a space
+	data := strings.Replace(u.Query().Get("data"), " ", "+", -1)
+	if data == "" {
+		return nil, MigrationURLError
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		if payload, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "=")); err != nil {
+			return nil, MigrationURLError
+		}
+	}
+
+	return decodeMigrationPayload(payload)
+}
+
+// URL returns the otpauth-migration URL of the batch
+func (batch *MigrationBatch) URL() (string, error) {
+
+	payload, err := batch.encode()
+	if err != nil {
+		return "", err
+	}
+
+	u := url.URL{}
+	v := url.Values{}
+	u.Scheme = migration_scheme
+	u.Host = migration_host
+	v.Add("data", base64.StdEncoding.EncodeToString(payload))
+	u.RawQuery = v.Encode()
+	return u.String(), nil
+}
+
+// QR generates a byte array containing the QR code encoded PNG image of the batch URL.
+// The QR code contains the secret keys of all the entries of the batch,
+// therefore it needs the same precautions of the Totp QR code.
+func (batch *MigrationBatch) QR() ([]byte, error) {
+
+	u, err := batch.URL()
+	if err != nil {
+		return nil, err
+	}
+	return encodeQR(u)
+}
+
+// QRCode returns the QR code of the batch URL with the given options.
+// The same precautions of QR() apply.
+func (batch *MigrationBatch) QRCode(options QROptions) (*QRCode, error) {
+
+	u, err := batch.URL()
+	if err != nil {
+		return nil, err
+	}
+	return NewQRCode(u, options)
+}
+
+// migrationParameters is the OtpParameters message of the MigrationPayload
+type migrationParameters struct {
+	secret    []byte
+	name      string
+	issuer    string
+	algorithm uint64
+	digits    uint64
+	otpType   uint64
+	counter   uint64
+}
+
+// parameters converts the entry in its protobuf representation
+func (entry MigrationEntry) parameters() (*migrationParameters, error) {
+
+	var key []byte
+	var account, issuer string
+	var hashFunction crypto.Hash
+	var digits int
+	p := new(migrationParameters)
+
+	switch {
+	case entry.Totp != nil:
+		otp := entry.Totp
+		if err := totpHasBeenInitialized(otp); err != nil {
+			return nil, err
+		}
+		if otp.stepSize != migration_time_steps {
+			return nil, errors.New(fmt.Sprintf("The TOTP of %s has a %d seconds period, Google Authenticator supports only %d seconds", otp.account, otp.stepSize, migration_time_steps))
+		}
+		key, account, issuer, hashFunction, digits = otp.key, otp.account, otp.issuer, otp.hashFunction, otp.digits
+		p.otpType = migration_type_totp
+	case entry.Hotp != nil:
+		otp := entry.Hotp
+		if err := hotpHasBeenInitialized(otp); err != nil {
+			return nil, err
+		}
+		key, account, issuer, hashFunction, digits = otp.key, otp.account, otp.issuer, otp.hashFunction, otp.digits
+		p.otpType = migration_type_hotp
+		p.counter = otp.Counter()
+	default:
+		return nil, initializationFailedError
+	}
+
+	switch hashFunction {
+	case crypto.SHA256:
+		p.algorithm = migration_algorithm_sha256
+	case crypto.SHA512:
+		p.algorithm = migration_algorithm_sha512
+	default:
+		p.algorithm = migration_algorithm_sha1
+	}
+
+	switch digits {
+	case 6:
+		p.digits = migration_digits_six
+	case 8:
+		p.digits = migration_digits_eight
+	default:
+		return nil, errors.New(fmt.Sprintf("The OTP of %s has %d digits, Google Authenticator supports only 6 or 8 digits", account, digits))
+	}
+
+	p.secret = key
+	p.name = account
+	p.issuer = issuer
+	return p, nil
+}
+
+// entry converts the protobuf representation in a Totp or Hotp object
+func (p *migrationParameters) entry() (MigrationEntry, error) {
+
+	entry := MigrationEntry{}
+
+	if len(p.secret) == 0 {
+		return entry, errors.New("The otpauth-migration entry has no secret")
+	}
+
+	var hashFunction crypto.Hash
+	switch p.algorithm {
+	case migration_algorithm_unspecified, migration_algorithm_sha1:
+		hashFunction = crypto.SHA1
+	case migration_algorithm_sha256:
+		hashFunction = crypto.SHA256
+	case migration_algorithm_sha512:
+		hashFunction = crypto.SHA512
+	default:
+		return entry, errors.New(fmt.Sprintf("Unsupported otpauth-migration algorithm %d", p.algorithm))
+	}
+
+	var digits int
+	switch p.digits {
+	case migration_digits_unspecified, migration_digits_six:
+		digits = 6
+	case migration_digits_eight:
+		digits = 8
+	default:
+		return entry, errors.New(fmt.Sprintf("Unsupported otpauth-migration digits %d", p.digits))
+	}
+
+	// the name may be the full issuer:account label
+	account := p.name
+	if i := strings.Index(account, ":"); i >= 0 && (p.issuer == "" || account[:i] == p.issuer) {
+		if p.issuer == "" {
+			p.issuer = account[:i]
+		}
+		account = strings.TrimSpace(account[i+1:])
+	}
+
+	var err error
+	switch p.otpType {
+	case migration_type_hotp:
+		entry.Hotp, err = makeHOTP(p.secret, account, p.issuer, hashFunction, digits, p.counter)
+	case migration_type_totp:
+		entry.Totp, err = makeTOTP(p.secret, account, p.issuer, hashFunction, digits)
+	default:
+		err = errors.New(fmt.Sprintf("Unsupported otpauth-migration OTP type %d", p.otpType))
+	}
+	return entry, err
+}
+
+// encode returns the protobuf encoded MigrationPayload message
+func (batch *MigrationBatch) encode() ([]byte, error) {
+
+	var payload protoBuffer
+	for _, entry := range batch.Entries {
+		p, err := entry.parameters()
+		if err != nil {
+			return nil, err
+		}
+
+		var parameters protoBuffer
+		parameters.writeBytes(1, p.secret)
+		parameters.writeBytes(2, []byte(p.name))
+		parameters.writeBytes(3, []byte(p.issuer))
+		parameters.writeVarint(4, p.algorithm)
+		parameters.writeVarint(5, p.digits)
+		parameters.writeVarint(6, p.otpType)
+		parameters.writeVarint(7, p.counter)
+
+		payload.writeBytes(1, parameters)
+	}
+	payload.writeVarint(2, uint64(batch.Version))
+	payload.writeVarint(3, uint64(batch.BatchSize))
+	payload.writeVarint(4, uint64(batch.BatchIndex))
+	payload.writeVarint(5, uint64(batch.BatchId))
+
+	return payload, nil
+}
+
+// decodeMigrationPayload parses the protobuf encoded MigrationPayload message
+func decodeMigrationPayload(data []byte) (*MigrationBatch, error) {
+
+	batch := new(MigrationBatch)
+	err := readProtoFields(data, func(field int, value uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			p := new(migrationParameters)
+			err := readProtoFields(bytes, func(field int, value uint64, bytes []byte) error {
+				switch field {
+				case 1:
+					p.secret = bytes
+				case 2:
+					p.name = string(bytes)
+				case 3:
+					p.issuer = string(bytes)
+				case 4:
+					p.algorithm = value
+				case 5:
+					p.digits = value
+				case 6:
+					p.otpType = value
+				case 7:
+					p.counter = value
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			entry, err := p.entry()
+			if err != nil {
+				return err
+			}
+			batch.Entries = append(batch.Entries, entry)
+		case 2:
+			batch.Version = int(int32(value))
+		case 3:
+			batch.BatchSize = int(int32(value))
+		case 4:
+			batch.BatchIndex = int(int32(value))
+		case 5:
+			batch.BatchId = int(int32(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
@@ -0,0 +1,143 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// secret JBSWY3DPEHPK3PXP, name Example:alice@google.com, issuer Example, TOTP
+var migrationURL = "otpauth-migration://offline?data=CjEKCkhlbGxvId6tvu8SGEV4YW1wbGU6YWxpY2VAZ29vZ2xlLmNvbRoHRXhhbXBsZTAC"
+
+func TestParseMigrationURL(t *testing.T) {
+
+	batch, err := ParseMigrationURL(migrationURL)
+	checkError(t, err)
+
+	if len(batch.Entries) != 1 {
+		t.Fatalf("Expected 1 entry, instead we've got %d\n", len(batch.Entries))
+	}
+
+	otp := batch.Entries[0].Totp
+	if otp == nil {
+		t.Fatal("Expected a TOTP entry")
+	}
+
+	if otp.Secret() != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Secret mismatch, got %s\n", otp.Secret())
+	}
+	if otp.issuer != "Example" || otp.account != "alice@google.com" {
+		t.Errorf("Issuer or account mismatch: %s %s\n", otp.issuer, otp.account)
+	}
+	if otp.digits != 6 || otp.hashFunction != crypto.SHA1 || otp.stepSize != 30 {
+		t.Errorf("Parameters mismatch: %d digits, %d seconds\n", otp.digits, otp.stepSize)
+	}
+
+	invalid := []string{
+		"otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP",
+		"otpauth-migration://online?data=CjEKCkhlbGxvId6tvu8SGEV4YW1wbGU6YWxpY2VAZ29vZ2xlLmNvbRoHRXhhbXBsZTAC",
+		"otpauth-migration://offline",
+		"otpauth-migration://offline?data=!!!",
+		"otpauth-migration://offline?data=CjEKCkhl",
+	}
+	for _, u := range invalid {
+		if _, err := ParseMigrationURL(u); err == nil {
+			t.Errorf("The invalid URL %s has been accepted\n", u)
+		}
+	}
+
+}
+
+func TestMigrationBatches(t *testing.T) {
+
+	var entries []MigrationEntry
+	for i := 0; i < 25; i++ {
+		account := fmt.Sprintf("user%d@sec51.com", i)
+		if i%5 == 0 {
+			otp, err := NewHOTP(account, "Sec51", crypto.SHA256, 8)
+			checkError(t, err)
+			otp.counter[7] = byte(i)
+			entries = append(entries, MigrationEntry{Hotp: otp})
+		} else {
+			otp, err := NewTOTP(account, "Sec51", crypto.SHA1, 6)
+			checkError(t, err)
+			entries = append(entries, MigrationEntry{Totp: otp})
+		}
+	}
+
+	batches, err := NewMigrationBatches(entries, 0)
+	checkError(t, err)
+
+	if len(batches) != 3 {
+		t.Fatalf("Expected 3 batches, instead we've got %d\n", len(batches))
+	}
+
+	var restored []MigrationEntry
+	for index, batch := range batches {
+		u, err := batch.URL()
+		checkError(t, err)
+
+		if !strings.HasPrefix(u, "otpauth-migration://offline?data=") {
+			t.Errorf("Unexpected migration URL %s\n", u)
+		}
+
+		code, err := batch.QR()
+		checkError(t, err)
+		if !bytes.HasPrefix(code, []byte("\x89PNG")) {
+			t.Error("The migration QR code is not a PNG image")
+		}
+
+		// some scanners do not escape the plus signs of the base64 data
+		parsed, err := ParseMigrationURL(strings.Replace(u, "%2B", "+", -1))
+		checkError(t, err)
+
+		if parsed.BatchIndex != index || parsed.BatchSize != 3 || parsed.BatchId != batches[0].BatchId || parsed.Version != 1 {
+			t.Errorf("Batch metadata mismatch: %+v\n", parsed)
+		}
+		restored = append(restored, parsed.Entries...)
+	}
+
+	if len(restored) != len(entries) {
+		t.Fatalf("Expected %d entries, instead we've got %d\n", len(entries), len(restored))
+	}
+
+	for i, entry := range entries {
+		if entry.Hotp != nil {
+			otp := restored[i].Hotp
+			if otp == nil || !bytes.Equal(otp.key, entry.Hotp.key) || otp.Counter() != entry.Hotp.Counter() ||
+				otp.digits != 8 || otp.hashFunction != crypto.SHA256 || otp.account != entry.Hotp.account {
+				t.Errorf("HOTP entry %d differs after the migration\n", i)
+			}
+			continue
+		}
+		otp := restored[i].Totp
+		if otp == nil || !bytes.Equal(otp.key, entry.Totp.key) || otp.label() != entry.Totp.label() ||
+			otp.digits != 6 || otp.hashFunction != crypto.SHA1 {
+			t.Errorf("TOTP entry %d differs after the migration\n", i)
+		}
+	}
+
+}
+
+func TestMigrationUnsupportedEntries(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 7)
+	checkError(t, err)
+	if _, err := NewMigrationBatches([]MigrationEntry{{Totp: otp}}, 1); err == nil {
+		t.Error("A 7 digits TOTP has been exported")
+	}
+
+	otp, err = NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	otp.stepSize = 60
+	if _, err := NewMigrationBatches([]MigrationEntry{{Totp: otp}}, 1); err == nil {
+		t.Error("A TOTP with a 60 seconds period has been exported")
+	}
+
+	if _, err := NewMigrationBatches([]MigrationEntry{{}}, 1); err == nil {
+		t.Error("An empty entry has been exported")
+	}
+
+}
@@ -0,0 +1,293 @@
+package twofactor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+// Event describes the outcome of a verification, without the code or the secret key
+type Event struct {
+	Account   string
+	Issuer    string
+	Algorithm string        // SHA1, SHA256 or SHA512
+	Time      time.Time     // UTC
+	Duration  time.Duration // the time spent in Validate until the event
+	Offset    int           // the offset of the matching time step: OnSuccess and OnResync
+	Failures  int           // the verification failures after the event
+	Err       error         // the reason of the failure: OnFailure
+	Operation string        // the method which revealed the secret key: OnReveal, start or confirm: OnEnroll
+}
+
+// BytesEvent describes the outcome of a serialization or of a deserialization of a TOTP, without the secret key
+type BytesEvent struct {
+	Operation string        // encode (ToBytes) or decode (TOTPFromBytes)
+	Issuer    string        // the cryptoengine identifier, the issuer unless ToBytesWith was used
+	Algorithm string        // SHA1, SHA256 or SHA512, empty when the bytes cannot be decrypted
+	Version   int           // the format version, 0 when the bytes cannot be decrypted
+	Duration  time.Duration // the time spent, including the encryption or the decryption
+	Err       error
+}
+
+// BytesObserver is an optional interface of the observers registered with RegisterObserver,
+// which are then notified of the serializations and of the deserializations of all the TOTPs
+type BytesObserver interface {
+	OnBytes(event BytesEvent)
+}
+
+// Observer is notified of the outcomes of Validate, for instance to alert the user about a lock down
+// or to feed a SIEM. The methods are called synchronously by Validate, they should return quickly.
+// Embed NopObserver to implement only some of the methods.
+type Observer interface {
+	OnSuccess(event Event) // a code has been accepted
+	OnFailure(event Event) // a code has been refused, including during the lock down
+	OnLockout(event Event) // the failures have reached the limit, the verification is locked down
+	OnUnlock(event Event)  // the lock down has ended, after the backoff time or with ResetLockDown
+	OnResync(event Event)  // the code of the previous or the next time step has been accepted: the client clock drifts
+	OnReuse(event Event)   // an already used code has been refused, see SetStateBackend
+}
+
+// LifecycleObserver is an optional interface of the observers, which are then notified of the enrollments,
+// of the secret key reveals and of the resets, for instance to keep an audit trail
+type LifecycleObserver interface {
+	OnEnroll(event Event) // an enrollment has started (NewEnrollment) or has been confirmed (Enrollment.Confirm)
+	OnReveal(event Event) // the secret key has been returned by Secret, URL, QR, QRCode, their Rotation variants or Key (Export)
+	OnReset(event Event)  // the verification failures have been cleared by ResetLockDown
+}
+
+// NopObserver implements all the methods of Observer and LifecycleObserver doing nothing
+type NopObserver struct{}
+
+func (NopObserver) OnSuccess(event Event) {}
+func (NopObserver) OnFailure(event Event) {}
+func (NopObserver) OnLockout(event Event) {}
+func (NopObserver) OnUnlock(event Event)  {}
+func (NopObserver) OnResync(event Event)  {}
+func (NopObserver) OnReuse(event Event)   {}
+func (NopObserver) OnEnroll(event Event)  {}
+func (NopObserver) OnReveal(event Event)  {}
+func (NopObserver) OnReset(event Event)   {}
+
+var (
+	observersMutex  sync.RWMutex
+	globalObservers []*Observer // pointers, so that the same observer can be registered twice and unregistered once
+)
+
+// RegisterObserver registers an observer of all the TOTPs, it returns the function which unregisters it
+func RegisterObserver(observer Observer) func() {
+	observersMutex.Lock()
+	defer observersMutex.Unlock()
+
+	registration := &observer
+	globalObservers = append(globalObservers, registration)
+
+	return func() {
+		observersMutex.Lock()
+		defer observersMutex.Unlock()
+		for i, o := range globalObservers {
+			if o == registration {
+				globalObservers = append(globalObservers[:i:i], globalObservers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// AddObserver registers an observer of this TOTP only, in addition to the global ones.
+// The observers are not serialized, they need to be added after TOTPFromBytes.
+func (otp *Totp) AddObserver(observer Observer) {
+	otp.observers = append(otp.observers, observer)
+}
+
+// RemoveObserver unregisters an observer added by AddObserver
+func (otp *Totp) RemoveObserver(observer Observer) {
+	for i, o := range otp.observers {
+		if o == observer {
+			otp.observers = append(otp.observers[:i:i], otp.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Private function which notifies the global and the TOTP observers
+func (otp *Totp) notify(notification func(Observer, Event), offset int, err error) {
+	otp.notifyFailures(notification, offset, otp.totalVerificationFailures, err)
+}
+
+// Private function which notifies the observers with the given amount of failures, which may come from the StateBackend
+func (otp *Totp) notifyFailures(notification func(Observer, Event), offset, failures int, err error) {
+	otp.notifyEvent(notification, offset, failures, err, "")
+}
+
+// Private function which notifies the observers implementing LifecycleObserver
+func (otp *Totp) notifyLifecycle(notification func(LifecycleObserver, Event), operation string) {
+	otp.notifyEvent(lifecycleNotification(notification), 0, otp.totalVerificationFailures, nil, operation)
+}
+
+// Private function which builds the event and notifies the global and the TOTP observers
+func (otp *Totp) notifyEvent(notification func(Observer, Event), offset, failures int, err error, operation string) {
+
+	event := Event{
+		Account:   otp.account,
+		Issuer:    otp.issuer,
+		Algorithm: hashFunctionName(otp.hashFunction),
+		Offset:    offset,
+		Failures:  failures,
+		Err:       err,
+		Operation: operation,
+	}
+	if !otp.validationStart.IsZero() {
+		event.Duration = time.Since(otp.validationStart)
+	}
+	notifyObservers(otp.observers, notification, event)
+}
+
+// Private function which notifies the global observers and the given ones, with the time of the event
+func notifyObservers(local []Observer, notification func(Observer, Event), event Event) {
+
+	observersMutex.RLock()
+	observers := make([]Observer, 0, len(globalObservers)+len(local))
+	for _, o := range globalObservers {
+		observers = append(observers, *o)
+	}
+	observersMutex.RUnlock()
+	observers = append(observers, local...)
+
+	if len(observers) == 0 {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	for _, o := range observers {
+		notification(o, event)
+	}
+}
+
+// Private function which wraps a LifecycleObserver notification, the other observers are skipped
+func lifecycleNotification(notification func(LifecycleObserver, Event)) func(Observer, Event) {
+	return func(o Observer, event Event) {
+		if lifecycleObserver, ok := o.(LifecycleObserver); ok {
+			notification(lifecycleObserver, event)
+		}
+	}
+}
+
+// Private function which notifies the global observers implementing BytesObserver
+// The observers are called after releasing the lock, so that they can register or remove observers.
+func notifyBytes(event BytesEvent) {
+	observersMutex.RLock()
+	var observers []BytesObserver
+	for _, o := range globalObservers {
+		if bytesObserver, ok := (*o).(BytesObserver); ok {
+			observers = append(observers, bytesObserver)
+		}
+	}
+	observersMutex.RUnlock()
+
+	for _, o := range observers {
+		o.OnBytes(event)
+	}
+}
+
+// Private function which completes a successful verification: it re-synchronizes the counter and notifies the observers
+func (otp *Totp) succeeded(offset int) error {
+	if offset != 0 {
+		otp.synchronizeCounter(offset)
+		otp.notify(Observer.OnResync, offset, nil)
+	}
+	otp.notify(Observer.OnSuccess, offset, nil)
+	return nil
+}
+
+// Private function which notifies a failed verification, and the lock down when the failures reach the limit
+func (otp *Totp) failed(failures int, err error) error {
+	otp.notifyFailures(Observer.OnFailure, 0, failures, err)
+	if failures == max_failures {
+		otp.notifyFailures(Observer.OnLockout, 0, failures, err)
+	}
+	return err
+}
+
+// AddObserver registers an observer of this HOTP only, in addition to the global ones.
+// The observers are not serialized, they need to be added after HOTPFromBytes.
+func (otp *Hotp) AddObserver(observer Observer) {
+	otp.observers = append(otp.observers, observer)
+}
+
+// Private function which builds the event and notifies the global and the HOTP observers
+func (otp *Hotp) notifyEvent(notification func(Observer, Event), offset, failures int, err error, operation string) {
+	notifyObservers(otp.observers, notification, Event{
+		Account:   otp.account,
+		Issuer:    otp.issuer,
+		Algorithm: hashFunctionName(otp.hashFunction),
+		Offset:    offset,
+		Failures:  failures,
+		Err:       err,
+		Operation: operation,
+	})
+}
+
+// Private function which notifies the observers implementing LifecycleObserver
+func (otp *Hotp) notifyLifecycle(notification func(LifecycleObserver, Event), operation string) {
+	otp.notifyEvent(lifecycleNotification(notification), 0, otp.totalVerificationFailures, nil, operation)
+}
+
+// Private function which completes a successful verification: it moves the counter past the matching one
+// and notifies the observers, the offset is the distance of the matching counter in the look ahead window
+func (otp *Hotp) succeeded(counter uint64) error {
+	offset := int(counter - otp.Counter())
+	otp.counter = bigendian.ToUint64(counter + 1)
+	if offset != 0 {
+		otp.notifyEvent(Observer.OnResync, offset, otp.totalVerificationFailures, nil, "")
+	}
+	otp.notifyEvent(Observer.OnSuccess, offset, otp.totalVerificationFailures, nil, "")
+	return nil
+}
+
+// Private function which notifies a failed verification, and the lock down when the failures reach the limit
+func (otp *Hotp) failed(failures int, err error) error {
+	otp.notifyEvent(Observer.OnFailure, 0, failures, err, "")
+	if failures == max_failures {
+		otp.notifyEvent(Observer.OnLockout, 0, failures, err, "")
+	}
+	return err
+}
+
+// AddObserver registers an observer of the devices, in addition to the global ones: it is notified
+// of the failures of the account and of the events of all its devices, including those added later.
+// The observers are not serialized, they need to be added after DevicesFromBytes.
+func (d *Devices) AddObserver(observer Observer) {
+	d.observers = append(d.observers, observer)
+	for _, dev := range d.devices {
+		dev.addObserver(observer)
+	}
+}
+
+// Private function which registers the observer on the TOTP or on the HOTP of the device
+func (dev *device) addObserver(observer Observer) {
+	if dev.totp != nil {
+		dev.totp.AddObserver(observer)
+	} else {
+		dev.hotp.AddObserver(observer)
+	}
+}
+
+// Private function which notifies the global and the devices observers of a verification which matched no device
+func (d *Devices) notifyEvent(notification func(Observer, Event), err error) {
+	notifyObservers(d.observers, notification, Event{
+		Account:  d.account,
+		Issuer:   d.issuer,
+		Failures: d.totalVerificationFailures,
+		Err:      err,
+	})
+}
+
+// Private function which notifies a failed verification, and the lock down when the failures reach the limit
+func (d *Devices) failed(err error) error {
+	d.notifyEvent(Observer.OnFailure, err)
+	if d.totalVerificationFailures == max_failures {
+		d.notifyEvent(Observer.OnLockout, err)
+	}
+	return err
+}
@@ -0,0 +1,318 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+	"time"
+)
+
+// recorder is an observer which records the names of the events
+type recorder struct {
+	events []string
+	last   Event
+}
+
+func (r *recorder) record(name string, event Event) {
+	r.events = append(r.events, name)
+	r.last = event
+}
+
+func (r *recorder) OnSuccess(event Event) { r.record("success", event) }
+func (r *recorder) OnFailure(event Event) { r.record("failure", event) }
+func (r *recorder) OnLockout(event Event) { r.record("lockout", event) }
+func (r *recorder) OnUnlock(event Event)  { r.record("unlock", event) }
+func (r *recorder) OnResync(event Event)  { r.record("resync", event) }
+func (r *recorder) OnReuse(event Event)   { r.record("reuse", event) }
+func (r *recorder) OnEnroll(event Event)  { r.record("enroll "+event.Operation, event) }
+func (r *recorder) OnReveal(event Event)  { r.record("reveal "+event.Operation, event) }
+func (r *recorder) OnReset(event Event)   { r.record("reset", event) }
+
+func (r *recorder) check(t *testing.T, expected ...string) {
+	if len(r.events) != len(expected) {
+		t.Errorf("Expected the events %v, got %v\n", expected, r.events)
+	} else {
+		for i := range expected {
+			if r.events[i] != expected[i] {
+				t.Errorf("Expected the events %v, got %v\n", expected, r.events)
+				break
+			}
+		}
+	}
+	r.events = nil
+}
+
+func TestObserver(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	r := &recorder{}
+	otp.AddObserver(r)
+
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, otp.Validate(code))
+	r.check(t, "success")
+	if r.last.Account != "info@sec51.com" || r.last.Issuer != "Sec51" || r.last.Offset != 0 {
+		t.Errorf("Unexpected event %+v\n", r.last)
+	}
+
+	// the code of the next time step
+	code, err = otp.OTPAt(time.Now().Add(time.Duration(otp.stepSize) * time.Second))
+	checkError(t, err)
+	checkError(t, otp.Validate(code))
+	r.check(t, "resync", "success")
+	if r.last.Offset != 1 {
+		t.Errorf("Expected the offset 1, got %d\n", r.last.Offset)
+	}
+
+	for i := 0; i < max_failures; i++ {
+		otp.Validate("000000x")
+	}
+	r.check(t, "failure", "failure", "failure", "lockout")
+	if r.last.Failures != max_failures || r.last.Err == nil {
+		t.Errorf("Unexpected lockout event %+v\n", r.last)
+	}
+
+	if err := otp.Validate(code); err != LockDownError {
+		t.Errorf("Expected LockDownError, got %v\n", err)
+	}
+	r.check(t, "failure")
+	if r.last.Err != LockDownError {
+		t.Errorf("Expected LockDownError in the event, got %v\n", r.last.Err)
+	}
+
+	// the backoff time has passed
+	otp.lastVerificationTime = time.Now().UTC().Add(-backoff_minutes*time.Minute - time.Second)
+	otp.Validate("000000x")
+	r.check(t, "unlock", "failure")
+
+	otp.Validate("000000x")
+	otp.Validate("000000x")
+	r.check(t, "failure", "failure", "lockout")
+	otp.ResetLockDown()
+	r.check(t, "reset", "unlock")
+	otp.ResetLockDown()
+	r.check(t, "reset")
+}
+
+func TestRemoveObserver(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	first, second := &recorder{}, &recorder{}
+	otp.AddObserver(first)
+	otp.AddObserver(second)
+	otp.RemoveObserver(first)
+
+	otp.Validate("000000x")
+	first.check(t)
+	second.check(t, "failure")
+}
+
+func TestGlobalObserver(t *testing.T) {
+
+	first, second := &recorder{}, &recorder{}
+	unregisterFirst := RegisterObserver(first)
+	unregisterSecond := RegisterObserver(second)
+	defer unregisterSecond()
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	otp.Validate("000000x")
+	first.check(t, "failure")
+	second.check(t, "failure")
+
+	unregisterFirst()
+	otp.Validate("000000x")
+	first.check(t)
+	second.check(t, "failure")
+}
+
+// unregisteringObserver removes itself on the first serialization
+type unregisteringObserver struct {
+	NopObserver
+	unregister func()
+	events     int
+}
+
+func (o *unregisteringObserver) OnBytes(event BytesEvent) {
+	o.events++
+	o.unregister()
+}
+
+func TestBytesObserverUnregister(t *testing.T) {
+
+	observer := &unregisteringObserver{}
+	observer.unregister = RegisterObserver(observer)
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	_, err = otp.ToBytes()
+	checkError(t, err)
+	_, err = otp.ToBytes()
+	checkError(t, err)
+
+	if observer.events != 1 {
+		t.Errorf("Expected 1 event before the removal, got %d\n", observer.events)
+	}
+}
+
+func TestObserverReuse(t *testing.T) {
+
+	backend := NewMemoryStateBackend()
+	first, second := newReplicas(t, backend)
+	r := &recorder{}
+	second.AddObserver(NopObserver{})
+	second.AddObserver(r)
+
+	code, err := first.OTP()
+	checkError(t, err)
+	checkError(t, first.Validate(code))
+	if err := second.Validate(code); err != ReplayError {
+		t.Errorf("Expected ReplayError, got %v\n", err)
+	}
+	r.check(t, "reuse")
+
+	for i := 0; i < max_failures; i++ {
+		first.Validate("000000x")
+	}
+	second.Validate(code)
+	r.check(t, "failure")
+	if r.last.Failures != max_failures {
+		t.Errorf("Expected the failures of the backend, got %d\n", r.last.Failures)
+	}
+}
+
+func TestLifecycleObserver(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	r := &recorder{}
+	otp.AddObserver(r)
+
+	enrollment, err := NewEnrollment(otp, EnrollmentOptions{})
+	checkError(t, err)
+	_, err = enrollment.QR()
+	checkError(t, err)
+	_, err = enrollment.Secret()
+	checkError(t, err)
+	r.check(t, "enroll start", "reveal QR", "reveal Secret")
+
+	if err := enrollment.Confirm("000000x"); err == nil {
+		t.Error("The wrong code has confirmed the enrollment")
+	}
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, enrollment.Confirm(code))
+	r.check(t, "failure", "enroll confirm")
+
+	// the key of the active enrollment cannot be revealed again
+	if _, err := otp.URL(); err != EnrollmentActiveError {
+		t.Errorf("Expected EnrollmentActiveError, got %v\n", err)
+	}
+	r.check(t)
+
+	// the internal uses of the URL are not reveals
+	otp, err = NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	otp.AddObserver(r)
+	_, err = otp.URL()
+	checkError(t, err)
+	_, err = otp.QRCode(QROptions{})
+	checkError(t, err)
+	r.check(t, "reveal URL", "reveal QRCode")
+
+	checkError(t, otp.StartRotation(time.Hour))
+	_, err = otp.RotationQR()
+	checkError(t, err)
+	_, err = otp.RotationSecret()
+	checkError(t, err)
+	r.check(t, "reveal RotationQR", "reveal RotationSecret")
+	if r.last.Account != "info@sec51.com" || r.last.Issuer != "Sec51" {
+		t.Errorf("Unexpected event %+v\n", r.last)
+	}
+}
+
+func TestHOTPObserver(t *testing.T) {
+
+	otp, err := NewHOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	r := &recorder{}
+	otp.AddObserver(r)
+
+	code, err := otp.OTPAt(0)
+	checkError(t, err)
+	checkError(t, otp.Validate(code))
+	r.check(t, "success")
+
+	// a code generated ahead on the device
+	code, err = otp.OTPAt(3)
+	checkError(t, err)
+	checkError(t, otp.Validate(code))
+	r.check(t, "resync", "success")
+	if r.last.Offset != 2 || r.last.Account != "info@sec51.com" || r.last.Algorithm != "SHA1" {
+		t.Errorf("Unexpected event %+v\n", r.last)
+	}
+
+	for i := 0; i < max_failures; i++ {
+		otp.Validate("000000x")
+	}
+	r.check(t, "failure", "failure", "failure", "lockout")
+	if err := otp.Validate(code); err != LockDownError {
+		t.Errorf("Expected LockDownError, got %v\n", err)
+	}
+	r.check(t, "failure")
+
+	otp.Secret()
+	_, err = otp.URL()
+	checkError(t, err)
+	_, err = otp.QR()
+	checkError(t, err)
+	_, err = otp.QRCode(QROptions{})
+	checkError(t, err)
+	r.check(t, "reveal Secret", "reveal URL", "reveal QR", "reveal QRCode")
+}
+
+func TestDevicesObserver(t *testing.T) {
+
+	devices, phone, token := newTestDevices(t)
+	r := &recorder{}
+	devices.AddObserver(r)
+
+	code, err := phone.OTP()
+	checkError(t, err)
+	_, err = devices.Validate(code)
+	checkError(t, err)
+	r.check(t, "success")
+
+	code, err = token.OTPAt(1)
+	checkError(t, err)
+	_, err = devices.Validate(code)
+	checkError(t, err)
+	r.check(t, "resync", "success")
+	if r.last.Algorithm != "SHA256" {
+		t.Errorf("Expected the event of the HOTP device, got %+v\n", r.last)
+	}
+
+	// the devices added later are observed as well
+	laptop, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA512, 8)
+	checkError(t, err)
+	checkError(t, devices.AddTOTP("laptop", "Laptop", laptop))
+	code, err = laptop.OTP()
+	checkError(t, err)
+	_, err = devices.Validate(code)
+	checkError(t, err)
+	r.check(t, "success")
+
+	for i := 0; i < max_failures; i++ {
+		devices.Validate("0000000x")
+	}
+	r.check(t, "failure", "failure", "failure", "lockout")
+	if r.last.Account != "info@sec51.com" || r.last.Failures != max_failures {
+		t.Errorf("Unexpected lockout event %+v\n", r.last)
+	}
+	if _, err := devices.Validate(code); err != LockDownError {
+		t.Errorf("Expected LockDownError, got %v\n", err)
+	}
+	r.check(t, "failure")
+}
@@ -0,0 +1,143 @@
+package twofactor
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	KeyURLError = errors.New("The URL is not a valid otpauth key URL.")
+)
+
+// keyURL holds the parameters of an otpauth key URL
+// see https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+type keyURL struct {
+	key          []byte
+	account      string
+	issuer       string
+	hashFunction crypto.Hash
+	digits       int
+	period       int
+	counter      uint64
+}
+
+// TOTPFromURL creates a TOTP object from an otpauth://totp/ key URL, like the ones
+// encoded in the QR codes of the other services.
+// The missing parameters get the Google Authenticator defaults: SHA1, 6 digits and a period of 30 seconds.
+func TOTPFromURL(rawurl string) (*Totp, error) {
+
+	params, err := parseKeyURL(rawurl, "totp")
+	if err != nil {
+		return nil, err
+	}
+
+	otp, err := makeTOTP(params.key, params.account, params.issuer, params.hashFunction, params.digits)
+	if err != nil {
+		return nil, err
+	}
+	otp.stepSize = params.period
+	return otp, nil
+}
+
+// HOTPFromURL creates a HOTP object from an otpauth://hotp/ key URL.
+// The missing parameters get the Google Authenticator defaults: SHA1, 6 digits and counter 0.
+func HOTPFromURL(rawurl string) (*Hotp, error) {
+
+	params, err := parseKeyURL(rawurl, "hotp")
+	if err != nil {
+		return nil, err
+	}
+
+	return makeHOTP(params.key, params.account, params.issuer, params.hashFunction, params.digits, params.counter)
+}
+
+// parseKeyURL parses and validates the key URL of the given type (totp or hotp)
+func parseKeyURL(rawurl string, otpType string) (*keyURL, error) {
+
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "otpauth" || strings.ToLower(u.Host) != otpType {
+		return nil, KeyURLError
+	}
+
+	params := &keyURL{hashFunction: crypto.SHA1, digits: 6, period: 30}
+	values := u.Query()
+
+	// the label is issuer:account or only account
+	label := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(label, ":"); i >= 0 {
+		params.issuer = strings.TrimSpace(label[:i])
+		label = label[i+1:]
+	}
+	params.account = strings.TrimSpace(label)
+
+	// the issuer parameter is preferred to the label prefix
+	if issuer := values.Get("issuer"); issuer != "" {
+		params.issuer = issuer
+	}
+
+	// the secret is base32 encoded, usually without padding
+	if params.key, err = decodeBase32Secret(values.Get("secret")); err != nil {
+		return nil, err
+	}
+
+	if algorithm := values.Get("algorithm"); algorithm != "" {
+		if params.hashFunction, err = hashFunctionFromName(algorithm); err != nil {
+			return nil, err
+		}
+	}
+
+	if digits := values.Get("digits"); digits != "" {
+		if params.digits, err = strconv.Atoi(digits); err != nil || params.digits < 6 || params.digits > 8 {
+			return nil, errors.New(fmt.Sprintf("Unsupported amount of digits %q", digits))
+		}
+	}
+
+	if period := values.Get("period"); period != "" && otpType == "totp" {
+		if params.period, err = strconv.Atoi(period); err != nil || params.period <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid period %q", period))
+		}
+	}
+
+	if counter := values.Get("counter"); counter != "" && otpType == "hotp" {
+		if params.counter, err = strconv.ParseUint(counter, 10, 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid counter %q", counter))
+		}
+	}
+
+	return params, nil
+}
+
+// Private function which returns the key URL name of the hash function
+func hashFunctionName(hashFunction crypto.Hash) string {
+	switch hashFunction {
+	case crypto.SHA256:
+		return "SHA256"
+	case crypto.SHA512:
+		return "SHA512"
+	default:
+		return "SHA1"
+	}
+}
+
+// Private function which returns the hash function of a key URL algorithm name
+// It accepts as well the names prefixed by HMAC- and with a dash, like HMAC-SHA-256
+func hashFunctionFromName(name string) (crypto.Hash, error) {
+	normalized := strings.Replace(strings.TrimPrefix(strings.ToUpper(name), "HMAC-"), "-", "", -1)
+	switch normalized {
+	case "SHA1":
+		return crypto.SHA1, nil
+	case "SHA256":
+		return crypto.SHA256, nil
+	case "SHA512":
+		return crypto.SHA512, nil
+	}
+	return 0, errors.New(fmt.Sprintf("Unsupported algorithm %q", name))
+}
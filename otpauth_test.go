@@ -0,0 +1,77 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+)
+
+func TestTOTPFromURL(t *testing.T) {
+
+	otp, err := TOTPFromURL("otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example")
+	checkError(t, err)
+
+	if otp.Secret() != "JBSWY3DPEHPK3PXP" || otp.issuer != "Example" || otp.account != "alice@google.com" {
+		t.Errorf("Key URL mismatch: %s %s %s\n", otp.Secret(), otp.issuer, otp.account)
+	}
+	if otp.digits != 6 || otp.stepSize != 30 || otp.hashFunction != crypto.SHA1 {
+		t.Errorf("Expected the default parameters, instead we've got %d digits, %d seconds\n", otp.digits, otp.stepSize)
+	}
+
+	// lower case secret without issuer parameter
+	otp, err = TOTPFromURL("otpauth://totp/ACME%20Co:john.doe@email.com?secret=hxdmvjecjjwsrb3hwizr4ifugftmxboz&algorithm=SHA256&digits=8&period=60")
+	checkError(t, err)
+	if otp.issuer != "ACME Co" || otp.account != "john.doe@email.com" || otp.digits != 8 || otp.stepSize != 60 || otp.hashFunction != crypto.SHA256 {
+		t.Errorf("Key URL mismatch: %s %s %d %d\n", otp.issuer, otp.account, otp.digits, otp.stepSize)
+	}
+
+	// round trip
+	original, err := NewTOTP("info@sec51.com", "Sec 51", crypto.SHA512, 7)
+	checkError(t, err)
+	original.stepSize = 45
+	u, err := original.URL()
+	checkError(t, err)
+	otp, err = TOTPFromURL(u)
+	checkError(t, err)
+	if !bytes.Equal(otp.key, original.key) || otp.label() != original.label() || otp.digits != 7 ||
+		otp.stepSize != 45 || otp.hashFunction != crypto.SHA512 {
+		t.Error("TOTP properties differ after the key URL round trip")
+	}
+
+	invalid := []string{
+		"otpauth://hotp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP",
+		"https://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP",
+		"otpauth://totp/Example:alice@google.com",
+		"otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PX1",
+		"otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&algorithm=MD5",
+		"otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&digits=10",
+		"otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&period=0",
+	}
+	for _, u := range invalid {
+		if _, err := TOTPFromURL(u); err == nil {
+			t.Errorf("The invalid URL %s has been accepted\n", u)
+		}
+	}
+
+}
+
+func TestHOTPFromURL(t *testing.T) {
+
+	original, err := makeHOTP(hotpKey, "info@sec51.com", "Sec51", crypto.SHA256, 8, 1234)
+	checkError(t, err)
+
+	u, err := original.URL()
+	checkError(t, err)
+
+	otp, err := HOTPFromURL(u)
+	checkError(t, err)
+	if !bytes.Equal(otp.key, original.key) || otp.label() != original.label() || otp.digits != 8 ||
+		otp.Counter() != 1234 || otp.hashFunction != crypto.SHA256 {
+		t.Error("HOTP properties differ after the key URL round trip")
+	}
+
+	if _, err := HOTPFromURL("otpauth://hotp/Sec51?secret=JBSWY3DPEHPK3PXP&counter=-1"); err == nil {
+		t.Error("A negative counter has been accepted")
+	}
+
+}
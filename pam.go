@@ -0,0 +1,350 @@
+package twofactor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	pam_option_prefix        = "\" "
+	pam_digits               = 6  // the PAM module supports only 6 digits codes
+	pam_scratch_code_size    = 8  // the scratch codes are 8 digits long
+	pam_scratch_codes        = 5  // the amount of scratch codes created by the google-authenticator tool
+	pam_max_scratch_codes    = 10 // the PAM module ignores the codes after the tenth one
+	pam_default_rate_limit   = 3  // attempts...
+	pam_default_rate_seconds = 30 // ...every 30 seconds
+	pam_default_window_size  = 3  // the current code, the previous and the next one
+	pam_min_step_size        = 1
+	pam_max_step_size        = 60
+)
+
+var (
+	PAMFileError        = errors.New("The data is not a valid google-authenticator file.")
+	PAMUnsupportedError = errors.New("The PAM module supports only HMAC-SHA1 keys and 6 digits codes.")
+)
+
+// PAMFile is the content of the ~/.google_authenticator file of libpam-google-authenticator.
+// Exactly one of Totp and Hotp is set, depending on the TOTP_AUTH and HOTP_COUNTER options.
+// see https://github.com/google/google-authenticator-libpam
+type PAMFile struct {
+	Totp                *Totp
+	Hotp                *Hotp
+	ScratchCodes        []string // the 8 digits emergency codes, each one can be used only once
+	RateLimit           int      // the amount of logins allowed every RateLimitSeconds, 0 disables the rate limit
+	RateLimitSeconds    int      // the rate limit interval
+	RateLimitTimestamps []int64  // the unix time of the recent logins, maintained by the PAM module
+	WindowSize          int      // the amount of codes accepted around the current one, 0 means the PAM default of 3
+	DisallowReuse       bool     // whether the codes can be used only once
+	UsedTimeSteps       []int64  // the time steps of the codes already used, when DisallowReuse is set
+	Options             []string // the options not understood by this package, written back unchanged
+}
+
+// This function creates the PAM file content for the TOTP, with the settings suggested by the google-authenticator tool:
+// time based codes, rate limit of 3 logins every 30 seconds, window size of 3, codes reuse disallowed and 5 scratch codes.
+// The TOTP must use HMAC-SHA1 and 6 digits, because the PAM module does not support anything else.
+func NewPAMFile(otp *Totp) (*PAMFile, error) {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return nil, err
+	}
+
+	if otp.hashFunction != crypto.SHA1 || otp.digits != pam_digits {
+		return nil, PAMUnsupportedError
+	}
+
+	scratchCodes, err := NewScratchCodes(pam_scratch_codes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PAMFile{
+		Totp:             otp,
+		ScratchCodes:     scratchCodes,
+		RateLimit:        pam_default_rate_limit,
+		RateLimitSeconds: pam_default_rate_seconds,
+		WindowSize:       pam_default_window_size,
+		DisallowReuse:    true,
+	}, nil
+}
+
+// This function generates the given amount of 8 digits scratch codes, in the same format used by the PAM module
+func NewScratchCodes(total int) ([]string, error) {
+
+	// the first digit is never 0, as in the google-authenticator tool
+	lowest := big.NewInt(10000000)
+	span := big.NewInt(90000000)
+
+	codes := make([]string, 0, total)
+	for len(codes) < total {
+		n, err := rand.Int(rand.Reader, span)
+		if err != nil {
+			return nil, err
+		}
+		code := n.Add(n, lowest).String()
+
+		duplicate := false
+		for _, c := range codes {
+			duplicate = duplicate || c == code
+		}
+		if !duplicate {
+			codes = append(codes, code)
+		}
+	}
+
+	return codes, nil
+}
+
+// ParsePAMFile parses the content of a ~/.google_authenticator file.
+// The file does not store the account and the issuer, therefore they need to be provided by the caller,
+// usually the user name and the host name.
+// The secret is always HMAC-SHA1 with 6 digits codes. STEP_SIZE, TIME_SKEW and HOTP_COUNTER are mapped to the OTP object.
+func ParsePAMFile(data []byte, account, issuer string) (*PAMFile, error) {
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	// the first line is the base32 encoded secret
+	if !scanner.Scan() {
+		return nil, PAMFileError
+	}
+	secret := strings.ToUpper(strings.TrimRight(strings.TrimSpace(scanner.Text()), "="))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, PAMFileError
+	}
+
+	file := new(PAMFile)
+	stepSize := 30
+	timeSkew := 0
+	totpAuth := false
+	var hotpCounter *uint64
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, pam_option_prefix) {
+			code := strings.TrimSpace(line)
+			if len(code) != pam_scratch_code_size || !isNumeric(code) {
+				return nil, errors.New(fmt.Sprintf("Invalid scratch code %q in the google-authenticator file", code))
+			}
+			file.ScratchCodes = append(file.ScratchCodes, code)
+			continue
+		}
+
+		option := strings.Fields(strings.TrimPrefix(line, pam_option_prefix))
+		if len(option) == 0 {
+			continue
+		}
+
+		// only the options known to the library have numeric values: the other ones, for instance
+		// RESETTING_TIME_SKEW, are kept verbatim
+		var values []int64
+		switch option[0] {
+		case "RATE_LIMIT", "WINDOW_SIZE", "DISALLOW_REUSE", "HOTP_COUNTER", "STEP_SIZE", "TIME_SKEW":
+			if values, err = parsePAMValues(option[1:]); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid google-authenticator option %s: %s", option[0], err))
+			}
+		}
+
+		switch option[0] {
+		case "RATE_LIMIT":
+			if len(values) < 2 || values[0] <= 0 || values[1] <= 0 {
+				return nil, errors.New("Invalid google-authenticator option RATE_LIMIT")
+			}
+			file.RateLimit = int(values[0])
+			file.RateLimitSeconds = int(values[1])
+			file.RateLimitTimestamps = values[2:]
+		case "WINDOW_SIZE":
+			if len(values) != 1 || values[0] < 1 || values[0] > 100 {
+				return nil, errors.New("Invalid google-authenticator option WINDOW_SIZE")
+			}
+			file.WindowSize = int(values[0])
+		case "DISALLOW_REUSE":
+			file.DisallowReuse = true
+			file.UsedTimeSteps = values
+		case "TOTP_AUTH":
+			totpAuth = true
+		case "HOTP_COUNTER":
+			if len(values) != 1 || values[0] < 0 {
+				return nil, errors.New("Invalid google-authenticator option HOTP_COUNTER")
+			}
+			counter := uint64(values[0])
+			hotpCounter = &counter
+		case "STEP_SIZE":
+			if len(values) != 1 || values[0] < pam_min_step_size || values[0] > pam_max_step_size {
+				return nil, errors.New("Invalid google-authenticator option STEP_SIZE")
+			}
+			stepSize = int(values[0])
+		case "TIME_SKEW":
+			if len(values) != 1 {
+				return nil, errors.New("Invalid google-authenticator option TIME_SKEW")
+			}
+			timeSkew = int(values[0])
+		default:
+			file.Options = append(file.Options, strings.Join(option, " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// the PAM module falls back to HOTP when TOTP_AUTH is missing
+	switch {
+	case totpAuth && hotpCounter != nil:
+		return nil, errors.New("The google-authenticator file has both TOTP_AUTH and HOTP_COUNTER")
+	case totpAuth:
+		if file.Totp, err = makeTOTP(key, account, issuer, crypto.SHA1, pam_digits); err != nil {
+			return nil, err
+		}
+		file.Totp.stepSize = stepSize
+		file.Totp.synchronizeCounter(timeSkew)
+	default:
+		counter := uint64(1)
+		if hotpCounter != nil {
+			counter = *hotpCounter
+		}
+		if file.Hotp, err = makeHOTP(key, account, issuer, crypto.SHA1, pam_digits, counter); err != nil {
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+// MarshalPAMFile returns the content of the ~/.google_authenticator file.
+// The PAM module refuses files readable by other users: the file needs to be written with mode 0400 or 0600.
+func MarshalPAMFile(file *PAMFile) ([]byte, error) {
+
+	var key []byte
+	var hashFunction crypto.Hash
+	var digits int
+
+	switch {
+	case file.Totp != nil:
+		if err := totpHasBeenInitialized(file.Totp); err != nil {
+			return nil, err
+		}
+		key, hashFunction, digits = file.Totp.key, file.Totp.hashFunction, file.Totp.digits
+		if file.Totp.stepSize < pam_min_step_size || file.Totp.stepSize > pam_max_step_size {
+			return nil, errors.New(fmt.Sprintf("The PAM module does not support a step size of %d seconds", file.Totp.stepSize))
+		}
+	case file.Hotp != nil:
+		if err := hotpHasBeenInitialized(file.Hotp); err != nil {
+			return nil, err
+		}
+		key, hashFunction, digits = file.Hotp.key, file.Hotp.hashFunction, file.Hotp.digits
+	default:
+		return nil, errors.New("The PAM file has neither a TOTP nor a HOTP")
+	}
+
+	if hashFunction != crypto.SHA1 || digits != pam_digits {
+		return nil, PAMUnsupportedError
+	}
+
+	if len(file.ScratchCodes) > pam_max_scratch_codes {
+		return nil, errors.New(fmt.Sprintf("The PAM module supports at most %d scratch codes", pam_max_scratch_codes))
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key))
+	buffer.WriteString("\n")
+
+	if file.RateLimit > 0 {
+		writePAMOption(&buffer, "RATE_LIMIT", append([]int64{int64(file.RateLimit), int64(file.RateLimitSeconds)}, file.RateLimitTimestamps...)...)
+	}
+	if file.WindowSize > 0 {
+		writePAMOption(&buffer, "WINDOW_SIZE", int64(file.WindowSize))
+	}
+	if file.DisallowReuse {
+		writePAMOption(&buffer, "DISALLOW_REUSE", file.UsedTimeSteps...)
+	}
+
+	if file.Totp != nil {
+		writePAMOption(&buffer, "TOTP_AUTH")
+		if file.Totp.stepSize != 30 {
+			writePAMOption(&buffer, "STEP_SIZE", int64(file.Totp.stepSize))
+		}
+		if file.Totp.clientOffset != 0 {
+			writePAMOption(&buffer, "TIME_SKEW", int64(file.Totp.clientOffset))
+		}
+	} else {
+		writePAMOption(&buffer, "HOTP_COUNTER", int64(file.Hotp.Counter()))
+	}
+
+	for _, option := range file.Options {
+		buffer.WriteString(pam_option_prefix + option + "\n")
+	}
+
+	for _, code := range file.ScratchCodes {
+		if len(code) != pam_scratch_code_size || !isNumeric(code) {
+			return nil, errors.New(fmt.Sprintf("Invalid scratch code %q", code))
+		}
+		buffer.WriteString(code + "\n")
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// UseScratchCode checks the code against the scratch codes and removes it when it matches,
+// so that it cannot be used again. The file needs to be written back after a successful call.
+func (file *PAMFile) UseScratchCode(code string) bool {
+
+	index := -1
+	for i, scratchCode := range file.ScratchCodes {
+		if subtle.ConstantTimeCompare([]byte(scratchCode), []byte(code)) == 1 {
+			index = i
+		}
+	}
+
+	if index < 0 {
+		return false
+	}
+
+	file.ScratchCodes = append(file.ScratchCodes[:index], file.ScratchCodes[index+1:]...)
+	return true
+}
+
+// Private function which writes an option line: " NAME value value...
+func writePAMOption(buffer *bytes.Buffer, name string, values ...int64) {
+	buffer.WriteString(pam_option_prefix + name)
+	for _, value := range values {
+		buffer.WriteString(" " + strconv.FormatInt(value, 10))
+	}
+	buffer.WriteString("\n")
+}
+
+// Private function which parses the numeric values of an option
+func parsePAMValues(fields []string) ([]int64, error) {
+	values := make([]int64, 0, len(fields))
+	for _, field := range fields {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Private function which checks that the string contains only decimal digits
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
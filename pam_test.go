@@ -0,0 +1,157 @@
+package twofactor
+
+import (
+	"crypto"
+	"strings"
+	"testing"
+)
+
+// file written by: google-authenticator -t -d -f -r 3 -R 30 -w 17
+var pamTOTPFile = `JBSWY3DPEHPK3PXP
+" RATE_LIMIT 3 30 1577836800
+" WINDOW_SIZE 17
+" DISALLOW_REUSE 52594560 52594561
+" TOTP_AUTH
+" TIME_SKEW -1
+" UNKNOWN_OPTION 1 2
+93178405
+58234710
+30924116
+75843690
+48907622
+`
+
+var pamHOTPFile = `GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ
+" WINDOW_SIZE 5
+" HOTP_COUNTER 1
+12345678
+`
+
+func TestParsePAMFile(t *testing.T) {
+
+	file, err := ParsePAMFile([]byte(pamTOTPFile), "alice", "bastion")
+	checkError(t, err)
+
+	if file.Totp == nil || file.Hotp != nil {
+		t.Fatal("Expected a TOTP from the TOTP_AUTH file")
+	}
+	if file.Totp.Secret() != "JBSWY3DPEHPK3PXP" || file.Totp.account != "alice" || file.Totp.issuer != "bastion" {
+		t.Errorf("PAM TOTP mismatch: %s %s %s\n", file.Totp.Secret(), file.Totp.account, file.Totp.issuer)
+	}
+	if file.Totp.clientOffset != -1 || file.Totp.stepSize != 30 {
+		t.Errorf("Expected a client offset of -1 and a step size of 30, instead we've got %d %d\n", file.Totp.clientOffset, file.Totp.stepSize)
+	}
+	if file.RateLimit != 3 || file.RateLimitSeconds != 30 || len(file.RateLimitTimestamps) != 1 {
+		t.Errorf("RATE_LIMIT mismatch: %d %d %v\n", file.RateLimit, file.RateLimitSeconds, file.RateLimitTimestamps)
+	}
+	if file.WindowSize != 17 || !file.DisallowReuse || len(file.UsedTimeSteps) != 2 {
+		t.Errorf("Options mismatch: %d %v %v\n", file.WindowSize, file.DisallowReuse, file.UsedTimeSteps)
+	}
+	if len(file.ScratchCodes) != 5 || file.ScratchCodes[0] != "93178405" {
+		t.Errorf("Scratch codes mismatch: %v\n", file.ScratchCodes)
+	}
+	if len(file.Options) != 1 || file.Options[0] != "UNKNOWN_OPTION 1 2" {
+		t.Errorf("Unknown options mismatch: %v\n", file.Options)
+	}
+
+	// writing it back produces the same file
+	data, err := MarshalPAMFile(file)
+	checkError(t, err)
+	if string(data) != pamTOTPFile {
+		t.Errorf("PAM file mismatch after the round trip:\n%s\n", data)
+	}
+}
+
+// file written by the PAM module while it resynchronizes the clock of the device
+var pamResettingFile = `JBSWY3DPEHPK3PXP
+" TOTP_AUTH
+" RESETTING_TIME_SKEW 46012345+2 46012346+1
+" PROMPT Verification code:
+`
+
+func TestParsePAMFileResettingTimeSkew(t *testing.T) {
+
+	file, err := ParsePAMFile([]byte(pamResettingFile), "alice", "bastion")
+	checkError(t, err)
+
+	if len(file.Options) != 2 || file.Options[0] != "RESETTING_TIME_SKEW 46012345+2 46012346+1" || file.Options[1] != "PROMPT Verification code:" {
+		t.Errorf("Unknown options mismatch: %v\n", file.Options)
+	}
+
+	data, err := MarshalPAMFile(file)
+	checkError(t, err)
+	if string(data) != pamResettingFile {
+		t.Errorf("PAM file mismatch after the round trip:\n%s\n", data)
+	}
+}
+
+func TestParsePAMFileHOTP(t *testing.T) {
+
+	file, err := ParsePAMFile([]byte(pamHOTPFile), "alice", "bastion")
+	checkError(t, err)
+
+	if file.Hotp == nil || file.Hotp.Counter() != 1 {
+		t.Fatal("Expected a HOTP with counter 1")
+	}
+
+	// RFC 4226 test vector for counter 1
+	token, err := file.Hotp.OTP()
+	checkError(t, err)
+	if token != "287082" {
+		t.Errorf("Expected the HOTP token 287082, instead we've got %s\n", token)
+	}
+
+	data, err := MarshalPAMFile(file)
+	checkError(t, err)
+	if string(data) != pamHOTPFile {
+		t.Errorf("PAM file mismatch after the round trip:\n%s\n", data)
+	}
+}
+
+func TestInvalidPAMFile(t *testing.T) {
+
+	invalid := []string{
+		"",
+		"NOT-BASE32\n",
+		"JBSWY3DPEHPK3PXP\n\" TOTP_AUTH\n1234\n",
+		"JBSWY3DPEHPK3PXP\n\" WINDOW_SIZE x\n",
+		"JBSWY3DPEHPK3PXP\n\" STEP_SIZE 120\n\" TOTP_AUTH\n",
+		"JBSWY3DPEHPK3PXP\n\" TOTP_AUTH\n\" HOTP_COUNTER 1\n",
+	}
+	for _, data := range invalid {
+		if _, err := ParsePAMFile([]byte(data), "alice", "bastion"); err == nil {
+			t.Errorf("The invalid file %q has been accepted\n", data)
+		}
+	}
+}
+
+func TestNewPAMFile(t *testing.T) {
+
+	otp, err := NewTOTP("alice", "bastion", crypto.SHA1, 6)
+	checkError(t, err)
+
+	file, err := NewPAMFile(otp)
+	checkError(t, err)
+
+	data, err := MarshalPAMFile(file)
+	checkError(t, err)
+
+	restored, err := ParsePAMFile(data, "alice", "bastion")
+	checkError(t, err)
+	if restored.Totp.Secret() != strings.TrimRight(otp.Secret(), "=") || len(restored.ScratchCodes) != 5 {
+		t.Error("PAM file mismatch after the round trip")
+	}
+
+	// the scratch codes can be used only once
+	code := restored.ScratchCodes[2]
+	if !restored.UseScratchCode(code) || restored.UseScratchCode(code) || len(restored.ScratchCodes) != 4 {
+		t.Error("The scratch code has not been consumed")
+	}
+
+	// the PAM module supports only SHA1 and 6 digits
+	otp, err = NewTOTP("alice", "bastion", crypto.SHA256, 8)
+	checkError(t, err)
+	if _, err := NewPAMFile(otp); err != PAMUnsupportedError {
+		t.Errorf("Expected PAMUnsupportedError, instead we've got %v\n", err)
+	}
+}
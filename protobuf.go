@@ -0,0 +1,104 @@
+package twofactor
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// protobuf wire types, see https://developers.google.com/protocol-buffers/docs/encoding
+const (
+	proto_varint  = 0
+	proto_fixed64 = 1
+	proto_bytes   = 2
+	proto_fixed32 = 5
+)
+
+var (
+	protoMalformedError = errors.New("Malformed protobuf message")
+)
+
+// protoBuffer is a minimal protobuf encoder, enough for the messages exchanged with the authenticator apps
+// as in proto3, fields with the default value are not written
+type protoBuffer []byte
+
+func (buffer *protoBuffer) writeKey(field int, wireType int) {
+	buffer.writeUvarint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (buffer *protoBuffer) writeUvarint(value uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], value)
+	*buffer = append(*buffer, tmp[:n]...)
+}
+
+func (buffer *protoBuffer) writeVarint(field int, value uint64) {
+	if value == 0 {
+		return
+	}
+	buffer.writeKey(field, proto_varint)
+	buffer.writeUvarint(value)
+}
+
+func (buffer *protoBuffer) writeBytes(field int, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	buffer.writeKey(field, proto_bytes)
+	buffer.writeUvarint(uint64(len(value)))
+	*buffer = append(*buffer, value...)
+}
+
+// readProtoFields calls fn for each field of the message.
+// value is set for varint fields, bytes for length delimited fields. Fixed size fields are skipped.
+func readProtoFields(data []byte, fn func(field int, value uint64, bytes []byte) error) error {
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return protoMalformedError
+		}
+		data = data[n:]
+
+		field := int(key >> 3)
+		if field == 0 {
+			return protoMalformedError
+		}
+
+		var value uint64
+		var bytes []byte
+		switch key & 7 {
+		case proto_varint:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return protoMalformedError
+			}
+			data = data[n:]
+		case proto_bytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return protoMalformedError
+			}
+			bytes = data[n : n+int(size)]
+			data = data[n+int(size):]
+		case proto_fixed64:
+			if len(data) < 8 {
+				return protoMalformedError
+			}
+			data = data[8:]
+			continue
+		case proto_fixed32:
+			if len(data) < 4 {
+				return protoMalformedError
+			}
+			data = data[4:]
+			continue
+		default:
+			return protoMalformedError
+		}
+
+		if err := fn(field, value, bytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,722 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/sec51/convert/bigendian"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	pskc_hotp_algorithm     = "urn:ietf:params:xml:ns:keyprov:pskc:hotp"
+	pskc_totp_algorithm     = "urn:ietf:params:xml:ns:keyprov:pskc:totp"
+	pskc_version            = "1.0"
+	pskc_pre_shared_key     = "Pre-shared-key"
+	pskc_pbkdf2_algorithm   = "http://www.rsasecurity.com/rsalabs/pkcs/schemas/pkcs-5v2-0#pbkdf2"
+	pskc_pbkdf2_iterations  = 100000 // used when writing password protected containers
+	pskc_pbkdf2_salt_size   = 16
+	pskc_pbkdf2_key_size    = 32 // AES-256
+	pskc_mac_algorithm      = "http://www.w3.org/2001/04/xmldsig-more#hmac-sha256"
+	pskc_mac_key_size       = 32
+	pskc_decimal_encoding   = "DECIMAL"
+	pskc_default_digits     = 6
+	pskc_default_time_steps = 30
+
+	// upper bounds of the parameters read from a container: they come from untrusted input
+	pskc_pbkdf2_max_iterations = 10000000
+	pskc_pbkdf2_max_key_size   = 32
+)
+
+var (
+	PSKCMissingKeyError     = errors.New("The PSKC container is encrypted, but no pre-shared key or password was provided.")
+	PSKCMACMismatchError    = errors.New("The PSKC value MAC does not match: the container has been altered or the decryption key is wrong.")
+	PSKCMissingMACError     = errors.New("The PSKC container has encrypted values without MAC.")
+	PSKCUnsupportedKeyError = errors.New("The PSKC key algorithm is not supported, only HOTP and TOTP keys can be imported.")
+)
+
+// the supported xmlenc block cipher algorithms, mapped to their key size
+var pskcEncryptionAlgorithms = map[string]int{
+	"http://www.w3.org/2001/04/xmlenc#aes128-cbc": 16,
+	"http://www.w3.org/2001/04/xmlenc#aes192-cbc": 24,
+	"http://www.w3.org/2001/04/xmlenc#aes256-cbc": 32,
+}
+
+// the supported MAC algorithms
+var pskcMACAlgorithms = map[string]func() hash.Hash{
+	"http://www.w3.org/2000/09/xmldsig#hmac-sha1":        sha1.New,
+	"http://www.w3.org/2001/04/xmldsig-more#hmac-sha256": sha256.New,
+	"http://www.w3.org/2001/04/xmldsig-more#hmac-sha384": sha512.New384,
+	"http://www.w3.org/2001/04/xmldsig-more#hmac-sha512": sha512.New,
+}
+
+// the supported pbkdf2 pseudo random functions, HMAC-SHA1 is the default
+var pskcPRFAlgorithms = map[string]func() hash.Hash{
+	"http://www.rsasecurity.com/rsalabs/pkcs/schemas/pkcs-5v2-0#hmac-sha1": sha1.New,
+	"http://www.w3.org/2001/04/xmldsig-more#hmac-sha256":                   sha256.New,
+	"http://www.w3.org/2001/04/xmldsig-more#hmac-sha512":                   sha512.New,
+}
+
+// the algorithm suites of the OTP keys
+var pskcSuites = map[crypto.Hash]string{
+	crypto.SHA1:   "HMAC-SHA1",
+	crypto.SHA256: "HMAC-SHA256",
+	crypto.SHA512: "HMAC-SHA512",
+}
+
+// PSKCKey is a key package of a PSKC (RFC 6030) key container.
+// Exactly one of Totp and Hotp is set, depending on the key algorithm.
+type PSKCKey struct {
+	Id           string // the identifier of the key inside the container
+	SerialNumber string // the serial number of the hardware token holding the key
+	Manufacturer string // the manufacturer of the hardware token
+	Model        string // the model of the hardware token
+	Totp         *Totp
+	Hotp         *Hotp
+}
+
+// ParsePSKC reads all the HOTP and TOTP keys of a PSKC (RFC 6030) key container.
+// secret is only needed when the key values are encrypted: it is the pre-shared AES key when the
+// container references a key by name, or the password when the key is derived with PBKDF2.
+// The MAC of every encrypted value is verified before decrypting it, a mismatch returns PSKCMACMismatchError.
+// The issuer and the account of the returned objects are taken from the Issuer and the UserId of each key.
+func ParsePSKC(data []byte, secret []byte) ([]PSKCKey, error) {
+
+	var container pskcKeyContainer
+	if err := xml.Unmarshal(data, &container); err != nil {
+		return nil, err
+	}
+
+	if container.Version != pskc_version {
+		return nil, errors.New(fmt.Sprintf("Unsupported PSKC version %q", container.Version))
+	}
+
+	// derive the encryption and MAC keys
+	c := new(pskcCipher)
+	if container.EncryptionKey != nil {
+		if len(secret) == 0 {
+			return nil, PSKCMissingKeyError
+		}
+		key, err := container.EncryptionKey.derive(secret)
+		if err != nil {
+			return nil, err
+		}
+		c.key = key
+	}
+	if container.MACMethod != nil {
+		if err := c.initMAC(container.MACMethod); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]PSKCKey, 0, len(container.KeyPackages))
+	for _, pkg := range container.KeyPackages {
+		key, err := pkg.toKey(c)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// MarshalPSKC writes the keys in a PSKC (RFC 6030) key container.
+// When preSharedKey is nil the secrets are written in plain text, otherwise they are encrypted
+// with AES-CBC (the pre-shared key must be 16, 24 or 32 bytes long) and authenticated with HMAC-SHA256.
+func MarshalPSKC(keys []PSKCKey, preSharedKey []byte) ([]byte, error) {
+
+	container := newPSKCKeyContainer()
+	if preSharedKey != nil {
+		if _, err := aes.NewCipher(preSharedKey); err != nil {
+			return nil, err
+		}
+		container.EncryptionKey = &pskcEncryptionKey{KeyName: pskc_pre_shared_key}
+		if err := container.encryptWith(preSharedKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return container.marshal(keys)
+}
+
+// MarshalPSKCWithPassword writes the keys in a PSKC (RFC 6030) key container, encrypting the secrets
+// with an AES-256 key derived from the password with PBKDF2.
+func MarshalPSKCWithPassword(keys []PSKCKey, password []byte) ([]byte, error) {
+
+	if len(password) == 0 {
+		return nil, PSKCMissingKeyError
+	}
+
+	salt := make([]byte, pskc_pbkdf2_salt_size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	container := newPSKCKeyContainer()
+	container.EncryptionKey = &pskcEncryptionKey{
+		DerivedKey: &pskcDerivedKey{
+			KeyDerivationMethod: pskcKeyDerivationMethod{
+				Algorithm: pskc_pbkdf2_algorithm,
+				Params: &pskcPBKDF2Params{
+					Salt:           base64.StdEncoding.EncodeToString(salt),
+					IterationCount: pskc_pbkdf2_iterations,
+					KeyLength:      pskc_pbkdf2_key_size,
+				},
+			},
+		},
+	}
+
+	key, err := container.EncryptionKey.derive(password)
+	if err != nil {
+		return nil, err
+	}
+	if err := container.encryptWith(key); err != nil {
+		return nil, err
+	}
+
+	return container.marshal(keys)
+}
+
+// XML representation of the container, see RFC 6030 section 4
+
+type pskcKeyContainer struct {
+	XMLName       xml.Name           `xml:"urn:ietf:params:xml:ns:keyprov:pskc KeyContainer"`
+	Version       string             `xml:"Version,attr"`
+	EncryptionKey *pskcEncryptionKey `xml:"urn:ietf:params:xml:ns:keyprov:pskc EncryptionKey,omitempty"`
+	MACMethod     *pskcMACMethod     `xml:"urn:ietf:params:xml:ns:keyprov:pskc MACMethod,omitempty"`
+	KeyPackages   []pskcKeyPackage   `xml:"urn:ietf:params:xml:ns:keyprov:pskc KeyPackage"`
+	cipher        *pskcCipher        // used when writing the container
+}
+
+type pskcEncryptionKey struct {
+	KeyName    string          `xml:"http://www.w3.org/2000/09/xmldsig# KeyName,omitempty"`
+	DerivedKey *pskcDerivedKey `xml:"http://www.w3.org/2009/xmlenc11# DerivedKey,omitempty"`
+}
+
+type pskcDerivedKey struct {
+	KeyDerivationMethod pskcKeyDerivationMethod `xml:"http://www.w3.org/2009/xmlenc11# KeyDerivationMethod"`
+}
+
+type pskcKeyDerivationMethod struct {
+	Algorithm string            `xml:"Algorithm,attr"`
+	Params    *pskcPBKDF2Params `xml:"http://www.rsasecurity.com/rsalabs/pkcs/schemas/pkcs-5v2-0# PBKDF2-params"`
+}
+
+type pskcPBKDF2Params struct {
+	Salt           string         `xml:"Salt>Specified"`
+	IterationCount int            `xml:"IterationCount"`
+	KeyLength      int            `xml:"KeyLength"`
+	PRF            *pskcAlgorithm `xml:"PRF,omitempty"`
+}
+
+type pskcAlgorithm struct {
+	Algorithm string `xml:"Algorithm,attr,omitempty"`
+}
+
+type pskcMACMethod struct {
+	Algorithm string              `xml:"Algorithm,attr"`
+	MACKey    *pskcEncryptedValue `xml:"urn:ietf:params:xml:ns:keyprov:pskc MACKey"`
+}
+
+type pskcEncryptedValue struct {
+	EncryptionMethod pskcAlgorithm  `xml:"http://www.w3.org/2001/04/xmlenc# EncryptionMethod"`
+	CipherData       pskcCipherData `xml:"http://www.w3.org/2001/04/xmlenc# CipherData"`
+}
+
+type pskcCipherData struct {
+	CipherValue string `xml:"http://www.w3.org/2001/04/xmlenc# CipherValue"`
+}
+
+type pskcKeyPackage struct {
+	DeviceInfo *pskcDeviceInfo `xml:"urn:ietf:params:xml:ns:keyprov:pskc DeviceInfo,omitempty"`
+	Key        pskcKey         `xml:"urn:ietf:params:xml:ns:keyprov:pskc Key"`
+}
+
+type pskcDeviceInfo struct {
+	Manufacturer string `xml:"urn:ietf:params:xml:ns:keyprov:pskc Manufacturer,omitempty"`
+	SerialNo     string `xml:"urn:ietf:params:xml:ns:keyprov:pskc SerialNo,omitempty"`
+	Model        string `xml:"urn:ietf:params:xml:ns:keyprov:pskc Model,omitempty"`
+	UserId       string `xml:"urn:ietf:params:xml:ns:keyprov:pskc UserId,omitempty"`
+}
+
+type pskcKey struct {
+	Id                  string                   `xml:"Id,attr"`
+	Algorithm           string                   `xml:"Algorithm,attr"`
+	Issuer              string                   `xml:"urn:ietf:params:xml:ns:keyprov:pskc Issuer,omitempty"`
+	AlgorithmParameters *pskcAlgorithmParameters `xml:"urn:ietf:params:xml:ns:keyprov:pskc AlgorithmParameters,omitempty"`
+	Data                pskcData                 `xml:"urn:ietf:params:xml:ns:keyprov:pskc Data"`
+	UserId              string                   `xml:"urn:ietf:params:xml:ns:keyprov:pskc UserId,omitempty"`
+}
+
+type pskcAlgorithmParameters struct {
+	Suite          string              `xml:"urn:ietf:params:xml:ns:keyprov:pskc Suite,omitempty"`
+	ResponseFormat *pskcResponseFormat `xml:"urn:ietf:params:xml:ns:keyprov:pskc ResponseFormat,omitempty"`
+}
+
+type pskcResponseFormat struct {
+	Length   int    `xml:"Length,attr"`
+	Encoding string `xml:"Encoding,attr"`
+}
+
+type pskcData struct {
+	Secret       *pskcValue `xml:"urn:ietf:params:xml:ns:keyprov:pskc Secret,omitempty"`
+	Counter      *pskcValue `xml:"urn:ietf:params:xml:ns:keyprov:pskc Counter,omitempty"`
+	Time         *pskcValue `xml:"urn:ietf:params:xml:ns:keyprov:pskc Time,omitempty"`
+	TimeInterval *pskcValue `xml:"urn:ietf:params:xml:ns:keyprov:pskc TimeInterval,omitempty"`
+	TimeDrift    *pskcValue `xml:"urn:ietf:params:xml:ns:keyprov:pskc TimeDrift,omitempty"`
+}
+
+type pskcValue struct {
+	PlainValue     string              `xml:"urn:ietf:params:xml:ns:keyprov:pskc PlainValue,omitempty"`
+	EncryptedValue *pskcEncryptedValue `xml:"urn:ietf:params:xml:ns:keyprov:pskc EncryptedValue,omitempty"`
+	ValueMAC       string              `xml:"urn:ietf:params:xml:ns:keyprov:pskc ValueMAC,omitempty"`
+}
+
+// derive returns the AES key used to encrypt the values of the container
+func (encryptionKey *pskcEncryptionKey) derive(secret []byte) ([]byte, error) {
+
+	// pre-shared key, referenced by name
+	if encryptionKey.DerivedKey == nil {
+		return secret, nil
+	}
+
+	// password based key derivation, see RFC 6030 section 6.2
+	method := encryptionKey.DerivedKey.KeyDerivationMethod
+	if method.Algorithm != pskc_pbkdf2_algorithm || method.Params == nil {
+		return nil, errors.New(fmt.Sprintf("Unsupported PSKC key derivation method %q", method.Algorithm))
+	}
+	params := method.Params
+
+	salt, err := base64.StdEncoding.DecodeString(strings.TrimSpace(params.Salt))
+	if err != nil {
+		return nil, err
+	}
+
+	prf := sha1.New
+	if params.PRF != nil && params.PRF.Algorithm != "" {
+		var ok bool
+		if prf, ok = pskcPRFAlgorithms[params.PRF.Algorithm]; !ok {
+			return nil, errors.New(fmt.Sprintf("Unsupported PSKC PBKDF2 pseudo random function %q", params.PRF.Algorithm))
+		}
+	}
+
+	if params.IterationCount <= 0 || params.KeyLength <= 0 {
+		return nil, errors.New("Invalid PSKC PBKDF2 parameters")
+	}
+	if params.IterationCount > pskc_pbkdf2_max_iterations {
+		return nil, errors.New(fmt.Sprintf("The PSKC PBKDF2 iteration count %d exceeds the maximum of %d", params.IterationCount, pskc_pbkdf2_max_iterations))
+	}
+	if params.KeyLength > pskc_pbkdf2_max_key_size {
+		return nil, errors.New(fmt.Sprintf("The PSKC PBKDF2 key length %d exceeds the maximum of %d", params.KeyLength, pskc_pbkdf2_max_key_size))
+	}
+
+	return pbkdf2.Key(secret, salt, params.IterationCount, params.KeyLength, prf), nil
+}
+
+// pskcCipher encrypts, decrypts and authenticates the values of a container
+type pskcCipher struct {
+	key           []byte           // the AES key
+	macKey        []byte           // the key of the HMAC which authenticates the encrypted values
+	mac           func() hash.Hash // the hash function of the HMAC
+	macAlgorithm  string           // the algorithm identifier of the HMAC
+	encryptMethod string           // the algorithm identifier of the block cipher used when writing
+}
+
+// initMAC decrypts the MAC key of the container
+func (c *pskcCipher) initMAC(method *pskcMACMethod) error {
+
+	mac, ok := pskcMACAlgorithms[method.Algorithm]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unsupported PSKC MAC algorithm %q", method.Algorithm))
+	}
+
+	if method.MACKey == nil {
+		return errors.New("The PSKC MAC key is missing")
+	}
+
+	// the MAC key itself is encrypted with the container key
+	raw, err := c.cipherValue(method.MACKey)
+	if err != nil {
+		return err
+	}
+	plain, err := c.decrypt(raw)
+	if err != nil {
+		return err
+	}
+
+	c.mac = mac
+	c.macKey = plain
+	return nil
+}
+
+// cipherValue returns the raw cipher value: the IV and the cipher text, still encrypted
+func (c *pskcCipher) cipherValue(value *pskcEncryptedValue) ([]byte, error) {
+
+	if c.key == nil {
+		return nil, PSKCMissingKeyError
+	}
+
+	keySize, ok := pskcEncryptionAlgorithms[value.EncryptionMethod.Algorithm]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unsupported PSKC encryption algorithm %q", value.EncryptionMethod.Algorithm))
+	}
+	if keySize != len(c.key) {
+		return nil, errors.New(fmt.Sprintf("The PSKC encryption algorithm requires a %d bytes key, got %d bytes", keySize, len(c.key)))
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value.CipherData.CipherValue), ""))
+	if err != nil {
+		return nil, err
+	}
+
+	// the IV is prepended to the cipher text
+	if len(raw) < 2*aes.BlockSize || len(raw)%aes.BlockSize != 0 {
+		return nil, errors.New("Invalid PSKC cipher value length")
+	}
+
+	return raw, nil
+}
+
+// decrypt returns the decrypted content of the raw cipher value.
+// The values are decrypted only after their MAC has been verified: otherwise the padding errors would be an oracle.
+func (c *pskcCipher) decrypt(raw []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(raw)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, raw[:aes.BlockSize]).CryptBlocks(plain, raw[aes.BlockSize:])
+
+	// XML encryption padding: the last byte is the length of the padding
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("Invalid PSKC cipher value padding")
+	}
+
+	return plain[:len(plain)-padding], nil
+}
+
+// encrypt returns the encrypted value and its MAC
+func (c *pskcCipher) encrypt(plain []byte) (*pskcEncryptedValue, string, error) {
+
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// PKCS#7 padding, which is a valid XML encryption padding
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	padded := make([]byte, len(plain)+padding)
+	copy(padded, plain)
+	for i := len(plain); i < len(padded); i++ {
+		padded[i] = byte(padding)
+	}
+
+	raw := make([]byte, aes.BlockSize+len(padded))
+	if _, err := rand.Read(raw[:aes.BlockSize]); err != nil {
+		return nil, "", err
+	}
+	cipher.NewCBCEncrypter(block, raw[:aes.BlockSize]).CryptBlocks(raw[aes.BlockSize:], padded)
+
+	value := &pskcEncryptedValue{
+		EncryptionMethod: pskcAlgorithm{Algorithm: c.encryptMethod},
+		CipherData:       pskcCipherData{CipherValue: base64.StdEncoding.EncodeToString(raw)},
+	}
+
+	mac := ""
+	if c.macKey != nil {
+		mac = base64.StdEncoding.EncodeToString(c.sum(raw))
+	}
+
+	return value, mac, nil
+}
+
+// sum returns the MAC of the raw cipher value
+func (c *pskcCipher) sum(raw []byte) []byte {
+	h := hmac.New(c.mac, c.macKey)
+	h.Write(raw)
+	return h.Sum(nil)
+}
+
+// bytes returns the plain or the decrypted content of a value,
+// after verifying the MAC of the cipher value in constant time
+func (value *pskcValue) bytes(c *pskcCipher) ([]byte, error) {
+
+	if value.EncryptedValue == nil {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(value.PlainValue))
+	}
+
+	if c.macKey == nil || value.ValueMAC == "" {
+		return nil, PSKCMissingMACError
+	}
+
+	raw, err := c.cipherValue(value.EncryptedValue)
+	if err != nil {
+		return nil, err
+	}
+
+	expectedMAC, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value.ValueMAC))
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(expectedMAC, c.sum(raw)) {
+		return nil, PSKCMACMismatchError
+	}
+
+	return c.decrypt(raw)
+}
+
+// integer returns the plain or the decrypted content of an integer value
+// encrypted integers are big endian, as defined in RFC 6030 section 6.1
+func (value *pskcValue) integer(c *pskcCipher) (int64, error) {
+
+	if value.EncryptedValue == nil {
+		return strconv.ParseInt(strings.TrimSpace(value.PlainValue), 10, 64)
+	}
+
+	plain, err := value.bytes(c)
+	if err != nil {
+		return 0, err
+	}
+	if len(plain) == 0 || len(plain) > 8 {
+		return 0, errors.New("Invalid PSKC encrypted integer length")
+	}
+
+	var b [8]byte
+	copy(b[8-len(plain):], plain)
+	return int64(bigendian.FromUint64(b)), nil
+}
+
+// toKey converts a key package into a Totp or Hotp object
+func (pkg *pskcKeyPackage) toKey(c *pskcCipher) (PSKCKey, error) {
+
+	key := PSKCKey{Id: pkg.Key.Id}
+	account := pkg.Key.UserId
+	if pkg.DeviceInfo != nil {
+		key.SerialNumber = pkg.DeviceInfo.SerialNo
+		key.Manufacturer = pkg.DeviceInfo.Manufacturer
+		key.Model = pkg.DeviceInfo.Model
+		if account == "" {
+			account = pkg.DeviceInfo.UserId
+		}
+	}
+
+	// algorithm parameters
+	hashFunction := crypto.SHA1
+	digits := pskc_default_digits
+	if params := pkg.Key.AlgorithmParameters; params != nil {
+		if params.Suite != "" {
+			found := false
+			for h, suite := range pskcSuites {
+				if strings.EqualFold(params.Suite, suite) || strings.EqualFold("HMAC-"+params.Suite, suite) {
+					hashFunction = h
+					found = true
+				}
+			}
+			if !found {
+				return key, errors.New(fmt.Sprintf("Unsupported PSKC algorithm suite %q in key %s", params.Suite, pkg.Key.Id))
+			}
+		}
+		if format := params.ResponseFormat; format != nil {
+			if format.Encoding != "" && format.Encoding != pskc_decimal_encoding {
+				return key, errors.New(fmt.Sprintf("Unsupported PSKC response encoding %q in key %s", format.Encoding, pkg.Key.Id))
+			}
+			digits = format.Length
+		}
+	}
+	if digits < 6 || digits > 8 {
+		return key, errors.New(fmt.Sprintf("Unsupported amount of digits %d in key %s", digits, pkg.Key.Id))
+	}
+
+	// the secret
+	data := pkg.Key.Data
+	if data.Secret == nil {
+		return key, errors.New(fmt.Sprintf("The PSKC key %s has no secret", pkg.Key.Id))
+	}
+	secret, err := data.Secret.bytes(c)
+	if err != nil {
+		return key, err
+	}
+	if len(secret) == 0 {
+		return key, errors.New(fmt.Sprintf("The PSKC key %s has an empty secret", pkg.Key.Id))
+	}
+
+	switch pkg.Key.Algorithm {
+	case pskc_hotp_algorithm:
+		counter := int64(0)
+		if data.Counter != nil {
+			if counter, err = data.Counter.integer(c); err != nil {
+				return key, err
+			}
+		}
+		key.Hotp, err = makeHOTP(secret, account, pkg.Key.Issuer, hashFunction, digits, uint64(counter))
+		return key, err
+
+	case pskc_totp_algorithm:
+		// the Totp counts the time steps from the unix epoch
+		if data.Time != nil {
+			t0, err := data.Time.integer(c)
+			if err != nil {
+				return key, err
+			}
+			if t0 != 0 {
+				return key, errors.New(fmt.Sprintf("Unsupported PSKC start time %d in key %s", t0, pkg.Key.Id))
+			}
+		}
+		stepSize := int64(pskc_default_time_steps)
+		if data.TimeInterval != nil {
+			if stepSize, err = data.TimeInterval.integer(c); err != nil {
+				return key, err
+			}
+			if stepSize <= 0 {
+				return key, errors.New(fmt.Sprintf("Invalid PSKC time interval %d in key %s", stepSize, pkg.Key.Id))
+			}
+		}
+		drift := int64(0)
+		if data.TimeDrift != nil {
+			if drift, err = data.TimeDrift.integer(c); err != nil {
+				return key, err
+			}
+		}
+		key.Totp, err = makeTOTP(secret, account, pkg.Key.Issuer, hashFunction, digits)
+		if err != nil {
+			return key, err
+		}
+		key.Totp.stepSize = int(stepSize)
+		key.Totp.clientOffset = int(drift)
+		return key, nil
+	}
+
+	return key, PSKCUnsupportedKeyError
+}
+
+func newPSKCKeyContainer() *pskcKeyContainer {
+	return &pskcKeyContainer{Version: pskc_version, cipher: new(pskcCipher)}
+}
+
+// encryptWith sets up the container so that all the values are encrypted with the key,
+// and authenticated with a newly generated MAC key
+func (container *pskcKeyContainer) encryptWith(key []byte) error {
+
+	for algorithm, size := range pskcEncryptionAlgorithms {
+		if size == len(key) {
+			container.cipher.encryptMethod = algorithm
+		}
+	}
+	container.cipher.key = key
+
+	macKey := make([]byte, pskc_mac_key_size)
+	if _, err := rand.Read(macKey); err != nil {
+		return err
+	}
+
+	// the MAC key is transported encrypted with the container key
+	encryptedMACKey, _, err := container.cipher.encrypt(macKey)
+	if err != nil {
+		return err
+	}
+	container.MACMethod = &pskcMACMethod{Algorithm: pskc_mac_algorithm, MACKey: encryptedMACKey}
+	container.cipher.mac = pskcMACAlgorithms[pskc_mac_algorithm]
+	container.cipher.macKey = macKey
+
+	return nil
+}
+
+// marshal converts the Totp and Hotp objects into key packages and encodes the container
+func (container *pskcKeyContainer) marshal(keys []PSKCKey) ([]byte, error) {
+
+	for i, key := range keys {
+		pkg := pskcKeyPackage{}
+		pkg.Key.Id = key.Id
+		if pkg.Key.Id == "" {
+			pkg.Key.Id = strconv.Itoa(i + 1)
+		}
+		if key.SerialNumber != "" || key.Manufacturer != "" || key.Model != "" {
+			pkg.DeviceInfo = &pskcDeviceInfo{
+				Manufacturer: key.Manufacturer,
+				SerialNo:     key.SerialNumber,
+				Model:        key.Model,
+			}
+		}
+
+		var secret []byte
+		var hashFunction crypto.Hash
+		var digits int
+		switch {
+		case key.Totp != nil:
+			if err := totpHasBeenInitialized(key.Totp); err != nil {
+				return nil, err
+			}
+			pkg.Key.Algorithm = pskc_totp_algorithm
+			pkg.Key.Issuer = key.Totp.issuer
+			pkg.Key.UserId = key.Totp.account
+			secret, hashFunction, digits = key.Totp.key, key.Totp.hashFunction, key.Totp.digits
+			pkg.Key.Data.Time = &pskcValue{PlainValue: "0"}
+			pkg.Key.Data.TimeInterval = &pskcValue{PlainValue: strconv.Itoa(key.Totp.stepSize)}
+			pkg.Key.Data.TimeDrift = &pskcValue{PlainValue: strconv.Itoa(key.Totp.clientOffset)}
+		case key.Hotp != nil:
+			if err := hotpHasBeenInitialized(key.Hotp); err != nil {
+				return nil, err
+			}
+			pkg.Key.Algorithm = pskc_hotp_algorithm
+			pkg.Key.Issuer = key.Hotp.issuer
+			pkg.Key.UserId = key.Hotp.account
+			secret, hashFunction, digits = key.Hotp.key, key.Hotp.hashFunction, key.Hotp.digits
+			pkg.Key.Data.Counter = &pskcValue{PlainValue: strconv.FormatUint(key.Hotp.Counter(), 10)}
+		default:
+			return nil, initializationFailedError
+		}
+
+		suite, ok := pskcSuites[hashFunction]
+		if !ok {
+			suite = pskcSuites[crypto.SHA1]
+		}
+		pkg.Key.AlgorithmParameters = &pskcAlgorithmParameters{
+			Suite:          suite,
+			ResponseFormat: &pskcResponseFormat{Length: digits, Encoding: pskc_decimal_encoding},
+		}
+
+		// the secret is the only value which is encrypted
+		pkg.Key.Data.Secret = new(pskcValue)
+		if container.cipher.key == nil {
+			pkg.Key.Data.Secret.PlainValue = base64.StdEncoding.EncodeToString(secret)
+		} else {
+			value, mac, err := container.cipher.encrypt(secret)
+			if err != nil {
+				return nil, err
+			}
+			pkg.Key.Data.Secret.EncryptedValue = value
+			pkg.Key.Data.Secret.ValueMAC = mac
+		}
+
+		container.KeyPackages = append(container.KeyPackages, pkg)
+	}
+
+	data, err := xml.MarshalIndent(container, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	buffer.Write(data)
+	buffer.WriteString("\n")
+	return buffer.Bytes(), nil
+}
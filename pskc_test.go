@@ -0,0 +1,347 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// RFC 6030 Figure 2
+var pskcPlainContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<KeyContainer Version="1.0"
+    Id="exampleID1"
+    xmlns="urn:ietf:params:xml:ns:keyprov:pskc">
+    <KeyPackage>
+        <DeviceInfo>
+            <Manufacturer>Manufacturer</Manufacturer>
+            <SerialNo>987654321</SerialNo>
+            <UserId>DC=example-bank,DC=net</UserId>
+        </DeviceInfo>
+        <CryptoModuleInfo>
+            <Id>CM_ID_001</Id>
+        </CryptoModuleInfo>
+        <Key Id="12345678"
+            Algorithm="urn:ietf:params:xml:ns:keyprov:pskc:hotp">
+            <Issuer>Issuer</Issuer>
+            <AlgorithmParameters>
+                <ResponseFormat Length="8" Encoding="DECIMAL"/>
+            </AlgorithmParameters>
+            <Data>
+                <Secret>
+                    <PlainValue>MTIzNDU2Nzg5MDEyMzQ1Njc4OTA=
+                    </PlainValue>
+                </Secret>
+                <Counter>
+                    <PlainValue>0</PlainValue>
+                </Counter>
+            </Data>
+            <UserId>UID=jsmith,DC=example-bank,DC=net</UserId>
+        </Key>
+    </KeyPackage>
+</KeyContainer>`
+
+// RFC 6030 Figure 6, the pre-shared key is 0x12345678901234567890123456789012
+var pskcPreSharedKeyContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<KeyContainer Version="1.0"
+    xmlns="urn:ietf:params:xml:ns:keyprov:pskc"
+    xmlns:ds="http://www.w3.org/2000/09/xmldsig#"
+    xmlns:xenc="http://www.w3.org/2001/04/xmlenc#">
+    <EncryptionKey>
+        <ds:KeyName>Pre-shared-key</ds:KeyName>
+    </EncryptionKey>
+    <MACMethod Algorithm="http://www.w3.org/2000/09/xmldsig#hmac-sha1">
+        <MACKey>
+            <xenc:EncryptionMethod
+            Algorithm="http://www.w3.org/2001/04/xmlenc#aes128-cbc"/>
+            <xenc:CipherData>
+                <xenc:CipherValue>
+     ESIzRFVmd4iZABEiM0RVZgKn6WjLaTC1sbeBMSvIhRejN9vJa2BOlSaMrR7I5wSX
+                </xenc:CipherValue>
+            </xenc:CipherData>
+        </MACKey>
+    </MACMethod>
+    <KeyPackage>
+        <DeviceInfo>
+            <Manufacturer>Manufacturer</Manufacturer>
+            <SerialNo>987654321</SerialNo>
+        </DeviceInfo>
+        <CryptoModuleInfo>
+            <Id>CM_ID_001</Id>
+        </CryptoModuleInfo>
+        <Key Id="12345678"
+            Algorithm="urn:ietf:params:xml:ns:keyprov:pskc:hotp">
+            <Issuer>Issuer</Issuer>
+            <AlgorithmParameters>
+                <ResponseFormat Length="8" Encoding="DECIMAL"/>
+            </AlgorithmParameters>
+            <Data>
+                <Secret>
+                    <EncryptedValue>
+                        <xenc:EncryptionMethod
+            Algorithm="http://www.w3.org/2001/04/xmlenc#aes128-cbc"/>
+                        <xenc:CipherData>
+                            <xenc:CipherValue>
+     AAECAwQFBgcICQoLDA0OD+cIHItlB3Wra1DUpxVvOx2lef1VmNPCMl8jwZqIUqGv
+                            </xenc:CipherValue>
+                        </xenc:CipherData>
+                    </EncryptedValue>
+                    <ValueMAC>Su+NvtQfmvfJzF6bmQiJqoLRExc=
+                    </ValueMAC>
+                </Secret>
+                <Counter>
+                    <PlainValue>0</PlainValue>
+                </Counter>
+            </Data>
+        </Key>
+    </KeyPackage>
+</KeyContainer>`
+
+// RFC 6030 Figure 7, the password is "qwerty"
+var pskcPasswordContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<pskc:KeyContainer
+  xmlns:pskc="urn:ietf:params:xml:ns:keyprov:pskc"
+  xmlns:xenc11="http://www.w3.org/2009/xmlenc11#"
+  xmlns:pkcs5=
+  "http://www.rsasecurity.com/rsalabs/pkcs/schemas/pkcs-5v2-0#"
+  xmlns:xenc="http://www.w3.org/2001/04/xmlenc#" Version="1.0">
+    <pskc:EncryptionKey>
+        <xenc11:DerivedKey>
+            <xenc11:KeyDerivationMethod
+              Algorithm=
+"http://www.rsasecurity.com/rsalabs/pkcs/schemas/pkcs-5v2-0#pbkdf2">
+                <pkcs5:PBKDF2-params>
+                    <Salt>
+                        <Specified>Ej7/PEpyEpw=</Specified>
+                    </Salt>
+                    <IterationCount>1000</IterationCount>
+                    <KeyLength>16</KeyLength>
+                    <PRF/>
+                </pkcs5:PBKDF2-params>
+            </xenc11:KeyDerivationMethod>
+            <xenc:ReferenceList>
+                <xenc:DataReference URI="#ED"/>
+            </xenc:ReferenceList>
+            <xenc11:MasterKeyName>My Password 1</xenc11:MasterKeyName>
+        </xenc11:DerivedKey>
+    </pskc:EncryptionKey>
+    <pskc:MACMethod
+        Algorithm="http://www.w3.org/2000/09/xmldsig#hmac-sha1">
+        <pskc:MACKey>
+            <xenc:EncryptionMethod
+            Algorithm="http://www.w3.org/2001/04/xmlenc#aes128-cbc"/>
+            <xenc:CipherData>
+                <xenc:CipherValue>
+2GTTnLwM3I4e5IO5FkufoOEiOhNj91fhKRQBtBJYluUDsPOLTfUvoU2dStyOwYZx
+                </xenc:CipherValue>
+            </xenc:CipherData>
+        </pskc:MACKey>
+    </pskc:MACMethod>
+    <pskc:KeyPackage>
+        <pskc:DeviceInfo>
+            <pskc:Manufacturer>TokenVendorAcme</pskc:Manufacturer>
+            <pskc:SerialNo>987654321</pskc:SerialNo>
+        </pskc:DeviceInfo>
+        <pskc:CryptoModuleInfo>
+            <pskc:Id>CM_ID_001</pskc:Id>
+        </pskc:CryptoModuleInfo>
+        <pskc:Key Algorithm=
+        "urn:ietf:params:xml:ns:keyprov:pskc:hotp" Id="123456">
+            <pskc:Issuer>Example-Issuer</pskc:Issuer>
+            <pskc:AlgorithmParameters>
+                <pskc:ResponseFormat Length="8" Encoding="DECIMAL"/>
+            </pskc:AlgorithmParameters>
+            <pskc:Data>
+                <pskc:Secret>
+                <pskc:EncryptedValue Id="ED">
+                    <xenc:EncryptionMethod
+                        Algorithm=
+"http://www.w3.org/2001/04/xmlenc#aes128-cbc"/>
+                        <xenc:CipherData>
+                            <xenc:CipherValue>
+      oTvo+S22nsmS2Z/RtcoF8Hfh+jzMe0RkiafpoDpnoZTjPYZu6V+A4aEn032yCr4f
+                        </xenc:CipherValue>
+                    </xenc:CipherData>
+                    </pskc:EncryptedValue>
+                    <pskc:ValueMAC>LP6xMvjtypbfT9PdkJhBZ+D6O4w=
+                    </pskc:ValueMAC>
+                </pskc:Secret>
+            </pskc:Data>
+        </pskc:Key>
+    </pskc:KeyPackage>
+</pskc:KeyContainer>`
+
+func checkPSKCHotp(t *testing.T, keys []PSKCKey, err error, id string) {
+	checkError(t, err)
+
+	if len(keys) != 1 {
+		t.Fatalf("Expected 1 key, instead we've got %d\n", len(keys))
+	}
+
+	key := keys[0]
+	if key.Hotp == nil || key.Totp != nil {
+		t.Fatal("Expected an HOTP key")
+	}
+	if key.Id != id || key.SerialNumber != "987654321" {
+		t.Errorf("Key metadata mismatch: %+v\n", key)
+	}
+	if string(key.Hotp.key) != "12345678901234567890" {
+		t.Errorf("Key secret mismatch, got %x\n", key.Hotp.key)
+	}
+	if key.Hotp.digits != 8 || key.Hotp.Counter() != 0 || key.Hotp.hashFunction != crypto.SHA1 {
+		t.Errorf("Key parameters mismatch: %d digits, counter %d\n", key.Hotp.digits, key.Hotp.Counter())
+	}
+}
+
+func TestParsePSKC(t *testing.T) {
+
+	keys, err := ParsePSKC([]byte(pskcPlainContainer), nil)
+	checkPSKCHotp(t, keys, err, "12345678")
+	if keys[0].Hotp.issuer != "Issuer" || keys[0].Hotp.account != "UID=jsmith,DC=example-bank,DC=net" {
+		t.Errorf("Issuer or account mismatch: %s %s\n", keys[0].Hotp.issuer, keys[0].Hotp.account)
+	}
+	if keys[0].Manufacturer != "Manufacturer" {
+		t.Errorf("Manufacturer mismatch: %s\n", keys[0].Manufacturer)
+	}
+
+	preSharedKey, err := hex.DecodeString("12345678901234567890123456789012")
+	checkError(t, err)
+	keys, err = ParsePSKC([]byte(pskcPreSharedKeyContainer), preSharedKey)
+	checkPSKCHotp(t, keys, err, "12345678")
+
+	keys, err = ParsePSKC([]byte(pskcPasswordContainer), []byte("qwerty"))
+	checkPSKCHotp(t, keys, err, "123456")
+
+}
+
+func TestParsePSKCErrors(t *testing.T) {
+
+	// encrypted container without key
+	if _, err := ParsePSKC([]byte(pskcPreSharedKeyContainer), nil); err != PSKCMissingKeyError {
+		t.Errorf("Expected the missing key error, instead we've got %v\n", err)
+	}
+
+	// wrong password: the MAC key decrypts to garbage (or has an invalid padding)
+	if _, err := ParsePSKC([]byte(pskcPasswordContainer), []byte("azerty")); err == nil {
+		t.Error("A container has been decrypted with the wrong password")
+	}
+
+	// PBKDF2 parameters over the upper bounds
+	altered := strings.Replace(pskcPasswordContainer, "<IterationCount>1000</IterationCount>", "<IterationCount>2000000000</IterationCount>", 1)
+	if _, err := ParsePSKC([]byte(altered), []byte("qwerty")); err == nil {
+		t.Error("A container with an excessive iteration count has been parsed")
+	}
+	altered = strings.Replace(pskcPasswordContainer, "<KeyLength>16</KeyLength>", "<KeyLength>1000000000</KeyLength>", 1)
+	if _, err := ParsePSKC([]byte(altered), []byte("qwerty")); err == nil {
+		t.Error("A container with an excessive key length has been parsed")
+	}
+
+	// altered MAC
+	altered = strings.Replace(pskcPreSharedKeyContainer, "Su+NvtQfmvfJzF6bmQiJqoLRExc=", "Tu+NvtQfmvfJzF6bmQiJqoLRExc=", 1)
+	preSharedKey, _ := hex.DecodeString("12345678901234567890123456789012")
+	if _, err := ParsePSKC([]byte(altered), preSharedKey); err != PSKCMACMismatchError {
+		t.Errorf("Expected the MAC mismatch error, instead we've got %v\n", err)
+	}
+
+	// tampered cipher text with an invalid padding: the MAC is verified before the padding
+	original := "AAECAwQFBgcICQoLDA0OD+cIHItlB3Wra1DUpxVvOx2lef1VmNPCMl8jwZqIUqGv"
+	raw, err := base64.StdEncoding.DecodeString(original)
+	checkError(t, err)
+	c := &pskcCipher{key: preSharedKey}
+	for i := 0; i < 256; i++ {
+		raw[len(raw)-1]++
+		if _, err := c.decrypt(raw); err != nil {
+			break
+		}
+	}
+	altered = strings.Replace(pskcPreSharedKeyContainer, original, base64.StdEncoding.EncodeToString(raw), 1)
+	if _, err := ParsePSKC([]byte(altered), preSharedKey); err != PSKCMACMismatchError {
+		t.Errorf("Expected the MAC mismatch error, instead we've got %v\n", err)
+	}
+
+	// encrypted value without MAC
+	altered = strings.Replace(pskcPreSharedKeyContainer, "<ValueMAC>Su+NvtQfmvfJzF6bmQiJqoLRExc=\n                    </ValueMAC>", "", 1)
+	if _, err := ParsePSKC([]byte(altered), preSharedKey); err != PSKCMissingMACError {
+		t.Errorf("Expected the missing MAC error, instead we've got %v\n", err)
+	}
+
+	// unsupported algorithm
+	altered = strings.Replace(pskcPlainContainer, "pskc:hotp", "pskc:ocra", 1)
+	if _, err := ParsePSKC([]byte(altered), nil); err != PSKCUnsupportedKeyError {
+		t.Errorf("Expected the unsupported key error, instead we've got %v\n", err)
+	}
+
+}
+
+func TestMarshalPSKC(t *testing.T) {
+
+	totp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 7)
+	checkError(t, err)
+	totp.stepSize = 60
+	totp.clientOffset = -1
+
+	hotp, err := makeHOTP(hotpKey, "info@sec51.com", "Sec51", crypto.SHA512, 8, 42)
+	checkError(t, err)
+
+	keys := []PSKCKey{
+		{Id: "totp", SerialNumber: "TOTP-1", Manufacturer: "Sec51", Totp: totp},
+		{Id: "hotp", SerialNumber: "HOTP-1", Hotp: hotp},
+	}
+
+	preSharedKey := bytes.Repeat([]byte{0x42}, 32)
+
+	plain, err := MarshalPSKC(keys, nil)
+	checkError(t, err)
+	encrypted, err := MarshalPSKC(keys, preSharedKey)
+	checkError(t, err)
+	passwordProtected, err := MarshalPSKCWithPassword(keys, []byte("qwerty"))
+	checkError(t, err)
+
+	if bytes.Contains(encrypted, []byte("PlainValue>"+totp.Secret())) {
+		t.Error("The secret has been written in plain text")
+	}
+
+	containers := []struct {
+		data   []byte
+		secret []byte
+	}{
+		{plain, nil},
+		{encrypted, preSharedKey},
+		{passwordProtected, []byte("qwerty")},
+	}
+
+	for _, container := range containers {
+		parsed, err := ParsePSKC(container.data, container.secret)
+		checkError(t, err)
+
+		if len(parsed) != 2 {
+			t.Fatalf("Expected 2 keys, instead we've got %d\n", len(parsed))
+		}
+
+		restoredTotp := parsed[0].Totp
+		if restoredTotp == nil || parsed[0].SerialNumber != "TOTP-1" || parsed[0].Manufacturer != "Sec51" {
+			t.Fatalf("TOTP key mismatch: %+v\n", parsed[0])
+		}
+		if !bytes.Equal(restoredTotp.key, totp.key) || restoredTotp.digits != 7 || restoredTotp.stepSize != 60 ||
+			restoredTotp.clientOffset != -1 || restoredTotp.hashFunction != crypto.SHA256 ||
+			restoredTotp.label() != totp.label() {
+			t.Error("TOTP properties differ after the PSKC round trip")
+		}
+
+		restoredHotp := parsed[1].Hotp
+		if restoredHotp == nil || parsed[1].SerialNumber != "HOTP-1" {
+			t.Fatalf("HOTP key mismatch: %+v\n", parsed[1])
+		}
+		if !bytes.Equal(restoredHotp.key, hotp.key) || restoredHotp.digits != 8 || restoredHotp.Counter() != 42 ||
+			restoredHotp.hashFunction != crypto.SHA512 {
+			t.Error("HOTP properties differ after the PSKC round trip")
+		}
+	}
+
+	if _, err := MarshalPSKC(keys, []byte("short")); err == nil {
+		t.Error("An invalid pre-shared key has been accepted")
+	}
+
+}
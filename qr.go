@@ -0,0 +1,348 @@
+package twofactor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+
+	qr "github.com/sec51/qrcode"
+)
+
+const (
+	qr_default_module_size = 8   // the pixels per module of the PNG images, as in QR()
+	qr_default_quiet_zone  = 4   // the modules of the blank border required by the QR code specification
+	qr_logo_ratio          = 0.3 // the maximum side of the logo area compared to the QR code side: 9% of the modules
+	qr_logo_margin         = 1   // the light modules around the logo
+)
+
+// QRLevel is the error correction level of the QR code: the higher the level,
+// the larger the QR code and the more damage it can sustain.
+type QRLevel int
+
+const (
+	QRLevelQ QRLevel = iota // 25% of the code can be restored, the default used by QR()
+	QRLevelL                // 7% of the code can be restored
+	QRLevelM                // 15% of the code can be restored
+	QRLevelH                // 30% of the code can be restored
+)
+
+// QROptions are the options of the QR code rendering.
+// The zero value renders the same QR code of QR(): level Q, 8 pixels per module, quiet zone of 4 modules, black on white.
+type QROptions struct {
+	Level      QRLevel
+	ModuleSize int         // the pixels of each module in the PNG and SVG images, default 8
+	QuietZone  int         // the modules of the blank border, default 4, a negative value removes it
+	Foreground color.Color // the color of the dark modules, default black
+	Background color.Color // the color of the light modules and of the quiet zone, default white
+	Logo       image.Image // drawn at the center of the PNG and SVG images, it raises the error correction level to H
+}
+
+// QRCode is a QR code which can be rendered as PNG, SVG or text for the terminals.
+// The QR codes of the key URLs contain the secret key: they need the same precautions of the QR() images.
+type QRCode struct {
+	code      *qr.Code
+	size      int // the modules of the QR code, without the quiet zone
+	quietZone int
+	scale     int
+	dark      color.RGBA
+	light     color.RGBA
+	logo      image.Image
+	logoArea  image.Rectangle // the modules covered by the logo and its margin, without the quiet zone
+	logoImage image.Rectangle // the modules where the logo is drawn
+}
+
+// This function encodes the text in a QR code with the given options
+func NewQRCode(text string, options QROptions) (*QRCode, error) {
+
+	// the logo hides some modules: the highest error correction level restores them
+	if options.Logo != nil {
+		options.Level = QRLevelH
+	}
+
+	var level qr.Level
+	switch options.Level {
+	case QRLevelQ:
+		level = qr.Q
+	case QRLevelL:
+		level = qr.L
+	case QRLevelM:
+		level = qr.M
+	case QRLevelH:
+		level = qr.H
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported QR code level %d", options.Level))
+	}
+
+	code, err := qr.Encode(text, level)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &QRCode{
+		code:      code,
+		size:      code.Size,
+		quietZone: options.QuietZone,
+		scale:     options.ModuleSize,
+		dark:      color.RGBA{0, 0, 0, 0xff},
+		light:     color.RGBA{0xff, 0xff, 0xff, 0xff},
+	}
+	if c.quietZone == 0 {
+		c.quietZone = qr_default_quiet_zone
+	} else if c.quietZone < 0 {
+		c.quietZone = 0
+	}
+	if c.scale <= 0 {
+		c.scale = qr_default_module_size
+	}
+	if options.Foreground != nil {
+		c.dark = color.RGBAModel.Convert(options.Foreground).(color.RGBA)
+	}
+	if options.Background != nil {
+		c.light = color.RGBAModel.Convert(options.Background).(color.RGBA)
+	}
+	if options.Logo != nil {
+		if err := c.placeLogo(options.Logo); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Private function which computes the area of the logo at the center of the QR code.
+// The logo keeps its aspect ratio and its area, margin included, is at most qr_logo_ratio of each side:
+// the modules it hides are restored by the level H error correction, which tolerates 30% of damaged codewords.
+func (c *QRCode) placeLogo(logo image.Image) error {
+
+	bounds := logo.Bounds()
+	if bounds.Empty() {
+		return errors.New("The QR code logo is empty")
+	}
+
+	maxSide := int(float64(c.size)*qr_logo_ratio) - 2*qr_logo_margin
+	if maxSide < 1 {
+		return errors.New("The QR code is too small for a logo")
+	}
+
+	// fit the logo in the square keeping its aspect ratio
+	width, height := maxSide, maxSide
+	if bounds.Dx() > bounds.Dy() {
+		height = maxSide * bounds.Dy() / bounds.Dx()
+	} else {
+		width = maxSide * bounds.Dx() / bounds.Dy()
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	x := (c.size - width) / 2
+	y := (c.size - height) / 2
+	c.logo = logo
+	c.logoImage = image.Rect(x, y, x+width, y+height)
+	c.logoArea = c.logoImage.Inset(-qr_logo_margin)
+	return nil
+}
+
+// Private function which reports whether the module is dark, the coordinates include the quiet zone
+func (c *QRCode) isDark(x, y int) bool {
+	x, y = x-c.quietZone, y-c.quietZone
+	if image.Pt(x, y).In(c.logoArea) {
+		return false
+	}
+	return c.code.Black(x, y)
+}
+
+// Private function which returns the modules of each side, including the quiet zone
+func (c *QRCode) modules() int {
+	return c.size + 2*c.quietZone
+}
+
+// PNG returns the PNG image of the QR code
+func (c *QRCode) PNG() ([]byte, error) {
+
+	side := c.modules() * c.scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{c.light, c.dark})
+	for y := 0; y < c.modules(); y++ {
+		for x := 0; x < c.modules(); x++ {
+			if !c.isDark(x, y) {
+				continue
+			}
+			for py := y * c.scale; py < (y+1)*c.scale; py++ {
+				row := img.Pix[py*img.Stride:]
+				for px := x * c.scale; px < (x+1)*c.scale; px++ {
+					row[px] = 1
+				}
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	if c.logo == nil {
+		if err := png.Encode(&buffer, img); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+
+	// the logo needs a true color image
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, image.Point{}, draw.Src)
+	logoRect := c.logoImage.Add(image.Pt(c.quietZone, c.quietZone))
+	logoRect = image.Rectangle{logoRect.Min.Mul(c.scale), logoRect.Max.Mul(c.scale)}
+	draw.Draw(rgba, logoRect, scaleImage(c.logo, logoRect.Dx(), logoRect.Dy()), image.Point{}, draw.Over)
+
+	if err := png.Encode(&buffer, rgba); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Private function which resizes the image, each pixel is the average of the source pixels it covers
+func scaleImage(src image.Image, width, height int) image.Image {
+
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			// average the alpha premultiplied values, then convert back to non premultiplied
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// DataURI returns the PNG image as data URI, which can be embedded in the src attribute of an HTML img element
+func (c *QRCode) DataURI() (string, error) {
+	data, err := c.PNG()
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// SVG returns the SVG image of the QR code. The horizontal runs of dark modules are drawn as a single path,
+// the background is omitted when its color is fully transparent.
+func (c *QRCode) SVG() string {
+
+	var path bytes.Buffer
+	for y := 0; y < c.modules(); y++ {
+		for x := 0; x < c.modules(); x++ {
+			if !c.isDark(x, y) {
+				continue
+			}
+			start := x
+			for x < c.modules() && c.isDark(x, y) {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+
+	side := c.modules() * c.scale
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		side, side, c.modules(), c.modules())
+	if c.light.A != 0 {
+		fmt.Fprintf(&svg, `<rect width="100%%" height="100%%" %s/>`, svgFill(c.light))
+	}
+	fmt.Fprintf(&svg, `<path d="%s" %s/>`, path.String(), svgFill(c.dark))
+	if c.logo != nil {
+		logoRect := c.logoImage.Add(image.Pt(c.quietZone, c.quietZone))
+		// the logo is embedded with the resolution of the PNG image
+		var logo bytes.Buffer
+		if err := png.Encode(&logo, scaleImage(c.logo, logoRect.Dx()*c.scale, logoRect.Dy()*c.scale)); err == nil {
+			fmt.Fprintf(&svg, `<image x="%d" y="%d" width="%d" height="%d" href="data:image/png;base64,%s"/>`,
+				logoRect.Min.X, logoRect.Min.Y, logoRect.Dx(), logoRect.Dy(), base64.StdEncoding.EncodeToString(logo.Bytes()))
+		}
+	}
+	svg.WriteString("</svg>")
+	return svg.String()
+}
+
+// Private function which returns the SVG fill attributes of the color
+func svgFill(c color.RGBA) string {
+	if c.A == 0xff {
+		return fmt.Sprintf(`fill="#%02x%02x%02x"`, c.R, c.G, c.B)
+	}
+
+	if c.A == 0 {
+		return `fill="none"`
+	}
+
+	// the RGBA colors are alpha premultiplied
+	alpha := float64(c.A) / 0xff
+	return fmt.Sprintf(`fill="#%02x%02x%02x" fill-opacity="%.3f"`,
+		uint8(float64(c.R)/alpha), uint8(float64(c.G)/alpha), uint8(float64(c.B)/alpha), alpha)
+}
+
+// Terminal returns the QR code drawn with Unicode half blocks and ANSI 24 bit colors, two modules per character.
+// The logo cannot be drawn on the terminal: its area is left blank.
+// The colors are explicit, therefore the QR code can be scanned on both the light and the dark terminals.
+func (c *QRCode) Terminal() string {
+
+	var out bytes.Buffer
+	for y := 0; y < c.modules(); y += 2 {
+		for x := 0; x < c.modules(); x++ {
+			upper, lower := c.light, c.light
+			if c.isDark(x, y) {
+				upper = c.dark
+			}
+			if y+1 < c.modules() && c.isDark(x, y+1) {
+				lower = c.dark
+			}
+			fmt.Fprintf(&out, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", upper.R, upper.G, upper.B, lower.R, lower.G, lower.B)
+		}
+		out.WriteString("\x1b[0m\n")
+	}
+	return out.String()
+}
+
+// Text returns the QR code drawn with Unicode half blocks without colors, two modules per character.
+// The light modules are drawn with the text color, so that the QR code can be scanned on the terminals
+// with a dark background, which are the most common ones. Use Terminal for the light backgrounds.
+// As in Terminal, the logo area is left blank.
+func (c *QRCode) Text() string {
+
+	blocks := []string{" ", "▄", "▀", "█"} // none, lower, upper, both
+	var out bytes.Buffer
+	for y := 0; y < c.modules(); y += 2 {
+		for x := 0; x < c.modules(); x++ {
+			index := 0
+			if !c.isDark(x, y) {
+				index |= 2
+			}
+			if y+1 >= c.modules() || !c.isDark(x, y+1) {
+				index |= 1
+			}
+			out.WriteString(blocks[index])
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
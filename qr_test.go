@@ -0,0 +1,151 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestQRCodeDefaults(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	// the default options render the same image of QR()
+	expected, err := otp.QR()
+	checkError(t, err)
+
+	code, err := otp.QRCode(QROptions{})
+	checkError(t, err)
+	data, err := code.PNG()
+	checkError(t, err)
+
+	expectedImage, err := png.Decode(bytes.NewReader(expected))
+	checkError(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	checkError(t, err)
+
+	if img.Bounds() != expectedImage.Bounds() {
+		t.Fatalf("Image size mismatch: got %v, expected %v\n", img.Bounds(), expectedImage.Bounds())
+	}
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			r1, _, _, _ := img.At(x, y).RGBA()
+			r2, _, _, _ := expectedImage.At(x, y).RGBA()
+			if r1 != r2 {
+				t.Fatalf("Pixel mismatch at %d,%d\n", x, y)
+			}
+		}
+	}
+
+	uri, err := code.DataURI()
+	checkError(t, err)
+	if !strings.HasPrefix(uri, "data:image/png;base64,iVBORw0KGgo") {
+		t.Errorf("Invalid data URI: %s\n", uri[:40])
+	}
+}
+
+func TestQRCodeOptions(t *testing.T) {
+
+	code, err := NewQRCode("otpauth://totp/Sec51:info@sec51.com?secret=JBSWY3DPEHPK3PXP", QROptions{
+		Level:      QRLevelH,
+		ModuleSize: 3,
+		QuietZone:  -1,
+		Foreground: color.RGBA{0x11, 0x22, 0x33, 0xff},
+		Background: color.Transparent,
+	})
+	checkError(t, err)
+
+	data, err := code.PNG()
+	checkError(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	checkError(t, err)
+	if img.Bounds().Dx() != code.size*3 {
+		t.Errorf("Expected a %d pixels image without quiet zone, instead we've got %d\n", code.size*3, img.Bounds().Dx())
+	}
+
+	// the finder pattern is in the top left corner, without quiet zone
+	if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 != 0x11 || g>>8 != 0x22 || b>>8 != 0x33 {
+		t.Errorf("Unexpected foreground color %x %x %x\n", r, g, b)
+	}
+
+	svg := code.SVG()
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, `fill="#112233"`) || strings.Contains(svg, "<rect") {
+		t.Errorf("Unexpected SVG: %s\n", svg[:120])
+	}
+
+	if _, err := NewQRCode("text", QROptions{Level: QRLevel(10)}); err == nil {
+		t.Error("The invalid QR level has been accepted")
+	}
+}
+
+func TestQRCodeTerminal(t *testing.T) {
+
+	code, err := NewQRCode("otpauth://totp/Sec51:info@sec51.com?secret=JBSWY3DPEHPK3PXP", QROptions{})
+	checkError(t, err)
+
+	rows := (code.modules() + 1) / 2
+
+	text := code.Text()
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if len(lines) != rows {
+		t.Fatalf("Expected %d text rows, instead we've got %d\n", rows, len(lines))
+	}
+	// the first row is the quiet zone, drawn with full blocks
+	if lines[0] != strings.Repeat("█", code.modules()) {
+		t.Errorf("Unexpected quiet zone row: %q\n", lines[0])
+	}
+
+	terminal := code.Terminal()
+	if strings.Count(terminal, "\n") != rows || strings.Count(terminal, "▀") != rows*code.modules() {
+		t.Error("Unexpected terminal rendering size")
+	}
+	if !strings.Contains(terminal, "\x1b[38;2;0;0;0m") {
+		t.Error("The terminal rendering does not contain the dark color")
+	}
+}
+
+// testLogo returns a colorful logo, with a transparent border
+func testLogo(width, height int) image.Image {
+	logo := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 2; y < height-2; y++ {
+		for x := 2; x < width-2; x++ {
+			logo.Set(x, y, color.NRGBA{uint8(x * 255 / width), 0x40, uint8(y * 255 / height), 0xff})
+		}
+	}
+	return logo
+}
+
+func TestQRCodeLogo(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA512, 8)
+	checkError(t, err)
+
+	for _, logo := range []image.Image{testLogo(200, 200), testLogo(300, 100), testLogo(8, 40)} {
+		code, err := otp.QRCode(QROptions{Level: QRLevelL, Logo: logo})
+		checkError(t, err)
+
+		if code.logoArea.Empty() || code.logoArea.Dx() > int(float64(code.size)*qr_logo_ratio) {
+			t.Errorf("Unexpected logo area %v for a QR code of %d modules\n", code.logoArea, code.size)
+		}
+
+		data, err := code.PNG()
+		checkError(t, err)
+
+		// the logo is drawn at the center
+		img, err := png.Decode(bytes.NewReader(data))
+		checkError(t, err)
+		center := img.Bounds().Dx() / 2
+		if _, g, _, _ := img.At(center, center).RGBA(); g>>8 != 0x40 {
+			t.Errorf("The logo is not drawn at the center of the QR code\n")
+		}
+
+		if svg := code.SVG(); !strings.Contains(svg, `<image `) {
+			t.Error("The SVG image does not contain the logo")
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Package qrdecode reads the QR codes of the screenshots and of the photos, to import the accounts of other services:
+
+	entries, err := qrdecode.Entries(data)
+
+A QR code with an otpauth:// key URL returns a single Totp or Hotp, an otpauth-migration:// export of
+Google Authenticator returns all the entries of the batch.
+The decoding is a separate package, so that the importers of twofactor do not depend on the QR decoder.
+*/
+package qrdecode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/sec51/twofactor"
+)
+
+const (
+	max_image_pixels = 4096 * 4096 // a 4K screenshot fits, the decoding of larger images could exhaust the memory
+	migration_prefix = "otpauth-migration://"
+)
+
+var (
+	NotFoundError  = errors.New("The image does not contain a readable QR code.")
+	PayloadError   = errors.New("The QR code does not contain an otpauth or otpauth-migration URL.")
+	ImageSizeError = errors.New("The image is too large to be decoded.")
+)
+
+// Decode locates the QR code in the PNG, JPEG or GIF image and returns its text.
+// The image can be a screenshot: the QR code does not need to fill the image, and light on dark codes are supported.
+// The size is checked from the header before the pixels are decoded: images above 4096x4096 pixels are refused.
+func Decode(data []byte) (string, error) {
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("The image cannot be decoded: %s", err))
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > max_image_pixels {
+		return "", ImageSizeError
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("The image cannot be decoded: %s", err))
+	}
+
+	text, err := decodeQR(img)
+	if isQRNotFound(err) {
+		// some apps display the QR code with light modules on a dark background
+		text, err = decodeQR(&invertedImage{img})
+	}
+
+	if isQRNotFound(err) {
+		return "", NotFoundError
+	}
+	return text, err
+}
+
+// Entries decodes the QR code of the image and converts its content in Totp and Hotp objects:
+// an otpauth:// key URL returns a single entry, an otpauth-migration:// export returns all the entries of the batch.
+// The QR code contains the secret keys, therefore the image needs to be deleted once imported.
+func Entries(data []byte) ([]twofactor.MigrationEntry, error) {
+
+	text, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	text = strings.TrimSpace(text)
+
+	lower := strings.ToLower(text)
+	switch {
+	case strings.HasPrefix(lower, "otpauth://totp/"):
+		otp, err := twofactor.TOTPFromURL(text)
+		if err != nil {
+			return nil, err
+		}
+		return []twofactor.MigrationEntry{{Totp: otp}}, nil
+	case strings.HasPrefix(lower, "otpauth://hotp/"):
+		otp, err := twofactor.HOTPFromURL(text)
+		if err != nil {
+			return nil, err
+		}
+		return []twofactor.MigrationEntry{{Hotp: otp}}, nil
+	case strings.HasPrefix(lower, migration_prefix):
+		batch, err := twofactor.ParseMigrationURL(text)
+		if err != nil {
+			return nil, err
+		}
+		return batch.Entries, nil
+	}
+
+	return nil, PayloadError
+}
+
+// TOTP decodes the QR code of the image, which must contain a single TOTP account.
+func TOTP(data []byte) (*twofactor.Totp, error) {
+
+	entries, err := Entries(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) != 1 || entries[0].Totp == nil {
+		return nil, errors.New("The QR code does not contain a single TOTP account, use Entries")
+	}
+	return entries[0].Totp, nil
+}
+
+// Private function which decodes the QR code of the image
+func decodeQR(img image.Image) (string, error) {
+
+	bitmap, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", err
+	}
+
+	hints := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bitmap, hints)
+	if err != nil {
+		// the finder patterns detection sometimes fails on the generated images, which contain only the QR code
+		hints[gozxing.DecodeHintType_PURE_BARCODE] = true
+		result, err = qrcode.NewQRCodeReader().Decode(bitmap, hints)
+	}
+	if err != nil {
+		return "", err
+	}
+	return result.GetText(), nil
+}
+
+// Private function which tells whether the error means that no readable QR code has been found
+func isQRNotFound(err error) bool {
+	switch err.(type) {
+	case gozxing.NotFoundException, gozxing.ChecksumException, gozxing.FormatException:
+		return true
+	}
+	return false
+}
+
+// invertedImage swaps the light and the dark colors of the image
+type invertedImage struct {
+	image.Image
+}
+
+func (img *invertedImage) ColorModel() color.Model {
+	return color.RGBA64Model
+}
+
+func (img *invertedImage) At(x, y int) color.Color {
+	r, g, b, a := img.Image.At(x, y).RGBA()
+	return color.RGBA64{uint16(a - r), uint16(a - g), uint16(a - b), uint16(a)}
+}
@@ -0,0 +1,181 @@
+package qrdecode
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/sec51/twofactor"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustDecode returns the text of the QR code image
+func mustDecode(t *testing.T, data []byte) string {
+	text, err := Decode(data)
+	checkError(t, err)
+	return text
+}
+
+func TestTOTP(t *testing.T) {
+
+	otp, err := twofactor.TOTPFromURL("otpauth://totp/Sec51:info@sec51.com?secret=HXDMVJECJJWSRB3HWIZR4IFUGFTMXBOZ&issuer=Sec51&algorithm=SHA256&digits=8&period=60")
+	checkError(t, err)
+	u, err := otp.URL()
+	checkError(t, err)
+
+	data, err := otp.QR()
+	checkError(t, err)
+
+	restored, err := TOTP(data)
+	checkError(t, err)
+	restoredURL, err := restored.URL()
+	checkError(t, err)
+	if restoredURL != u {
+		t.Errorf("TOTP properties differ after the QR code round trip: %s, expected %s\n", restoredURL, u)
+	}
+}
+
+func TestDecodeScreenshot(t *testing.T) {
+
+	otp, err := twofactor.NewHOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	u, err := otp.URL()
+	checkError(t, err)
+
+	// a small QR code in the corner of a larger gray JPEG screenshot
+	code, err := otp.QRCode(twofactor.QROptions{ModuleSize: 4})
+	checkError(t, err)
+	data, err := code.PNG()
+	checkError(t, err)
+	qrImage, err := png.Decode(bytes.NewReader(data))
+	checkError(t, err)
+
+	screenshot := image.NewRGBA(image.Rect(0, 0, 1080, 1920))
+	draw.Draw(screenshot, screenshot.Bounds(), &image.Uniform{color.RGBA{0xee, 0xee, 0xee, 0xff}}, image.Point{}, draw.Src)
+	offset := image.Pt(600, 1200)
+	draw.Draw(screenshot, qrImage.Bounds().Add(offset), qrImage, image.Point{}, draw.Src)
+
+	var buffer bytes.Buffer
+	checkError(t, jpeg.Encode(&buffer, screenshot, &jpeg.Options{Quality: 85}))
+
+	entries, err := Entries(buffer.Bytes())
+	checkError(t, err)
+	if len(entries) != 1 || entries[0].Hotp == nil {
+		t.Fatal("The HOTP has not been decoded from the screenshot")
+	}
+	restored, err := entries[0].Hotp.URL()
+	checkError(t, err)
+	if restored != u {
+		t.Errorf("HOTP mismatch: got %s, expected %s\n", restored, u)
+	}
+}
+
+func TestDecodeInvertedQRImage(t *testing.T) {
+
+	text := "otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example"
+	code, err := twofactor.NewQRCode(text, twofactor.QROptions{Foreground: color.White, Background: color.Black})
+	checkError(t, err)
+	data, err := code.PNG()
+	checkError(t, err)
+
+	if decoded := mustDecode(t, data); decoded != text {
+		t.Errorf("The inverted QR code decodes to %s\n", decoded)
+	}
+}
+
+func TestDecodeMigrationQRImage(t *testing.T) {
+
+	var entries []twofactor.MigrationEntry
+	for _, account := range []string{"alice@sec51.com", "bob@sec51.com", "carol@sec51.com"} {
+		otp, err := twofactor.NewTOTP(account, "Sec51", crypto.SHA1, 6)
+		checkError(t, err)
+		entries = append(entries, twofactor.MigrationEntry{Totp: otp})
+	}
+
+	batches, err := twofactor.NewMigrationBatches(entries, 0)
+	checkError(t, err)
+	data, err := batches[0].QR()
+	checkError(t, err)
+
+	restored, err := Entries(data)
+	checkError(t, err)
+	if len(restored) != 3 || restored[2].Totp == nil {
+		t.Fatal("The migration entries have not been decoded")
+	}
+	state, err := restored[2].Totp.State()
+	checkError(t, err)
+	if state.Account != "carol@sec51.com" {
+		t.Errorf("Expected the account carol@sec51.com, got %s\n", state.Account)
+	}
+
+	// a migration export is not a single TOTP
+	if _, err := TOTP(data); err == nil {
+		t.Error("The migration export has been accepted as a single TOTP")
+	}
+}
+
+func TestDecodeQRImageErrors(t *testing.T) {
+
+	code, err := twofactor.NewQRCode("https://www.sec51.com", twofactor.QROptions{})
+	checkError(t, err)
+	data, err := code.PNG()
+	checkError(t, err)
+	if _, err := Entries(data); err != PayloadError {
+		t.Errorf("Expected PayloadError, instead we've got %v\n", err)
+	}
+
+	blank := image.NewGray(image.Rect(0, 0, 200, 200))
+	var buffer bytes.Buffer
+	checkError(t, png.Encode(&buffer, blank))
+	if _, err := Decode(buffer.Bytes()); err != NotFoundError {
+		t.Errorf("Expected NotFoundError, instead we've got %v\n", err)
+	}
+
+	if _, err := Decode([]byte("not an image")); err == nil {
+		t.Error("The invalid image has been accepted")
+	}
+
+	// a header of 65536x65536 pixels is refused before the pixels are decoded
+	huge := append([]byte{}, buffer.Bytes()...)
+	binary.BigEndian.PutUint32(huge[16:20], 1<<16)
+	binary.BigEndian.PutUint32(huge[20:24], 1<<16)
+	binary.BigEndian.PutUint32(huge[29:33], crc32.ChecksumIEEE(huge[12:29]))
+	if _, err := Decode(huge); err != ImageSizeError {
+		t.Errorf("Expected ImageSizeError, instead we've got %v\n", err)
+	}
+}
+
+func TestDecodeGeneratedQRCodes(t *testing.T) {
+
+	text := "otpauth://hotp/Sec51:info@sec51.com?secret=JBSWY3DPEHPK3PXP&counter=3"
+	code, err := twofactor.NewQRCode(text, twofactor.QROptions{Level: twofactor.QRLevelM, ModuleSize: 4})
+	checkError(t, err)
+	data, err := code.PNG()
+	checkError(t, err)
+	if decoded := mustDecode(t, data); decoded != text {
+		t.Errorf("The QR code decodes to %s\n", decoded)
+	}
+
+	// the logo at the center does not prevent the decoding
+	logo := image.NewNRGBA(image.Rect(0, 0, 200, 200))
+	draw.Draw(logo, logo.Bounds(), &image.Uniform{color.NRGBA{0x80, 0x40, 0x80, 0xff}}, image.Point{}, draw.Src)
+	code, err = twofactor.NewQRCode(text, twofactor.QROptions{Level: twofactor.QRLevelL, Logo: logo})
+	checkError(t, err)
+	data, err = code.PNG()
+	checkError(t, err)
+	if decoded := mustDecode(t, data); decoded != text {
+		t.Errorf("The QR code with logo decodes to %s\n", decoded)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Package redisbackend implements the twofactor.StateBackend with Redis, so that the used codes and the verification
+failures are shared by all the replicas of a service:
+
+	backend := redisbackend.New(redis.NewClient(&redis.Options{Addr: "localhost:6379"}), "")
+	otp, err := twofactor.TOTPFromBytes(data, issuer)
+	...
+	otp.SetStateBackend(backend)
+	err = otp.ValidateContext(ctx, userCode)
+
+The backend is a twofactor.ContextStateBackend: the context of ValidateContext is passed to the Redis commands,
+so that they are cancelled with the request and, with the OpenTelemetry instrumentation of the client,
+traced as children of the twofactor.Validate span of tracing.Validate.
+
+The go-redis v9 import path has a major version suffix: the package builds only in module mode.
+
+The keys expire with the TTL given by the TOTP, no cleanup is needed.
+*/
+package redisbackend
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	default_prefix = "twofactor:"
+)
+
+// Backend is a twofactor.StateBackend stored in Redis
+type Backend struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// New creates a backend with the Redis client, which can be a single node, a sentinel or a cluster client.
+// The keys start with the prefix, "twofactor:" when empty. The timeouts are the ones of the client options.
+func New(client redis.UniversalClient, prefix string) *Backend {
+	if prefix == "" {
+		prefix = default_prefix
+	}
+	return &Backend{client: client, prefix: prefix}
+}
+
+// MarkUsed records the time step with SET NX, it returns false when it had already been marked
+func (b *Backend) MarkUsed(id string, step uint64, ttl time.Duration) (bool, error) {
+	return b.MarkUsedContext(context.Background(), id, step, ttl)
+}
+
+// MarkUsedContext is MarkUsed with the context of the Redis command
+func (b *Backend) MarkUsedContext(ctx context.Context, id string, step uint64, ttl time.Duration) (bool, error) {
+	return b.client.SetNX(ctx, b.usedKey(id, step), 1, ttl).Result()
+}
+
+// Failures returns the current amount of failures
+func (b *Backend) Failures(id string) (int, error) {
+	return b.FailuresContext(context.Background(), id)
+}
+
+// FailuresContext is Failures with the context of the Redis command
+func (b *Backend) FailuresContext(ctx context.Context, id string) (int, error) {
+	failures, err := b.client.Get(ctx, b.failuresKey(id)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return failures, err
+}
+
+// AddFailure increments the failures and sets their expiry, in a single transaction
+func (b *Backend) AddFailure(id string, ttl time.Duration) (int, error) {
+	return b.AddFailureContext(context.Background(), id, ttl)
+}
+
+// AddFailureContext is AddFailure with the context of the Redis transaction
+func (b *Backend) AddFailureContext(ctx context.Context, id string, ttl time.Duration) (int, error) {
+	key := b.failuresKey(id)
+	var incr *redis.IntCmd
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+// ResetFailures clears the failures, so that a locked down user can verify again without waiting
+func (b *Backend) ResetFailures(id string) error {
+	return b.client.Del(context.Background(), b.failuresKey(id)).Err()
+}
+
+// Private function which returns the key of the used time step
+func (b *Backend) usedKey(id string, step uint64) string {
+	return fmt.Sprintf("%sused:%s:%d", b.prefix, id, step)
+}
+
+// Private function which returns the key of the failures
+func (b *Backend) failuresKey(id string) string {
+	return fmt.Sprintf("%sfailures:%s", b.prefix, id)
+}
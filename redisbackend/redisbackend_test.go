@@ -0,0 +1,142 @@
+package redisbackend
+
+import (
+	"context"
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sec51/twofactor"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestBackend(t *testing.T) (*Backend, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return New(client, ""), server
+}
+
+func TestMarkUsed(t *testing.T) {
+
+	backend, server := newTestBackend(t)
+
+	first, err := backend.MarkUsed("Sec51:info@sec51.com", 10, 90*time.Second)
+	checkError(t, err)
+	again, err := backend.MarkUsed("Sec51:info@sec51.com", 10, 90*time.Second)
+	checkError(t, err)
+	if !first || again {
+		t.Error("The time step has not been marked once")
+	}
+
+	if ttl := server.TTL("twofactor:used:Sec51:info@sec51.com:10"); ttl != 90*time.Second {
+		t.Errorf("Unexpected TTL of the marker: %s\n", ttl)
+	}
+
+	server.FastForward(91 * time.Second)
+	again, err = backend.MarkUsed("Sec51:info@sec51.com", 10, 90*time.Second)
+	checkError(t, err)
+	if !again {
+		t.Error("The marker of the time step has not expired")
+	}
+}
+
+func TestFailures(t *testing.T) {
+
+	backend, server := newTestBackend(t)
+
+	failures, err := backend.Failures("Sec51:info@sec51.com")
+	checkError(t, err)
+	if failures != 0 {
+		t.Errorf("Expected no failures, got %d\n", failures)
+	}
+
+	for i := 1; i <= 3; i++ {
+		failures, err = backend.AddFailure("Sec51:info@sec51.com", 5*time.Minute)
+		checkError(t, err)
+		if failures != i {
+			t.Errorf("Expected %d failures, got %d\n", i, failures)
+		}
+	}
+
+	// the failures expire after the ttl from the last one
+	server.FastForward(5*time.Minute + time.Second)
+	failures, err = backend.Failures("Sec51:info@sec51.com")
+	checkError(t, err)
+	if failures != 0 {
+		t.Errorf("Expected the failures to expire, got %d\n", failures)
+	}
+
+	_, err = backend.AddFailure("Sec51:info@sec51.com", 5*time.Minute)
+	checkError(t, err)
+	checkError(t, backend.ResetFailures("Sec51:info@sec51.com"))
+	failures, err = backend.Failures("Sec51:info@sec51.com")
+	checkError(t, err)
+	if failures != 0 {
+		t.Errorf("Expected the failures to be reset, got %d\n", failures)
+	}
+}
+
+func TestValidateAcrossReplicas(t *testing.T) {
+
+	backend, server := newTestBackend(t)
+
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	data, err := otp.ToBytes()
+	checkError(t, err)
+
+	replicas := make([]*twofactor.Totp, 2)
+	for i := range replicas {
+		replicas[i], err = twofactor.TOTPFromBytes(data, "Sec51")
+		checkError(t, err)
+		replicas[i].SetStateBackend(backend)
+	}
+
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, replicas[0].Validate(code))
+	if err := replicas[1].Validate(code); err != twofactor.ReplayError {
+		t.Errorf("Expected ReplayError, got %v\n", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := replicas[i%2].Validate("000000x"); err == nil {
+			t.Error("The wrong code has been accepted")
+		}
+	}
+	if err := replicas[1].Validate(code); err != twofactor.LockDownError {
+		t.Errorf("Expected LockDownError, got %v\n", err)
+	}
+
+	// the backend is unavailable
+	server.Close()
+	if err := replicas[0].Validate(code); err == nil {
+		t.Error("The code has been accepted without the backend")
+	}
+}
+
+func TestValidateContextCancelled(t *testing.T) {
+
+	backend, _ := newTestBackend(t)
+
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	otp.SetStateBackend(backend)
+
+	code, err := otp.OTP()
+	checkError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := otp.ValidateContext(ctx, code); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v\n", err)
+	}
+	checkError(t, otp.ValidateContext(context.Background(), code))
+}
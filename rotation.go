@@ -0,0 +1,154 @@
+package twofactor
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	RotationPendingError      = errors.New("A secret rotation is already in progress.")
+	NoRotationError           = errors.New("There is no secret rotation in progress.")
+	RotationBytesVersionError = errors.New("The secret rotation can be serialized only with BytesVersion2.")
+)
+
+// StartRotation generates the next secret key of the TOTP, to be offered to the user with RotationQR.
+// Until the end of the grace period both the current and the next secret are accepted by Validate:
+// the first code validated with the next secret promotes it and discards the current one.
+// Once the grace period has ended the next secret is promoted anyway, so the users who did not scan the new QR code
+// need to enroll again.
+// The rotation is stored in the extension records, therefore it requires ToBytesWith and BytesVersion2.
+func (otp *Totp) StartRotation(grace time.Duration) error {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return err
+	}
+
+	if otp.nextKey != nil {
+		return RotationPendingError
+	}
+
+	if grace <= 0 {
+		return errors.New("The rotation grace period must be positive")
+	}
+
+	keySize := otp.hashFunction.Size()
+	key := make([]byte, keySize)
+	total, err := rand.Read(key)
+	if err != nil {
+		return errors.New(fmt.Sprintf("TOTP failed to rotate because there is not enough entropy, we got only %d random bytes", total))
+	}
+
+	otp.nextKey = key
+	otp.rotationDeadline = time.Now().UTC().Add(grace)
+	return nil
+}
+
+// CancelRotation discards the next secret key, only the current one is accepted
+func (otp *Totp) CancelRotation() {
+	otp.nextKey = nil
+	otp.rotationDeadline = time.Time{}
+}
+
+// RotationDeadline returns the end of the grace period of the rotation in progress, and whether a rotation is in progress
+func (otp *Totp) RotationDeadline() (time.Time, bool) {
+	otp.expireRotation()
+	return otp.rotationDeadline, otp.nextKey != nil
+}
+
+// RotationURL returns the otpauth URL of the next secret key, the same precautions of URL apply
+func (otp *Totp) RotationURL() (string, error) {
+	next, err := otp.nextTotp()
+	if err != nil {
+		return "", err
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "RotationURL")
+	return next.keyURL()
+}
+
+// RotationQR returns the PNG QR code of the next secret key, the same precautions of QR apply
+func (otp *Totp) RotationQR() ([]byte, error) {
+	next, err := otp.nextTotp()
+	if err != nil {
+		return nil, err
+	}
+	u, err := next.keyURL()
+	if err != nil {
+		return nil, err
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "RotationQR")
+	return encodeQR(u)
+}
+
+// RotationQRCode returns the QR code of the next secret key with the given options
+func (otp *Totp) RotationQRCode(options QROptions) (*QRCode, error) {
+	next, err := otp.nextTotp()
+	if err != nil {
+		return nil, err
+	}
+	u, err := next.keyURL()
+	if err != nil {
+		return nil, err
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "RotationQRCode")
+	return NewQRCode(u, options)
+}
+
+// RotationSecret returns the base32 next secret key, for the users who cannot scan the QR code
+func (otp *Totp) RotationSecret() (string, error) {
+	next, err := otp.nextTotp()
+	if err != nil {
+		return "", err
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "RotationSecret")
+	return base32.StdEncoding.EncodeToString(next.key), nil
+}
+
+// Private function which returns a copy of the TOTP with the next secret key
+func (otp *Totp) nextTotp() (*Totp, error) {
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return nil, err
+	}
+
+	otp.expireRotation()
+	if otp.nextKey == nil {
+		return nil, NoRotationError
+	}
+
+	next := *otp
+	next.key = otp.nextKey
+	next.nextKey = nil
+	next.rotationDeadline = time.Time{}
+	next.clientOffset = 0
+	return &next, nil
+}
+
+// Private function which checks the user code against the next secret key,
+// it returns the offset of the matching step and whether a step matched
+func (otp *Totp) matchNextKey(userCode string, now time.Time) (int, bool) {
+	if otp.nextKey == nil {
+		return 0, false
+	}
+	next := *otp
+	next.key = otp.nextKey
+	return matchTOTP(&next, userCode, now)
+}
+
+// Private function which promotes the next secret key, wiping the current one
+func (otp *Totp) promoteNextKey() {
+	wipe(otp.key)
+	otp.key = otp.nextKey
+	otp.nextKey = nil
+	otp.rotationDeadline = time.Time{}
+	otp.clientOffset = 0
+}
+
+// Private function which promotes the next secret key once the grace period has ended
+func (otp *Totp) expireRotation() {
+	if otp.nextKey != nil && !time.Now().UTC().Before(otp.rotationDeadline) {
+		otp.promoteNextKey()
+	}
+}
@@ -0,0 +1,164 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+	"time"
+)
+
+func TestRotation(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	currentSecret := otp.Secret()
+
+	if _, err := otp.RotationURL(); err != NoRotationError {
+		t.Errorf("Expected NoRotationError, got %v\n", err)
+	}
+
+	checkError(t, otp.StartRotation(24*time.Hour))
+	if err := otp.StartRotation(24 * time.Hour); err != RotationPendingError {
+		t.Errorf("Expected RotationPendingError, got %v\n", err)
+	}
+
+	deadline, pending := otp.RotationDeadline()
+	if !pending || deadline.Before(time.Now().Add(23*time.Hour)) {
+		t.Errorf("Unexpected rotation deadline %s\n", deadline)
+	}
+
+	nextSecret, err := otp.RotationSecret()
+	checkError(t, err)
+	if nextSecret == currentSecret {
+		t.Error("The next secret is the current one")
+	}
+
+	// the QR code offers the next secret
+	u, err := otp.RotationURL()
+	checkError(t, err)
+	next, err := TOTPFromURL(u)
+	checkError(t, err)
+	if next.Secret() != nextSecret {
+		t.Error("The rotation URL does not contain the next secret")
+	}
+	_, err = otp.RotationQR()
+	checkError(t, err)
+
+	// the current secret is still accepted during the grace period
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, otp.Validate(code))
+	if otp.Secret() != currentSecret {
+		t.Error("The current secret has been replaced")
+	}
+
+	// the first code of the next secret promotes it
+	code, err = next.OTP()
+	checkError(t, err)
+	checkError(t, otp.Validate(code))
+	if otp.Secret() != nextSecret {
+		t.Error("The next secret has not been promoted")
+	}
+	if _, pending := otp.RotationDeadline(); pending {
+		t.Error("The rotation is still pending")
+	}
+
+	// the old secret is not accepted anymore
+	old, err := NewTOTPFromBase32Secret(currentSecret, "info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	code, err = old.OTP()
+	checkError(t, err)
+	if err := otp.Validate(code); err == nil {
+		t.Error("The old secret has been accepted after the rotation")
+	}
+}
+
+func TestRotationGracePeriodEnd(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	currentSecret := otp.Secret()
+
+	checkError(t, otp.StartRotation(time.Hour))
+	nextSecret, err := otp.RotationSecret()
+	checkError(t, err)
+
+	// the grace period ends
+	otp.rotationDeadline = time.Now().UTC().Add(-time.Second)
+
+	state, err := otp.State()
+	checkError(t, err)
+	if state.RotationPending {
+		t.Error("The rotation is still pending after the grace period")
+	}
+	if otp.Secret() != nextSecret || otp.nextKey != nil {
+		t.Error("The next secret has not been promoted after the grace period")
+	}
+
+	old, err := NewTOTPFromBase32Secret(currentSecret, "info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	code, err := old.OTP()
+	checkError(t, err)
+	if err := otp.Validate(code); err == nil {
+		t.Error("The old secret has been accepted after the grace period")
+	}
+
+	// cancel a rotation
+	checkError(t, otp.StartRotation(time.Hour))
+	otp.CancelRotation()
+	if otp.Secret() != nextSecret || otp.nextKey != nil {
+		t.Error("The rotation has not been cancelled")
+	}
+}
+
+func TestRotationSerialization(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	checkError(t, otp.StartRotation(time.Hour))
+
+	// the version 1 cannot store the rotation
+	if _, err := otp.ToBytes(); err != RotationBytesVersionError {
+		t.Errorf("Expected RotationBytesVersionError, got %v\n", err)
+	}
+
+	data, err := otp.ToBytesWith("Sec51", BytesVersion2)
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, "Sec51")
+	checkError(t, err)
+
+	if restored.Secret() != otp.Secret() {
+		t.Error("The current secret has not been restored")
+	}
+	restoredDeadline, pending := restored.RotationDeadline()
+	deadline, _ := otp.RotationDeadline()
+	if !pending || !restoredDeadline.Equal(deadline) {
+		t.Errorf("The rotation has not been restored: got %s, expected %s\n", restoredDeadline, deadline)
+	}
+
+	nextSecret, err := otp.RotationSecret()
+	checkError(t, err)
+	restoredNextSecret, err := restored.RotationSecret()
+	checkError(t, err)
+	if restoredNextSecret != nextSecret {
+		t.Error("The next secret has not been restored")
+	}
+}
+
+func TestDevicesRotation(t *testing.T) {
+
+	devices, phone, _ := newTestDevices(t)
+	checkError(t, phone.StartRotation(time.Hour))
+
+	u, err := phone.RotationURL()
+	checkError(t, err)
+	next, err := TOTPFromURL(u)
+	checkError(t, err)
+
+	code, err := next.OTP()
+	checkError(t, err)
+	name, err := devices.Validate(code)
+	checkError(t, err)
+	if name != "phone" || phone.Secret() != next.Secret() {
+		t.Error("The next secret of the device has not been promoted")
+	}
+}
@@ -0,0 +1,196 @@
+package twofactor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ReplayError = errors.New("The code has already been used.")
+)
+
+// StateBackend holds the verification state of the TOTPs outside of their byte arrays, so that it is shared
+// by all the replicas of a service: the used codes, to refuse the same code twice, and the failures, for the lock down.
+// The id identifies the TOTP, it is the query escaped issuer and the account separated by a colon.
+// The implementations must be safe for concurrent use. See the redisbackend package for a Redis implementation.
+type StateBackend interface {
+	// MarkUsed records that the code of the time step has been accepted, the marker expires after the ttl.
+	// It returns false when the time step had already been marked, atomically.
+	MarkUsed(id string, step uint64, ttl time.Duration) (bool, error)
+	// Failures returns the current amount of failures
+	Failures(id string) (int, error)
+	// AddFailure increments the failures and returns the new amount, the failures expire after the ttl from the last one
+	AddFailure(id string, ttl time.Duration) (int, error)
+}
+
+// ContextStateBackend is a StateBackend which receives the context of ValidateContext, with the span of tracing.Validate:
+// its calls can then be traced as children of the span, and cancelled with the request.
+// Validate passes context.Background().
+type ContextStateBackend interface {
+	StateBackend
+	MarkUsedContext(ctx context.Context, id string, step uint64, ttl time.Duration) (bool, error)
+	FailuresContext(ctx context.Context, id string) (int, error)
+	AddFailureContext(ctx context.Context, id string, ttl time.Duration) (int, error)
+}
+
+// SetStateBackend makes Validate use the backend for the used codes and the failures, instead of the state of the TOTP.
+// The backend is not serialized, it needs to be set after TOTPFromBytes. A nil backend restores the default behaviour.
+// With a backend, ResetLockDown clears only the failures of the TOTP: use the ResetFailures method of the backend.
+func (otp *Totp) SetStateBackend(backend StateBackend) {
+	otp.backend = backend
+}
+
+// Private function which validates the user code with the state backend.
+// The failures expire backoff_minutes after the last one, like the lock down of Validate,
+// and each code is accepted only once in all the replicas.
+func (otp *Totp) validateWithBackend(ctx context.Context, userCode string) error {
+
+	id := otp.stateId()
+
+	// check against the total amount of failures
+	failures, err := otp.backendFailures(ctx, id)
+	if err != nil {
+		return err
+	}
+	if failures >= max_failures {
+		otp.notifyFailures(Observer.OnFailure, 0, failures, LockDownError)
+		return LockDownError
+	}
+
+	// during a rotation check the next secret as well
+	otp.expireRotation()
+	now := time.Now().UTC()
+	offset, matched := matchTOTP(otp, userCode, now)
+	nextOffset, nextMatched := otp.matchNextKey(userCode, now)
+
+	if !matched && !nextMatched {
+		failures, err := otp.backendAddFailure(ctx, id, backoff_minutes*time.Minute)
+		if err != nil {
+			return err
+		}
+		otp.totalVerificationFailures++
+		otp.lastVerificationTime = now
+		return otp.failed(failures, errors.New("Tokens mismatch."))
+	}
+
+	if !matched {
+		offset = nextOffset
+	}
+
+	// the marker must outlive the window of the accepted time steps
+	step := increment(now.Unix(), otp.stepSize) + uint64(offset)
+	ttl := time.Duration(3*otp.stepSize) * time.Second
+	first, err := otp.backendMarkUsed(ctx, id, step, ttl)
+	if err != nil {
+		return err
+	}
+	if !first {
+		otp.notify(Observer.OnReuse, offset, ReplayError)
+		return ReplayError
+	}
+
+	if !matched {
+		// the first code of the next secret completes the rotation
+		otp.promoteNextKey()
+	}
+	return otp.succeeded(offset)
+}
+
+// Private functions which call the backend with the context, when it is a ContextStateBackend
+
+func (otp *Totp) backendMarkUsed(ctx context.Context, id string, step uint64, ttl time.Duration) (bool, error) {
+	if backend, ok := otp.backend.(ContextStateBackend); ok {
+		return backend.MarkUsedContext(ctx, id, step, ttl)
+	}
+	return otp.backend.MarkUsed(id, step, ttl)
+}
+
+func (otp *Totp) backendFailures(ctx context.Context, id string) (int, error) {
+	if backend, ok := otp.backend.(ContextStateBackend); ok {
+		return backend.FailuresContext(ctx, id)
+	}
+	return otp.backend.Failures(id)
+}
+
+func (otp *Totp) backendAddFailure(ctx context.Context, id string, ttl time.Duration) (int, error) {
+	if backend, ok := otp.backend.(ContextStateBackend); ok {
+		return backend.AddFailureContext(ctx, id, ttl)
+	}
+	return otp.backend.AddFailure(id, ttl)
+}
+
+// MemoryStateBackend is a StateBackend which keeps the state in memory.
+// It is shared only by the TOTPs of the same process, it is useful for the tests and for the single instance services.
+type MemoryStateBackend struct {
+	mutex    sync.Mutex
+	used     map[string]time.Time // the expiry of the used time steps
+	failures map[string]int
+	expiry   map[string]time.Time // the expiry of the failures
+}
+
+// NewMemoryStateBackend creates an empty MemoryStateBackend
+func NewMemoryStateBackend() *MemoryStateBackend {
+	return &MemoryStateBackend{
+		used:     map[string]time.Time{},
+		failures: map[string]int{},
+		expiry:   map[string]time.Time{},
+	}
+}
+
+// MarkUsed records the time step, it returns false when it had already been marked
+func (b *MemoryStateBackend) MarkUsed(id string, step uint64, ttl time.Duration) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	for key, expiry := range b.used {
+		if !now.Before(expiry) {
+			delete(b.used, key)
+		}
+	}
+
+	key := fmt.Sprintf("%s:%d", id, step)
+	if _, ok := b.used[key]; ok {
+		return false, nil
+	}
+	b.used[key] = now.Add(ttl)
+	return true, nil
+}
+
+// Failures returns the current amount of failures
+func (b *MemoryStateBackend) Failures(id string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.expireFailures(id)
+	return b.failures[id], nil
+}
+
+// AddFailure increments the failures and returns the new amount
+func (b *MemoryStateBackend) AddFailure(id string, ttl time.Duration) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.expireFailures(id)
+	b.failures[id]++
+	b.expiry[id] = time.Now().Add(ttl)
+	return b.failures[id], nil
+}
+
+// ResetFailures clears the failures, so that a locked down user can verify again without waiting
+func (b *MemoryStateBackend) ResetFailures(id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.failures, id)
+	delete(b.expiry, id)
+	return nil
+}
+
+// Private function which removes the expired failures, the caller holds the mutex
+func (b *MemoryStateBackend) expireFailures(id string) {
+	if expiry, ok := b.expiry[id]; ok && !time.Now().Before(expiry) {
+		delete(b.failures, id)
+		delete(b.expiry, id)
+	}
+}
@@ -0,0 +1,114 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+	"time"
+)
+
+// Private function which returns two copies of the same TOTP, as loaded by two replicas
+func newReplicas(t *testing.T, backend StateBackend) (*Totp, *Totp) {
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	data, err := otp.ToBytes()
+	checkError(t, err)
+
+	first, err := TOTPFromBytes(data, "Sec51")
+	checkError(t, err)
+	second, err := TOTPFromBytes(data, "Sec51")
+	checkError(t, err)
+	first.SetStateBackend(backend)
+	second.SetStateBackend(backend)
+	return first, second
+}
+
+func TestStateBackendReplay(t *testing.T) {
+
+	first, second := newReplicas(t, NewMemoryStateBackend())
+
+	code, err := first.OTP()
+	checkError(t, err)
+	checkError(t, first.Validate(code))
+
+	// the same code is refused by all the replicas
+	if err := first.Validate(code); err != ReplayError {
+		t.Errorf("Expected ReplayError, got %v\n", err)
+	}
+	if err := second.Validate(code); err != ReplayError {
+		t.Errorf("Expected ReplayError, got %v\n", err)
+	}
+}
+
+func TestStateBackendSynchronization(t *testing.T) {
+
+	// the code of the current time step keeps the offset of the client, with and without the backend
+	withBackend, withoutBackend := newReplicas(t, NewMemoryStateBackend())
+	withoutBackend.SetStateBackend(nil)
+	for _, otp := range []*Totp{withBackend, withoutBackend} {
+		otp.synchronizeCounter(1)
+		code, err := otp.OTP()
+		checkError(t, err)
+		checkError(t, otp.Validate(code))
+		if otp.clientOffset != 1 {
+			t.Errorf("Expected the client offset 1, got %d\n", otp.clientOffset)
+		}
+	}
+}
+
+func TestStateBackendSharedLockDown(t *testing.T) {
+
+	backend := NewMemoryStateBackend()
+	first, second := newReplicas(t, backend)
+
+	// the failures on different replicas add up
+	for i := 0; i < max_failures; i++ {
+		replica := first
+		if i%2 == 1 {
+			replica = second
+		}
+		if err := replica.Validate("000000x"); err == nil {
+			t.Error("The wrong code has been accepted")
+		}
+	}
+
+	code, err := second.OTP()
+	checkError(t, err)
+	if err := second.Validate(code); err != LockDownError {
+		t.Errorf("Expected LockDownError, got %v\n", err)
+	}
+
+	checkError(t, backend.ResetFailures(second.stateId()))
+	checkError(t, second.Validate(code))
+}
+
+func TestMemoryStateBackendExpiry(t *testing.T) {
+
+	backend := NewMemoryStateBackend()
+
+	first, err := backend.MarkUsed("Sec51:info@sec51.com", 10, time.Millisecond)
+	checkError(t, err)
+	again, err := backend.MarkUsed("Sec51:info@sec51.com", 10, time.Millisecond)
+	checkError(t, err)
+	if !first || again {
+		t.Error("The time step has not been marked once")
+	}
+
+	failures, err := backend.AddFailure("Sec51:info@sec51.com", time.Millisecond)
+	checkError(t, err)
+	if failures != 1 {
+		t.Errorf("Expected 1 failure, got %d\n", failures)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	again, err = backend.MarkUsed("Sec51:info@sec51.com", 10, time.Millisecond)
+	checkError(t, err)
+	if !again {
+		t.Error("The marker of the time step has not expired")
+	}
+	failures, err = backend.Failures("Sec51:info@sec51.com")
+	checkError(t, err)
+	if failures != 0 {
+		t.Errorf("Expected the failures to expire, got %d\n", failures)
+	}
+}
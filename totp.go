@@ -2,12 +2,14 @@ package twofactor
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base32"
 	"encoding/hex"
 	"errors"
@@ -17,6 +19,7 @@ import (
 	"math"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sec51/convert"
@@ -32,9 +35,20 @@ const (
 	message_type    = 0 // this is the message type for the crypto engine
 )
 
+const (
+	min_key_size = 16 // the minimum length in bytes of the imported secret keys: 128 bits, as required by the RFC 4226
+)
+
+const (
+	BytesVersion1 = 1 // the original ToBytes layout, encrypted as message type 0
+	BytesVersion2 = 2 // the original layout followed by the extension records, encrypted as message type 1
+)
+
 var (
 	initializationFailedError = errors.New("Totp has not been initialized correctly")
 	LockDownError             = errors.New("The verification is locked down, because of too many trials.")
+	MalformedBytesError       = errors.New("The TOTP bytes are malformed.")
+	WeakKeyError              = errors.New("The secret key is too short or too weak: at least 128 bits are required.")
 )
 
 // WARNING: The `Totp` struct should never be instantiated manually!
@@ -50,6 +64,17 @@ type Totp struct {
 	totalVerificationFailures int                // the total amount of verification failures from the client - by default 10
 	lastVerificationTime      time.Time          // the last verification executed
 	hashFunction              crypto.Hash        // the hash function used in the HMAC construction (sha1 - sha156 - sha512)
+	nextKey                   []byte             // the next secret key during a rotation, see StartRotation
+	rotationDeadline          time.Time          // the end of the grace period of the rotation
+	binding                   []byte             // the SHA-256 of the associated data, see ToBytesBound
+	generation                uint64             // incremented each time the TOTP is serialized with BytesVersion2, see VerifyLoad
+	trustedDevicesGeneration  uint64             // incremented to revoke the trusted device tokens, see RevokeTrustedDevices
+	keyring                   *Keyring           // the keyring the TOTP has been opened with, not serialized
+	keyID                     string             // the id of the key the TOTP has been opened with, not serialized
+	backend                   StateBackend       // the shared verification state, not serialized, see SetStateBackend
+	observers                 []Observer         // notified of the outcomes of Validate, not serialized
+	validationStart           time.Time          // the start of the Validate in progress, for the observers
+	sealed                    bool               // the key cannot be revealed anymore, see Enrollment.Totp; not serialized
 }
 
 // This function is used to synchronize the counter with the client
@@ -98,6 +123,83 @@ func NewTOTP(account, issuer string, hash crypto.Hash, digits int) (*Totp, error
 
 }
 
+// This function creates a new TOTP object from an existing secret key, for instance the seed of a hardware token
+// or a key migrated from another system.
+// The key must be at least 128 bits long as required by RFC 4226 and the keys made of a single repeated byte,
+// like the all-zero keys, are rejected as weak.
+// Unlike NewTOTP the digits are not sanitized: an unsupported amount of digits returns an error,
+// because the codes would not match the ones of the existing device.
+func NewTOTPFromSecret(secret []byte, account, issuer string, hash crypto.Hash, digits int) (*Totp, error) {
+
+	if err := checkSecret(secret); err != nil {
+		return nil, err
+	}
+
+	if hash != crypto.SHA1 && hash != crypto.SHA256 && hash != crypto.SHA512 {
+		return nil, errors.New("Unsupported hash function, only SHA1, SHA256 and SHA512 are allowed")
+	}
+
+	if digits < 6 || digits > 8 {
+		return nil, errors.New(fmt.Sprintf("Unsupported amount of digits %d, only 6, 7 and 8 are allowed", digits))
+	}
+
+	// copy the key, so that the caller cannot change it
+	key := make([]byte, len(secret))
+	copy(key, secret)
+
+	return makeTOTP(key, account, issuer, hash, digits)
+}
+
+// This function creates a new TOTP object from a hex encoded secret key, see NewTOTPFromSecret
+func NewTOTPFromHexSecret(secret string, account, issuer string, hash crypto.Hash, digits int) (*Totp, error) {
+
+	key, err := hex.DecodeString(strings.Replace(strings.TrimSpace(secret), " ", "", -1))
+	if err != nil {
+		return nil, errors.New("The secret is not hex encoded")
+	}
+
+	return NewTOTPFromSecret(key, account, issuer, hash, digits)
+}
+
+// This function creates a new TOTP object from a base32 encoded secret key, see NewTOTPFromSecret
+// The secret is accepted in upper and lower case, with or without padding and spaces, as displayed by the services.
+func NewTOTPFromBase32Secret(secret string, account, issuer string, hash crypto.Hash, digits int) (*Totp, error) {
+
+	key, err := decodeBase32Secret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTOTPFromSecret(key, account, issuer, hash, digits)
+}
+
+// Private function which checks the length and the strength of an external secret key
+func checkSecret(secret []byte) error {
+
+	if len(secret) < min_key_size {
+		return WeakKeyError
+	}
+
+	// a key made of a single repeated byte, like all zeros, is a placeholder rather than a secret
+	for _, b := range secret[1:] {
+		if b != secret[0] {
+			return nil
+		}
+	}
+	return WeakKeyError
+}
+
+// Private function which decodes a base32 secret in any case, with or without padding and spaces
+func decodeBase32Secret(secret string) ([]byte, error) {
+
+	secret = strings.ToUpper(strings.TrimRight(strings.Replace(strings.TrimSpace(secret), " ", "", -1), "="))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, errors.New("The secret is missing or not base32 encoded")
+	}
+	return key, nil
+}
+
 // Private function which initialize the TOTP so that it's easier to unit test it
 // Used internally
 func makeTOTP(key []byte, account, issuer string, hash crypto.Hash, digits int) (*Totp, error) {
@@ -122,27 +224,53 @@ func makeTOTP(key []byte, account, issuer string, hash crypto.Hash, digits int)
 // An attacker can still learn the synchronization offset. This is however irrelevant because the attacker has then 30 seconds to
 // guess the code and after 3 failures the function returns an error for the following 5 minutes
 func (otp *Totp) Validate(userCode string) error {
+	return otp.validate(context.Background(), userCode)
+}
+
+// ValidateContext validates the user code like Validate, the context is passed to a ContextStateBackend,
+// so that its calls are cancelled with the request. The tracing package validates in a span.
+func (otp *Totp) ValidateContext(ctx context.Context, userCode string) error {
+	return otp.validate(ctx, userCode)
+}
+
+// Private function which implements Validate and ValidateContext, the context is passed to a ContextStateBackend
+func (otp *Totp) validate(ctx context.Context, userCode string) error {
 
 	// check Totp initialization
 	if err := totpHasBeenInitialized(otp); err != nil {
 		return err
 	}
 
+	// the observers receive the time spent
+	otp.validationStart = time.Now()
+	defer func() { otp.validationStart = time.Time{} }()
+
 	// verify that the token is valid
 	if userCode == "" {
 		return errors.New("User provided token is empty")
 	}
 
+	// the used codes and the failures are shared by all the replicas
+	if otp.backend != nil {
+		return otp.validateWithBackend(ctx, userCode)
+	}
+
 	// check against the total amount of failures
 	if otp.totalVerificationFailures >= max_failures && !validBackoffTime(otp.lastVerificationTime) {
+		otp.notify(Observer.OnFailure, 0, LockDownError)
 		return LockDownError
 	}
 
 	if otp.totalVerificationFailures >= max_failures && validBackoffTime(otp.lastVerificationTime) {
 		// reset the total verification failures counter
 		otp.totalVerificationFailures = 0
+		otp.notify(Observer.OnUnlock, 0, nil)
 	}
 
+	// during a rotation check the next secret as well, before the early returns of the current one
+	otp.expireRotation()
+	nextOffset, nextMatched := otp.matchNextKey(userCode, time.Now())
+
 	// calculate the sha256 of the user code
 	userTokenHash := sha256.Sum256([]byte(userCode))
 	userToken := hex.EncodeToString(userTokenHash[:])
@@ -159,26 +287,30 @@ func (otp *Totp) Validate(userCode string) error {
 
 	// if the current time token is valid then, no need to re-sync and return nil
 	if tokens[1] == userToken {
-		return nil
+		return otp.succeeded(0)
 	}
 
 	// if the 30 seconds ago token is valid then return nil, but re-synchronize
 	if tokens[0] == userToken {
-		otp.synchronizeCounter(-1)
-		return nil
+		return otp.succeeded(-1)
 	}
 
 	// if the let's say 30 seconds ago token is valid then return nil, but re-synchronize
 	if tokens[2] == userToken {
-		otp.synchronizeCounter(1)
-		return nil
+		return otp.succeeded(1)
+	}
+
+	// the first code of the next secret completes the rotation
+	if nextMatched {
+		otp.promoteNextKey()
+		return otp.succeeded(nextOffset)
 	}
 
 	otp.totalVerificationFailures++
 	otp.lastVerificationTime = time.Now().UTC() // important to have it in UTC
 
 	// if we got here everything is good
-	return errors.New("Tokens mismatch.")
+	return otp.failed(otp.totalVerificationFailures, errors.New("Tokens mismatch."))
 }
 
 // Checks the time difference between the function call time and the parameter
@@ -218,27 +350,48 @@ func (otp *Totp) OTP() (string, error) {
 		return "", err
 	}
 
+	// once the grace period of a rotation has ended the next secret is the current one
+	otp.expireRotation()
+
 	// it uses the index 0, meaning that it calculates the current one
 	return calculateTOTP(otp, 0), nil
 }
 
-// Private function which calculates the OTP token based on the index offset
-// example: 1 * steps or -1 * steps
-func calculateTOTP(otp *Totp, index int) string {
-	var h hash.Hash
+// Generates the one time password for the given time, without changing the state of the TOTP.
+// Useful to show the upcoming codes or to check a code generated at a known time.
+func (otp *Totp) OTPAt(t time.Time) (string, error) {
 
-	switch otp.hashFunction {
-	case crypto.SHA256:
-		h = hmac.New(sha256.New, otp.key)
-		break
-	case crypto.SHA512:
-		h = hmac.New(sha512.New, otp.key)
-		break
-	default:
-		h = hmac.New(sha1.New, otp.key)
-		break
+	// verify the proper initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return "", err
+	}
 
+	counter := bigendian.ToUint64(increment(t.UTC().Unix(), otp.stepSize))
+	return calculateToken(counter[:], otp.digits, newHMAC(otp.hashFunction, otp.key)), nil
+}
+
+// Private function which checks the user code against the previous, the current and the next time steps of the given time,
+// without stopping at the first match. It returns the offset of the matching step and whether a step matched.
+// Unlike Validate, it does not change the state of the TOTP.
+func matchTOTP(otp *Totp, userCode string, now time.Time) (int, bool) {
+	current := increment(now.UTC().Unix(), otp.stepSize)
+	h := newHMAC(otp.hashFunction, otp.key)
+	matched, ok := 0, false
+	for offset := -1; offset <= 1; offset++ {
+		step := bigendian.ToUint64(current + uint64(offset))
+		h.Reset()
+		token := calculateToken(step[:], otp.digits, h)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(userCode)) == 1 && !ok {
+			matched, ok = offset, true
+		}
 	}
+	return matched, ok
+}
+
+// Private function which calculates the OTP token based on the index offset
+// example: 1 * steps or -1 * steps
+func calculateTOTP(otp *Totp, index int) string {
+	h := newHMAC(otp.hashFunction, otp.key)
 
 	// set the counter to the current step based ont the current time
 	// this is necessary to generate the proper OTP
@@ -248,6 +401,19 @@ func calculateTOTP(otp *Totp, index int) string {
 
 }
 
+// Private function which returns the HMAC construction for the given hash function
+// SHA1 is used for any hash function which is not SHA256 or SHA512
+func newHMAC(hashFunction crypto.Hash, key []byte) hash.Hash {
+	switch hashFunction {
+	case crypto.SHA256:
+		return hmac.New(sha256.New, key)
+	case crypto.SHA512:
+		return hmac.New(sha512.New, key)
+	default:
+		return hmac.New(sha1.New, key)
+	}
+}
+
 func truncateHash(hmac_result []byte, size int) int64 {
 	offset := hmac_result[size-1] & 0xf
 	bin_code := (uint32(hmac_result[offset])&0x7f)<<24 |
@@ -260,9 +426,13 @@ func truncateHash(hmac_result []byte, size int) int64 {
 // this is the function which calculates the HTOP code
 func calculateToken(counter []byte, digits int, h hash.Hash) string {
 
+	// the HMAC result is wiped once truncated
+	var sum [sha512.Size]byte
 	h.Write(counter)
-	hashResult := h.Sum(nil)
+	hashResult := h.Sum(sum[:0])
 	result := truncateHash(hashResult, h.Size())
+	wipe(hashResult)
+	h.Reset()
 
 	mod := int32(result % int64(math.Pow10(digits)))
 
@@ -275,13 +445,44 @@ func calculateToken(counter []byte, digits int, h hash.Hash) string {
 // This should only be displayed the first time a user enables 2FA,
 // and should be transmitted over a secure connection.
 // Useful for supporting TOTP clients that don't support QR scanning.
+// It returns an empty string, without notifying the observers, when the key cannot be revealed anymore
+// (see Enrollment.Totp) or after Destroy: the callers must not display an empty secret.
 func (otp *Totp) Secret() string {
+	if otp.sealed || totpHasBeenInitialized(otp) != nil {
+		return ""
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "Secret")
 	return base32.StdEncoding.EncodeToString(otp.key)
 }
 
+// Key returns a copy of the secret key for the conversion of the keys in bulk, like the backups of the vault package:
+// the observers are notified of a reveal with the Export operation, once per call. The caller should wipe the copy after use.
+// It returns nil when the key cannot be revealed anymore, see Enrollment.Totp, or after Destroy.
+func (otp *Totp) Key() []byte {
+	if otp.sealed || totpHasBeenInitialized(otp) != nil {
+		return nil
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "Export")
+	key := make([]byte, len(otp.key))
+	copy(key, otp.key)
+	return key
+}
+
 // URL returns a suitable URL, such as for the Google Authenticator app
 // example: otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example
-func (otp *Totp) url() (string, error) {
+func (otp *Totp) URL() (string, error) {
+	if otp.sealed {
+		return "", EnrollmentActiveError
+	}
+	u, err := otp.keyURL()
+	if err == nil {
+		otp.notifyLifecycle(LifecycleObserver.OnReveal, "URL")
+	}
+	return u, err
+}
+
+// Private function which returns the otpauth URL without notifying the observers
+func (otp *Totp) keyURL() (string, error) {
 
 	// verify the proper initialization
 	if err := totpHasBeenInitialized(otp); err != nil {
@@ -299,17 +500,7 @@ func (otp *Totp) url() (string, error) {
 	v.Add("issuer", otp.issuer)
 	v.Add("digits", strconv.Itoa(otp.digits))
 	v.Add("period", strconv.Itoa(otp.stepSize))
-	switch otp.hashFunction {
-	case crypto.SHA256:
-		v.Add("algorithm", "SHA256")
-		break
-	case crypto.SHA512:
-		v.Add("algorithm", "SHA512")
-		break
-	default:
-		v.Add("algorithm", "SHA1")
-		break
-	}
+	v.Add("algorithm", hashFunctionName(otp.hashFunction))
 	u.RawQuery = v.Encode()
 	return u.String(), nil
 }
@@ -321,15 +512,41 @@ func (otp *Totp) url() (string, error) {
 // therefore the QR code should be delivered via secure connection.
 func (otp *Totp) QR() ([]byte, error) {
 
+	if otp.sealed {
+		return nil, EnrollmentActiveError
+	}
+
 	// get the URL
-	u, err := otp.url()
+	u, err := otp.keyURL()
 
 	// check for errors during initialization
 	// this is already done on the URL method
 	if err != nil {
 		return nil, err
 	}
-	code, err := qr.Encode(u, qr.Q)
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "QR")
+	return encodeQR(u)
+}
+
+// QRCode returns the QR code of the key URL with the given options, which can be rendered
+// as PNG, SVG, data URI or text for the terminals. The same precautions of QR() apply.
+func (otp *Totp) QRCode(options QROptions) (*QRCode, error) {
+
+	if otp.sealed {
+		return nil, EnrollmentActiveError
+	}
+
+	u, err := otp.keyURL()
+	if err != nil {
+		return nil, err
+	}
+	otp.notifyLifecycle(LifecycleObserver.OnReveal, "QRCode")
+	return NewQRCode(u, options)
+}
+
+// Private function which encodes the text in a PNG QR code with level Q error correction
+func encodeQR(text string) ([]byte, error) {
+	code, err := qr.Encode(text, qr.Q)
 	if err != nil {
 		return nil, err
 	}
@@ -344,12 +561,89 @@ func (otp *Totp) QR() ([]byte, error) {
 // TODO:
 // 1- improve sizes. For instance the hashFunction_type could be a short.
 func (otp *Totp) ToBytes() ([]byte, error) {
+	return otp.ToBytesWith(otp.issuer, BytesVersion1)
+}
+
+// ToBytesWith serialises the TOTP object like ToBytes, but encrypts it with the given cryptoengine identifier
+// instead of the issuer, and writes the given format version.
+// BytesVersion2 appends the extension records to the original layout (see blob.go): the readers of version 1
+// cannot decode it, therefore it should be written only once all the services have been upgraded.
+func (otp *Totp) ToBytesWith(engineID string, version int) ([]byte, error) {
 
 	// check Totp initialization
 	if err := totpHasBeenInitialized(otp); err != nil {
 		return nil, err
 	}
 
+	start := time.Now()
+	data, err := otp.encrypt(engineID, version)
+	notifyBytes(BytesEvent{
+		Operation: "encode",
+		Issuer:    engineID,
+		Algorithm: hashFunctionName(otp.hashFunction),
+		Version:   version,
+		Duration:  time.Since(start),
+		Err:       err,
+	})
+	return data, err
+}
+
+// Private function which serialises and encrypts the TOTP, see ToBytesWith
+func (otp *Totp) encrypt(engineID string, version int) ([]byte, error) {
+
+	messageType, err := messageTypeOfVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	// each serialized state has a new generation, so that an older one can be detected
+	if version >= BytesVersion2 {
+		otp.generation++
+	}
+
+	data, err := encodeTOTP(otp, version)
+	if err != nil {
+		return nil, err
+	}
+
+	// encrypt the TOTP bytes
+	engine, err := cryptoengine.InitCryptoEngine(engineID)
+	if err != nil {
+		return nil, err
+	}
+
+	// init the message to be encrypted: cryptoengine keeps a string copy of the layout, which cannot be wiped
+	message, err := cryptoengine.NewMessage(string(data), messageType)
+	wipe(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// encrypt it
+	encryptedMessage, err := engine.NewEncryptedMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptedMessage.ToBytes()
+
+}
+
+// Private function which encodes the plain text layout described in ToBytes
+func encodeTOTP(otp *Totp, version int) ([]byte, error) {
+
+	// the rotation and the binding are stored in the extension records
+	otp.expireRotation()
+	if otp.nextKey != nil && version < BytesVersion2 {
+		return nil, RotationBytesVersionError
+	}
+	if otp.binding != nil && version < BytesVersion2 {
+		return nil, BindingBytesVersionError
+	}
+	if otp.trustedDevicesGeneration != 0 && version < BytesVersion2 {
+		return nil, TrustedDevicesBytesVersionError
+	}
+
 	var buffer bytes.Buffer
 
 	// calculate the length of the key and create its byte representation
@@ -454,76 +748,135 @@ func (otp *Totp) ToBytes() ([]byte, error) {
 		}
 	}
 
-	// encrypt the TOTP bytes
-	engine, err := cryptoengine.InitCryptoEngine(otp.issuer)
-	if err != nil {
-		return nil, err
+	// extension records
+	if version >= BytesVersion2 {
+		if _, err := buffer.Write(encodeExtensions(otp)); err != nil {
+			return nil, err
+		}
 	}
 
-	// init the message to be encrypted
-	message, err := cryptoengine.NewMessage(buffer.String(), message_type)
+	return buffer.Bytes(), nil
+}
+
+// TOTPFromBytes converts a byte array to a totp object
+// it stores the state of the TOTP object, like the key, the current counter, the client offset,
+// the total amount of verification failures and the last time a verification happened
+func TOTPFromBytes(encryptedMessage []byte, issuer string) (*Totp, error) {
+	otp, _, err := TOTPFromBytesWith(encryptedMessage, issuer)
+	return otp, err
+}
+
+// TOTPFromBytesWith converts a byte array encrypted with the given cryptoengine identifier to a totp object.
+// It returns the format version of the byte array as well, so that it can be upgraded with ToBytesWith.
+// The byte arrays bound to associated data return AssociatedDataError, use TOTPFromBytesBound.
+func TOTPFromBytesWith(encryptedMessage []byte, engineID string) (*Totp, int, error) {
+
+	otp, version, err := decryptTOTP(encryptedMessage, engineID)
 	if err != nil {
-		return nil, err
+		return otp, version, err
 	}
 
-	// encrypt it
-	encryptedMessage, err := engine.NewEncryptedMessage(message)
-	if err != nil {
-		return nil, err
+	if otp.binding != nil {
+		return nil, 0, AssociatedDataError
 	}
 
-	return encryptedMessage.ToBytes()
+	return otp, version, nil
+}
 
+// Private function which decrypts and decodes the byte array, without checking the associated data binding
+func decryptTOTP(encryptedMessage []byte, engineID string) (*Totp, int, error) {
+
+	start := time.Now()
+	otp, version, err := decryptBytes(encryptedMessage, engineID)
+	event := BytesEvent{
+		Operation: "decode",
+		Issuer:    engineID,
+		Version:   version,
+		Duration:  time.Since(start),
+		Err:       err,
+	}
+	if err == nil {
+		event.Algorithm = hashFunctionName(otp.hashFunction)
+	}
+	notifyBytes(event)
+	return otp, version, err
 }
 
-// TOTPFromBytes converts a byte array to a totp object
-// it stores the state of the TOTP object, like the key, the current counter, the client offset,
-// the total amount of verification failures and the last time a verification happened
-func TOTPFromBytes(encryptedMessage []byte, issuer string) (*Totp, error) {
+// Private function which decrypts and decodes the byte array, see decryptTOTP
+func decryptBytes(encryptedMessage []byte, engineID string) (*Totp, int, error) {
 
 	// init the cryptoengine
-	engine, err := cryptoengine.InitCryptoEngine(issuer)
+	engine, err := cryptoengine.InitCryptoEngine(engineID)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// decrypt the message
 	data, err := engine.Decrypt(encryptedMessage)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	version, err := versionOfMessageType(data.Type)
+	if err != nil {
+		return nil, 0, err
 	}
 
+	// the decoded TOTP copies the key, the byte copy of the plain text is wiped:
+	// the string of the message cannot be, see wipe
+	plainText := []byte(data.Text)
+	defer wipe(plainText)
+
+	otp, err := decodeTOTP(plainText, version)
+	return otp, version, err
+}
+
+// Private function which decodes the plain text layout described in ToBytes
+func decodeTOTP(data []byte, version int) (*Totp, error) {
+
 	// new reader
-	reader := bytes.NewReader([]byte(data.Text))
+	reader := bytes.NewReader(data)
 
 	// otp object
 	otp := new(Totp)
 
 	// get the length
 	length := make([]byte, 4)
-	_, err = reader.Read(length) // read the 4 bytes for the total length
+	_, err := reader.Read(length) // read the 4 bytes for the total length
 	if err != nil && err != io.EOF {
 		return otp, err
 	}
 
 	totalSize := bigendian.FromInt([4]byte{length[0], length[1], length[2], length[3]})
+	if totalSize < totp_fixed_size || totalSize > len(data) {
+		return otp, MalformedBytesError
+	}
 	buffer := make([]byte, totalSize-4)
+	defer wipe(buffer)
 	_, err = reader.Read(buffer)
 	if err != nil && err != io.EOF {
 		return otp, err
 	}
 
+	// the key, the issuer and the account have a variable size: check that they fit in the total size
+	variableSize := totalSize - totp_fixed_size
+
 	// skip the total bytes size
 	startOffset := 0
 	// read key size
 	endOffset := startOffset + 4
 	keyBytes := buffer[startOffset:endOffset]
 	keySize := bigendian.FromInt([4]byte{keyBytes[0], keyBytes[1], keyBytes[2], keyBytes[3]})
+	if keySize < 0 || keySize > variableSize {
+		return otp, MalformedBytesError
+	}
+	variableSize -= keySize
 
 	// read the key
 	startOffset = endOffset
 	endOffset = startOffset + keySize
-	otp.key = buffer[startOffset:endOffset]
+	otp.key = make([]byte, keySize)
+	copy(otp.key, buffer[startOffset:endOffset])
 
 	// read the counter
 	startOffset = endOffset
@@ -542,6 +895,10 @@ func TOTPFromBytes(encryptedMessage []byte, issuer string) (*Totp, error) {
 	endOffset = startOffset + 4
 	b = buffer[startOffset:endOffset]
 	issuerSize := bigendian.FromInt([4]byte{b[0], b[1], b[2], b[3]})
+	if issuerSize < 0 || issuerSize > variableSize {
+		return otp, MalformedBytesError
+	}
+	variableSize -= issuerSize
 
 	// read the issuer string
 	startOffset = endOffset
@@ -553,6 +910,9 @@ func TOTPFromBytes(encryptedMessage []byte, issuer string) (*Totp, error) {
 	endOffset = startOffset + 4
 	b = buffer[startOffset:endOffset]
 	accountSize := bigendian.FromInt([4]byte{b[0], b[1], b[2], b[3]})
+	if accountSize != variableSize {
+		return otp, MalformedBytesError
+	}
 
 	// read the account string
 	startOffset = endOffset
@@ -601,7 +961,71 @@ func TOTPFromBytes(encryptedMessage []byte, issuer string) (*Totp, error) {
 		otp.hashFunction = crypto.SHA1
 	}
 
-	return otp, err
+	// the extension records follow the original layout
+	if version >= BytesVersion2 {
+		if err := decodeExtensions(otp, data[totalSize:]); err != nil {
+			return otp, err
+		}
+	}
+
+	return otp, nil
+}
+
+// TotpState is a snapshot of the TOTP properties without the secret key,
+// which can be logged or displayed to the support staff.
+type TotpState struct {
+	Account              string
+	Issuer               string
+	Algorithm            string // SHA1, SHA256 or SHA512
+	KeySize              int    // the size of the secret key in bytes
+	Digits               int
+	StepSize             int // in seconds
+	ClientOffset         int // the amount of steps the client is off
+	Counter              uint64
+	VerificationFailures int
+	LastVerificationTime time.Time
+	LockedDown           bool      // whether Validate returns LockDownError
+	RotationPending      bool      // whether a next secret key has been generated with StartRotation
+	RotationDeadline     time.Time // the end of the grace period of the rotation
+}
+
+// State returns the properties of the TOTP, without the secret key
+func (otp *Totp) State() (TotpState, error) {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return TotpState{}, err
+	}
+
+	otp.expireRotation()
+
+	return TotpState{
+		Account:              otp.account,
+		Issuer:               otp.issuer,
+		Algorithm:            hashFunctionName(otp.hashFunction),
+		KeySize:              len(otp.key),
+		Digits:               otp.digits,
+		StepSize:             otp.stepSize,
+		ClientOffset:         otp.clientOffset,
+		Counter:              otp.getIntCounter(),
+		VerificationFailures: otp.totalVerificationFailures,
+		LastVerificationTime: otp.lastVerificationTime,
+		LockedDown:           otp.totalVerificationFailures >= max_failures && !validBackoffTime(otp.lastVerificationTime),
+		RotationPending:      otp.nextKey != nil,
+		RotationDeadline:     otp.rotationDeadline,
+	}, nil
+}
+
+// ResetLockDown clears the verification failures, so that a locked down user can verify again
+// without waiting for the backoff time. Used by the support staff after the identity of the user has been checked.
+func (otp *Totp) ResetLockDown() {
+	lockedDown := otp.totalVerificationFailures >= max_failures
+	otp.totalVerificationFailures = 0
+	otp.lastVerificationTime = time.Time{}
+	otp.notifyLifecycle(LifecycleObserver.OnReset, "")
+	if lockedDown {
+		otp.notify(Observer.OnUnlock, 0, nil)
+	}
 }
 
 // this method checks the proper initialization of the Totp object
@@ -10,6 +10,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -308,12 +309,12 @@ func TestSerialization(t *testing.T) {
 		t.Error("Deserialized hash property differ from original TOTP")
 	}
 
-	deserializedUrl, err := deserializedOTP.url()
+	deserializedUrl, err := deserializedOTP.URL()
 	if err != nil {
 		t.Error(err)
 	}
 
-	otpdUrl, err := otp.url()
+	otpdUrl, err := otp.URL()
 	if err != nil {
 		t.Error(err)
 	}
@@ -342,7 +343,7 @@ func TestSerialization(t *testing.T) {
 
 func TestProperInitialization(t *testing.T) {
 	otp := Totp{}
-	if _, err := otp.url(); err == nil {
+	if _, err := otp.URL(); err == nil {
 		t.Fatal("Totp is not properly initialized and the method did not catch it")
 	}
 }
@@ -398,3 +399,78 @@ func TestCounterSynchronization(t *testing.T) {
 	}
 
 }
+
+func TestTOTPAt(t *testing.T) {
+
+	key, err := hex.DecodeString(sha1KeyHex)
+	checkError(t, err)
+
+	otp, err := makeTOTP(key, "info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+
+	for index, ts := range timeCounters {
+		token, err := otp.OTPAt(time.Unix(ts, 0))
+		checkError(t, err)
+		if token != sha1TestData[index] {
+			t.Errorf("OTPAt token mismatch. Got %s, expected %s\n", token, sha1TestData[index])
+		}
+	}
+}
+
+func TestNewTOTPFromSecret(t *testing.T) {
+
+	key, err := hex.DecodeString(sha1KeyHex)
+	checkError(t, err)
+
+	// the same key in the three encodings
+	fromBytes, err := NewTOTPFromSecret(key, "info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+	fromHex, err := NewTOTPFromHexSecret(strings.ToUpper(sha1KeyHex), "info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+	fromBase32, err := NewTOTPFromBase32Secret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", "info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+	fromPadded, err := NewTOTPFromBase32Secret("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ====", "info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+
+	for _, otp := range []*Totp{fromBytes, fromHex, fromBase32, fromPadded} {
+		token, err := otp.OTPAt(time.Unix(timeCounters[0], 0))
+		checkError(t, err)
+		if token != sha1TestData[0] {
+			t.Errorf("SHA1 test data, token mismatch. Got %s, expected %s\n", token, sha1TestData[0])
+		}
+	}
+
+	// the key is copied
+	key[0] = 0
+	if fromBytes.key[0] != '1' {
+		t.Error("The TOTP key has been changed by the caller")
+	}
+}
+
+func TestNewTOTPFromWeakSecret(t *testing.T) {
+
+	weak := [][]byte{
+		nil,
+		[]byte("1234567890"), // 80 bits
+		make([]byte, 20),     // all zeros
+		bytes.Repeat([]byte{0xff}, 32),
+	}
+	for _, key := range weak {
+		if _, err := NewTOTPFromSecret(key, "info@sec51.com", "Sec51", crypto.SHA1, 6); err != WeakKeyError {
+			t.Errorf("Expected WeakKeyError for the key %x, instead we've got %v\n", key, err)
+		}
+	}
+
+	if _, err := NewTOTPFromHexSecret("not hex", "info@sec51.com", "Sec51", crypto.SHA1, 6); err == nil {
+		t.Error("The invalid hex secret has been accepted")
+	}
+	if _, err := NewTOTPFromBase32Secret("GEZDGNBVGY3TQOJ1", "info@sec51.com", "Sec51", crypto.SHA1, 6); err == nil {
+		t.Error("The invalid base32 secret has been accepted")
+	}
+	if _, err := NewTOTPFromHexSecret(sha1KeyHex, "info@sec51.com", "Sec51", crypto.SHA1, 9); err == nil {
+		t.Error("The invalid amount of digits has been accepted")
+	}
+	if _, err := NewTOTPFromHexSecret(sha1KeyHex, "info@sec51.com", "Sec51", crypto.MD5, 6); err == nil {
+		t.Error("The invalid hash function has been accepted")
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Package tracing records the OpenTelemetry spans of the validations, of the serializations and of the QR code generations:
+
+	tracing.SetTracerProvider(provider)
+	otp, version, err := tracing.TOTPFromBytes(ctx, data, issuer)
+	...
+	err = tracing.Validate(ctx, otp, userCode)
+
+The spans have only non-sensitive attributes: the algorithm, the digits, the version of the bytes,
+the outcome of the validation and the matched offset, never the codes, the secret keys, the accounts or the issuers.
+Validate passes the context of its span to a twofactor.ContextStateBackend, so that the calls of the backend
+are children of the span and are cancelled with the request.
+The tracing is a separate package, so that the importers of twofactor do not depend on OpenTelemetry.
+*/
+package tracing
+
+import (
+	"context"
+
+	"github.com/sec51/twofactor"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracer_name = "github.com/sec51/twofactor"
+
+	attribute_algorithm = "twofactor.algorithm"
+	attribute_digits    = "twofactor.digits"
+	attribute_version   = "twofactor.bytes_version"
+	attribute_outcome   = "twofactor.outcome" // success, failure, locked_down or reused
+	attribute_offset    = "twofactor.offset"  // the offset of the matching time step
+)
+
+var tracerProvider trace.TracerProvider
+
+// SetTracerProvider sets the provider of the spans, the global OpenTelemetry provider when nil
+func SetTracerProvider(provider trace.TracerProvider) {
+	tracerProvider = provider
+}
+
+// Private function which starts a span of the package, it returns the context of the children spans
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	provider := tracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracer_name).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Private function which ends the span, recording the error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Private function which returns the attributes describing the TOTP
+func spanAttributes(otp *twofactor.Totp) ([]attribute.KeyValue, error) {
+	state, err := otp.State()
+	if err != nil {
+		return nil, err
+	}
+	return []attribute.KeyValue{
+		attribute.String(attribute_algorithm, state.Algorithm),
+		attribute.Int(attribute_digits, state.Digits),
+	}, nil
+}
+
+// spanObserver sets the outcome of Validate on its span
+type spanObserver struct {
+	twofactor.NopObserver
+	span    trace.Span
+	outcome string
+}
+
+func (o *spanObserver) setOutcome(outcome string) {
+	o.outcome = outcome
+	o.span.SetAttributes(attribute.String(attribute_outcome, outcome))
+}
+
+func (o *spanObserver) OnSuccess(event twofactor.Event) {
+	o.setOutcome("success")
+	o.span.SetAttributes(attribute.Int(attribute_offset, event.Offset))
+}
+
+func (o *spanObserver) OnFailure(event twofactor.Event) {
+	if event.Err == twofactor.LockDownError {
+		o.setOutcome("locked_down")
+	} else {
+		o.setOutcome("failure")
+	}
+}
+
+func (o *spanObserver) OnReuse(event twofactor.Event)   { o.setOutcome("reused") }
+func (o *spanObserver) OnLockout(event twofactor.Event) { o.span.AddEvent("lockout") }
+func (o *spanObserver) OnUnlock(event twofactor.Event)  { o.span.AddEvent("unlock") }
+
+// Validate validates the user code like Totp.ValidateContext, in a span with the outcome and the matched offset.
+// The refused codes are an outcome, not an error of the span: the span records only the other errors, like those of the StateBackend.
+func Validate(ctx context.Context, otp *twofactor.Totp, userCode string) error {
+
+	attributes, err := spanAttributes(otp)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := startSpan(ctx, "twofactor.Validate", attributes...)
+	observer := &spanObserver{span: span}
+	otp.AddObserver(observer)
+	defer otp.RemoveObserver(observer)
+
+	err = otp.ValidateContext(ctx, userCode)
+	if observer.outcome != "" {
+		span.End()
+	} else {
+		endSpan(span, err)
+	}
+	return err
+}
+
+// ToBytes serialises the TOTP like Totp.ToBytesWith, in a span which includes the encryption
+func ToBytes(ctx context.Context, otp *twofactor.Totp, engineID string, version int) ([]byte, error) {
+
+	attributes, err := spanAttributes(otp)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := startSpan(ctx, "twofactor.ToBytes", append(attributes, attribute.Int(attribute_version, version))...)
+	data, err := otp.ToBytesWith(engineID, version)
+	endSpan(span, err)
+	return data, err
+}
+
+// TOTPFromBytes converts the byte array like twofactor.TOTPFromBytesWith, in a span which includes the decryption.
+// The algorithm, the digits and the version are known only once the bytes have been decrypted.
+func TOTPFromBytes(ctx context.Context, encryptedMessage []byte, engineID string) (*twofactor.Totp, int, error) {
+
+	_, span := startSpan(ctx, "twofactor.TOTPFromBytes")
+	otp, version, err := twofactor.TOTPFromBytesWith(encryptedMessage, engineID)
+	if err == nil {
+		attributes, _ := spanAttributes(otp)
+		span.SetAttributes(append(attributes, attribute.Int(attribute_version, version))...)
+	}
+	endSpan(span, err)
+	return otp, version, err
+}
+
+// QR generates the PNG QR code like Totp.QR, in a span which includes the encoding
+func QR(ctx context.Context, otp *twofactor.Totp) ([]byte, error) {
+
+	attributes, err := spanAttributes(otp)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := startSpan(ctx, "twofactor.QR", attributes...)
+	data, err := otp.QR()
+	endSpan(span, err)
+	return data, err
+}
+
+// QRCode returns the QR code like Totp.QRCode, in a span which includes the encoding of the matrix.
+// The rendering of the returned QR code happens after the span.
+func QRCode(ctx context.Context, otp *twofactor.Totp, options twofactor.QROptions) (*twofactor.QRCode, error) {
+
+	attributes, err := spanAttributes(otp)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := startSpan(ctx, "twofactor.QRCode", attributes...)
+	code, err := otp.QRCode(options)
+	endSpan(span, err)
+	return code, err
+}
@@ -0,0 +1,218 @@
+package tracing
+
+import (
+	"context"
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sec51/twofactor"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Private function which records the spans in memory until the end of the test
+func newTestExporter(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { SetTracerProvider(nil) })
+	return exporter
+}
+
+// Private function which returns the attributes of the only span exported, and resets the exporter
+func checkSpan(t *testing.T, exporter *tracetest.InMemoryExporter, name string) map[attribute.Key]attribute.Value {
+	spans := exporter.GetSpans()
+	exporter.Reset()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d\n", len(spans))
+	}
+	if spans[0].Name != name {
+		t.Errorf("Expected the span %s, got %s\n", name, spans[0].Name)
+	}
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans[0].Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestValidate(t *testing.T) {
+
+	exporter := newTestExporter(t)
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 8)
+	checkError(t, err)
+	ctx := context.Background()
+
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, Validate(ctx, otp, code))
+	attributes := checkSpan(t, exporter, "twofactor.Validate")
+	if attributes[attribute_outcome].AsString() != "success" || attributes[attribute_offset].AsInt64() != 0 {
+		t.Errorf("Unexpected attributes %v\n", attributes)
+	}
+	if attributes[attribute_algorithm].AsString() != "SHA256" || attributes[attribute_digits].AsInt64() != 8 {
+		t.Errorf("Unexpected attributes %v\n", attributes)
+	}
+
+	// the refused codes are not errors of the span
+	if err := Validate(ctx, otp, "00000000"); err == nil {
+		t.Error("The wrong code has been accepted")
+	}
+	spans := exporter.GetSpans()
+	attributes = checkSpan(t, exporter, "twofactor.Validate")
+	if attributes[attribute_outcome].AsString() != "failure" || spans[0].Status.Code == codes.Error {
+		t.Errorf("Unexpected span %v\n", spans[0])
+	}
+
+	for i := 0; i < 3; i++ {
+		Validate(ctx, otp, "00000000")
+	}
+	exporter.Reset()
+	Validate(ctx, otp, code)
+	attributes = checkSpan(t, exporter, "twofactor.Validate")
+	if attributes[attribute_outcome].AsString() != "locked_down" {
+		t.Errorf("Unexpected attributes %v\n", attributes)
+	}
+
+	// the other errors are recorded
+	Validate(ctx, otp, "")
+	spans = exporter.GetSpans()
+	checkSpan(t, exporter, "twofactor.Validate")
+	if spans[0].Status.Code != codes.Error {
+		t.Errorf("Expected an error status, got %v\n", spans[0].Status)
+	}
+}
+
+// tracingBackend is a ContextStateBackend which records a span for each call
+type tracingBackend struct {
+	*twofactor.MemoryStateBackend
+}
+
+func (b tracingBackend) trace(ctx context.Context, name string) {
+	_, span := tracerProvider.Tracer("backend").Start(ctx, name)
+	span.End()
+}
+
+func (b tracingBackend) MarkUsedContext(ctx context.Context, id string, step uint64, ttl time.Duration) (bool, error) {
+	b.trace(ctx, "backend.MarkUsed")
+	return b.MarkUsed(id, step, ttl)
+}
+
+func (b tracingBackend) FailuresContext(ctx context.Context, id string) (int, error) {
+	b.trace(ctx, "backend.Failures")
+	return b.Failures(id)
+}
+
+func (b tracingBackend) AddFailureContext(ctx context.Context, id string, ttl time.Duration) (int, error) {
+	b.trace(ctx, "backend.AddFailure")
+	return b.AddFailure(id, ttl)
+}
+
+func TestValidateBackendSpans(t *testing.T) {
+
+	exporter := newTestExporter(t)
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	otp.SetStateBackend(tracingBackend{twofactor.NewMemoryStateBackend()})
+
+	code, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, Validate(context.Background(), otp, code))
+
+	// the backend spans end first
+	spans := exporter.GetSpans()
+	if len(spans) != 3 || spans[0].Name != "backend.Failures" || spans[1].Name != "backend.MarkUsed" || spans[2].Name != "twofactor.Validate" {
+		t.Fatalf("Unexpected spans %v\n", spans)
+	}
+	for _, span := range spans[:2] {
+		if span.Parent.SpanID() != spans[2].SpanContext.SpanID() {
+			t.Errorf("The span %s is not a child of twofactor.Validate\n", span.Name)
+		}
+	}
+}
+
+func TestBytes(t *testing.T) {
+
+	exporter := newTestExporter(t)
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	ctx := context.Background()
+
+	data, err := ToBytes(ctx, otp, "Sec51", twofactor.BytesVersion2)
+	checkError(t, err)
+	attributes := checkSpan(t, exporter, "twofactor.ToBytes")
+	if attributes[attribute_version].AsInt64() != twofactor.BytesVersion2 {
+		t.Errorf("Unexpected attributes %v\n", attributes)
+	}
+
+	restored, _, err := TOTPFromBytes(ctx, data, "Sec51")
+	checkError(t, err)
+	if restored.Secret() != otp.Secret() {
+		t.Error("The TOTP has not been restored")
+	}
+	attributes = checkSpan(t, exporter, "twofactor.TOTPFromBytes")
+	if attributes[attribute_algorithm].AsString() != "SHA1" || attributes[attribute_version].AsInt64() != twofactor.BytesVersion2 {
+		t.Errorf("Unexpected attributes %v\n", attributes)
+	}
+
+	if _, _, err := TOTPFromBytes(ctx, data[:10], "Sec51"); err == nil {
+		t.Error("The truncated bytes have been decoded")
+	}
+	spans := exporter.GetSpans()
+	checkSpan(t, exporter, "twofactor.TOTPFromBytes")
+	if spans[0].Status.Code != codes.Error {
+		t.Errorf("Expected an error status, got %v\n", spans[0].Status)
+	}
+}
+
+func TestQR(t *testing.T) {
+
+	exporter := newTestExporter(t)
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	_, err = QR(context.Background(), otp)
+	checkError(t, err)
+	checkSpan(t, exporter, "twofactor.QR")
+
+	_, err = QRCode(context.Background(), otp, twofactor.QROptions{})
+	checkError(t, err)
+	checkSpan(t, exporter, "twofactor.QRCode")
+}
+
+func TestSpansWithoutSecrets(t *testing.T) {
+
+	exporter := newTestExporter(t)
+	otp, err := twofactor.NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	ctx := context.Background()
+
+	code, err := otp.OTP()
+	checkError(t, err)
+	Validate(ctx, otp, code)
+	Validate(ctx, otp, "123456")
+	data, err := ToBytes(ctx, otp, "Sec51", twofactor.BytesVersion1)
+	checkError(t, err)
+	TOTPFromBytes(ctx, data, "Sec51")
+	QR(ctx, otp)
+
+	for _, span := range exporter.GetSpans() {
+		for _, kv := range span.Attributes {
+			value := kv.Value.Emit()
+			for _, secret := range []string{code, "123456", otp.Secret(), "info@sec51.com", "Sec51"} {
+				if strings.Contains(value, secret) {
+					t.Errorf("The span %s contains a sensitive value: %s\n", span.Name, kv.Key)
+				}
+			}
+		}
+	}
+}
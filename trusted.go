@@ -0,0 +1,165 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The trusted device token is encoded with the URL-safe base64 alphabet without padding, so it can be stored in a cookie:
+// Sizes:      1        8      8      32
+// Format: |version|issued|expiry|mac|
+// The MAC is keyed with a key of the server (see NewTrustedDeviceKey), never with the secret key of the TOTP,
+// which is known to the authenticator apps and to the exports. It covers the account, the issuer, the SHA-256
+// of the device id, the SHA-256 of the secret key and the trusted devices generation as well, which are not part
+// of the token: a token of another account, of another device, of a previous secret key or of a revoked generation
+// fails the same constant time comparison of the MAC.
+const (
+	trusted_token_version  = 2
+	trusted_token_size     = 1 + 8 + 8 + sha256.Size
+	trusted_token_label    = "sec51/twofactor trusted device v2" // separates the token key from the other uses of the server key
+	trusted_token_key_size = 32                                  // the minimum length in bytes of the server key: 256 bits
+)
+
+var (
+	TrustedDeviceError              = errors.New("The trusted device token is invalid, revoked or issued to another device.")
+	TrustedDeviceExpiredError       = errors.New("The trusted device token has expired.")
+	TrustedDevicesBytesVersionError = errors.New("The trusted devices revocation can be serialized only with BytesVersion2.")
+	TrustedDeviceKeyError           = errors.New("The trusted device key is too short: at least 256 bits are required.")
+)
+
+// TrustedDeviceKey signs the trusted device tokens. The key belongs to the server, like a session key,
+// and must be the same in all the replicas. The max age is enforced by the server, whatever the expiry of the token:
+// lowering it shortens the tokens already issued.
+type TrustedDeviceKey struct {
+	key    []byte
+	maxAge time.Duration
+}
+
+// NewTrustedDeviceKey creates the key of the trusted device tokens from a random key of at least 256 bits
+func NewTrustedDeviceKey(key []byte, maxAge time.Duration) (*TrustedDeviceKey, error) {
+	if len(key) < trusted_token_key_size {
+		return nil, TrustedDeviceKeyError
+	}
+	if maxAge <= 0 {
+		return nil, errors.New("The trusted device max age must be positive")
+	}
+
+	derived := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(trusted_token_label)), derived); err != nil {
+		return nil, err
+	}
+	return &TrustedDeviceKey{key: derived, maxAge: maxAge}, nil
+}
+
+// TrustDevice returns a token which lets the device skip the code until it expires, to be issued only after
+// a successful Validate, see ValidateAndTrust. The device id identifies the browser or the device, for instance
+// a random value of a long lived cookie: the token is accepted only together with the same device id.
+// The ttl cannot exceed the max age of the key. The secret rotation revokes all the tokens as well.
+// The token does not need to be stored on the server.
+func (otp *Totp) TrustDevice(key *TrustedDeviceKey, deviceID string, ttl time.Duration) (string, error) {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return "", err
+	}
+
+	if deviceID == "" {
+		return "", errors.New("The device id is required to trust the device")
+	}
+	if ttl <= 0 || ttl > key.maxAge {
+		return "", errors.New("The trusted device duration must be positive and within the max age of the key")
+	}
+
+	now := time.Now()
+	token, err := otp.trustedDeviceToken(key, deviceID, now.Unix(), now.Add(ttl).Unix())
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// ValidateAndTrust validates the user code like Validate and, when it succeeds, returns the token of the trusted device
+func (otp *Totp) ValidateAndTrust(userCode string, key *TrustedDeviceKey, deviceID string, ttl time.Duration) (string, error) {
+	if err := otp.Validate(userCode); err != nil {
+		return "", err
+	}
+	return otp.TrustDevice(key, deviceID, ttl)
+}
+
+// VerifyTrustedDevice checks the token of the device: it returns nil when the OTP prompt can be skipped,
+// TrustedDeviceExpiredError when the token has expired or is older than the max age of the key, TrustedDeviceError otherwise.
+// The comparison of the MAC is constant time, the expiry is checked only once the MAC is valid.
+func (otp *Totp) VerifyTrustedDevice(key *TrustedDeviceKey, token, deviceID string) error {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return err
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) != trusted_token_size || data[0] != trusted_token_version {
+		return TrustedDeviceError
+	}
+
+	issued := int64(bigendian.FromUint64([8]byte{data[1], data[2], data[3], data[4], data[5], data[6], data[7], data[8]}))
+	expiry := int64(bigendian.FromUint64([8]byte{data[9], data[10], data[11], data[12], data[13], data[14], data[15], data[16]}))
+	expected, err := otp.trustedDeviceToken(key, deviceID, issued, expiry)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(data, expected) {
+		return TrustedDeviceError
+	}
+
+	now := time.Now()
+	if !now.Before(time.Unix(expiry, 0)) || now.Sub(time.Unix(issued, 0)) > key.maxAge {
+		return TrustedDeviceExpiredError
+	}
+	return nil
+}
+
+// RevokeTrustedDevices invalidates all the tokens issued so far, for instance when the user reports a lost device
+// or changes the password. The revocation is part of the TOTP state: it takes effect once the TOTP is stored
+// with ToBytesWith and BytesVersion2.
+func (otp *Totp) RevokeTrustedDevices() {
+	otp.trustedDevicesGeneration++
+}
+
+// Private function which returns the token of the device with the given issue time and expiry in Unix seconds
+func (otp *Totp) trustedDeviceToken(key *TrustedDeviceKey, deviceID string, issued, expiry int64) ([]byte, error) {
+
+	if key == nil {
+		return nil, TrustedDeviceKeyError
+	}
+
+	var token bytes.Buffer
+	issuedBytes := bigendian.ToUint64(uint64(issued))
+	expiryBytes := bigendian.ToUint64(uint64(expiry))
+	token.WriteByte(trusted_token_version)
+	token.Write(issuedBytes[:])
+	token.Write(expiryBytes[:])
+
+	// the fields have a size prefix, so that two different inputs can never be the same
+	deviceHash := sha256.Sum256([]byte(deviceID))
+	secretHash := sha256.Sum256(otp.key)
+	generationBytes := bigendian.ToUint64(otp.trustedDevicesGeneration)
+	mac := hmac.New(sha256.New, key.key)
+	mac.Write(token.Bytes())
+	mac.Write(generationBytes[:])
+	mac.Write(deviceHash[:])
+	mac.Write(secretHash[:])
+	var fields bytes.Buffer
+	writeSizedBytes(&fields, []byte(otp.account))
+	writeSizedBytes(&fields, []byte(otp.issuer))
+	mac.Write(fields.Bytes())
+
+	return mac.Sum(token.Bytes()), nil
+}
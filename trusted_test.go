@@ -0,0 +1,147 @@
+package twofactor
+
+import (
+	"crypto"
+	"encoding/base64"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var testTrustedDeviceKey, _ = NewTrustedDeviceKey([]byte("0123456789abcdef0123456789abcdef"), 30*24*time.Hour)
+
+func TestTrustedDevice(t *testing.T) {
+
+	key := testTrustedDeviceKey
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	code, err := otp.OTP()
+	checkError(t, err)
+	token, err := otp.ValidateAndTrust(code, key, "laptop", 30*24*time.Hour)
+	checkError(t, err)
+	if !regexp.MustCompile(`^[A-Za-z0-9_-]+$`).MatchString(token) {
+		t.Errorf("The token cannot be stored in a cookie: %s\n", token)
+	}
+
+	checkError(t, otp.VerifyTrustedDevice(key, token, "laptop"))
+
+	// another device
+	if err := otp.VerifyTrustedDevice(key, token, "phone"); err != TrustedDeviceError {
+		t.Errorf("Expected TrustedDeviceError, got %v\n", err)
+	}
+
+	// another account
+	other, err := NewTOTPFromSecret(otp.key, "other@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	if err := other.VerifyTrustedDevice(key, token, "laptop"); err != TrustedDeviceError {
+		t.Errorf("Expected TrustedDeviceError, got %v\n", err)
+	}
+
+	// altered or malformed tokens
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	checkError(t, err)
+	data[11] ^= 1 // a later expiry
+	for _, altered := range []string{base64.RawURLEncoding.EncodeToString(data), token[:len(token)-2], "", "not a token"} {
+		if err := otp.VerifyTrustedDevice(key, altered, "laptop"); err != TrustedDeviceError {
+			t.Errorf("Expected TrustedDeviceError for %q, got %v\n", altered, err)
+		}
+	}
+
+	// a wrong code does not trust the device
+	if token, err := otp.ValidateAndTrust("000000x", key, "laptop", time.Hour); err == nil || token != "" {
+		t.Error("The device has been trusted without a valid code")
+	}
+
+	if _, err := otp.TrustDevice(key, "", time.Hour); err == nil {
+		t.Error("The empty device id has been accepted")
+	}
+	if _, err := otp.TrustDevice(key, "laptop", 0); err == nil {
+		t.Error("The zero duration has been accepted")
+	}
+	if _, err := otp.TrustDevice(key, "laptop", 31*24*time.Hour); err == nil {
+		t.Error("A duration beyond the max age has been accepted")
+	}
+
+	// the secret key of the TOTP, 160 bits, is too short to sign the tokens
+	if _, err := NewTrustedDeviceKey(otp.key, time.Hour); err != TrustedDeviceKeyError {
+		t.Errorf("Expected TrustedDeviceKeyError, got %v\n", err)
+	}
+	otherKey, err := NewTrustedDeviceKey([]byte("another key of the server, 256 bits"), 30*24*time.Hour)
+	checkError(t, err)
+	if err := otp.VerifyTrustedDevice(otherKey, token, "laptop"); err != TrustedDeviceError {
+		t.Errorf("Expected TrustedDeviceError with another key, got %v\n", err)
+	}
+}
+
+func TestTrustedDeviceExpiry(t *testing.T) {
+
+	key := testTrustedDeviceKey
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	now := time.Now()
+	data, err := otp.trustedDeviceToken(key, "laptop", now.Add(-time.Hour).Unix(), now.Add(-time.Second).Unix())
+	checkError(t, err)
+	if err := otp.VerifyTrustedDevice(key, base64.RawURLEncoding.EncodeToString(data), "laptop"); err != TrustedDeviceExpiredError {
+		t.Errorf("Expected TrustedDeviceExpiredError, got %v\n", err)
+	}
+
+	// the max age of the server applies whatever the expiry of the token
+	token, err := otp.TrustDevice(key, "laptop", 30*24*time.Hour)
+	checkError(t, err)
+	shorter, err := NewTrustedDeviceKey([]byte("0123456789abcdef0123456789abcdef"), time.Hour)
+	checkError(t, err)
+	checkError(t, otp.VerifyTrustedDevice(shorter, token, "laptop"))
+	data, err = otp.trustedDeviceToken(shorter, "laptop", now.Add(-2*time.Hour).Unix(), now.Add(time.Hour).Unix())
+	checkError(t, err)
+	if err := otp.VerifyTrustedDevice(shorter, base64.RawURLEncoding.EncodeToString(data), "laptop"); err != TrustedDeviceExpiredError {
+		t.Errorf("Expected TrustedDeviceExpiredError beyond the max age, got %v\n", err)
+	}
+}
+
+func TestRevokeTrustedDevices(t *testing.T) {
+
+	key := testTrustedDeviceKey
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+	token, err := otp.TrustDevice(key, "laptop", time.Hour)
+	checkError(t, err)
+
+	otp.RevokeTrustedDevices()
+	if err := otp.VerifyTrustedDevice(key, token, "laptop"); err != TrustedDeviceError {
+		t.Errorf("Expected TrustedDeviceError, got %v\n", err)
+	}
+
+	// the revocation needs the version 2
+	if _, err := otp.ToBytes(); err != TrustedDevicesBytesVersionError {
+		t.Errorf("Expected TrustedDevicesBytesVersionError, got %v\n", err)
+	}
+
+	// the new tokens are accepted, the revoked ones are still refused after the serialization
+	token2, err := otp.TrustDevice(key, "laptop", time.Hour)
+	checkError(t, err)
+	data, err := otp.ToBytesWith("Sec51", BytesVersion2)
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, "Sec51")
+	checkError(t, err)
+	if restored.trustedDevicesGeneration != 1 {
+		t.Errorf("Expected the generation 1, got %d\n", restored.trustedDevicesGeneration)
+	}
+	checkError(t, restored.VerifyTrustedDevice(key, token2, "laptop"))
+	if err := restored.VerifyTrustedDevice(key, token, "laptop"); err != TrustedDeviceError {
+		t.Errorf("Expected TrustedDeviceError, got %v\n", err)
+	}
+
+	// the secret rotation revokes the tokens as well
+	checkError(t, restored.StartRotation(time.Hour))
+	restored.promoteNextKey()
+	if err := restored.VerifyTrustedDevice(key, token2, "laptop"); err != TrustedDeviceError {
+		t.Errorf("Expected TrustedDeviceError, got %v\n", err)
+	}
+
+	otp.Destroy()
+	if err := otp.VerifyTrustedDevice(key, token2, "laptop"); err != initializationFailedError {
+		t.Errorf("Expected initializationFailedError, got %v\n", err)
+	}
+}
@@ -0,0 +1,325 @@
+package vault
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	aegis_version         = 1
+	aegis_db_version      = 2
+	aegis_password_slot   = 1
+	aegis_master_key_size = 32
+	aegis_salt_size       = 32
+	aegis_nonce_size      = 12
+	aegis_tag_size        = 16
+	aegis_scrypt_n        = 1 << 15
+	aegis_scrypt_r        = 8
+	aegis_scrypt_p        = 1
+
+	// upper bounds of the scrypt parameters read from a vault: 256 MiB of memory
+	aegis_max_scrypt_n = 1 << 18
+	aegis_max_scrypt_r = 8
+	aegis_max_scrypt_p = 16
+)
+
+// see https://github.com/beemdevelopment/Aegis/blob/master/docs/vault.md
+type aegisVault struct {
+	Version int             `json:"version"`
+	Header  aegisHeader     `json:"header"`
+	DB      json.RawMessage `json:"db"` // the database object, or its base64 encrypted representation
+}
+
+type aegisHeader struct {
+	Slots  []aegisSlot  `json:"slots"`
+	Params *aegisParams `json:"params"`
+}
+
+type aegisSlot struct {
+	Type      int         `json:"type"`
+	UUID      string      `json:"uuid"`
+	Key       string      `json:"key"`
+	KeyParams aegisParams `json:"key_params"`
+	N         int         `json:"n,omitempty"`
+	R         int         `json:"r,omitempty"`
+	P         int         `json:"p,omitempty"`
+	Salt      string      `json:"salt,omitempty"`
+	Repaired  bool        `json:"repaired,omitempty"`
+}
+
+type aegisParams struct {
+	Nonce string `json:"nonce"`
+	Tag   string `json:"tag"`
+}
+
+type aegisDB struct {
+	Version int          `json:"version"`
+	Entries []aegisEntry `json:"entries"`
+}
+
+type aegisEntry struct {
+	Type     string    `json:"type"`
+	UUID     string    `json:"uuid"`
+	Name     string    `json:"name"`
+	Issuer   string    `json:"issuer"`
+	Note     string    `json:"note"`
+	Favorite bool      `json:"favorite"`
+	Icon     []byte    `json:"icon"`
+	IconMIME string    `json:"icon_mime,omitempty"`
+	Info     aegisInfo `json:"info"`
+}
+
+type aegisInfo struct {
+	Secret  string  `json:"secret"`
+	Algo    string  `json:"algo"`
+	Digits  int     `json:"digits"`
+	Period  int     `json:"period,omitempty"`
+	Counter *uint64 `json:"counter,omitempty"`
+}
+
+func readAegis(data []byte, password []byte) ([]Entry, error) {
+
+	var vault aegisVault
+	if err := json.Unmarshal(data, &vault); err != nil {
+		return nil, err
+	}
+
+	if vault.Version != aegis_version {
+		return nil, errors.New(fmt.Sprintf("Unsupported Aegis vault version %d", vault.Version))
+	}
+
+	content := []byte(vault.DB)
+	if vault.Header.Params != nil {
+		var err error
+		if content, err = decryptAegisDB(&vault, password); err != nil {
+			return nil, err
+		}
+	}
+
+	var db aegisDB
+	if err := json.Unmarshal(content, &db); err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(db.Entries))
+	var labels []string
+	for _, e := range db.Entries {
+		f := &fields{
+			otpType:   e.Type,
+			issuer:    e.Issuer,
+			account:   e.Name,
+			algorithm: e.Info.Algo,
+			digits:    e.Info.Digits,
+			period:    e.Info.Period,
+		}
+		if e.Info.Counter != nil {
+			f.counter = *e.Info.Counter
+		}
+
+		if !f.supported() {
+			labels = append(labels, f.label())
+			continue
+		}
+
+		var err error
+		if f.secret, err = decodeBase32(e.Info.Secret); err != nil {
+			return nil, err
+		}
+
+		entry, err := f.entry(Icon{Data: e.Icon, MIME: e.IconMIME})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, skipped(labels)
+}
+
+// decryptAegisDB unlocks the master key with the first password slot which accepts the password
+// and decrypts the database
+func decryptAegisDB(vault *aegisVault, password []byte) ([]byte, error) {
+
+	if len(password) == 0 {
+		return nil, PasswordRequiredError
+	}
+
+	var encrypted string
+	if err := json.Unmarshal(vault.DB, &encrypted); err != nil {
+		return nil, err
+	}
+
+	var masterKey []byte
+	for _, slot := range vault.Header.Slots {
+		if slot.Type != aegis_password_slot {
+			continue
+		}
+
+		if slot.N > aegis_max_scrypt_n || slot.R > aegis_max_scrypt_r || slot.P > aegis_max_scrypt_p {
+			return nil, errors.New(fmt.Sprintf("The Aegis scrypt parameters N=%d r=%d p=%d exceed the maximum N=%d r=%d p=%d",
+				slot.N, slot.R, slot.P, aegis_max_scrypt_n, aegis_max_scrypt_r, aegis_max_scrypt_p))
+		}
+
+		salt, err := hex.DecodeString(slot.Salt)
+		if err != nil {
+			return nil, err
+		}
+		key, err := scrypt.Key(password, salt, slot.N, slot.R, slot.P, aegis_master_key_size)
+		if err != nil {
+			return nil, err
+		}
+
+		encryptedKey, err := hex.DecodeString(slot.Key)
+		if err != nil {
+			return nil, err
+		}
+		if masterKey, err = openAegis(key, slot.KeyParams, encryptedKey); err == nil {
+			break
+		}
+	}
+	if masterKey == nil {
+		return nil, WrongPasswordError
+	}
+
+	db, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	return openAegis(masterKey, *vault.Header.Params, db)
+}
+
+// openAegis decrypts the cipher text, Aegis stores the GCM tag separately
+func openAegis(key []byte, params aegisParams, cipherText []byte) ([]byte, error) {
+
+	nonce, err := hex.DecodeString(params.Nonce)
+	if err != nil {
+		return nil, WrongPasswordError
+	}
+	tag, err := hex.DecodeString(params.Tag)
+	if err != nil {
+		return nil, WrongPasswordError
+	}
+
+	return openGCM(key, nonce, append(append([]byte{}, cipherText...), tag...))
+}
+
+// sealAegis encrypts the plain text, returning the cipher text and its parameters
+func sealAegis(key []byte, plain []byte) ([]byte, *aegisParams, error) {
+
+	nonce, err := randomBytes(aegis_nonce_size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealed, err := sealGCM(key, nonce, plain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipherText, tag := sealed[:len(sealed)-aegis_tag_size], sealed[len(sealed)-aegis_tag_size:]
+	return cipherText, &aegisParams{Nonce: hex.EncodeToString(nonce), Tag: hex.EncodeToString(tag)}, nil
+}
+
+func writeAegis(entries []Entry, password []byte) ([]byte, error) {
+
+	db := aegisDB{Version: aegis_db_version, Entries: make([]aegisEntry, 0, len(entries))}
+	for _, entry := range entries {
+		f, err := entryFields(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		uuid, err := newUUID()
+		if err != nil {
+			return nil, err
+		}
+
+		e := aegisEntry{
+			Type:     f.otpType,
+			UUID:     uuid,
+			Name:     f.account,
+			Issuer:   f.issuer,
+			Icon:     entry.Icon.Data,
+			IconMIME: entry.Icon.MIME,
+			Info: aegisInfo{
+				Secret: encodeBase32(f.secret),
+				Algo:   f.algorithm,
+				Digits: f.digits,
+				Period: f.period,
+			},
+		}
+		if f.otpType == "hotp" {
+			counter := f.counter
+			e.Info.Counter = &counter
+		}
+		db.Entries = append(db.Entries, e)
+	}
+
+	content, err := json.Marshal(db)
+	if err != nil {
+		return nil, err
+	}
+
+	vault := aegisVault{Version: aegis_version, DB: content}
+	if len(password) > 0 {
+		if err := encryptAegisDB(&vault, password); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.MarshalIndent(vault, "", "    ")
+}
+
+// encryptAegisDB encrypts the database with a new master key, protected by a password slot
+func encryptAegisDB(vault *aegisVault, password []byte) error {
+
+	masterKey, err := randomBytes(aegis_master_key_size)
+	if err != nil {
+		return err
+	}
+	salt, err := randomBytes(aegis_salt_size)
+	if err != nil {
+		return err
+	}
+	uuid, err := newUUID()
+	if err != nil {
+		return err
+	}
+
+	key, err := scrypt.Key(password, salt, aegis_scrypt_n, aegis_scrypt_r, aegis_scrypt_p, aegis_master_key_size)
+	if err != nil {
+		return err
+	}
+
+	encryptedKey, keyParams, err := sealAegis(key, masterKey)
+	if err != nil {
+		return err
+	}
+
+	encryptedDB, params, err := sealAegis(masterKey, vault.DB)
+	if err != nil {
+		return err
+	}
+
+	vault.Header.Slots = []aegisSlot{{
+		Type:      aegis_password_slot,
+		UUID:      uuid,
+		Key:       hex.EncodeToString(encryptedKey),
+		KeyParams: *keyParams,
+		N:         aegis_scrypt_n,
+		R:         aegis_scrypt_r,
+		P:         aegis_scrypt_p,
+		Salt:      hex.EncodeToString(salt),
+		Repaired:  true,
+	}}
+	vault.Header.Params = params
+
+	vault.DB, err = json.Marshal(base64.StdEncoding.EncodeToString(encryptedDB))
+	return err
+}
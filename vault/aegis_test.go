@@ -0,0 +1,98 @@
+package vault
+
+import (
+	"strings"
+	"testing"
+)
+
+// plain vault exported by Aegis, the icon is a 1x1 PNG
+var aegisPlainVault = `{
+    "version": 1,
+    "header": {"slots": null, "params": null},
+    "db": {
+        "version": 2,
+        "entries": [
+            {
+                "type": "totp",
+                "uuid": "3ae6f1ad-2e65-4ed2-a953-1ec0dff2386d",
+                "name": "Mason",
+                "issuer": "Deno",
+                "note": "",
+                "favorite": false,
+                "icon": "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==",
+                "icon_mime": "image/png",
+                "info": {"secret": "4SJHB4GSD43FZBAI7C2HLRJGPQ", "algo": "SHA1", "digits": 6, "period": 30}
+            },
+            {
+                "type": "hotp",
+                "uuid": "ec8e4c4e-7f8a-4e3b-9c7a-3b9e3c0e2a11",
+                "name": "James",
+                "issuer": "Issuu",
+                "note": "",
+                "favorite": false,
+                "icon": null,
+                "info": {"secret": "YOOMIXWS5GN6RTBPUFFWKTW5M4", "algo": "SHA256", "digits": 8, "counter": 5}
+            }
+        ]
+    }
+}`
+
+func TestReadAegis(t *testing.T) {
+
+	entries, err := Read(Aegis, []byte(aegisPlainVault), nil)
+	checkError(t, err)
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, instead we've got %d\n", len(entries))
+	}
+
+	if entries[0].Totp == nil || entries[0].Totp.Secret() != "4SJHB4GSD43FZBAI7C2HLRJGPQ======" {
+		t.Error("The Aegis TOTP entry has not been read correctly")
+	}
+	if entries[0].Icon.MIME != "image/png" || len(entries[0].Icon.Data) == 0 {
+		t.Error("The Aegis icon has not been read")
+	}
+
+	if entries[1].Hotp == nil || entries[1].Hotp.Counter() != 5 {
+		t.Error("The Aegis HOTP entry has not been read correctly")
+	}
+
+	f, err := entryFields(entries[1])
+	checkError(t, err)
+	if f.issuer != "Issuu" || f.account != "James" || f.algorithm != "SHA256" || f.digits != 8 {
+		t.Errorf("Aegis HOTP entry mismatch: %+v\n", *f)
+	}
+}
+
+func TestWriteAegisIcon(t *testing.T) {
+
+	entries, err := Read(Aegis, []byte(aegisPlainVault), nil)
+	checkError(t, err)
+
+	data, err := Write(Aegis, entries, []byte("test"))
+	checkError(t, err)
+
+	restored, err := Read(Aegis, data, []byte("test"))
+	checkError(t, err)
+
+	if string(restored[0].Icon.Data) != string(entries[0].Icon.Data) || restored[0].Icon.MIME != "image/png" {
+		t.Error("The icon differs after the Aegis round trip")
+	}
+}
+
+func TestAegisScryptParameters(t *testing.T) {
+
+	entries, err := Read(Aegis, []byte(aegisPlainVault), nil)
+	checkError(t, err)
+
+	data, err := Write(Aegis, entries, []byte("test"))
+	checkError(t, err)
+
+	altered := strings.Replace(string(data), `"n": 32768`, `"n": 1073741824`, 1)
+	if altered == string(data) {
+		t.Fatal("The scrypt N parameter has not been found in the vault")
+	}
+	if _, err := Read(Aegis, []byte(altered), []byte("test")); err == nil || err == WrongPasswordError {
+		t.Errorf("Expected an error for the excessive scrypt parameters, instead we've got %v\n", err)
+	}
+}
@@ -0,0 +1,184 @@
+package vault
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	andotp_iterations_size = 4
+	andotp_salt_size       = 12
+	andotp_nonce_size      = 12
+	andotp_key_size        = 32
+	andotp_iterations      = 150000
+	andotp_max_iterations  = 10000000 // upper bound of the iterations read from a backup
+	andotp_header_size     = andotp_iterations_size + andotp_salt_size + andotp_nonce_size
+)
+
+// see https://github.com/andOTP/andOTP/wiki/Backup-Formats
+type andOTPEntry struct {
+	Secret        string   `json:"secret"`
+	Issuer        string   `json:"issuer"`
+	Label         string   `json:"label"`
+	Digits        int      `json:"digits"`
+	Type          string   `json:"type"`
+	Algorithm     string   `json:"algorithm"`
+	Thumbnail     string   `json:"thumbnail"`
+	LastUsed      int64    `json:"last_used"`
+	UsedFrequency int      `json:"used_frequency"`
+	Period        int      `json:"period,omitempty"`
+	Counter       *uint64  `json:"counter,omitempty"`
+	Tags          []string `json:"tags"`
+}
+
+func readAndOTP(data []byte, password []byte) ([]Entry, error) {
+
+	content := data
+	if !isJSON(data) {
+		if len(password) == 0 {
+			return nil, PasswordRequiredError
+		}
+		var err error
+		if content, err = decryptAndOTP(data, password); err != nil {
+			return nil, err
+		}
+	}
+
+	var backup []andOTPEntry
+	if err := json.Unmarshal(content, &backup); err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(backup))
+	var labels []string
+	for _, e := range backup {
+		f := &fields{
+			otpType:   e.Type,
+			issuer:    e.Issuer,
+			account:   e.Label,
+			algorithm: e.Algorithm,
+			digits:    e.Digits,
+			period:    e.Period,
+		}
+		if e.Counter != nil {
+			f.counter = *e.Counter
+		}
+
+		if !f.supported() {
+			labels = append(labels, f.label())
+			continue
+		}
+
+		var err error
+		if f.secret, err = decodeBase32(e.Secret); err != nil {
+			return nil, err
+		}
+
+		entry, err := f.entry(Icon{Name: e.Thumbnail})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, skipped(labels)
+}
+
+// decryptAndOTP decrypts a backup with the layout iterations | salt | nonce | cipher text and tag
+func decryptAndOTP(data []byte, password []byte) ([]byte, error) {
+
+	if len(data) < andotp_header_size {
+		return nil, WrongPasswordError
+	}
+
+	iterations := int(binary.BigEndian.Uint32(data[:andotp_iterations_size]))
+	salt := data[andotp_iterations_size : andotp_iterations_size+andotp_salt_size]
+	nonce := data[andotp_iterations_size+andotp_salt_size : andotp_header_size]
+
+	if iterations <= 0 || iterations > andotp_max_iterations {
+		return nil, errors.New(fmt.Sprintf("The andOTP iteration count %d is not between 1 and %d", iterations, andotp_max_iterations))
+	}
+
+	key := pbkdf2.Key(password, salt, iterations, andotp_key_size, sha1.New)
+	return openGCM(key, nonce, data[andotp_header_size:])
+}
+
+func writeAndOTP(entries []Entry, password []byte) ([]byte, error) {
+
+	backup := make([]andOTPEntry, 0, len(entries))
+	for _, entry := range entries {
+		f, err := entryFields(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		thumbnail := entry.Icon.Name
+		if thumbnail == "" {
+			thumbnail = "Default"
+		}
+
+		e := andOTPEntry{
+			Secret:    encodeBase32(f.secret),
+			Issuer:    f.issuer,
+			Label:     f.account,
+			Digits:    f.digits,
+			Type:      strings.ToUpper(f.otpType),
+			Algorithm: f.algorithm,
+			Thumbnail: thumbnail,
+			Period:    f.period,
+			Tags:      []string{},
+		}
+		if f.otpType == "hotp" {
+			counter := f.counter
+			e.Counter = &counter
+		}
+		backup = append(backup, e)
+	}
+
+	content, err := json.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(password) == 0 {
+		return content, nil
+	}
+
+	return encryptAndOTP(content, password)
+}
+
+func encryptAndOTP(content []byte, password []byte) ([]byte, error) {
+
+	salt, err := randomBytes(andotp_salt_size)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(andotp_nonce_size)
+	if err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2.Key(password, salt, andotp_iterations, andotp_key_size, sha1.New)
+	sealed, err := sealGCM(key, nonce, content)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, andotp_iterations_size, andotp_header_size+len(sealed))
+	binary.BigEndian.PutUint32(header, andotp_iterations)
+	header = append(header, salt...)
+	header = append(header, nonce...)
+	return append(header, sealed...), nil
+}
+
+// isJSON reports whether the backup is a plain JSON document rather than an encrypted blob
+func isJSON(data []byte) bool {
+	trimmed := strings.TrimSpace(string(data))
+	return strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{")
+}
@@ -0,0 +1,67 @@
+package vault
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var andOTPPlainBackup = `[
+  {"secret":"JBSWY3DPEHPK3PXP","issuer":"Example","label":"alice@google.com","digits":6,"type":"TOTP","algorithm":"SHA1","thumbnail":"Google","last_used":1577836800000,"used_frequency":3,"period":30,"tags":["work"]},
+  {"secret":"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ","issuer":"","label":"rfc4226","digits":6,"type":"HOTP","algorithm":"SHA1","thumbnail":"Default","last_used":0,"used_frequency":0,"counter":1,"tags":[]}
+]`
+
+func TestReadAndOTP(t *testing.T) {
+
+	entries, err := Read(AndOTP, []byte(andOTPPlainBackup), nil)
+	checkError(t, err)
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, instead we've got %d\n", len(entries))
+	}
+
+	if entries[0].Totp == nil || entries[0].Icon.Name != "Google" {
+		t.Error("The andOTP TOTP entry has not been read correctly")
+	}
+
+	// RFC 4226 test vector for counter 1
+	if entries[1].Hotp == nil {
+		t.Fatal("The andOTP HOTP entry has not been read")
+	}
+	token, err := entries[1].Hotp.OTP()
+	checkError(t, err)
+	if token != "287082" {
+		t.Errorf("Expected the HOTP token 287082, instead we've got %s\n", token)
+	}
+}
+
+func TestAndOTPTruncated(t *testing.T) {
+
+	if _, err := Read(AndOTP, []byte{0, 0, 1}, []byte("test")); err != WrongPasswordError {
+		t.Errorf("Expected WrongPasswordError for a truncated backup, instead we've got %v\n", err)
+	}
+}
+
+func TestAndOTPSkipped(t *testing.T) {
+
+	backup := strings.Replace(andOTPPlainBackup, `"type":"TOTP"`, `"type":"STEAM"`, 1)
+	entries, err := Read(AndOTP, []byte(backup), nil)
+
+	var skippedError *SkippedEntriesError
+	if !errors.As(err, &skippedError) || len(skippedError.Entries) != 1 || skippedError.Entries[0] != "Example:alice@google.com" {
+		t.Fatalf("Expected the steam entry to be skipped, instead we've got %v\n", err)
+	}
+	if len(entries) != 1 || entries[0].Hotp == nil {
+		t.Errorf("Expected the HOTP entry, instead we've got %d entries\n", len(entries))
+	}
+}
+
+func TestAndOTPIterations(t *testing.T) {
+
+	data := make([]byte, andotp_header_size+32)
+	binary.BigEndian.PutUint32(data, andotp_max_iterations+1)
+	if _, err := Read(AndOTP, data, []byte("test")); err == nil || err == WrongPasswordError {
+		t.Errorf("Expected an error for the excessive iteration count, instead we've got %v\n", err)
+	}
+}
@@ -0,0 +1,109 @@
+package vault
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// see https://github.com/helloworld1/FreeOTPPlus
+type freeOTPBackup struct {
+	TokenOrder []string       `json:"tokenOrder"`
+	Tokens     []freeOTPToken `json:"tokens"`
+}
+
+type freeOTPToken struct {
+	Algo      string `json:"algo"`
+	Counter   uint64 `json:"counter"`
+	Digits    int    `json:"digits"`
+	IssuerExt string `json:"issuerExt"`
+	IssuerInt string `json:"issuerInt,omitempty"`
+	Label     string `json:"label"`
+	Period    int    `json:"period"`
+	Secret    []int8 `json:"secret"` // Java signed bytes
+	Type      string `json:"type"`
+	ImagePath string `json:"imagePath,omitempty"`
+}
+
+func readFreeOTPPlus(data []byte) ([]Entry, error) {
+
+	var backup freeOTPBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(backup.Tokens))
+	var labels []string
+	for _, token := range backup.Tokens {
+		f := &fields{
+			otpType:   token.Type,
+			issuer:    token.IssuerExt,
+			account:   token.Label,
+			algorithm: token.Algo,
+			digits:    token.Digits,
+			period:    token.Period,
+			counter:   token.Counter,
+			secret:    make([]byte, len(token.Secret)),
+		}
+		if f.issuer == "" {
+			f.issuer = token.IssuerInt
+		}
+		if !f.supported() {
+			labels = append(labels, f.label())
+			continue
+		}
+
+		for i, b := range token.Secret {
+			f.secret[i] = byte(b)
+		}
+		if f.otpType != "hotp" && f.otpType != "HOTP" {
+			f.counter = 0
+		}
+
+		entry, err := f.entry(Icon{Name: token.ImagePath})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, skipped(labels)
+}
+
+func writeFreeOTPPlus(entries []Entry) ([]byte, error) {
+
+	backup := freeOTPBackup{
+		TokenOrder: make([]string, 0, len(entries)),
+		Tokens:     make([]freeOTPToken, 0, len(entries)),
+	}
+
+	for _, entry := range entries {
+		f, err := entryFields(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		token := freeOTPToken{
+			Algo:      f.algorithm,
+			Counter:   f.counter,
+			Digits:    f.digits,
+			IssuerExt: f.issuer,
+			Label:     f.account,
+			Period:    f.period,
+			Secret:    make([]int8, len(f.secret)),
+			Type:      strings.ToUpper(f.otpType),
+			ImagePath: entry.Icon.Name,
+		}
+		if token.Period == 0 {
+			// FreeOTP+ stores a period for the HOTP tokens as well
+			token.Period = 30
+		}
+		for i, b := range f.secret {
+			token.Secret[i] = int8(b)
+		}
+
+		backup.TokenOrder = append(backup.TokenOrder, f.issuer+":"+f.account)
+		backup.Tokens = append(backup.Tokens, token)
+	}
+
+	return json.Marshal(backup)
+}
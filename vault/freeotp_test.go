@@ -0,0 +1,42 @@
+package vault
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var freeOTPPlusBackup = `{
+  "tokenOrder": ["Example:alice@google.com"],
+  "tokens": [
+    {"algo": "SHA1", "counter": 0, "digits": 6, "issuerExt": "Example", "label": "alice@google.com", "period": 30,
+     "secret": [72, 101, 108, 108, 111, 33, -34, -83, -66, -17], "type": "TOTP"}
+  ]
+}`
+
+func TestReadFreeOTPPlus(t *testing.T) {
+
+	entries, err := Read(FreeOTPPlus, []byte(freeOTPPlusBackup), nil)
+	checkError(t, err)
+
+	if len(entries) != 1 || entries[0].Totp == nil {
+		t.Fatal("The FreeOTP+ entry has not been read")
+	}
+
+	// the signed bytes are the secret Hello!\xde\xad\xbe\xef
+	if entries[0].Totp.Secret() != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("FreeOTP+ secret mismatch: %s\n", entries[0].Totp.Secret())
+	}
+}
+
+func TestWriteFreeOTPPlusOrder(t *testing.T) {
+
+	data, err := Write(FreeOTPPlus, testEntries(t), nil)
+	checkError(t, err)
+
+	var backup freeOTPBackup
+	checkError(t, json.Unmarshal(data, &backup))
+
+	if len(backup.TokenOrder) != 2 || backup.TokenOrder[0] != "ACME Co:john.doe@email.com" {
+		t.Errorf("FreeOTP+ token order mismatch: %v\n", backup.TokenOrder)
+	}
+}
@@ -0,0 +1,245 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	twofas_schema_version = 4
+	twofas_iterations     = 10000
+	twofas_key_size       = 32
+	twofas_salt_size      = 256
+	twofas_nonce_size     = 12
+	twofas_icon_selected  = "IconCollection"
+)
+
+// the plain text encrypted in the reference field, which 2FAS uses to check the password before decrypting the services
+const twofas_reference = "tRViSsLKzd86Hprh4ceC2OP7xazn4rrt4xhfEUbOjxLX8Rc3mkISXE0lWbmnWfggogbBJhtYgpK6fMl1D6mtsy92R3HkdGfwuXbzLebqVFJsR7IZ2w58t938iymwG4824igYy1wi6n2WDpO1Q1P69zwJGs2F5a1qP4MyIiDSD7NCV2OvidXQCBnDlGfmz0f1BQySRkkt4ryiJeCjD2o4QsveJ9uDBUn8ELyOrESv5R5DMDkD4iAF8TXU7KyoJujd"
+
+// see https://github.com/twofas/2fas-android
+type twoFASBackup struct {
+	Services          []twoFASService `json:"services"`
+	Groups            []interface{}   `json:"groups"`
+	UpdatedAt         int64           `json:"updatedAt"`
+	SchemaVersion     int             `json:"schemaVersion"`
+	AppOrigin         string          `json:"appOrigin,omitempty"`
+	ServicesEncrypted string          `json:"servicesEncrypted,omitempty"`
+	Reference         string          `json:"reference,omitempty"`
+}
+
+type twoFASService struct {
+	Name      string      `json:"name"`
+	Secret    string      `json:"secret"`
+	UpdatedAt int64       `json:"updatedAt"`
+	OTP       twoFASOTP   `json:"otp"`
+	Order     twoFASOrder `json:"order"`
+	Icon      *twoFASIcon `json:"icon,omitempty"`
+}
+
+type twoFASOTP struct {
+	Label     string `json:"label,omitempty"`
+	Account   string `json:"account"`
+	Issuer    string `json:"issuer"`
+	Digits    int    `json:"digits"`
+	Period    int    `json:"period,omitempty"`
+	Algorithm string `json:"algorithm"`
+	Counter   uint64 `json:"counter"`
+	TokenType string `json:"tokenType"`
+	Source    string `json:"source"`
+}
+
+type twoFASOrder struct {
+	Position int `json:"position"`
+}
+
+type twoFASIcon struct {
+	Selected       string                `json:"selected"`
+	IconCollection *twoFASIconCollection `json:"iconCollection,omitempty"`
+}
+
+type twoFASIconCollection struct {
+	ID string `json:"id"`
+}
+
+func readTwoFAS(data []byte, password []byte) ([]Entry, error) {
+
+	var backup twoFASBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, err
+	}
+
+	services := backup.Services
+	if backup.ServicesEncrypted != "" {
+		if len(password) == 0 {
+			return nil, PasswordRequiredError
+		}
+		content, err := decryptTwoFAS(backup.ServicesEncrypted, password)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, &services); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make([]Entry, 0, len(services))
+	var labels []string
+	for _, s := range services {
+		f := &fields{
+			otpType:   s.OTP.TokenType,
+			issuer:    s.OTP.Issuer,
+			account:   s.OTP.Account,
+			algorithm: s.OTP.Algorithm,
+			digits:    s.OTP.Digits,
+			period:    s.OTP.Period,
+			counter:   s.OTP.Counter,
+		}
+		if f.issuer == "" {
+			f.issuer = s.Name
+		}
+		if f.account == "" {
+			f.account = s.OTP.Label
+		}
+		if f.otpType == "" {
+			f.otpType = "totp"
+		}
+
+		if !f.supported() {
+			labels = append(labels, f.label())
+			continue
+		}
+
+		var err error
+		if f.secret, err = decodeBase32(s.Secret); err != nil {
+			return nil, err
+		}
+
+		icon := Icon{}
+		if s.Icon != nil && s.Icon.IconCollection != nil {
+			icon.Name = s.Icon.IconCollection.ID
+		}
+
+		entry, err := f.entry(icon)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, skipped(labels)
+}
+
+// decryptTwoFAS decrypts a value encoded as base64(cipher text and tag):base64(salt):base64(nonce)
+func decryptTwoFAS(value string, password []byte) ([]byte, error) {
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return nil, errors.New(fmt.Sprintf("Malformed 2FAS encrypted value: expected 3 parts, got %d", len(parts)))
+	}
+
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.StdEncoding.DecodeString(part); err != nil {
+			return nil, err
+		}
+	}
+
+	key := pbkdf2.Key(password, decoded[1], twofas_iterations, twofas_key_size, sha256.New)
+	return openGCM(key, decoded[2], decoded[0])
+}
+
+func writeTwoFAS(entries []Entry, password []byte) ([]byte, error) {
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	services := make([]twoFASService, 0, len(entries))
+	for index, entry := range entries {
+		f, err := entryFields(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		s := twoFASService{
+			Name:      f.issuer,
+			Secret:    encodeBase32(f.secret),
+			UpdatedAt: now,
+			OTP: twoFASOTP{
+				Label:     f.account,
+				Account:   f.account,
+				Issuer:    f.issuer,
+				Digits:    f.digits,
+				Period:    f.period,
+				Algorithm: f.algorithm,
+				Counter:   f.counter,
+				TokenType: strings.ToUpper(f.otpType),
+				Source:    "Link",
+			},
+			Order: twoFASOrder{Position: index},
+		}
+		if entry.Icon.Name != "" {
+			s.Icon = &twoFASIcon{
+				Selected:       twofas_icon_selected,
+				IconCollection: &twoFASIconCollection{ID: entry.Icon.Name},
+			}
+		}
+		services = append(services, s)
+	}
+
+	backup := twoFASBackup{
+		Services:      services,
+		Groups:        []interface{}{},
+		UpdatedAt:     now,
+		SchemaVersion: twofas_schema_version,
+	}
+
+	if len(password) > 0 {
+		content, err := json.Marshal(services)
+		if err != nil {
+			return nil, err
+		}
+
+		salt, err := randomBytes(twofas_salt_size)
+		if err != nil {
+			return nil, err
+		}
+		key := pbkdf2.Key(password, salt, twofas_iterations, twofas_key_size, sha256.New)
+
+		if backup.ServicesEncrypted, err = encryptTwoFAS(key, salt, content); err != nil {
+			return nil, err
+		}
+		if backup.Reference, err = encryptTwoFAS(key, salt, []byte(twofas_reference)); err != nil {
+			return nil, err
+		}
+		backup.Services = []twoFASService{}
+	}
+
+	return json.Marshal(backup)
+}
+
+func encryptTwoFAS(key, salt, plain []byte) (string, error) {
+
+	nonce, err := randomBytes(twofas_nonce_size)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := sealGCM(key, nonce, plain)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		base64.StdEncoding.EncodeToString(sealed),
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(nonce),
+	}, ":"), nil
+}
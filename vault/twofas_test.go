@@ -0,0 +1,56 @@
+package vault
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var twoFASPlainBackup = `{
+  "services": [
+    {
+      "name": "Example",
+      "secret": "JBSWY3DPEHPK3PXP",
+      "updatedAt": 1577836800000,
+      "otp": {"label": "alice@google.com", "account": "alice@google.com", "issuer": "Example", "digits": 6, "period": 30, "algorithm": "SHA1", "counter": 0, "tokenType": "TOTP", "source": "Link"},
+      "order": {"position": 0},
+      "icon": {"selected": "IconCollection", "iconCollection": {"id": "a5b3fb65-4ec5-43e6-8ec1-49e24ca9e7ad"}}
+    }
+  ],
+  "groups": [],
+  "updatedAt": 1577836800000,
+  "schemaVersion": 4,
+  "appOrigin": "android"
+}`
+
+func TestReadTwoFAS(t *testing.T) {
+
+	entries, err := Read(TwoFAS, []byte(twoFASPlainBackup), nil)
+	checkError(t, err)
+
+	if len(entries) != 1 || entries[0].Totp == nil {
+		t.Fatal("The 2FAS entry has not been read")
+	}
+	if entries[0].Icon.Name != "a5b3fb65-4ec5-43e6-8ec1-49e24ca9e7ad" {
+		t.Errorf("2FAS icon mismatch: %s\n", entries[0].Icon.Name)
+	}
+}
+
+func TestWriteTwoFASReference(t *testing.T) {
+
+	password := []byte("test")
+	data, err := Write(TwoFAS, testEntries(t), password)
+	checkError(t, err)
+
+	var backup twoFASBackup
+	checkError(t, json.Unmarshal(data, &backup))
+
+	if len(backup.Services) != 0 {
+		t.Error("The encrypted 2FAS backup contains plain services")
+	}
+
+	reference, err := decryptTwoFAS(backup.Reference, password)
+	checkError(t, err)
+	if string(reference) != twofas_reference {
+		t.Error("The 2FAS reference does not match")
+	}
+}
@@ -0,0 +1,315 @@
+/*
+The package vault converts the backups of the most common authenticator apps in Totp and Hotp objects and back.
+
+The supported formats are Aegis, andOTP, 2FAS (plain and password encrypted) and FreeOTP+ (plain only).
+Only the properties which can be represented by the twofactor objects are preserved: issuer, account, secret,
+algorithm, digits, period, counter and the icon. App specific properties like notes, groups and usage statistics are lost.
+
+The backups contain the secret keys of all the accounts, therefore they need to be protected like the keys themselves.
+*/
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sec51/twofactor"
+)
+
+// Format is the backup format of an authenticator app
+type Format int
+
+const (
+	Aegis       Format = iota // Aegis Authenticator vault (aegis.json)
+	AndOTP                    // andOTP backup (otp_accounts.json and otp_accounts.json.aes)
+	TwoFAS                    // 2FAS backup (.2fas)
+	FreeOTPPlus               // FreeOTP+ backup (freeotp-backup.json)
+)
+
+var (
+	PasswordRequiredError = errors.New("The backup is encrypted, but no password was provided.")
+	WrongPasswordError    = errors.New("The backup cannot be decrypted: the password is wrong or the backup has been altered.")
+	UnsupportedError      = errors.New("The format does not support encrypted backups.")
+)
+
+// String returns the name of the format
+func (format Format) String() string {
+	switch format {
+	case Aegis:
+		return "Aegis"
+	case AndOTP:
+		return "andOTP"
+	case TwoFAS:
+		return "2FAS"
+	case FreeOTPPlus:
+		return "FreeOTP+"
+	}
+	return fmt.Sprintf("Format(%d)", int(format))
+}
+
+// Icon is the icon of an entry, as stored by the authenticator app
+type Icon struct {
+	Data []byte // the image, only Aegis embeds it
+	MIME string // the MIME type of the image, for example image/png
+	Name string // the app specific reference: andOTP thumbnail, 2FAS icon collection id, FreeOTP+ image URI
+}
+
+// Entry is an account of the backup. Exactly one of Totp and Hotp is set.
+type Entry struct {
+	Totp *twofactor.Totp
+	Hotp *twofactor.Hotp
+	Icon Icon
+}
+
+// SkippedEntriesError is returned by Read together with the entries of the backup,
+// when some of them have an OTP type which is not supported, for example steam.
+type SkippedEntriesError struct {
+	Entries []string // the issuer:account labels of the skipped entries
+}
+
+func (e *SkippedEntriesError) Error() string {
+	return fmt.Sprintf("%d unsupported entries have been skipped: %s.", len(e.Entries), strings.Join(e.Entries, ", "))
+}
+
+// skipped returns a *SkippedEntriesError with the labels, or nil when there are none
+func skipped(labels []string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	return &SkippedEntriesError{Entries: labels}
+}
+
+// Read returns the entries of the backup. The password is needed only for encrypted backups.
+// The entries which cannot be represented by the twofactor objects do not abort the import:
+// they are skipped and listed by a *SkippedEntriesError, returned with the other entries.
+func Read(format Format, data []byte, password []byte) ([]Entry, error) {
+	switch format {
+	case Aegis:
+		return readAegis(data, password)
+	case AndOTP:
+		return readAndOTP(data, password)
+	case TwoFAS:
+		return readTwoFAS(data, password)
+	case FreeOTPPlus:
+		if len(password) > 0 {
+			return nil, UnsupportedError
+		}
+		return readFreeOTPPlus(data)
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported backup format %s", format))
+}
+
+// Write returns the backup of the entries. When the password is not empty, the backup is encrypted
+// with the scheme of the app, so that it can be imported with the same password.
+func Write(format Format, entries []Entry, password []byte) ([]byte, error) {
+	switch format {
+	case Aegis:
+		return writeAegis(entries, password)
+	case AndOTP:
+		return writeAndOTP(entries, password)
+	case TwoFAS:
+		return writeTwoFAS(entries, password)
+	case FreeOTPPlus:
+		if len(password) > 0 {
+			return nil, UnsupportedError
+		}
+		return writeFreeOTPPlus(entries)
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported backup format %s", format))
+}
+
+// fields are the properties of an entry shared by all the formats
+type fields struct {
+	otpType   string // totp or hotp
+	secret    []byte
+	issuer    string
+	account   string
+	algorithm string // SHA1, SHA256 or SHA512
+	digits    int
+	period    int
+	counter   uint64
+}
+
+// entryFields reads the properties of the entry. The TOTP key is read with Key,
+// which notifies the observers of a single reveal with the Export operation.
+func entryFields(entry Entry) (*fields, error) {
+
+	switch {
+	case entry.Totp != nil:
+		state, err := entry.Totp.State()
+		if err != nil {
+			return nil, err
+		}
+		return &fields{
+			otpType:   "totp",
+			secret:    entry.Totp.Key(),
+			issuer:    state.Issuer,
+			account:   state.Account,
+			algorithm: state.Algorithm,
+			digits:    state.Digits,
+			period:    state.StepSize,
+		}, nil
+	case entry.Hotp != nil:
+		return hotpFields(entry.Hotp)
+	}
+	return nil, errors.New("The vault entry has neither a TOTP nor a HOTP")
+}
+
+// hotpFields reads the properties of the HOTP from its key URL, the observers are notified of a URL reveal
+func hotpFields(hotp *twofactor.Hotp) (*fields, error) {
+
+	rawurl, err := hotp.URL()
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	values := u.Query()
+
+	f := &fields{otpType: u.Host, issuer: values.Get("issuer"), algorithm: values.Get("algorithm")}
+
+	// the label is issuer:account, the issuer is query escaped: the first ':' of the escaped path is the separator
+	label := strings.TrimPrefix(u.EscapedPath(), "/")
+	if f.account, err = url.PathUnescape(label[strings.Index(label, ":")+1:]); err != nil {
+		return nil, err
+	}
+
+	if f.secret, err = base32.StdEncoding.DecodeString(values.Get("secret")); err != nil {
+		return nil, err
+	}
+	if f.digits, err = strconv.Atoi(values.Get("digits")); err != nil {
+		return nil, err
+	}
+	if f.counter, err = strconv.ParseUint(values.Get("counter"), 10, 64); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// supported reports whether the OTP type can be represented by the twofactor objects:
+// the other types, for example steam, are skipped by Read
+func (f *fields) supported() bool {
+	otpType := strings.ToLower(f.otpType)
+	return otpType == "totp" || otpType == "hotp"
+}
+
+func (f *fields) label() string {
+	return f.issuer + ":" + f.account
+}
+
+// entry converts the properties in a Totp or Hotp object
+func (f *fields) entry(icon Icon) (Entry, error) {
+
+	entry := Entry{Icon: icon}
+
+	if len(f.secret) == 0 {
+		return entry, errors.New(fmt.Sprintf("The entry %s:%s has no secret", f.issuer, f.account))
+	}
+
+	u := url.URL{}
+	v := url.Values{}
+	u.Scheme = "otpauth"
+	u.Host = strings.ToLower(f.otpType)
+	u.Path = url.QueryEscape(f.issuer) + ":" + f.account
+	v.Add("secret", base32.StdEncoding.EncodeToString(f.secret))
+	v.Add("issuer", f.issuer)
+	if f.algorithm != "" {
+		v.Add("algorithm", f.algorithm)
+	}
+	if f.digits != 0 {
+		v.Add("digits", strconv.Itoa(f.digits))
+	}
+	if f.period != 0 {
+		v.Add("period", strconv.Itoa(f.period))
+	}
+	v.Add("counter", strconv.FormatUint(f.counter, 10))
+	u.RawQuery = v.Encode()
+
+	var err error
+	switch u.Host {
+	case "totp":
+		entry.Totp, err = twofactor.TOTPFromURL(u.String())
+	case "hotp":
+		entry.Hotp, err = twofactor.HOTPFromURL(u.String())
+	default:
+		err = errors.New(fmt.Sprintf("Unsupported OTP type %q of the entry %s:%s", f.otpType, f.issuer, f.account))
+	}
+	if err != nil {
+		return entry, errors.New(fmt.Sprintf("Invalid entry %s:%s: %s", f.issuer, f.account, err))
+	}
+
+	return entry, nil
+}
+
+// the secrets are base32 encoded without padding by most of the apps
+func decodeBase32(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(strings.TrimRight(secret, "="), " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+func encodeBase32(secret []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// the authenticator apps encrypt the backups with AES-GCM
+
+func sealGCM(key, nonce, plain []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plain, nil), nil
+}
+
+func openGCM(key, nonce, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, WrongPasswordError
+	}
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, WrongPasswordError
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(size int) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,128 @@
+package vault
+
+import (
+	"crypto"
+	"testing"
+
+	"github.com/sec51/twofactor"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testEntries(t *testing.T) []Entry {
+
+	totp, err := twofactor.TOTPFromURL("otpauth://totp/ACME%20Co:john.doe@email.com?secret=HXDMVJECJJWSRB3HWIZR4IFUGFTMXBOZ&algorithm=SHA256&digits=8&period=60")
+	checkError(t, err)
+
+	hotp, err := twofactor.NewHOTP("info@sec51.com", "Sec51", crypto.SHA1, 6)
+	checkError(t, err)
+
+	return []Entry{
+		{Totp: totp, Icon: Icon{Name: "acme"}},
+		{Hotp: hotp},
+	}
+}
+
+// checkEntries compares the entries through their key URLs
+func checkEntries(t *testing.T, format Format, expected, got []Entry) {
+
+	if len(got) != len(expected) {
+		t.Fatalf("%s: expected %d entries, instead we've got %d\n", format, len(expected), len(got))
+	}
+
+	for i := range expected {
+		expectedFields, err := entryFields(expected[i])
+		checkError(t, err)
+		gotFields, err := entryFields(got[i])
+		checkError(t, err)
+		if !fieldsEqual(expectedFields, gotFields) {
+			t.Errorf("%s: entry %d differs: expected %+v, got %+v\n", format, i, *expectedFields, *gotFields)
+		}
+	}
+}
+
+func fieldsEqual(a, b *fields) bool {
+	return a.otpType == b.otpType && string(a.secret) == string(b.secret) && a.issuer == b.issuer &&
+		a.account == b.account && a.algorithm == b.algorithm && a.digits == b.digits &&
+		a.period == b.period && a.counter == b.counter
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	entries := testEntries(t)
+
+	for _, format := range []Format{Aegis, AndOTP, TwoFAS, FreeOTPPlus} {
+		data, err := Write(format, entries, nil)
+		checkError(t, err)
+
+		restored, err := Read(format, data, nil)
+		checkError(t, err)
+		checkEntries(t, format, entries, restored)
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+
+	entries := testEntries(t)
+	password := []byte("correct horse battery staple")
+
+	for _, format := range []Format{Aegis, AndOTP, TwoFAS} {
+		data, err := Write(format, entries, password)
+		checkError(t, err)
+
+		if _, err := Read(format, data, nil); err != PasswordRequiredError {
+			t.Errorf("%s: expected PasswordRequiredError, instead we've got %v\n", format, err)
+		}
+
+		if _, err := Read(format, data, []byte("wrong password")); err != WrongPasswordError {
+			t.Errorf("%s: expected WrongPasswordError, instead we've got %v\n", format, err)
+		}
+
+		restored, err := Read(format, data, password)
+		checkError(t, err)
+		checkEntries(t, format, entries, restored)
+	}
+
+	if _, err := Write(FreeOTPPlus, entries, password); err != UnsupportedError {
+		t.Errorf("Expected UnsupportedError for an encrypted FreeOTP+ backup, instead we've got %v\n", err)
+	}
+}
+
+// revealRecorder records the operations of the reveals of the secret keys
+type revealRecorder struct {
+	twofactor.NopObserver
+	operations []string
+}
+
+func (r *revealRecorder) OnReveal(event twofactor.Event) {
+	r.operations = append(r.operations, event.Operation)
+}
+
+func TestWriteReveal(t *testing.T) {
+
+	entries := testEntries(t)
+	r := &revealRecorder{}
+	entries[0].Totp.AddObserver(r)
+
+	_, err := Write(Aegis, entries, nil)
+	checkError(t, err)
+	if len(r.operations) != 1 || r.operations[0] != "Export" {
+		t.Errorf("Expected a single Export reveal when writing the backup, instead we've got %v\n", r.operations)
+	}
+}
+
+func TestHotpFields(t *testing.T) {
+
+	hotp, err := twofactor.NewHOTP("john:doe@sec51.com", "Sec51: Labs", crypto.SHA1, 6)
+	checkError(t, err)
+
+	f, err := hotpFields(hotp)
+	checkError(t, err)
+	if f.issuer != "Sec51: Labs" || f.account != "john:doe@sec51.com" {
+		t.Errorf("Expected the issuer Sec51: Labs and the account john:doe@sec51.com, instead we've got %q and %q\n", f.issuer, f.account)
+	}
+}